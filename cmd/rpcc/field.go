@@ -108,7 +108,7 @@ func GoTypeName(name string) string {
 }
 
 var trimPrefixes = []string{
-	"p", "ul", "pul", "h", "ph",
+	"p", "ul", "pul", "h", "ph", "b",
 }
 
 // GoFieldName converts the name to Go field name.
@@ -553,6 +553,24 @@ func (b *Base) %s(`, goFunc, goFunc, goFunc)
 			result)
 	}
 
+	// RPC message types.
+	var width int
+	for _, msg := range goMessages {
+		name := "Msg" + GoFuncName(msg.Name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	fmt.Printf(`
+// RPC message types.
+const (
+`)
+	for _, msg := range goMessages {
+		fmt.Printf("\t%-*s Type = 0x%08x\n", width,
+			"Msg"+GoFuncName(msg.Name), int(msg.Type))
+	}
+	fmt.Printf(")\n")
+
 	// RPC message names.
 	fmt.Printf(`
 var msgTypeNames = map[Type]string{
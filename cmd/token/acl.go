@@ -0,0 +1,274 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+var (
+	_ pkcs11.Storage = &aclStorage{}
+)
+
+// ACL defines the token's access control rules. The rules are
+// matched against the peer credentials of the connecting process and
+// the first matching rule authorizes the connection. If the token
+// has no ACL, all connections are authorized without restrictions.
+type ACL struct {
+	Rules []*ACLRule `json:"rules"`
+}
+
+// ACLRule defines an access control rule. The empty UIDs and GIDs
+// match all peers, including the peers whose credentials are
+// unknown. The empty Slots, Labels, and Mechanisms allow all slots,
+// objects, and mechanisms, respectively.
+type ACLRule struct {
+	// UIDs lists the user IDs the rule applies to.
+	UIDs []uint32 `json:"uids"`
+
+	// GIDs lists the group IDs the rule applies to.
+	GIDs []uint32 `json:"gids"`
+
+	// Slots lists the slots visible to the peer.
+	Slots []pkcs11.SlotID `json:"slots"`
+
+	// Labels lists the CKA_LABEL prefixes of the objects the peer
+	// can access.
+	Labels []string `json:"labels"`
+
+	// Mechanisms lists the names of the mechanisms the peer can use,
+	// for example, CKM_AES_GCM.
+	Mechanisms []string `json:"mechanisms"`
+
+	mechanisms map[pkcs11.MechanismType]bool
+}
+
+// LoadACL loads the access control rules from the JSON file.
+func LoadACL(file string) (*ACL, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	acl := new(ACL)
+	err = json.Unmarshal(data, acl)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for idx, rule := range acl.Rules {
+		err = rule.init()
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %v", file, idx, err)
+		}
+	}
+	return acl, nil
+}
+
+func (rule *ACLRule) init() error {
+	if len(rule.Mechanisms) == 0 {
+		return nil
+	}
+	names := make(map[string]pkcs11.MechanismType)
+	for mech := range mechanisms {
+		names[mech.String()] = mech
+	}
+	rule.mechanisms = make(map[pkcs11.MechanismType]bool)
+	for _, name := range rule.Mechanisms {
+		mech, ok := names[name]
+		if !ok {
+			return fmt.Errorf("unknown mechanism: %s", name)
+		}
+		rule.mechanisms[mech] = true
+	}
+	return nil
+}
+
+// Lookup finds the rule for the peer. The function returns nil if the
+// peer is not authorized to connect to the token.
+func (acl *ACL) Lookup(peer *PeerCred) *ACLRule {
+	for _, rule := range acl.Rules {
+		if rule.match(peer) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *ACLRule) match(peer *PeerCred) bool {
+	if len(rule.UIDs) == 0 && len(rule.GIDs) == 0 {
+		return true
+	}
+	if peer == nil {
+		return false
+	}
+	for _, uid := range rule.UIDs {
+		if uid == peer.UID {
+			return true
+		}
+	}
+	for _, gid := range rule.GIDs {
+		if gid == peer.GID {
+			return true
+		}
+	}
+	return false
+}
+
+// SlotVisible tests if the slot is visible for the rule.
+func (rule *ACLRule) SlotVisible(id pkcs11.SlotID) bool {
+	if rule == nil || len(rule.Slots) == 0 {
+		return true
+	}
+	for _, slot := range rule.Slots {
+		if slot == id {
+			return true
+		}
+	}
+	return false
+}
+
+// MechanismAllowed tests if the mechanism is allowed for the rule.
+func (rule *ACLRule) MechanismAllowed(mech pkcs11.MechanismType) bool {
+	if rule == nil || rule.mechanisms == nil {
+		return true
+	}
+	return rule.mechanisms[mech]
+}
+
+// ObjectAllowed tests if the object is accessible for the rule.
+func (rule *ACLRule) ObjectAllowed(obj *pkcs11.Object) bool {
+	if rule == nil || len(rule.Labels) == 0 {
+		return true
+	}
+	label, err := obj.Attrs.OptBytes(pkcs11.CkaLabel)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range rule.Labels {
+		if strings.HasPrefix(string(label), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclStorage implements an object storage that restricts the object
+// access based on the ACL rule. The objects not accessible for the
+// rule are not visible in the storage.
+type aclStorage struct {
+	storage pkcs11.Storage
+	rule    *ACLRule
+}
+
+// newACLStorage wraps the storage with the ACL rule. If the rule does
+// not restrict the object access, the function returns the storage
+// as-is.
+func newACLStorage(storage pkcs11.Storage, rule *ACLRule) pkcs11.Storage {
+	if rule == nil || len(rule.Labels) == 0 {
+		return storage
+	}
+	return &aclStorage{
+		storage: storage,
+		rule:    rule,
+	}
+}
+
+// Create implements Storage.Create().
+func (s *aclStorage) Create(obj *pkcs11.Object) (pkcs11.ObjectHandle, error) {
+	if !s.rule.ObjectAllowed(obj) {
+		Errorf("ACL: object label not allowed")
+		return 0, pkcs11.ErrAttributeValueInvalid
+	}
+	return s.storage.Create(obj)
+}
+
+// Read implements Storage.Read().
+func (s *aclStorage) Read(h pkcs11.ObjectHandle) (*pkcs11.Object, error) {
+	obj, err := s.storage.Read(h)
+	if err != nil {
+		return nil, err
+	}
+	if !s.rule.ObjectAllowed(obj) {
+		Errorf("ACL: object %08x not allowed", h)
+		return nil, pkcs11.ErrObjectHandleInvalid
+	}
+	return obj, nil
+}
+
+// Update implements Storage.Update().
+func (s *aclStorage) Update(h pkcs11.ObjectHandle, obj *pkcs11.Object) error {
+	_, err := s.Read(h)
+	if err != nil {
+		return err
+	}
+	if !s.rule.ObjectAllowed(obj) {
+		Errorf("ACL: object label not allowed")
+		return pkcs11.ErrAttributeValueInvalid
+	}
+	return s.storage.Update(h, obj)
+}
+
+// Delete implements Storage.Delete().
+func (s *aclStorage) Delete(h pkcs11.ObjectHandle) error {
+	_, err := s.Read(h)
+	if err != nil {
+		return err
+	}
+	return s.storage.Delete(h)
+}
+
+// Find implements Storage.Find().
+func (s *aclStorage) Find(t pkcs11.Template) ([]pkcs11.ObjectHandle, error) {
+	handles, err := s.storage.Find(t)
+	if err != nil {
+		return nil, err
+	}
+	var result []pkcs11.ObjectHandle
+	for _, h := range handles {
+		obj, err := s.storage.Read(h)
+		if err != nil {
+			continue
+		}
+		if s.rule.ObjectAllowed(obj) {
+			result = append(result, h)
+		}
+	}
+	return result, nil
+}
+
+// authorize checks that the provider's peer is authorized to use the
+// token. The function is called for each dispatched call.
+func (p *Provider) authorize() error {
+	if acl != nil && p.rule == nil {
+		return pkcs11.ErrFunctionRejected
+	}
+	return nil
+}
+
+// checkSlot checks that the slot exists and it is visible for the
+// provider's peer.
+func (p *Provider) checkSlot(id pkcs11.SlotID) error {
+	_, err := LookupSlot(id)
+	if err != nil || !p.rule.SlotVisible(id) {
+		return pkcs11.ErrSlotIDInvalid
+	}
+	return nil
+}
+
+// checkMechanism checks that the provider's peer is allowed to use
+// the mechanism.
+func (p *Provider) checkMechanism(mech pkcs11.MechanismType) error {
+	if !p.rule.MechanismAllowed(mech) {
+		Errorf("ACL: mechanism %s not allowed for %s", mech, p.peer)
+		return pkcs11.ErrMechanismInvalid
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func loadTestACL(t *testing.T, data string) (*ACL, error) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	err := os.WriteFile(file, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LoadACL(file)
+}
+
+func TestACLLookup(t *testing.T) {
+	acl, err := loadTestACL(t, `{
+  "rules": [
+    {
+      "uids": [1000],
+      "slots": [1],
+      "mechanisms": ["CKM_AES_GCM"]
+    },
+    {
+      "gids": [2000],
+      "labels": ["app-"]
+    }
+  ]
+}`)
+	if err != nil {
+		t.Fatalf("LoadACL: %v", err)
+	}
+
+	rule := acl.Lookup(&PeerCred{UID: 1000, GID: 100})
+	if rule != acl.Rules[0] {
+		t.Fatalf("uid 1000: wrong rule")
+	}
+	if rule.SlotVisible(0) {
+		t.Errorf("slot 0 visible")
+	}
+	if !rule.MechanismAllowed(pkcs11.CkmAESGCM) {
+		t.Errorf("CKM_AES_GCM not allowed")
+	}
+	if rule.MechanismAllowed(pkcs11.CkmSHA256) {
+		t.Errorf("CKM_SHA256 allowed")
+	}
+
+	rule = acl.Lookup(&PeerCred{UID: 1001, GID: 2000})
+	if rule != acl.Rules[1] {
+		t.Fatalf("gid 2000: wrong rule")
+	}
+	if !rule.SlotVisible(0) || !rule.MechanismAllowed(pkcs11.CkmSHA256) {
+		t.Errorf("rule without slots and mechanisms is restricted")
+	}
+
+	if acl.Lookup(&PeerCred{UID: 1001, GID: 100}) != nil {
+		t.Errorf("unauthorized uid matched")
+	}
+	if acl.Lookup(nil) != nil {
+		t.Errorf("unknown peer matched")
+	}
+
+	_, err = loadTestACL(t, `{"rules":[{"mechanisms":["CKM_UNKNOWN"]}]}`)
+	if err == nil {
+		t.Errorf("unknown mechanism accepted")
+	}
+}
+
+func TestACLStorage(t *testing.T) {
+	rule := &ACLRule{
+		Labels: []string{"app-"},
+	}
+	storage := pkcs11.NewMemoryStorage(allocObjectHandle)
+	s := newACLStorage(storage, rule)
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoData))
+
+	_, err := s.Create(&pkcs11.Object{
+		Attrs: tmpl.Set(pkcs11.CkaLabel, []byte("other")),
+	})
+	if err != pkcs11.ErrAttributeValueInvalid {
+		t.Errorf("Create with other label: %v", err)
+	}
+	allowed, err := s.Create(&pkcs11.Object{
+		Attrs: tmpl.Set(pkcs11.CkaLabel, []byte("app-key")),
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	hidden, err := storage.Create(&pkcs11.Object{
+		Attrs: tmpl.Set(pkcs11.CkaLabel, []byte("other")),
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	_, err = s.Read(hidden)
+	if err != pkcs11.ErrObjectHandleInvalid {
+		t.Errorf("Read hidden object: %v", err)
+	}
+	err = s.Delete(hidden)
+	if err != pkcs11.ErrObjectHandleInvalid {
+		t.Errorf("Delete hidden object: %v", err)
+	}
+	handles, err := s.Find(nil)
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if len(handles) != 1 || handles[0] != allowed {
+		t.Errorf("Find: got %v, expected [%v]", handles, allowed)
+	}
+}
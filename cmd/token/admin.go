@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// startAdmin starts the admin interface at the Unix domain socket
+// path. The admin socket is accessible only by the token's user. The
+// socket is created in a private directory and moved to the path
+// after its permissions are set so that other users can't connect to
+// it before that.
+func startAdmin(path string) error {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".admin")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "admin.sock")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		os.RemoveAll(path)
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("admin: accept failed: %s", err)
+				continue
+			}
+			go adminLoop(conn)
+		}
+	}()
+	return nil
+}
+
+// adminPeerAllowed tests if the admin connection's peer runs as the
+// token's user. The connections with unknown peer credentials are
+// rejected.
+func adminPeerAllowed(conn net.Conn) bool {
+	peer, err := peerCredentials(conn)
+	if err != nil {
+		log.Printf("admin: peer credentials: %s", err)
+		return false
+	}
+	if peer == nil || int64(peer.UID) != int64(os.Getuid()) {
+		log.Printf("admin: connection from %s rejected", peer)
+		return false
+	}
+	return true
+}
+
+func adminLoop(conn net.Conn) {
+	defer conn.Close()
+
+	if !adminPeerAllowed(conn) {
+		fmt.Fprintln(conn, "error: permission denied")
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		_, err := fmt.Fprintln(conn, adminCommand(line))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// adminCommand executes the admin command and returns its result. The
+// commands are:
+//
+//	list      list slots and their token status
+//	eject N   eject the token from the virtual slot N
+//	insert N  insert the token into the virtual slot N
+//
+// The eject and insert commands return "ok" on success and all failed
+// commands return "error: " followed by the error message.
+func adminCommand(line string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "error: no command"
+	}
+	switch args[0] {
+	case "list":
+		var result []string
+		for _, slot := range slots {
+			status := "present"
+			if !slot.TokenPresent() {
+				status = "ejected"
+			}
+			if !slot.Removable {
+				status += " (builtin)"
+			}
+			result = append(result, fmt.Sprintf("slot %d: %s", slot.ID, status))
+		}
+		return strings.Join(result, "\n")
+
+	case "eject", "insert":
+		if len(args) != 2 {
+			return fmt.Sprintf("error: usage: %s SLOT", args[0])
+		}
+		id, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Sprintf("error: invalid slot: %s", args[1])
+		}
+		if args[0] == "eject" {
+			err = EjectToken(pkcs11.SlotID(id))
+		} else {
+			err = InsertToken(pkcs11.SlotID(id))
+		}
+		if err != nil {
+			return fmt.Sprintf("error: %s", err)
+		}
+		return "ok"
+
+	default:
+		return fmt.Sprintf("error: unknown command: %s", args[0])
+	}
+}
@@ -0,0 +1,251 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"io"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// derivedKeyLen returns the length of the derived key or data object
+// based on the template. The defaultLen is used for generic secret
+// keys and data objects which do not specify CKA_VALUE_LEN. The
+// length is limited to MaxDerivedKeyLen bytes.
+func derivedKeyLen(tmpl pkcs11.Template, defaultLen int) (int, error) {
+	cls := pkcs11.ObjectClass(tmpl.OptInt(pkcs11.CkaClass,
+		int(pkcs11.CkoSecretKey)))
+	size := tmpl.OptInt(pkcs11.CkaValueLen, 0)
+
+	switch cls {
+	case pkcs11.CkoData:
+
+	case pkcs11.CkoSecretKey:
+		keyType := pkcs11.KeyType(tmpl.OptInt(pkcs11.CkaKeyType,
+			int(pkcs11.CkkGenericSecret)))
+		switch keyType {
+		case pkcs11.CkkAES:
+			if size == 0 {
+				return 0, pkcs11.ErrTemplateIncomplete
+			}
+			if size != 16 && size != 24 && size != 32 {
+				return 0, pkcs11.ErrTemplateInconsistent
+			}
+			return size, nil
+
+		case pkcs11.CkkDES3:
+			if size == 0 {
+				size = DES3KeySize
+			}
+			if size != DES3KeySize {
+				return 0, pkcs11.ErrTemplateInconsistent
+			}
+			return size, nil
+
+		case pkcs11.CkkGenericSecret, pkcs11.CkkHKDF:
+
+		default:
+			return 0, pkcs11.ErrTemplateInconsistent
+		}
+
+	default:
+		return 0, pkcs11.ErrTemplateInconsistent
+	}
+
+	if size == 0 {
+		size = defaultLen
+	}
+	if size <= 0 {
+		return 0, pkcs11.ErrTemplateIncomplete
+	}
+	if size > MaxDerivedKeyLen {
+		return 0, pkcs11.ErrTemplateInconsistent
+	}
+	return size, nil
+}
+
+// derivedKeyTemplate creates the attributes for the derived key or
+// data object. The CKA_ALWAYS_SENSITIVE and CKA_NEVER_EXTRACTABLE
+// attributes of the derived key are inherited from the base keys.
+func derivedKeyTemplate(tmpl pkcs11.Template, data []byte,
+	bases ...*pkcs11.Object) (pkcs11.Template, error) {
+
+	cls := pkcs11.ObjectClass(tmpl.OptInt(pkcs11.CkaClass,
+		int(pkcs11.CkoSecretKey)))
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(cls))
+
+	if cls == pkcs11.CkoData {
+		return tmpl.Set(pkcs11.CkaValue, data), nil
+	}
+
+	keyType := pkcs11.KeyType(tmpl.OptInt(pkcs11.CkaKeyType,
+		int(pkcs11.CkkGenericSecret)))
+	if keyType == pkcs11.CkkDES3 {
+		pkcs11.DES3SetParity(data)
+	}
+	sensitive, err := tmpl.OptBool(pkcs11.CkaSensitive)
+	if err != nil {
+		return nil, err
+	}
+	extractable, err := tmpl.OptBool(pkcs11.CkaExtractable)
+	if err != nil {
+		return nil, err
+	}
+	alwaysSensitive := true
+	neverExtractable := true
+	for _, base := range bases {
+		v, err := base.Attrs.Bool(pkcs11.CkaAlwaysSensitive)
+		if err != nil || !v {
+			alwaysSensitive = false
+		}
+		v, err = base.Attrs.Bool(pkcs11.CkaNeverExtractable)
+		if err != nil || !v {
+			neverExtractable = false
+		}
+	}
+
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(keyType))
+	tmpl = tmpl.SetBool(pkcs11.CkaSensitive, sensitive)
+	tmpl = tmpl.SetBool(pkcs11.CkaExtractable, extractable)
+	tmpl = tmpl.SetBool(pkcs11.CkaLocal, false)
+	tmpl = tmpl.SetBool(pkcs11.CkaAlwaysSensitive,
+		alwaysSensitive && sensitive)
+	tmpl = tmpl.SetBool(pkcs11.CkaNeverExtractable,
+		neverExtractable && !extractable)
+
+	return tmpl.Set(pkcs11.CkaValue, data), nil
+}
+
+// inheritKeyAttrs sets the derived key's CKA_SENSITIVE if any of the
+// base keys is sensitive and clears its CKA_EXTRACTABLE if any of the
+// base keys is not extractable.
+func inheritKeyAttrs(tmpl pkcs11.Template,
+	bases ...*pkcs11.Object) pkcs11.Template {
+
+	for _, base := range bases {
+		sensitive, err := base.Attrs.Bool(pkcs11.CkaSensitive)
+		if err == nil && sensitive {
+			tmpl = tmpl.SetBool(pkcs11.CkaSensitive, true)
+		}
+		extractable, err := base.Attrs.Bool(pkcs11.CkaExtractable)
+		if err == nil && !extractable {
+			tmpl = tmpl.SetBool(pkcs11.CkaExtractable, false)
+		}
+	}
+	return tmpl
+}
+
+// truncateKey returns the leading bytes of the value for the derived
+// key. The key length defaults to the length of the value.
+func truncateKey(tmpl pkcs11.Template, value []byte) ([]byte, error) {
+	size, err := derivedKeyLen(tmpl, len(value))
+	if err != nil {
+		return nil, err
+	}
+	if size > len(value) {
+		return nil, pkcs11.ErrTemplateInconsistent
+	}
+	return value[:size], nil
+}
+
+// extractKey extracts size bytes from the key starting from the bit
+// position. The bits are numbered from the most significant bit of
+// the first byte and the extraction wraps around the end of the key.
+func extractKey(key []byte, pos, size int) []byte {
+	bits := len(key) * 8
+	result := make([]byte, size)
+
+	for i := 0; i < size*8; i++ {
+		bit := (pos + i) % bits
+		if key[bit/8]&(0x80>>(bit%8)) != 0 {
+			result[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return result
+}
+
+// hkdfDerive derives the key data with the HKDF extract and expand
+// functions (RFC 5869).
+func hkdfDerive(params *pkcs11.HkdfParams, key, salt []byte,
+	tmpl pkcs11.Template) ([]byte, error) {
+
+	digest, ok := digests[params.PrfHashMechanism]
+	if !ok {
+		Errorf("HKDF: invalid PRF hash %v", params.PrfHashMechanism)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	size, err := derivedKeyLen(tmpl, digest.New().Size())
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	extract := bool(params.Extract)
+	expand := bool(params.Expand)
+
+	switch {
+	case extract && expand:
+		r = hkdf.New(digest.New, key, salt, params.Info)
+
+	case extract:
+		prk := hkdf.Extract(digest.New, key, salt)
+		if size != len(prk) {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		return prk, nil
+
+	case expand:
+		r = hkdf.Expand(digest.New, key, params.Info)
+
+	default:
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		// The size exceeds the HKDF output limit.
+		return nil, pkcs11.ErrTemplateInconsistent
+	}
+	return data, nil
+}
+
+// pbkdf2PRFs maps the PBKDF2 pseudorandom functions to their HMAC
+// digest mechanisms.
+var pbkdf2PRFs = map[pkcs11.Pkcs5Pbkd2PseudoRandomFunctionType]pkcs11.MechanismType{
+	pkcs11.CkpPKCS5PBKD2HMACSHA1:      pkcs11.CkmSHA1,
+	pkcs11.CkpPKCS5PBKD2HMACSHA224:    pkcs11.CkmSHA224,
+	pkcs11.CkpPKCS5PBKD2HMACSHA256:    pkcs11.CkmSHA256,
+	pkcs11.CkpPKCS5PBKD2HMACSHA384:    pkcs11.CkmSHA384,
+	pkcs11.CkpPKCS5PBKD2HMACSHA512:    pkcs11.CkmSHA512,
+	pkcs11.CkpPKCS5PBKD2HMACSHA512224: pkcs11.CkmSHA512224,
+	pkcs11.CkpPKCS5PBKD2HMACSHA512256: pkcs11.CkmSHA512256,
+}
+
+// pbkdf2Derive derives size bytes of key data from the password with
+// the PKCS #5 PBKDF2 function.
+func pbkdf2Derive(params *pkcs11.Pkcs5Pbkd2Params2, size int) (
+	[]byte, error) {
+
+	if params.SaltSource != pkcs11.CkzSaltSpecified {
+		Errorf("PBKDF2: invalid salt source %v", params.SaltSource)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	m, ok := pbkdf2PRFs[params.Prf]
+	if !ok || len(params.PrfData) != 0 {
+		Errorf("PBKDF2: invalid PRF %v", params.Prf)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	if params.Iterations == 0 || params.Iterations > PBKDF2MaxIterations {
+		Errorf("PBKDF2: invalid iteration count %v", params.Iterations)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	return pbkdf2.Key(params.Password, params.SaltSourceData,
+		int(params.Iterations), size, digests[m].New), nil
+}
@@ -0,0 +1,622 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func TestDerivedKeyLen(t *testing.T) {
+	tests := []struct {
+		cls        pkcs11.ObjectClass
+		keyType    pkcs11.KeyType
+		valueLen   int
+		defaultLen int
+		size       int
+		err        error
+	}{
+		{pkcs11.CkoSecretKey, pkcs11.CkkAES, 16, 0, 16, nil},
+		{pkcs11.CkoSecretKey, pkcs11.CkkAES, 32, 0, 32, nil},
+		{pkcs11.CkoSecretKey, pkcs11.CkkAES, 0, 32, 0,
+			pkcs11.ErrTemplateIncomplete},
+		{pkcs11.CkoSecretKey, pkcs11.CkkAES, 20, 0, 0,
+			pkcs11.ErrTemplateInconsistent},
+		{pkcs11.CkoSecretKey, pkcs11.CkkDES3, 0, 0, DES3KeySize, nil},
+		{pkcs11.CkoSecretKey, pkcs11.CkkGenericSecret, 0, 20, 20, nil},
+		{pkcs11.CkoSecretKey, pkcs11.CkkGenericSecret, 0, 0, 0,
+			pkcs11.ErrTemplateIncomplete},
+		{pkcs11.CkoSecretKey, pkcs11.CkkGenericSecret, MaxDerivedKeyLen, 0,
+			MaxDerivedKeyLen, nil},
+		{pkcs11.CkoSecretKey, pkcs11.CkkGenericSecret, MaxDerivedKeyLen + 1,
+			0, 0, pkcs11.ErrTemplateInconsistent},
+		{pkcs11.CkoSecretKey, pkcs11.CkkGenericSecret, 1 << 30, 0, 0,
+			pkcs11.ErrTemplateInconsistent},
+		{pkcs11.CkoData, pkcs11.CkkGenericSecret, 1 << 30, 0, 0,
+			pkcs11.ErrTemplateInconsistent},
+		{pkcs11.CkoData, pkcs11.CkkGenericSecret, 0, MaxDerivedKeyLen + 1,
+			0, pkcs11.ErrTemplateInconsistent},
+		{pkcs11.CkoPrivateKey, pkcs11.CkkRSA, 16, 0, 0,
+			pkcs11.ErrTemplateInconsistent},
+	}
+	for idx, test := range tests {
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(test.cls))
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(test.keyType))
+		if test.valueLen != 0 {
+			tmpl = tmpl.SetInt(pkcs11.CkaValueLen, test.valueLen)
+		}
+		size, err := derivedKeyLen(tmpl, test.defaultLen)
+		if err != test.err {
+			t.Errorf("test %d: derivedKeyLen: error %v, expected %v",
+				idx, err, test.err)
+			continue
+		}
+		if size != test.size {
+			t.Errorf("test %d: derivedKeyLen: %v, expected %v",
+				idx, size, test.size)
+		}
+	}
+}
+
+// RFC 5869 test cases 1 and 3.
+var hkdfTests = []struct {
+	ikm  string
+	salt string
+	info string
+	prk  string
+	okm  string
+}{
+	{
+		ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+		salt: "000102030405060708090a0b0c",
+		info: "f0f1f2f3f4f5f6f7f8f9",
+		prk:  "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5",
+		okm: "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db0" +
+			"2d56ecc4c5bf34007208d5b887185865",
+	},
+	{
+		ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+		salt: "",
+		info: "",
+		prk:  "19ef24a32c717b167f33a91d6f648bdf96596776afdb6377ac434c1c293ccb04",
+		okm: "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec345" +
+			"4e5f3c738d2d9d201395faa4b61a96c8",
+	},
+}
+
+func TestHKDF(t *testing.T) {
+	for idx, test := range hkdfTests {
+		ikm := unhex(t, test.ikm)
+		salt := unhex(t, test.salt)
+		prk := unhex(t, test.prk)
+		okm := unhex(t, test.okm)
+
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoData))
+		tmpl = tmpl.SetInt(pkcs11.CkaValueLen, len(okm))
+
+		params := &pkcs11.HkdfParams{
+			Extract:          true,
+			Expand:           true,
+			PrfHashMechanism: pkcs11.CkmSHA256,
+			Info:             unhex(t, test.info),
+		}
+		data, err := hkdfDerive(params, ikm, salt, tmpl)
+		if err != nil {
+			t.Fatalf("test %d: hkdfDerive: %v", idx, err)
+		}
+		if !bytes.Equal(data, okm) {
+			t.Errorf("test %d: OKM %x, expected %x", idx, data, okm)
+		}
+
+		// Extract only.
+		params.Expand = false
+		data, err = hkdfDerive(params, ikm, salt, nil)
+		if err != nil {
+			t.Fatalf("test %d: hkdfDerive: %v", idx, err)
+		}
+		if !bytes.Equal(data, prk) {
+			t.Errorf("test %d: PRK %x, expected %x", idx, data, prk)
+		}
+		_, err = hkdfDerive(params, ikm, salt, tmpl)
+		if err != pkcs11.ErrTemplateInconsistent {
+			t.Errorf("test %d: extract with CKA_VALUE_LEN %v: %v",
+				idx, len(okm), err)
+		}
+
+		// Expand only.
+		params.Extract = false
+		params.Expand = true
+		data, err = hkdfDerive(params, prk, nil, tmpl)
+		if err != nil {
+			t.Fatalf("test %d: hkdfDerive: %v", idx, err)
+		}
+		if !bytes.Equal(data, okm) {
+			t.Errorf("test %d: expand OKM %x, expected %x", idx, data, okm)
+		}
+
+		params.Expand = false
+		_, err = hkdfDerive(params, ikm, salt, tmpl)
+		if err != pkcs11.ErrMechanismParamInvalid {
+			t.Errorf("test %d: no extract or expand: %v", idx, err)
+		}
+	}
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, MaxDerivedKeyLen+1)
+	_, err := hkdfDerive(&pkcs11.HkdfParams{
+		Expand:           true,
+		PrfHashMechanism: pkcs11.CkmSHA256,
+	}, make([]byte, 32), nil, tmpl)
+	if err != pkcs11.ErrTemplateInconsistent {
+		t.Errorf("hkdfDerive with too long output: %v", err)
+	}
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, MaxDerivedKeyLen)
+	_, err = hkdfDerive(&pkcs11.HkdfParams{
+		Extract:          true,
+		Expand:           true,
+		PrfHashMechanism: pkcs11.CkmSHA256HMAC,
+	}, make([]byte, 20), nil, tmpl)
+	if err != pkcs11.ErrMechanismParamInvalid {
+		t.Errorf("hkdfDerive with HMAC PRF: %v", err)
+	}
+}
+
+func TestHKDFDeriveKey(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	test := hkdfTests[0]
+
+	createKey := func(value []byte) pkcs11.ObjectHandle {
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkHKDF))
+		tmpl = tmpl.SetBool(pkcs11.CkaDerive, true)
+		tmpl = tmpl.Set(pkcs11.CkaValue, value)
+
+		var obj pkcs11.CreateObjectResp
+		session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+			Template: tmpl,
+		}, &obj)
+		return obj.Object
+	}
+	base := createKey(unhex(t, test.ikm))
+	saltKey := createKey(unhex(t, test.salt))
+
+	params, err := pkcs11.Marshal(&pkcs11.HkdfParams{
+		Extract:          true,
+		Expand:           true,
+		PrfHashMechanism: pkcs11.CkmSHA256,
+		SaltType:         pkcs11.CkfHKDFSaltKey,
+		SaltKey:          saltKey,
+		Info:             unhex(t, test.info),
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	okm := unhex(t, test.okm)
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoData))
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, len(okm))
+
+	// CKM_HKDF_DERIVE creates keys and CKM_HKDF_DATA data objects.
+	ret := session.call(msgDeriveKey, &pkcs11.DeriveKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmHKDFDerive,
+			Parameter: params,
+		},
+		BaseKey:  base,
+		Template: tmpl,
+	}, nil)
+	if ret != pkcs11.ErrTemplateInconsistent {
+		t.Errorf("CKM_HKDF_DERIVE data object: %s", ret)
+	}
+
+	var resp pkcs11.DeriveKeyResp
+	session.mustCall(msgDeriveKey, &pkcs11.DeriveKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmHKDFData,
+			Parameter: params,
+		},
+		BaseKey:  base,
+		Template: tmpl,
+	}, &resp)
+
+	obj, err := provider.storage.Read(resp.Key)
+	if err != nil {
+		t.Fatalf("storage.Read: %v", err)
+	}
+	cls, err := obj.Attrs.Int(pkcs11.CkaClass)
+	if err != nil || pkcs11.ObjectClass(cls) != pkcs11.CkoData {
+		t.Errorf("derived object class %v: %v", cls, err)
+	}
+	value, err := obj.Attrs.OptBytes(pkcs11.CkaValue)
+	if err != nil || !bytes.Equal(value, okm) {
+		t.Errorf("derived data %x, expected %x", value, okm)
+	}
+
+	// The base key must have CKA_DERIVE. It is false by default.
+	var keyTmpl pkcs11.Template
+	keyTmpl = keyTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	keyTmpl = keyTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkHKDF))
+	keyTmpl = keyTmpl.Set(pkcs11.CkaValue, unhex(t, test.ikm))
+
+	var noDerive pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: keyTmpl,
+	}, &noDerive)
+
+	ret = session.call(msgDeriveKey, &pkcs11.DeriveKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmHKDFData,
+			Parameter: params,
+		},
+		BaseKey:  noDerive.Object,
+		Template: tmpl,
+	}, nil)
+	if ret != pkcs11.ErrKeyFunctionNotPermitted {
+		t.Errorf("DeriveKey without CKA_DERIVE: %s", ret)
+	}
+}
+
+func pbkdf2Params(password, salt string, iterations int,
+	prf pkcs11.Pkcs5Pbkd2PseudoRandomFunctionType) *pkcs11.Pkcs5Pbkd2Params2 {
+
+	return &pkcs11.Pkcs5Pbkd2Params2{
+		SaltSource:     pkcs11.CkzSaltSpecified,
+		SaltSourceData: []byte(salt),
+		Iterations:     pkcs11.Ulong(iterations),
+		Prf:            prf,
+		Password:       utf8(password),
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 6070 test vectors, and the same password and salt with
+	// HMAC-SHA256.
+	tests := []struct {
+		prf        pkcs11.Pkcs5Pbkd2PseudoRandomFunctionType
+		iterations int
+		key        string
+	}{
+		{pkcs11.CkpPKCS5PBKD2HMACSHA1, 1,
+			"0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{pkcs11.CkpPKCS5PBKD2HMACSHA1, 2,
+			"ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{pkcs11.CkpPKCS5PBKD2HMACSHA1, 4096,
+			"4b007901b765489abead49d926f721d065a429c1"},
+		{pkcs11.CkpPKCS5PBKD2HMACSHA256, 1,
+			"120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+	}
+	for idx, test := range tests {
+		expected := unhex(t, test.key)
+		key, err := pbkdf2Derive(pbkdf2Params("password", "salt",
+			test.iterations, test.prf), len(expected))
+		if err != nil {
+			t.Fatalf("test %d: pbkdf2Derive: %v", idx, err)
+		}
+		if !bytes.Equal(key, expected) {
+			t.Errorf("test %d: got %x, expected %x", idx, key, expected)
+		}
+	}
+
+	invalid := []*pkcs11.Pkcs5Pbkd2Params2{
+		pbkdf2Params("password", "salt", 0, pkcs11.CkpPKCS5PBKD2HMACSHA1),
+		pbkdf2Params("password", "salt", PBKDF2MaxIterations+1,
+			pkcs11.CkpPKCS5PBKD2HMACSHA1),
+		pbkdf2Params("password", "salt", 1,
+			pkcs11.CkpPKCS5PBKD2HMACGOSTR3411),
+	}
+	params := pbkdf2Params("password", "salt", 1, pkcs11.CkpPKCS5PBKD2HMACSHA1)
+	params.SaltSource = 0
+	invalid = append(invalid, params)
+
+	for idx, params := range invalid {
+		_, err := pbkdf2Derive(params, 16)
+		if err != pkcs11.ErrMechanismParamInvalid {
+			t.Errorf("test %d: pbkdf2Derive: %v", idx, err)
+		}
+	}
+}
+
+func TestPBKDF2GenerateKey(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	params, err := pkcs11.Marshal(pbkdf2Params("password", "salt", 4096,
+		pkcs11.CkpPKCS5PBKD2HMACSHA1))
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	mech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmPKCS5PBKD2,
+		Parameter: params,
+	}
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+
+	ret := session.call(msgGenerateKey, &pkcs11.GenerateKeyReq{
+		Mechanism: mech,
+		Template:  tmpl,
+	}, nil)
+	if ret != pkcs11.ErrTemplateIncomplete {
+		t.Errorf("GenerateKey without CKA_VALUE_LEN: %s", ret)
+	}
+	ret = session.call(msgGenerateKey, &pkcs11.GenerateKeyReq{
+		Mechanism: mech,
+		Template:  tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkDES3)),
+	}, nil)
+	if ret != pkcs11.ErrTemplateInconsistent {
+		t.Errorf("GenerateKey DES3 key: %s", ret)
+	}
+
+	var key pkcs11.GenerateKeyResp
+	session.mustCall(msgGenerateKey, &pkcs11.GenerateKeyReq{
+		Mechanism: mech,
+		Template:  tmpl.SetInt(pkcs11.CkaValueLen, 16),
+	}, &key)
+
+	obj, err := provider.storage.Read(key.Key)
+	if err != nil {
+		t.Fatalf("storage.Read: %v", err)
+	}
+	expected := unhex(t, "4b007901b765489abead49d926f721d0")
+	if !bytes.Equal(obj.Native.([]byte), expected) {
+		t.Errorf("PBKDF2 key %x, expected %x", obj.Native, expected)
+	}
+}
+
+func TestExtractKey(t *testing.T) {
+	// The CKM_EXTRACT_KEY_FROM_KEY example of the PKCS #11
+	// specification.
+	key := []byte{0x32, 0x9f, 0x84, 0xa9}
+	result := extractKey(key, 21, 2)
+	if !bytes.Equal(result, []byte{0x95, 0x26}) {
+		t.Errorf("extractKey: got %x, expected 9526", result)
+	}
+	result = extractKey(key, 0, 4)
+	if !bytes.Equal(result, key) {
+		t.Errorf("extractKey: got %x, expected %x", result, key)
+	}
+}
+
+func TestKeyCombination(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	createKey := func(value []byte, sensitive, extractable bool) pkcs11.ObjectHandle {
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkGenericSecret))
+		tmpl = tmpl.SetBool(pkcs11.CkaDerive, true)
+		tmpl = tmpl.SetBool(pkcs11.CkaSensitive, sensitive)
+		tmpl = tmpl.SetBool(pkcs11.CkaExtractable, extractable)
+		tmpl = tmpl.Set(pkcs11.CkaValue, value)
+
+		var obj pkcs11.CreateObjectResp
+		session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+			Template: tmpl,
+		}, &obj)
+		return obj.Object
+	}
+	valueA := []byte{0x32, 0x9f, 0x84, 0xa9}
+	valueB := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	keyA := createKey(valueA, false, true)
+	keyB := createKey(valueB, true, false)
+	data := []byte{0xff, 0x00}
+
+	marshal := func(v interface{}) []byte {
+		data, err := pkcs11.Marshal(v)
+		if err != nil {
+			t.Fatalf("pkcs11.Marshal: %v", err)
+		}
+		return data
+	}
+	stringData := marshal(&pkcs11.KeyDerivationStringData{
+		Data: data,
+	})
+
+	var extractable pkcs11.Template
+	extractable = extractable.SetBool(pkcs11.CkaExtractable, true)
+
+	tests := []struct {
+		mech        pkcs11.MechanismType
+		base        pkcs11.ObjectHandle
+		param       []byte
+		tmpl        pkcs11.Template
+		value       []byte
+		sensitive   bool
+		extractable bool
+	}{
+		{
+			mech:        pkcs11.CkmConcatenateBaseAndKey,
+			base:        keyA,
+			param:       marshal(keyB),
+			tmpl:        extractable,
+			value:       append(append([]byte{}, valueA...), valueB...),
+			sensitive:   true,
+			extractable: false,
+		},
+		{
+			mech:        pkcs11.CkmConcatenateBaseAndKey,
+			base:        keyA,
+			param:       marshal(keyA),
+			tmpl:        extractable.SetInt(pkcs11.CkaValueLen, 6),
+			value:       append(append([]byte{}, valueA...), valueA[:2]...),
+			extractable: true,
+		},
+		{
+			mech:        pkcs11.CkmConcatenateBaseAndData,
+			base:        keyA,
+			param:       stringData,
+			tmpl:        extractable,
+			value:       append(append([]byte{}, valueA...), data...),
+			extractable: true,
+		},
+		{
+			mech:      pkcs11.CkmConcatenateDataAndBase,
+			base:      keyB,
+			param:     stringData,
+			tmpl:      extractable,
+			value:     append(append([]byte{}, data...), valueB...),
+			sensitive: true,
+		},
+		{
+			mech:        pkcs11.CkmXORBaseAndData,
+			base:        keyA,
+			param:       stringData,
+			tmpl:        extractable,
+			value:       []byte{0x32 ^ 0xff, 0x9f},
+			extractable: true,
+		},
+		{
+			mech:        pkcs11.CkmExtractKeyFromKey,
+			base:        keyA,
+			param:       marshal(pkcs11.Ulong(21)),
+			tmpl:        extractable.SetInt(pkcs11.CkaValueLen, 2),
+			value:       []byte{0x95, 0x26},
+			extractable: true,
+		},
+	}
+	for idx, test := range tests {
+		var resp pkcs11.DeriveKeyResp
+		session.mustCall(msgDeriveKey, &pkcs11.DeriveKeyReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: test.mech,
+				Parameter: test.param,
+			},
+			BaseKey:  test.base,
+			Template: test.tmpl,
+		}, &resp)
+
+		obj, err := provider.storage.Read(resp.Key)
+		if err != nil {
+			t.Fatalf("storage.Read: %v", err)
+		}
+		if !bytes.Equal(obj.Native.([]byte), test.value) {
+			t.Errorf("test %d: %s: got %x, expected %x",
+				idx, test.mech, obj.Native, test.value)
+		}
+		sensitive, err := obj.Attrs.OptBool(pkcs11.CkaSensitive)
+		if err != nil || sensitive != test.sensitive {
+			t.Errorf("test %d: %s: CKA_SENSITIVE=%v, expected %v",
+				idx, test.mech, sensitive, test.sensitive)
+		}
+		extractable, err := obj.Attrs.OptBool(pkcs11.CkaExtractable)
+		if err != nil || extractable != test.extractable {
+			t.Errorf("test %d: %s: CKA_EXTRACTABLE=%v, expected %v",
+				idx, test.mech, extractable, test.extractable)
+		}
+	}
+
+	// The derived key can't be longer than the combined value.
+	ret := session.call(msgDeriveKey, &pkcs11.DeriveKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmConcatenateBaseAndData,
+			Parameter: stringData,
+		},
+		BaseKey:  keyA,
+		Template: extractable.SetInt(pkcs11.CkaValueLen, 7),
+	}, nil)
+	if ret != pkcs11.ErrTemplateInconsistent {
+		t.Errorf("DeriveKey with too long key: %s", ret)
+	}
+	ret = session.call(msgDeriveKey, &pkcs11.DeriveKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmExtractKeyFromKey,
+			Parameter: marshal(pkcs11.Ulong(32)),
+		},
+		BaseKey:  keyA,
+		Template: extractable.SetInt(pkcs11.CkaValueLen, 2),
+	}, nil)
+	if ret != pkcs11.ErrMechanismParamInvalid {
+		t.Errorf("DeriveKey with invalid bit index: %s", ret)
+	}
+
+	// The second key of CKM_CONCATENATE_BASE_AND_KEY must have
+	// CKA_DERIVE and be a secret key of a compatible type.
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkGenericSecret))
+	tmpl = tmpl.Set(pkcs11.CkaValue, valueB)
+
+	var noDerive pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl,
+	}, &noDerive)
+
+	tmpl = nil
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+	tmpl = tmpl.SetBool(pkcs11.CkaDerive, true)
+	tmpl = tmpl.Set(pkcs11.CkaValue, make([]byte, 16))
+
+	var aesKey pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl,
+	}, &aesKey)
+
+	for _, test := range []struct {
+		key pkcs11.ObjectHandle
+		ret pkcs11.CKRV
+	}{
+		{noDerive.Object, pkcs11.ErrKeyFunctionNotPermitted},
+		{aesKey.Object, pkcs11.ErrKeyTypeInconsistent},
+	} {
+		ret = session.call(msgDeriveKey, &pkcs11.DeriveKeyReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: pkcs11.CkmConcatenateBaseAndKey,
+				Parameter: marshal(test.key),
+			},
+			BaseKey:  keyA,
+			Template: extractable,
+		}, nil)
+		if ret != test.ret {
+			t.Errorf("CKM_CONCATENATE_BASE_AND_KEY: %s, expected %s",
+				ret, test.ret)
+		}
+	}
+}
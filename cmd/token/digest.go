@@ -0,0 +1,118 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// Digest describes a message digest algorithm.
+type Digest struct {
+	// Hash specifies the crypto.Hash of the algorithm. It is 0 for
+	// algorithms that do not have a crypto.Hash identifier.
+	Hash crypto.Hash
+	New  func() hash.Hash
+}
+
+var digests = map[pkcs11.MechanismType]Digest{
+	pkcs11.CkmSHA1: {
+		Hash: crypto.SHA1,
+		New:  sha1.New,
+	},
+	pkcs11.CkmSHA224: {
+		Hash: crypto.SHA224,
+		New:  sha256.New224,
+	},
+	pkcs11.CkmSHA256: {
+		Hash: crypto.SHA256,
+		New:  sha256.New,
+	},
+	pkcs11.CkmSHA384: {
+		Hash: crypto.SHA384,
+		New:  sha512.New384,
+	},
+	pkcs11.CkmSHA512: {
+		Hash: crypto.SHA512,
+		New:  sha512.New,
+	},
+	pkcs11.CkmSHA512224: {
+		Hash: crypto.SHA512_224,
+		New:  sha512.New512_224,
+	},
+	pkcs11.CkmSHA512256: {
+		Hash: crypto.SHA512_256,
+		New:  sha512.New512_256,
+	},
+	pkcs11.CkmSHA3224: {
+		Hash: crypto.SHA3_224,
+		New:  sha3.New224,
+	},
+	pkcs11.CkmSHA3256: {
+		Hash: crypto.SHA3_256,
+		New:  sha3.New256,
+	},
+	pkcs11.CkmSHA3384: {
+		Hash: crypto.SHA3_384,
+		New:  sha3.New384,
+	},
+	pkcs11.CkmSHA3512: {
+		Hash: crypto.SHA3_512,
+		New:  sha3.New512,
+	},
+	pkcs11.CkmBlake2b160: {
+		New: newBlake2b(20),
+	},
+	pkcs11.CkmBlake2b256: {
+		Hash: crypto.BLAKE2b_256,
+		New:  newBlake2b(blake2b.Size256),
+	},
+	pkcs11.CkmBlake2b384: {
+		Hash: crypto.BLAKE2b_384,
+		New:  newBlake2b(blake2b.Size384),
+	},
+	pkcs11.CkmBlake2b512: {
+		Hash: crypto.BLAKE2b_512,
+		New:  newBlake2b(blake2b.Size),
+	},
+}
+
+func newBlake2b(size int) func() hash.Hash {
+	return func() hash.Hash {
+		h, err := blake2b.New(size, nil)
+		if err != nil {
+			panic(err)
+		}
+		return h
+	}
+}
+
+// hmacs maps the HMAC mechanisms to their digest mechanisms.
+var hmacs = map[pkcs11.MechanismType]pkcs11.MechanismType{
+	pkcs11.CkmSHA1HMAC:       pkcs11.CkmSHA1,
+	pkcs11.CkmSHA224HMAC:     pkcs11.CkmSHA224,
+	pkcs11.CkmSHA256HMAC:     pkcs11.CkmSHA256,
+	pkcs11.CkmSHA384HMAC:     pkcs11.CkmSHA384,
+	pkcs11.CkmSHA512HMAC:     pkcs11.CkmSHA512,
+	pkcs11.CkmSHA512224HMAC:  pkcs11.CkmSHA512224,
+	pkcs11.CkmSHA512256HMAC:  pkcs11.CkmSHA512256,
+	pkcs11.CkmSHA3224HMAC:    pkcs11.CkmSHA3224,
+	pkcs11.CkmSHA3256HMAC:    pkcs11.CkmSHA3256,
+	pkcs11.CkmSHA3384HMAC:    pkcs11.CkmSHA3384,
+	pkcs11.CkmSHA3512HMAC:    pkcs11.CkmSHA3512,
+	pkcs11.CkmBlake2b160HMAC: pkcs11.CkmBlake2b160,
+	pkcs11.CkmBlake2b256HMAC: pkcs11.CkmBlake2b256,
+	pkcs11.CkmBlake2b384HMAC: pkcs11.CkmBlake2b384,
+	pkcs11.CkmBlake2b512HMAC: pkcs11.CkmBlake2b512,
+}
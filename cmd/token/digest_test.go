@@ -0,0 +1,133 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func TestDigestKey(t *testing.T) {
+	app, provider, sessions, _, key := testApplication(t, 1)
+	defer app.kill()
+	session := sessions[0]
+	defer session.kill()
+
+	obj, err := provider.storage.Read(key)
+	if err != nil {
+		t.Fatalf("storage.Read: %v", err)
+	}
+	extractable, err := obj.Attrs.OptBool(pkcs11.CkaExtractable)
+	if err != nil || extractable {
+		t.Fatalf("key CKA_EXTRACTABLE=%v: %v", extractable, err)
+	}
+
+	// Secret keys are digested without extracting them.
+	session.mustCall(msgDigestKey, &pkcs11.DigestKeyReq{
+		Key: key,
+	}, nil)
+
+	var final pkcs11.DigestFinalResp
+	session.mustCall(msgDigestFinal, &pkcs11.DigestFinalReq{
+		DigestSize: sha256.Size,
+	}, &final)
+
+	h := sha256.New()
+	h.Write([]byte("Hello, world!"))
+	h.Write(obj.Native.([]byte))
+	if !bytes.Equal(final.Digest, h.Sum(nil)) {
+		t.Errorf("DigestKey: got %x, expected %x", final.Digest, h.Sum(nil))
+	}
+
+	// Non-secret keys are indigestible.
+	var pubTmpl pkcs11.Template
+	pubTmpl = pubTmpl.Set(pkcs11.CkaECParams, secp256r1)
+
+	var keys pkcs11.GenerateKeyPairResp
+	session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmECKeyPairGen,
+		},
+		PublicKeyTemplate: pubTmpl,
+	}, &keys)
+
+	session.mustCall(msgDigestInit, &pkcs11.DigestInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSHA256,
+		},
+	}, nil)
+	for _, h := range []pkcs11.ObjectHandle{keys.PublicKey, keys.PrivateKey} {
+		ret := session.call(msgDigestKey, &pkcs11.DigestKeyReq{
+			Key: h,
+		}, nil)
+		if ret != pkcs11.ErrKeyIndigestible {
+			t.Errorf("DigestKey(%v): %s", h, ret)
+		}
+	}
+}
+
+func TestDigests(t *testing.T) {
+	tests := []struct {
+		mech   pkcs11.MechanismType
+		digest string
+	}{
+		{pkcs11.CkmSHA1, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{pkcs11.CkmSHA512224,
+			"4634270f707b6a54daae7530460842e20e37ed265ceee9a43e8924aa"},
+		{pkcs11.CkmSHA512256,
+			"53048e2681941ef99b2e29b76b4c7dabe4c2d0c634fc6d46e0e2f13107e7af23"},
+		{pkcs11.CkmSHA3224,
+			"e642824c3f8cf24ad09234ee7d3c766fc9a3a5168d0c94ad73b46fdf"},
+		{pkcs11.CkmSHA3256,
+			"3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+		{pkcs11.CkmSHA3384,
+			"ec01498288516fc926459f58e2c6ad8df9b473cb0fc08c2596da7cf0e49be4b2" +
+				"98d88cea927ac7f539f1edf228376d25"},
+		{pkcs11.CkmSHA3512,
+			"b751850b1a57168a5693cd924b6b096e08f621827444f70d884f5d0240d2712e" +
+				"10e116e9192af3c91a7ec57647e3934057340b4cf408d5a56592f8274eec53f0"},
+		{pkcs11.CkmBlake2b256,
+			"bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{pkcs11.CkmBlake2b512,
+			"ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d1" +
+				"7d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+	}
+	for _, test := range tests {
+		d, ok := digests[test.mech]
+		if !ok {
+			t.Errorf("%s: digest not found", test.mech)
+			continue
+		}
+		h := d.New()
+		h.Write([]byte("abc"))
+		expected := unhex(t, test.digest)
+		if !bytes.Equal(h.Sum(nil), expected) {
+			t.Errorf("%s: got %x, expected %x", test.mech, h.Sum(nil), expected)
+		}
+		if d.Hash != 0 && d.Hash.Size() != len(expected) {
+			t.Errorf("%s: hash %v size %v, expected %v",
+				test.mech, d.Hash, d.Hash.Size(), len(expected))
+		}
+	}
+	for mech, size := range map[pkcs11.MechanismType]int{
+		pkcs11.CkmBlake2b160: 20,
+		pkcs11.CkmBlake2b384: 48,
+	} {
+		h := digests[mech].New()
+		if h.Size() != size {
+			t.Errorf("%s: size %v, expected %v", mech, h.Size(), size)
+		}
+	}
+	for hmac, mech := range hmacs {
+		if _, ok := digests[mech]; !ok {
+			t.Errorf("%s: digest %s not found", hmac, mech)
+		}
+	}
+}
@@ -44,3 +44,15 @@ func (hash *HashNone) Size() int {
 func (hash *HashNone) BlockSize() int {
 	return 1
 }
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (hash *HashNone) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), hash.buf.Bytes()...), nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+func (hash *HashNone) UnmarshalBinary(data []byte) error {
+	hash.buf.Reset()
+	hash.buf.Write(data)
+	return nil
+}
@@ -0,0 +1,326 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"hash"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// kbkdfMode defines the NIST SP 800-108 key derivation modes.
+type kbkdfMode int
+
+// SP 800-108 key derivation modes.
+const (
+	kbkdfCounter kbkdfMode = iota
+	kbkdfFeedback
+	kbkdfDoublePipeline
+)
+
+// kbkdfParam is a decoded PRF data parameter.
+type kbkdfParam struct {
+	Type    pkcs11.PrfDataType
+	Counter *pkcs11.Sp800108CounterFormat
+	DKM     *pkcs11.Sp800108DkmLengthFormat
+	Data    []byte
+}
+
+// newPRF creates the pseudorandom function for the SP 800-108 key
+// derivation. The PRF is either HMAC or AES-CMAC keyed with the key.
+func newPRF(prfType pkcs11.MechanismType, keyType pkcs11.KeyType,
+	key []byte) (func() hash.Hash, error) {
+
+	if prfType == pkcs11.CkmAESCMAC {
+		if keyType != pkcs11.CkkAES {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, pkcs11.ErrKeySizeRange
+		}
+		return func() hash.Hash {
+			return newCMAC(block)
+		}, nil
+	}
+	m, ok := hmacs[prfType]
+	if !ok {
+		Errorf("SP800-108: invalid PRF %v", prfType)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	return func() hash.Hash {
+		return hmac.New(digests[m].New, key)
+	}, nil
+}
+
+// kbkdfParams decodes and validates the PRF data parameters for the
+// key derivation mode.
+func kbkdfParams(mode kbkdfMode, params []pkcs11.PrfDataParam) (
+	[]kbkdfParam, error) {
+
+	var result []kbkdfParam
+	var numIter, numCounter, numDKM int
+
+	for _, param := range params {
+		p := kbkdfParam{
+			Type: param.Type,
+		}
+		switch param.Type {
+		case pkcs11.CkSP800108IterationVariable:
+			numIter++
+			if mode == kbkdfCounter {
+				p.Counter = new(pkcs11.Sp800108CounterFormat)
+			} else if len(param.Value) != 0 {
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+
+		case pkcs11.CkSP800108OptionalCounter:
+			numCounter++
+			if mode == kbkdfCounter {
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+			p.Counter = new(pkcs11.Sp800108CounterFormat)
+
+		case pkcs11.CkSP800108DKMLength:
+			numDKM++
+			p.DKM = new(pkcs11.Sp800108DkmLengthFormat)
+			err := pkcs11.Unmarshal(param.Value, p.DKM)
+			if err != nil {
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+			switch p.DKM.DkmLengthMethod {
+			case pkcs11.CkSP800108DKMLengthSumOfKeys,
+				pkcs11.CkSP800108DKMLengthSumOfSegments:
+			default:
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+			w := p.DKM.WidthInBits
+			if w == 0 || w > 64 || w%8 != 0 {
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+
+		case pkcs11.CkSP800108ByteArray:
+			p.Data = param.Value
+
+		default:
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if p.Counter != nil {
+			err := pkcs11.Unmarshal(param.Value, p.Counter)
+			if err != nil {
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+			w := p.Counter.WidthInBits
+			if w == 0 || w > 32 || w%8 != 0 {
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+		}
+		result = append(result, p)
+	}
+	if numIter != 1 || numCounter > 1 || numDKM > 1 {
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	return result, nil
+}
+
+// kbkdfInt encodes the integer value v as a width bits long integer.
+func kbkdfInt(v uint64, width pkcs11.Ulong, littleEndian pkcs11.Bbool) []byte {
+	n := int(width / 8)
+	result := make([]byte, n)
+	for i := 0; i < n; i++ {
+		b := byte(v >> (8 * i))
+		if littleEndian {
+			result[i] = b
+		} else {
+			result[n-1-i] = b
+		}
+	}
+	return result
+}
+
+// kbkdfDerive derives size bytes of keying material with the NIST SP
+// 800-108 key derivation function. The size is the total length of
+// all derived keys and it is limited to MaxDerivedKeyLen bytes. The
+// iv is the feedback mode IV.
+func kbkdfDerive(mode kbkdfMode, prf func() hash.Hash,
+	params []pkcs11.PrfDataParam, iv []byte, size int) ([]byte, error) {
+
+	if size > MaxDerivedKeyLen {
+		return nil, pkcs11.ErrTemplateInconsistent
+	}
+
+	data, err := kbkdfParams(mode, params)
+	if err != nil {
+		return nil, err
+	}
+	mac := prf()
+	hLen := mac.Size()
+	n := (size + hLen - 1) / hLen
+
+	for idx := range data {
+		p := &data[idx]
+		if p.Counter != nil && uint64(n)>>p.Counter.WidthInBits != 0 {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		if p.DKM != nil {
+			var l uint64
+			if p.DKM.DkmLengthMethod == pkcs11.CkSP800108DKMLengthSumOfKeys {
+				l = uint64(size) * 8
+			} else {
+				l = uint64(n*hLen) * 8
+			}
+			if p.DKM.WidthInBits < 64 && l>>p.DKM.WidthInBits != 0 {
+				return nil, pkcs11.ErrTemplateInconsistent
+			}
+			p.Data = kbkdfInt(l, p.DKM.WidthInBits, p.DKM.LittleEndian)
+		}
+	}
+
+	// The double pipeline mode computes the first pipeline value
+	// A(0) from the fixed input data.
+	var pipeline []byte
+	if mode == kbkdfDoublePipeline {
+		for _, p := range data {
+			if p.Type != pkcs11.CkSP800108IterationVariable &&
+				p.Type != pkcs11.CkSP800108OptionalCounter {
+				pipeline = append(pipeline, p.Data...)
+			}
+		}
+	}
+
+	var result []byte
+	k := iv
+
+	for i := 1; i <= n; i++ {
+		if mode == kbkdfDoublePipeline {
+			mac.Reset()
+			mac.Write(pipeline)
+			pipeline = mac.Sum(nil)
+		}
+		mac.Reset()
+		for _, p := range data {
+			switch {
+			case p.Counter != nil:
+				mac.Write(kbkdfInt(uint64(i), p.Counter.WidthInBits,
+					p.Counter.LittleEndian))
+
+			case p.Type == pkcs11.CkSP800108IterationVariable:
+				if mode == kbkdfFeedback {
+					mac.Write(k)
+				} else {
+					mac.Write(pipeline)
+				}
+
+			default:
+				mac.Write(p.Data)
+			}
+		}
+		k = mac.Sum(nil)
+		result = append(result, k...)
+	}
+	return result[:size], nil
+}
+
+// cmac implements the CMAC message authentication code (NIST SP
+// 800-38B) as a hash.Hash.
+type cmac struct {
+	b   cipher.Block
+	k1  []byte
+	k2  []byte
+	x   []byte
+	buf []byte
+}
+
+func newCMAC(b cipher.Block) hash.Hash {
+	bs := b.BlockSize()
+	l := make([]byte, bs)
+	b.Encrypt(l, l)
+	k1 := cmacSubkey(l)
+
+	return &cmac{
+		b:   b,
+		k1:  k1,
+		k2:  cmacSubkey(k1),
+		x:   make([]byte, bs),
+		buf: make([]byte, 0, bs),
+	}
+}
+
+// cmacSubkey derives the next CMAC subkey by doubling the value in
+// GF(2^n).
+func cmacSubkey(in []byte) []byte {
+	out := make([]byte, len(in))
+	var carry byte
+	for i := len(in) - 1; i >= 0; i-- {
+		out[i] = in[i]<<1 | carry
+		carry = in[i] >> 7
+	}
+	if carry != 0 {
+		if len(in) == 16 {
+			out[len(out)-1] ^= 0x87
+		} else {
+			out[len(out)-1] ^= 0x1b
+		}
+	}
+	return out
+}
+
+func (c *cmac) Write(p []byte) (int, error) {
+	n := len(p)
+	bs := len(c.x)
+
+	for len(p) > 0 {
+		// The last block is processed in Sum.
+		if len(c.buf) == bs {
+			xorBytes(c.x, c.buf)
+			c.b.Encrypt(c.x, c.x)
+			c.buf = c.buf[:0]
+		}
+		l := bs - len(c.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		c.buf = append(c.buf, p[:l]...)
+		p = p[l:]
+	}
+	return n, nil
+}
+
+func (c *cmac) Sum(b []byte) []byte {
+	bs := len(c.x)
+	last := make([]byte, bs)
+	copy(last, c.buf)
+
+	if len(c.buf) == bs {
+		xorBytes(last, c.k1)
+	} else {
+		last[len(c.buf)] = 0x80
+		xorBytes(last, c.k2)
+	}
+	xorBytes(last, c.x)
+	c.b.Encrypt(last, last)
+
+	return append(b, last...)
+}
+
+func (c *cmac) Reset() {
+	for i := range c.x {
+		c.x[i] = 0
+	}
+	c.buf = c.buf[:0]
+}
+
+func (c *cmac) Size() int {
+	return len(c.x)
+}
+
+func (c *cmac) BlockSize() int {
+	return len(c.x)
+}
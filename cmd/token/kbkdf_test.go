@@ -0,0 +1,358 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// RFC 4493 AES-CMAC test vectors.
+func TestCMAC(t *testing.T) {
+	key := unhex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	msg := unhex(t, "6bc1bee22e409f96e93d7e117393172a"+
+		"ae2d8a571e03ac9c9eb76fac45af8e51"+
+		"30c81c46a35ce411e5fbc1191a0a52ef"+
+		"f69f2445df4f9b17ad2b417be66c3710")
+
+	tests := []struct {
+		len int
+		mac string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := newCMAC(b)
+	for _, test := range tests {
+		expected := unhex(t, test.mac)
+
+		mac.Reset()
+		mac.Write(msg[:test.len])
+		if !bytes.Equal(mac.Sum(nil), expected) {
+			t.Errorf("CMAC(%d): got %x, expected %x",
+				test.len, mac.Sum(nil), expected)
+		}
+
+		// Write the message in parts.
+		mac.Reset()
+		for i := 0; i < test.len; i += 7 {
+			end := i + 7
+			if end > test.len {
+				end = test.len
+			}
+			mac.Write(msg[i:end])
+		}
+		if !bytes.Equal(mac.Sum(nil), expected) {
+			t.Errorf("CMAC(%d) in parts: got %x, expected %x",
+				test.len, mac.Sum(nil), expected)
+		}
+	}
+}
+
+func kbkdfCounterParam(t *testing.T, typ pkcs11.PrfDataType,
+	width int) pkcs11.PrfDataParam {
+
+	value, err := pkcs11.Marshal(&pkcs11.Sp800108CounterFormat{
+		WidthInBits: pkcs11.Ulong(width),
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	return pkcs11.PrfDataParam{
+		Type:  typ,
+		Value: value,
+	}
+}
+
+func kbkdfDKMParam(t *testing.T, width int) pkcs11.PrfDataParam {
+	value, err := pkcs11.Marshal(&pkcs11.Sp800108DkmLengthFormat{
+		DkmLengthMethod: pkcs11.CkSP800108DKMLengthSumOfKeys,
+		WidthInBits:     pkcs11.Ulong(width),
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	return pkcs11.PrfDataParam{
+		Type:  pkcs11.CkSP800108DKMLength,
+		Value: value,
+	}
+}
+
+func kbkdfByteArray(data []byte) pkcs11.PrfDataParam {
+	return pkcs11.PrfDataParam{
+		Type:  pkcs11.CkSP800108ByteArray,
+		Value: data,
+	}
+}
+
+// RFC 8009 uses the SP 800-108 counter mode KDF with HMAC-SHA256 to
+// derive the Kerberos keys.
+func TestKBKDFCounter(t *testing.T) {
+	key := unhex(t, "3705d96080c17728a0e800eab6e0d23c")
+	tests := []struct {
+		label string
+		key   string
+	}{
+		{"0000000299", "b31a018a48f54776f403e9a396325dc3"},
+		{"00000002aa", "9b197dd1e8c5609d6e67c3e37c62c72e"},
+		{"0000000255", "9fda0e56ab2d85e1569a688696c26a6c"},
+	}
+	prf, err := newPRF(pkcs11.CkmSHA256HMAC, pkcs11.CkkGenericSecret, key)
+	if err != nil {
+		t.Fatalf("newPRF: %v", err)
+	}
+	for _, test := range tests {
+		params := []pkcs11.PrfDataParam{
+			kbkdfCounterParam(t, pkcs11.CkSP800108IterationVariable, 32),
+			kbkdfByteArray(append(unhex(t, test.label), 0)),
+			kbkdfDKMParam(t, 32),
+		}
+		dkm, err := kbkdfDerive(kbkdfCounter, prf, params, nil, 16)
+		if err != nil {
+			t.Fatalf("kbkdfDerive: %v", err)
+		}
+		expected := unhex(t, test.key)
+		if !bytes.Equal(dkm, expected) {
+			t.Errorf("label %s: got %x, expected %x", test.label, dkm, expected)
+		}
+	}
+}
+
+// kbkdfReference computes the feedback and double pipeline mode KDFs
+// as specified in SP 800-108 with the fixed input data and 8-bit
+// counter.
+func kbkdfReference(mode kbkdfMode, prf func() hash.Hash, iv,
+	fixed []byte, size int) []byte {
+
+	var result []byte
+	k := iv
+	a := fixed
+	for i := 1; len(result) < size; i++ {
+		mac := prf()
+		if mode == kbkdfDoublePipeline {
+			mac.Write(a)
+			a = mac.Sum(nil)
+			mac.Reset()
+			mac.Write(a)
+		} else {
+			mac.Write(k)
+		}
+		mac.Write([]byte{byte(i)})
+		mac.Write(fixed)
+		k = mac.Sum(nil)
+		result = append(result, k...)
+	}
+	return result[:size]
+}
+
+func TestKBKDFModes(t *testing.T) {
+	key := bytes.Repeat([]byte{0x0b}, 32)
+	prf, err := newPRF(pkcs11.CkmSHA256HMAC, pkcs11.CkkGenericSecret, key)
+	if err != nil {
+		t.Fatalf("newPRF: %v", err)
+	}
+	reference := func() hash.Hash {
+		return hmac.New(sha256.New, key)
+	}
+	iv := bytes.Repeat([]byte{0x5c}, sha256.Size)
+	label := []byte("label\x00context")
+
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], 100*8)
+	fixed := append(append([]byte{}, label...), l[:]...)
+
+	for _, mode := range []kbkdfMode{kbkdfFeedback, kbkdfDoublePipeline} {
+		params := []pkcs11.PrfDataParam{
+			{
+				Type: pkcs11.CkSP800108IterationVariable,
+			},
+			kbkdfCounterParam(t, pkcs11.CkSP800108OptionalCounter, 8),
+			kbkdfByteArray(label),
+			kbkdfDKMParam(t, 32),
+		}
+		var modeIV []byte
+		if mode == kbkdfFeedback {
+			modeIV = iv
+		}
+		dkm, err := kbkdfDerive(mode, prf, params, modeIV, 100)
+		if err != nil {
+			t.Fatalf("mode %v: kbkdfDerive: %v", mode, err)
+		}
+		expected := kbkdfReference(mode, reference, modeIV, fixed, 100)
+		if !bytes.Equal(dkm, expected) {
+			t.Errorf("mode %v:\ngot:  %x\nwant: %x", mode, dkm, expected)
+		}
+	}
+}
+
+func TestKBKDFParams(t *testing.T) {
+	iter := kbkdfCounterParam(t, pkcs11.CkSP800108IterationVariable, 16)
+	counter := kbkdfCounterParam(t, pkcs11.CkSP800108OptionalCounter, 16)
+	label := kbkdfByteArray([]byte("label"))
+	dkm := kbkdfDKMParam(t, 32)
+
+	tests := []struct {
+		mode   kbkdfMode
+		params []pkcs11.PrfDataParam
+		err    error
+	}{
+		{kbkdfCounter, []pkcs11.PrfDataParam{iter, label, dkm}, nil},
+		{kbkdfCounter, []pkcs11.PrfDataParam{label, dkm},
+			pkcs11.ErrMechanismParamInvalid},
+		{kbkdfCounter, []pkcs11.PrfDataParam{iter, iter},
+			pkcs11.ErrMechanismParamInvalid},
+		{kbkdfCounter, []pkcs11.PrfDataParam{iter, counter},
+			pkcs11.ErrMechanismParamInvalid},
+		{kbkdfCounter, []pkcs11.PrfDataParam{iter, dkm, dkm},
+			pkcs11.ErrMechanismParamInvalid},
+		{kbkdfCounter, []pkcs11.PrfDataParam{
+			kbkdfCounterParam(t, pkcs11.CkSP800108IterationVariable, 12),
+		}, pkcs11.ErrMechanismParamInvalid},
+		{kbkdfCounter, []pkcs11.PrfDataParam{
+			kbkdfCounterParam(t, pkcs11.CkSP800108IterationVariable, 40),
+		}, pkcs11.ErrMechanismParamInvalid},
+		{kbkdfFeedback, []pkcs11.PrfDataParam{
+			{Type: pkcs11.CkSP800108IterationVariable}, counter, label,
+		}, nil},
+		{kbkdfFeedback, []pkcs11.PrfDataParam{iter, label},
+			pkcs11.ErrMechanismParamInvalid},
+		{kbkdfDoublePipeline, []pkcs11.PrfDataParam{
+			{Type: pkcs11.CkSP800108IterationVariable}, counter, counter,
+		}, pkcs11.ErrMechanismParamInvalid},
+		{kbkdfCounter, []pkcs11.PrfDataParam{iter, {Type: 0x1234}},
+			pkcs11.ErrMechanismParamInvalid},
+	}
+	for idx, test := range tests {
+		_, err := kbkdfParams(test.mode, test.params)
+		if err != test.err {
+			t.Errorf("test %d: kbkdfParams: %v, expected %v",
+				idx, err, test.err)
+		}
+	}
+
+	// The 8-bit counter can't encode the number of iterations.
+	prf, err := newPRF(pkcs11.CkmSHA256HMAC, pkcs11.CkkGenericSecret,
+		make([]byte, 32))
+	if err != nil {
+		t.Fatalf("newPRF: %v", err)
+	}
+	params := []pkcs11.PrfDataParam{
+		kbkdfCounterParam(t, pkcs11.CkSP800108IterationVariable, 8),
+	}
+	_, err = kbkdfDerive(kbkdfCounter, prf, params, nil, 256*sha256.Size)
+	if err != pkcs11.ErrTemplateInconsistent {
+		t.Errorf("kbkdfDerive with counter overflow: %v", err)
+	}
+	_, err = newPRF(pkcs11.CkmAESCMAC, pkcs11.CkkGenericSecret,
+		make([]byte, 16))
+	if err != pkcs11.ErrKeyTypeInconsistent {
+		t.Errorf("newPRF CMAC with generic secret: %v", err)
+	}
+}
+
+func TestKBKDFDeriveKey(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkGenericSecret))
+	tmpl = tmpl.SetBool(pkcs11.CkaDerive, true)
+	tmpl = tmpl.Set(pkcs11.CkaValue, key)
+
+	var base pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl,
+	}, &base)
+
+	dataParams := []pkcs11.PrfDataParam{
+		kbkdfCounterParam(t, pkcs11.CkSP800108IterationVariable, 32),
+		kbkdfByteArray([]byte("key hierarchy")),
+		kbkdfDKMParam(t, 32),
+	}
+	var aesTmpl pkcs11.Template
+	aesTmpl = aesTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+	aesTmpl = aesTmpl.SetInt(pkcs11.CkaValueLen, 16)
+
+	var macTmpl pkcs11.Template
+	macTmpl = macTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkGenericSecret))
+	macTmpl = macTmpl.SetInt(pkcs11.CkaValueLen, 40)
+
+	params, err := pkcs11.Marshal(&pkcs11.Sp800108KdfParams{
+		PrfType:    pkcs11.CkmSHA256HMAC,
+		DataParams: dataParams,
+		AdditionalDerivedKeys: []pkcs11.DerivedKey{
+			{Template: aesTmpl},
+			{Template: macTmpl},
+		},
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+
+	var resp pkcs11.DeriveKeyResp
+	session.mustCall(msgDeriveKey, &pkcs11.DeriveKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSP800108CounterKDF,
+			Parameter: params,
+		},
+		BaseKey:  base.Object,
+		Template: aesTmpl.SetInt(pkcs11.CkaValueLen, 32),
+	}, &resp)
+	if len(resp.AdditionalKeys) != 2 {
+		t.Fatalf("DeriveKey: %v additional keys, expected 2",
+			len(resp.AdditionalKeys))
+	}
+
+	// The keys are consecutive parts of the derived keying material.
+	prf, err := newPRF(pkcs11.CkmSHA256HMAC, pkcs11.CkkGenericSecret, key)
+	if err != nil {
+		t.Fatalf("newPRF: %v", err)
+	}
+	dkm, err := kbkdfDerive(kbkdfCounter, prf, dataParams, nil, 32+16+40)
+	if err != nil {
+		t.Fatalf("kbkdfDerive: %v", err)
+	}
+	handles := append([]pkcs11.ObjectHandle{resp.Key}, resp.AdditionalKeys...)
+	for idx, size := range []int{32, 16, 40} {
+		obj, err := provider.storage.Read(handles[idx])
+		if err != nil {
+			t.Fatalf("storage.Read: %v", err)
+		}
+		value, ok := obj.Native.([]byte)
+		if !ok || !bytes.Equal(value, dkm[:size]) {
+			t.Errorf("key %d: got %x, expected %x", idx, value, dkm[:size])
+		}
+		dkm = dkm[size:]
+	}
+}
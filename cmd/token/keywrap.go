@@ -0,0 +1,415 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"hash"
+	"math/big"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// RFC 5649 alternative initial value.
+var kwpAIV = []byte{0xa6, 0x59, 0x59, 0xa6}
+
+// kwpLen returns the length of the RFC 5649 wrapped data for the
+// plaintext length.
+func kwpLen(n int) int {
+	return (n+7)/8*8 + 8
+}
+
+// kwpWrap wraps the data with the key encryption key kek using AES
+// Key Wrap with Padding algorithm (RFC 5649).
+func kwpWrap(kek, data []byte) ([]byte, error) {
+	b, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, pkcs11.ErrDataLenRange
+	}
+	n := (len(data) + 7) / 8
+
+	result := make([]byte, 8+n*8)
+	copy(result[0:4], kwpAIV)
+	binary.BigEndian.PutUint32(result[4:8], uint32(len(data)))
+	copy(result[8:], data)
+
+	if n == 1 {
+		b.Encrypt(result, result)
+		return result, nil
+	}
+
+	var block [16]byte
+	a := result[0:8]
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			r := result[i*8 : i*8+8]
+			copy(block[0:8], a)
+			copy(block[8:16], r)
+			b.Encrypt(block[:], block[:])
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(block[0:8])^t)
+			copy(r, block[8:16])
+		}
+	}
+	return result, nil
+}
+
+// kwpUnwrap unwraps the RFC 5649 wrapped data with the key
+// encryption key kek.
+func kwpUnwrap(kek, wrapped []byte) ([]byte, error) {
+	b, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, pkcs11.ErrWrappedKeyLenRange
+	}
+	n := len(wrapped)/8 - 1
+
+	result := make([]byte, len(wrapped))
+	copy(result, wrapped)
+
+	if n == 1 {
+		b.Decrypt(result, result)
+	} else {
+		var block [16]byte
+		a := result[0:8]
+		for j := 5; j >= 0; j-- {
+			for i := n; i >= 1; i-- {
+				r := result[i*8 : i*8+8]
+				t := uint64(n*j + i)
+				binary.BigEndian.PutUint64(block[0:8],
+					binary.BigEndian.Uint64(a)^t)
+				copy(block[8:16], r)
+				b.Decrypt(block[:], block[:])
+
+				copy(a, block[0:8])
+				copy(r, block[8:16])
+			}
+		}
+	}
+
+	// Check integrity.
+	if subtle.ConstantTimeCompare(result[0:4], kwpAIV) != 1 {
+		return nil, pkcs11.ErrWrappedKeyInvalid
+	}
+	mli := int(binary.BigEndian.Uint32(result[4:8]))
+	if mli <= 8*(n-1) || mli > 8*n {
+		return nil, pkcs11.ErrWrappedKeyInvalid
+	}
+	var pad byte
+	for _, v := range result[8+mli:] {
+		pad |= v
+	}
+	if pad != 0 {
+		return nil, pkcs11.ErrWrappedKeyInvalid
+	}
+	return result[8 : 8+mli], nil
+}
+
+// oaepHash returns the hash function and label from the OAEP
+// parameters.
+func oaepHash(params *pkcs11.RsaPkcsOaepParams) (hash.Hash, []byte, error) {
+	var h hash.Hash
+	var mgf pkcs11.RsaPkcsMgfType
+
+	// The crypto/rsa uses the same hash function for the label
+	// and the MGF1 mask generation.
+	switch params.HashAlg {
+	case pkcs11.CkmSHA1:
+		h = sha1.New()
+		mgf = pkcs11.CkgMGF1SHA1
+
+	case pkcs11.CkmSHA224:
+		h = sha256.New224()
+		mgf = pkcs11.CkgMGF1SHA224
+
+	case pkcs11.CkmSHA256:
+		h = sha256.New()
+		mgf = pkcs11.CkgMGF1SHA256
+
+	case pkcs11.CkmSHA384:
+		h = sha512.New384()
+		mgf = pkcs11.CkgMGF1SHA384
+
+	case pkcs11.CkmSHA512:
+		h = sha512.New()
+		mgf = pkcs11.CkgMGF1SHA512
+
+	default:
+		Errorf("OAEP: unsupported hash %v", params.HashAlg)
+		return nil, nil, pkcs11.ErrMechanismParamInvalid
+	}
+	if params.Mgf != mgf {
+		Errorf("OAEP: MGF %v does not match hash %v",
+			params.Mgf, params.HashAlg)
+		return nil, nil, pkcs11.ErrMechanismParamInvalid
+	}
+
+	switch params.Source {
+	case 0:
+		if len(params.SourceData) != 0 {
+			return nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		return h, nil, nil
+
+	case pkcs11.CkzDataSpecified:
+		return h, params.SourceData, nil
+
+	default:
+		return nil, nil, pkcs11.ErrMechanismParamInvalid
+	}
+}
+
+// rsaPublicKey returns the RSA public key of the key object. The
+// public key of an RSA private key object is also accepted.
+func rsaPublicKey(obj *pkcs11.Object) (*rsa.PublicKey, bool) {
+	switch key := obj.Native.(type) {
+	case *rsa.PublicKey:
+		return key, true
+	case *rsa.PrivateKey:
+		return &key.PublicKey, true
+	default:
+		return nil, false
+	}
+}
+
+// aesKeyValue returns the value of the CKK_AES key object.
+func aesKeyValue(obj *pkcs11.Object) ([]byte, bool) {
+	keyType := obj.Attrs.OptInt(pkcs11.CkaKeyType, -1)
+	if pkcs11.KeyType(keyType) != pkcs11.CkkAES {
+		return nil, false
+	}
+	key, ok := obj.Native.([]byte)
+	return key, ok
+}
+
+// secretKeyValue returns the value of the secret key object.
+func secretKeyValue(obj *pkcs11.Object) ([]byte, error) {
+	key, ok := obj.Native.([]byte)
+	if !ok {
+		return nil, pkcs11.ErrKeyHandleInvalid
+	}
+	return key, nil
+}
+
+// wrapKeyData returns the data to be wrapped for the key object.
+// Secret keys are wrapped as their raw values and private keys as
+// PKCS #8 PrivateKeyInfo structures.
+func wrapKeyData(obj *pkcs11.Object) ([]byte, pkcs11.ObjectClass, error) {
+	cls := pkcs11.ObjectClass(obj.Attrs.OptInt(pkcs11.CkaClass, -1))
+	switch cls {
+	case pkcs11.CkoSecretKey:
+		key, err := secretKeyValue(obj)
+		if err != nil {
+			return nil, cls, pkcs11.ErrKeyNotWrappable
+		}
+		return key, cls, nil
+
+	case pkcs11.CkoPrivateKey:
+		switch priv := obj.Native.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			data, err := x509.MarshalPKCS8PrivateKey(priv)
+			if err != nil {
+				Errorf("x509.MarshalPKCS8PrivateKey: %s", err)
+				return nil, cls, pkcs11.ErrKeyNotWrappable
+			}
+			return data, cls, nil
+
+		default:
+			return nil, cls, pkcs11.ErrKeyNotWrappable
+		}
+
+	default:
+		return nil, cls, pkcs11.ErrKeyNotWrappable
+	}
+}
+
+// unwrapKeyTemplate creates the attributes for the unwrapped key
+// data based on the unwrap template.
+func unwrapKeyTemplate(tmpl pkcs11.Template, data []byte) (
+	pkcs11.Template, error) {
+
+	cls := pkcs11.ObjectClass(tmpl.OptInt(pkcs11.CkaClass,
+		int(pkcs11.CkoSecretKey)))
+
+	switch cls {
+	case pkcs11.CkoSecretKey:
+		keyType, err := tmpl.Int(pkcs11.CkaKeyType)
+		if err != nil {
+			return nil, err
+		}
+		switch pkcs11.KeyType(keyType) {
+		case pkcs11.CkkAES:
+			if len(data) != 16 && len(data) != 24 && len(data) != 32 {
+				return nil, pkcs11.ErrWrappedKeyInvalid
+			}
+		case pkcs11.CkkDES3:
+			if len(data) != pkcs11.DES3KeySize {
+				return nil, pkcs11.ErrWrappedKeyInvalid
+			}
+		case pkcs11.CkkGenericSecret:
+		default:
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		size := tmpl.OptInt(pkcs11.CkaValueLen, len(data))
+		if size != len(data) {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(cls))
+		return tmpl.Set(pkcs11.CkaValue, data), nil
+
+	case pkcs11.CkoPrivateKey:
+		priv, err := x509.ParsePKCS8PrivateKey(data)
+		if err != nil {
+			Errorf("x509.ParsePKCS8PrivateKey: %s", err)
+			return nil, pkcs11.ErrWrappedKeyInvalid
+		}
+		var keyType pkcs11.KeyType
+
+		switch key := priv.(type) {
+		case *rsa.PrivateKey:
+			if len(key.Primes) != 2 {
+				return nil, pkcs11.ErrWrappedKeyInvalid
+			}
+			keyType = pkcs11.CkkRSA
+			tmpl = tmpl.Set(pkcs11.CkaModulus, key.N.Bytes())
+			tmpl = tmpl.Set(pkcs11.CkaPublicExponent,
+				big.NewInt(int64(key.E)).Bytes())
+			tmpl = tmpl.Set(pkcs11.CkaPrivateExponent, key.D.Bytes())
+			tmpl = tmpl.Set(pkcs11.CkaPrime1, key.Primes[0].Bytes())
+			tmpl = tmpl.Set(pkcs11.CkaPrime2, key.Primes[1].Bytes())
+
+		case *ecdsa.PrivateKey:
+			params, err := pkcs11.CurveParams(key.Curve)
+			if err != nil {
+				return nil, err
+			}
+			keyType = pkcs11.CkkEC
+			tmpl = tmpl.Set(pkcs11.CkaECParams, params)
+			tmpl = tmpl.Set(pkcs11.CkaValue, key.D.Bytes())
+
+		default:
+			return nil, pkcs11.ErrWrappedKeyInvalid
+		}
+		kt := tmpl.OptInt(pkcs11.CkaKeyType, int(keyType))
+		if pkcs11.KeyType(kt) != keyType {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(cls))
+		return tmpl.SetInt(pkcs11.CkaKeyType, int(keyType)), nil
+
+	default:
+		return nil, pkcs11.ErrTemplateInconsistent
+	}
+}
+
+// rsaPKCSUnwrap decrypts the secret key wrapped with the PKCS #1 v1.5
+// encryption (CKM_RSA_PKCS). The key length must be known before the
+// decryption: it is taken from the template's CKA_VALUE_LEN or from
+// the fixed length of the key type. If the padding or the length of
+// the decrypted key is invalid, the function returns a random key
+// instead of an error so that the unwrap does not reveal the padding
+// errors (Bleichenbacher's attack).
+func rsaPKCSUnwrap(priv *rsa.PrivateKey, tmpl pkcs11.Template,
+	wrapped []byte) ([]byte, error) {
+
+	size := tmpl.OptInt(pkcs11.CkaValueLen, 0)
+	if size == 0 {
+		keyType, err := tmpl.Int(pkcs11.CkaKeyType)
+		if err != nil {
+			return nil, err
+		}
+		if pkcs11.KeyType(keyType) != pkcs11.CkkDES3 {
+			return nil, pkcs11.ErrTemplateIncomplete
+		}
+		size = pkcs11.DES3KeySize
+	}
+	if size < 0 || size > priv.Size()-11 {
+		return nil, pkcs11.ErrTemplateInconsistent
+	}
+	if len(wrapped) != priv.Size() {
+		return nil, pkcs11.ErrWrappedKeyLenRange
+	}
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, pkcs11.ErrDeviceError
+	}
+	err = rsa.DecryptPKCS1v15SessionKey(nil, priv, wrapped, key)
+	if err != nil {
+		// The ciphertext is not smaller than the modulus.
+		return nil, pkcs11.ErrWrappedKeyInvalid
+	}
+	return key, nil
+}
+
+// rsaAESKeyWrap wraps the data with an ephemeral AES key which is
+// encrypted with the RSA public key (CKM_RSA_AES_KEY_WRAP).
+func rsaAESKeyWrap(pub *rsa.PublicKey, params *pkcs11.RsaAesKeyWrapParams,
+	data []byte) ([]byte, error) {
+
+	switch params.AESKeyBits {
+	case 128, 192, 256:
+	default:
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	h, label, err := oaepHash(&params.OAEPParams)
+	if err != nil {
+		return nil, err
+	}
+	kek := make([]byte, params.AESKeyBits/8)
+	_, err = rand.Read(kek)
+	if err != nil {
+		return nil, pkcs11.ErrDeviceError
+	}
+	encrypted, err := rsa.EncryptOAEP(h, rand.Reader, pub, kek, label)
+	if err != nil {
+		Errorf("rsa.EncryptOAEP: %s", err)
+		return nil, pkcs11.ErrWrappingKeySizeRange
+	}
+	wrapped, err := kwpWrap(kek, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(encrypted, wrapped...), nil
+}
+
+// rsaAESKeyUnwrap unwraps the CKM_RSA_AES_KEY_WRAP wrapped data.
+func rsaAESKeyUnwrap(priv *rsa.PrivateKey,
+	params *pkcs11.RsaAesKeyWrapParams, wrapped []byte) ([]byte, error) {
+
+	h, label, err := oaepHash(&params.OAEPParams)
+	if err != nil {
+		return nil, err
+	}
+	size := priv.PublicKey.Size()
+	if len(wrapped) <= size {
+		return nil, pkcs11.ErrWrappedKeyLenRange
+	}
+	kek, err := rsa.DecryptOAEP(h, nil, priv, wrapped[:size], label)
+	if err != nil {
+		return nil, pkcs11.ErrWrappedKeyInvalid
+	}
+	if len(kek)*8 != int(params.AESKeyBits) {
+		return nil, pkcs11.ErrWrappedKeyInvalid
+	}
+	return kwpUnwrap(kek, wrapped[size:])
+}
@@ -0,0 +1,609 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex string %q: %v", s, err)
+	}
+	return data
+}
+
+// RFC 5649 section 6 test vectors.
+var kwpTests = []struct {
+	kek     string
+	key     string
+	wrapped string
+}{
+	{
+		kek:     "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8",
+		key:     "c37b7e6492584340bed12207808941155068f738",
+		wrapped: "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a",
+	},
+	{
+		kek:     "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8",
+		key:     "466f7250617369",
+		wrapped: "afbeb0f07dfbf5419200f2ccb50bb24f",
+	},
+}
+
+func TestKWP(t *testing.T) {
+	for idx, test := range kwpTests {
+		kek := unhex(t, test.kek)
+		key := unhex(t, test.key)
+		expected := unhex(t, test.wrapped)
+
+		wrapped, err := kwpWrap(kek, key)
+		if err != nil {
+			t.Fatalf("test %d: kwpWrap: %v", idx, err)
+		}
+		if !bytes.Equal(wrapped, expected) {
+			t.Errorf("test %d: kwpWrap: got %x, expected %x",
+				idx, wrapped, expected)
+		}
+		if len(wrapped) != kwpLen(len(key)) {
+			t.Errorf("test %d: kwpLen: %v, expected %v",
+				idx, kwpLen(len(key)), len(wrapped))
+		}
+		unwrapped, err := kwpUnwrap(kek, expected)
+		if err != nil {
+			t.Fatalf("test %d: kwpUnwrap: %v", idx, err)
+		}
+		if !bytes.Equal(unwrapped, key) {
+			t.Errorf("test %d: kwpUnwrap: got %x, expected %x",
+				idx, unwrapped, key)
+		}
+		expected[len(expected)-1] ^= 0x01
+		_, err = kwpUnwrap(kek, expected)
+		if err != pkcs11.ErrWrappedKeyInvalid {
+			t.Errorf("test %d: kwpUnwrap with modified data: %v", idx, err)
+		}
+	}
+}
+
+func TestRSAPKCSUnwrap(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{0x5a}, 16)
+	wrapped, err := rsa.EncryptPKCS1v15(rand.Reader, &priv.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+
+	_, err = rsaPKCSUnwrap(priv, tmpl, wrapped)
+	if err != pkcs11.ErrTemplateIncomplete {
+		t.Errorf("rsaPKCSUnwrap without CKA_VALUE_LEN: %v", err)
+	}
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, len(key))
+
+	unwrapped, err := rsaPKCSUnwrap(priv, tmpl, wrapped)
+	if err != nil {
+		t.Fatalf("rsaPKCSUnwrap: %v", err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Errorf("rsaPKCSUnwrap: got %x, expected %x", unwrapped, key)
+	}
+
+	// The padding errors and the invalid key lengths are not
+	// reported but they result in random keys.
+	invalid := make([]byte, len(wrapped))
+	invalid[len(invalid)-1] = 1
+	shortKey, err := rsa.EncryptPKCS1v15(rand.Reader, &priv.PublicKey,
+		key[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, data := range [][]byte{invalid, shortKey} {
+		unwrapped, err = rsaPKCSUnwrap(priv, tmpl, data)
+		if err != nil {
+			t.Errorf("test %d: rsaPKCSUnwrap: %v", idx, err)
+		}
+		if len(unwrapped) != len(key) || bytes.Equal(unwrapped, key) {
+			t.Errorf("test %d: rsaPKCSUnwrap: got %x", idx, unwrapped)
+		}
+	}
+
+	_, err = rsaPKCSUnwrap(priv, tmpl, wrapped[1:])
+	if err != pkcs11.ErrWrappedKeyLenRange {
+		t.Errorf("rsaPKCSUnwrap with short data: %v", err)
+	}
+
+	tmpl = nil
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkDES3))
+	unwrapped, err = rsaPKCSUnwrap(priv, tmpl, wrapped)
+	if err != nil || len(unwrapped) != pkcs11.DES3KeySize {
+		t.Errorf("rsaPKCSUnwrap DES3: %x, %v", unwrapped, err)
+	}
+}
+
+func TestRSAAESKeyWrap(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := &pkcs11.RsaAesKeyWrapParams{
+		AESKeyBits: 256,
+		OAEPParams: pkcs11.RsaPkcsOaepParams{
+			HashAlg: pkcs11.CkmSHA256,
+			Mgf:     pkcs11.CkgMGF1SHA256,
+		},
+	}
+	data := []byte("PKCS #8 private key info")
+
+	wrapped, err := rsaAESKeyWrap(&priv.PublicKey, params, data)
+	if err != nil {
+		t.Fatalf("rsaAESKeyWrap: %v", err)
+	}
+	if len(wrapped) != priv.Size()+kwpLen(len(data)) {
+		t.Errorf("rsaAESKeyWrap: wrapped length %v", len(wrapped))
+	}
+	unwrapped, err := rsaAESKeyUnwrap(priv, params, wrapped)
+	if err != nil {
+		t.Fatalf("rsaAESKeyUnwrap: %v", err)
+	}
+	if !bytes.Equal(unwrapped, data) {
+		t.Errorf("rsaAESKeyUnwrap: got %x, expected %x", unwrapped, data)
+	}
+
+	params.AESKeyBits = 128
+	_, err = rsaAESKeyUnwrap(priv, params, wrapped)
+	if err != pkcs11.ErrWrappedKeyInvalid {
+		t.Errorf("rsaAESKeyUnwrap with wrong AES key size: %v", err)
+	}
+	params.AESKeyBits = 256
+	params.OAEPParams.Mgf = pkcs11.CkgMGF1SHA1
+	_, err = rsaAESKeyUnwrap(priv, params, wrapped)
+	if err != pkcs11.ErrMechanismParamInvalid {
+		t.Errorf("rsaAESKeyUnwrap with mismatching MGF: %v", err)
+	}
+}
+
+func TestWrapUnwrapKey(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	native := func(h pkcs11.ObjectHandle) interface{} {
+		obj, err := provider.storage.Read(h)
+		if err != nil {
+			t.Fatalf("storage.Read: %v", err)
+		}
+		return obj.Native
+	}
+
+	generateRSA := func(wrap bool) pkcs11.GenerateKeyPairResp {
+		var pubTmpl, privTmpl pkcs11.Template
+		pubTmpl = pubTmpl.SetInt(pkcs11.CkaModulusBits, 2048)
+		pubTmpl = pubTmpl.Set(pkcs11.CkaPublicExponent, []byte{1, 0, 1})
+		if wrap {
+			pubTmpl = pubTmpl.SetBool(pkcs11.CkaWrap, true)
+			privTmpl = privTmpl.SetBool(pkcs11.CkaUnwrap, true)
+		}
+		var keys pkcs11.GenerateKeyPairResp
+		session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: pkcs11.CkmRSAPKCSKeyPairGen,
+			},
+			PublicKeyTemplate:  pubTmpl,
+			PrivateKeyTemplate: privTmpl,
+		}, &keys)
+		return keys
+	}
+	rsaKeys := generateRSA(true)
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, 32)
+	tmpl = tmpl.SetBool(pkcs11.CkaExtractable, true)
+
+	var aesKey pkcs11.GenerateKeyResp
+	session.mustCall(msgGenerateKey, &pkcs11.GenerateKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmAESKeyGen,
+		},
+		Template: tmpl,
+	}, &aesKey)
+
+	oaep, err := pkcs11.Marshal(&pkcs11.RsaPkcsOaepParams{
+		HashAlg: pkcs11.CkmSHA256,
+		Mgf:     pkcs11.CkgMGF1SHA256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mechs := []pkcs11.Mechanism{
+		{
+			Mechanism: pkcs11.CkmRSAPKCS,
+		},
+		{
+			Mechanism: pkcs11.CkmRSAPKCSOAEP,
+			Parameter: oaep,
+		},
+	}
+	for _, mech := range mechs {
+		var wrapped pkcs11.WrapKeyResp
+		session.mustCall(msgWrapKey, &pkcs11.WrapKeyReq{
+			Mechanism:      mech,
+			WrappingKey:    rsaKeys.PublicKey,
+			Key:            aesKey.Key,
+			WrappedKeySize: 256,
+		}, &wrapped)
+
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+		tmpl = tmpl.SetInt(pkcs11.CkaValueLen, 32)
+
+		var unwrapped pkcs11.UnwrapKeyResp
+		session.mustCall(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+			Mechanism:     mech,
+			UnwrappingKey: rsaKeys.PrivateKey,
+			WrappedKey:    wrapped.WrappedKey,
+			Template:      tmpl,
+		}, &unwrapped)
+
+		if !bytes.Equal(native(unwrapped.Key).([]byte),
+			native(aesKey.Key).([]byte)) {
+			t.Errorf("%s: unwrapped key does not match", mech.Mechanism)
+		}
+
+		// The RSA PKCS #1 v1.5 padding errors are not reported.
+		wrapped.WrappedKey[len(wrapped.WrappedKey)-1] ^= 0x01
+		ret := session.call(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+			Mechanism:     mech,
+			UnwrappingKey: rsaKeys.PrivateKey,
+			WrappedKey:    wrapped.WrappedKey,
+			Template:      tmpl,
+		}, &unwrapped)
+		if mech.Mechanism == pkcs11.CkmRSAPKCS {
+			if ret != pkcs11.ErrOk {
+				t.Errorf("%s: unwrap of modified key: %s",
+					mech.Mechanism, ret)
+			}
+		} else if ret != pkcs11.ErrWrappedKeyInvalid {
+			t.Errorf("%s: unwrap of modified key: %s", mech.Mechanism, ret)
+		}
+	}
+
+	// Private key wrapping with CKM_RSA_AES_KEY_WRAP.
+	var pubTmpl, privTmpl pkcs11.Template
+	pubTmpl = pubTmpl.Set(pkcs11.CkaECParams, secp256r1)
+	privTmpl = privTmpl.SetBool(pkcs11.CkaExtractable, true)
+
+	var ecKeys pkcs11.GenerateKeyPairResp
+	session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmECKeyPairGen,
+		},
+		PublicKeyTemplate:  pubTmpl,
+		PrivateKeyTemplate: privTmpl,
+	}, &ecKeys)
+
+	params, err := pkcs11.Marshal(&pkcs11.RsaAesKeyWrapParams{
+		AESKeyBits: 256,
+		OAEPParams: pkcs11.RsaPkcsOaepParams{
+			HashAlg: pkcs11.CkmSHA256,
+			Mgf:     pkcs11.CkgMGF1SHA256,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmRSAAESKeyWrap,
+		Parameter: params,
+	}
+	var wrapped pkcs11.WrapKeyResp
+	session.mustCall(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism:      mech,
+		WrappingKey:    rsaKeys.PublicKey,
+		Key:            ecKeys.PrivateKey,
+		WrappedKeySize: 1024,
+	}, &wrapped)
+
+	tmpl = nil
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPrivateKey))
+
+	var unwrapped pkcs11.UnwrapKeyResp
+	session.mustCall(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+		Mechanism:     mech,
+		UnwrappingKey: rsaKeys.PrivateKey,
+		WrappedKey:    wrapped.WrappedKey,
+		Template:      tmpl,
+	}, &unwrapped)
+
+	ecKey, ok := native(ecKeys.PrivateKey).(*ecdsa.PrivateKey)
+	if !ok {
+		t.Fatalf("EC private key: %T", native(ecKeys.PrivateKey))
+	}
+	if !ecKey.Equal(native(unwrapped.Key)) {
+		t.Errorf("unwrapped EC private key does not match")
+	}
+
+	// The wrapping and unwrapping keys must have CKA_WRAP and
+	// CKA_UNWRAP.
+	noWrap := generateRSA(false)
+	ret := session.call(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism:      mechs[0],
+		WrappingKey:    noWrap.PublicKey,
+		Key:            aesKey.Key,
+		WrappedKeySize: 256,
+	}, &wrapped)
+	if ret != pkcs11.ErrKeyFunctionNotPermitted {
+		t.Errorf("WrapKey without CKA_WRAP: %s", ret)
+	}
+	ret = session.call(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+		Mechanism:     mech,
+		UnwrappingKey: noWrap.PrivateKey,
+		WrappedKey:    wrapped.WrappedKey,
+		Template:      tmpl,
+	}, &unwrapped)
+	if ret != pkcs11.ErrKeyFunctionNotPermitted {
+		t.Errorf("UnwrapKey without CKA_UNWRAP: %s", ret)
+	}
+}
+
+func TestGCMWrapKey(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	native := func(h pkcs11.ObjectHandle) interface{} {
+		obj, err := provider.storage.Read(h)
+		if err != nil {
+			t.Fatalf("storage.Read: %v", err)
+		}
+		return obj.Native
+	}
+	generateAES := func(tmpl pkcs11.Template) pkcs11.ObjectHandle {
+		var key pkcs11.GenerateKeyResp
+		session.mustCall(msgGenerateKey, &pkcs11.GenerateKeyReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: pkcs11.CkmAESKeyGen,
+			},
+			Template: tmpl.SetInt(pkcs11.CkaValueLen, 32),
+		}, &key)
+		return key.Key
+	}
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetBool(pkcs11.CkaWrap, true)
+	tmpl = tmpl.SetBool(pkcs11.CkaUnwrap, true)
+	kek := generateAES(tmpl)
+
+	tmpl = nil
+	tmpl = tmpl.SetBool(pkcs11.CkaExtractable, true)
+	aesKey := generateAES(tmpl)
+
+	var pubTmpl, privTmpl pkcs11.Template
+	pubTmpl = pubTmpl.Set(pkcs11.CkaECParams, secp256r1)
+	privTmpl = privTmpl.SetBool(pkcs11.CkaExtractable, true)
+
+	var ecKeys pkcs11.GenerateKeyPairResp
+	session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmECKeyPairGen,
+		},
+		PublicKeyTemplate:  pubTmpl,
+		PrivateKeyTemplate: privTmpl,
+	}, &ecKeys)
+
+	gcmMech := func(iv []byte, ivBits int, aad []byte) pkcs11.Mechanism {
+		params, err := pkcs11.Marshal(&pkcs11.GcmParams{
+			Iv:      iv,
+			IvBits:  pkcs11.Ulong(ivBits),
+			AAD:     aad,
+			TagBits: 128,
+		})
+		if err != nil {
+			t.Fatalf("pkcs11.Marshal: %v", err)
+		}
+		return pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmAESGCM,
+			Parameter: params,
+		}
+	}
+	aad := []byte("key wrapping AAD")
+
+	var secretTmpl pkcs11.Template
+	secretTmpl = secretTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+
+	var privateTmpl pkcs11.Template
+	privateTmpl = privateTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPrivateKey))
+
+	tests := []struct {
+		key  pkcs11.ObjectHandle
+		tmpl pkcs11.Template
+	}{
+		{aesKey, secretTmpl},
+		{ecKeys.PrivateKey, privateTmpl},
+	}
+	for idx, test := range tests {
+		// Size query with the token generated IV.
+		var wrapped pkcs11.WrapKeyResp
+		session.mustCall(msgWrapKey, &pkcs11.WrapKeyReq{
+			Mechanism:   gcmMech(make([]byte, 12), 0, aad),
+			WrappingKey: kek,
+			Key:         test.key,
+		}, &wrapped)
+		if len(wrapped.Iv) != 0 || len(wrapped.WrappedKey) != 0 {
+			t.Errorf("test %d: size query: IV %x, wrapped %x",
+				idx, wrapped.Iv, wrapped.WrappedKey)
+		}
+		size := wrapped.WrappedKeyLen
+
+		session.mustCall(msgWrapKey, &pkcs11.WrapKeyReq{
+			Mechanism:      gcmMech(make([]byte, 12), 0, aad),
+			WrappingKey:    kek,
+			Key:            test.key,
+			WrappedKeySize: uint32(size),
+		}, &wrapped)
+		if len(wrapped.Iv) != 12 || bytes.Equal(wrapped.Iv, make([]byte, 12)) {
+			t.Errorf("test %d: generated IV %x", idx, wrapped.Iv)
+		}
+		if len(wrapped.WrappedKey) != size {
+			t.Errorf("test %d: wrapped key length %v, expected %v",
+				idx, len(wrapped.WrappedKey), size)
+		}
+
+		var unwrapped pkcs11.UnwrapKeyResp
+		session.mustCall(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+			Mechanism:     gcmMech(wrapped.Iv, 96, aad),
+			UnwrappingKey: kek,
+			WrappedKey:    wrapped.WrappedKey,
+			Template:      test.tmpl,
+		}, &unwrapped)
+
+		switch key := native(test.key).(type) {
+		case []byte:
+			if !bytes.Equal(native(unwrapped.Key).([]byte), key) {
+				t.Errorf("test %d: unwrapped key does not match", idx)
+			}
+		case *ecdsa.PrivateKey:
+			if !key.Equal(native(unwrapped.Key)) {
+				t.Errorf("test %d: unwrapped key does not match", idx)
+			}
+		default:
+			t.Fatalf("test %d: unexpected key %T", idx, key)
+		}
+
+		// The wrapped key is authenticated with the AAD.
+		ret := session.call(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+			Mechanism:     gcmMech(wrapped.Iv, 96, nil),
+			UnwrappingKey: kek,
+			WrappedKey:    wrapped.WrappedKey,
+			Template:      test.tmpl,
+		}, &unwrapped)
+		if ret != pkcs11.ErrWrappedKeyInvalid {
+			t.Errorf("test %d: unwrap with wrong AAD: %s", idx, ret)
+		}
+		wrapped.WrappedKey[0] ^= 0x01
+		ret = session.call(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+			Mechanism:     gcmMech(wrapped.Iv, 96, aad),
+			UnwrappingKey: kek,
+			WrappedKey:    wrapped.WrappedKey,
+			Template:      test.tmpl,
+		}, &unwrapped)
+		if ret != pkcs11.ErrWrappedKeyInvalid {
+			t.Errorf("test %d: unwrap of modified key: %s", idx, ret)
+		}
+	}
+
+	// The caller provided IV.
+	iv := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	var wrapped pkcs11.WrapKeyResp
+	session.mustCall(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism:      gcmMech(iv, 96, nil),
+		WrappingKey:    kek,
+		Key:            aesKey,
+		WrappedKeySize: 1024,
+	}, &wrapped)
+	if len(wrapped.Iv) != 0 {
+		t.Errorf("caller provided IV returned %x", wrapped.Iv)
+	}
+	var unwrapped pkcs11.UnwrapKeyResp
+	session.mustCall(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+		Mechanism:     gcmMech(iv, 96, nil),
+		UnwrappingKey: kek,
+		WrappedKey:    wrapped.WrappedKey,
+		Template:      secretTmpl,
+	}, &unwrapped)
+
+	// Invalid IV and tag lengths.
+	ret := session.call(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism:      gcmMech(iv[:8], 64, nil),
+		WrappingKey:    kek,
+		Key:            aesKey,
+		WrappedKeySize: 1024,
+	}, &wrapped)
+	if ret != pkcs11.ErrMechanismParamInvalid {
+		t.Errorf("WrapKey with 64-bit IV: %s", ret)
+	}
+	ret = session.call(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism:   gcmMech(iv[:8], 64, nil),
+		WrappingKey: kek,
+		Key:         aesKey,
+	}, &wrapped)
+	if ret != pkcs11.ErrMechanismParamInvalid {
+		t.Errorf("WrapKey size query with 64-bit IV: %s", ret)
+	}
+
+	// The wrapped 32 byte key and the 16 byte tag.
+	session.mustCall(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism:   gcmMech(make([]byte, 12), 0, nil),
+		WrappingKey: kek,
+		Key:         aesKey,
+	}, &wrapped)
+	if wrapped.WrappedKeyLen != 48 {
+		t.Errorf("WrapKey size query: %v, expected 48", wrapped.WrappedKeyLen)
+	}
+
+	// The wrapping key must be an AES key.
+	tmpl = nil
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkGenericSecret))
+	tmpl = tmpl.SetBool(pkcs11.CkaWrap, true)
+	tmpl = tmpl.SetBool(pkcs11.CkaUnwrap, true)
+	tmpl = tmpl.Set(pkcs11.CkaValue, make([]byte, 32))
+
+	var generic pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl,
+	}, &generic)
+
+	ret = session.call(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism:      gcmMech(iv, 96, nil),
+		WrappingKey:    generic.Object,
+		Key:            aesKey,
+		WrappedKeySize: 1024,
+	}, &wrapped)
+	if ret != pkcs11.ErrWrappingKeyTypeInconsistent {
+		t.Errorf("WrapKey with generic secret: %s", ret)
+	}
+	ret = session.call(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+		Mechanism:     gcmMech(iv, 96, nil),
+		UnwrappingKey: generic.Object,
+		WrappedKey:    make([]byte, 48),
+		Template:      secretTmpl,
+	}, &unwrapped)
+	if ret != pkcs11.ErrUnwrappingKeyTypeInconsistent {
+		t.Errorf("UnwrapKey with generic secret: %s", ret)
+	}
+}
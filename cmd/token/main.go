@@ -9,9 +9,11 @@ package main
 import (
 	"crypto"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
-	"crypto/sha512"
+	"crypto/rsa"
 	"encoding/binary"
 	"encoding/hex"
 	"flag"
@@ -21,6 +23,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/markkurossi/pkcs11-provider/pkcs11"
 )
@@ -36,19 +39,23 @@ const (
 )
 
 var (
-	debug        bool
-	m            sync.Mutex
-	bo           = binary.BigEndian
-	providers    = make(map[pkcs11.Ulong]*Provider)
-	sessions     = make(map[pkcs11.SessionHandle]*Session)
-	tokenStorage = pkcs11.NewMemoryStorage(func() (pkcs11.ObjectHandle, error) {
-		h, err := allocObjectHandle()
-		if err != nil {
-			return 0, err
-		}
-		h |= FlagToken
-		return h, nil
-	})
+	debug         bool
+	legacyCiphers bool
+	acl           *ACL
+	users         *Users
+	m             sync.Mutex
+	bo            = binary.BigEndian
+	providers     = make(map[pkcs11.Ulong]*Provider)
+	sessions      = make(map[pkcs11.SessionHandle]*Session)
+	tokenStorage  = newTokenStorage()
+
+	// Session limits. The value 0 means no limit. The maxSessions
+	// and maxRWSessions limit the sessions with each slot's token
+	// and maxTotalSessions limits the sessions with all tokens.
+	maxSessions      = 1024
+	maxRWSessions    = 0
+	maxAppSessions   = 256
+	maxTotalSessions = 4096
 )
 
 func allocObjectHandle() (pkcs11.ObjectHandle, error) {
@@ -61,6 +68,18 @@ func allocObjectHandle() (pkcs11.ObjectHandle, error) {
 	return pkcs11.ObjectHandle(bo.Uint64(buf[:])), nil
 }
 
+// newTokenStorage creates a storage for token objects.
+func newTokenStorage() pkcs11.Storage {
+	return pkcs11.NewMemoryStorage(func() (pkcs11.ObjectHandle, error) {
+		h, err := allocObjectHandle()
+		if err != nil {
+			return 0, err
+		}
+		h |= FlagToken
+		return h, nil
+	})
+}
+
 // NewProvider creates a new provider instance.
 func NewProvider(tokenStorage, storage pkcs11.Storage) (*Provider, error) {
 	var buf [4]byte
@@ -83,6 +102,10 @@ func NewProvider(tokenStorage, storage pkcs11.Storage) (*Provider, error) {
 			id:           id,
 			tokenStorage: tokenStorage,
 			storage:      storage,
+			sessions:     make(map[pkcs11.SessionHandle]*Session),
+			logins:       make(map[pkcs11.SlotID]*loginState),
+			slotEventCh:  make(chan struct{}, 1),
+			done:         make(chan struct{}),
 		}
 		providers[id] = provider
 		return provider, nil
@@ -102,29 +125,107 @@ func LookupProvider(id pkcs11.Ulong) (*Provider, error) {
 	return provider, nil
 }
 
+// RemoveProvider removes the provider by its ID.
+func RemoveProvider(id pkcs11.Ulong) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(providers, id)
+}
+
 // Session implements a session with the token.
 type Session struct {
-	ID    pkcs11.SessionHandle
-	Flags pkcs11.Flags
+	ID     pkcs11.SessionHandle
+	SlotID pkcs11.SlotID
+	Flags  pkcs11.Flags
+
+	// Owner is the application provider that opened the session.
+	Owner *Provider
 
 	// Objects contain the session objects created by this session.
-	Objects map[pkcs11.ObjectHandle]pkcs11.Storage
+	// The objectsM mutex guards Objects and Closed since the session
+	// can be closed from other goroutines than the one running the
+	// session's message loop. Closed specifies that the session has
+	// been closed and its objects deleted.
+	Objects  map[pkcs11.ObjectHandle]pkcs11.Storage
+	Closed   bool
+	objectsM sync.Mutex
 
 	Digest      hash.Hash
+	DigestMech  pkcs11.MechanismType
 	Encrypt     *EncDec
 	Decrypt     *EncDec
+	MsgEncrypt  *MessageCrypt
+	MsgDecrypt  *MessageCrypt
 	Sign        *SignVerify
 	Verify      *SignVerify
+	MsgSign     *MessageSignVerify
+	MsgVerify   *MessageSignVerify
 	FindObjects *FindObjects
+
+	// LastActivity is the time of the session's last call.
+	LastActivity time.Time
+
+	// LoginExpired specifies that the user was logged out because of
+	// the login timeout.
+	LoginExpired bool
+
+	// Removed specifies that the session's token has been ejected.
+	// The field is guarded by the global mutex.
+	Removed bool
+
+	// SignAuth and DecryptAuth specify that the active sign and
+	// decrypt operations use a CKA_ALWAYS_AUTHENTICATE key and they
+	// are waiting for the context-specific login. MsgSignAuth and
+	// MsgDecryptAuth are the same for the next message of the
+	// message-based operations.
+	SignAuth       bool
+	DecryptAuth    bool
+	MsgSignAuth    bool
+	MsgDecryptAuth bool
+
+	// UnwrapAuthKey is the CKA_ALWAYS_AUTHENTICATE unwrapping key of
+	// the rejected C_UnwrapKey. UnwrapAuth specifies that the unwrap
+	// is waiting for the context-specific login. After the login,
+	// the next C_UnwrapKey with the key is allowed.
+	UnwrapAuthKey pkcs11.ObjectHandle
+	UnwrapAuth    bool
+}
+
+// MessageCrypt implements the message-based encrypt and decrypt
+// operations.
+type MessageCrypt struct {
+	Mechanism pkcs11.MechanismType
+	Encrypt   bool
+	Key       []byte
+	Block     cipher.Block
+	AEAD      cipher.AEAD
+
+	// Storage and Handle identify the key object that holds the IV
+	// counter of the generated IVs.
+	Storage pkcs11.Storage
+	Handle  pkcs11.ObjectHandle
+
+	// AlwaysAuth specifies that each message requires the
+	// context-specific login.
+	AlwaysAuth bool
+
+	// Message holds the state of the active multi-part message.
+	Message *aeadMessage
 }
 
 // EncDec implements symmetric encrypt and decrypt operations.
 type EncDec struct {
+	// Init and Key hold the operation's init mechanism and key.
+	Init pkcs11.Mechanism
+	Key  []byte
+
 	Mechanism pkcs11.MechanismType
 	Block     cipher.Block
 	BlockMode cipher.BlockMode
 	AEAD      cipher.AEAD
 	Stream    cipher.Stream
+	Stealing  StealingMode
 	IV        []byte
 	AAD       []byte
 
@@ -137,49 +238,189 @@ type EncDec struct {
 type SignVerify struct {
 	Hash      crypto.Hash
 	Digest    hash.Hash
+	MAC       func(key []byte) hash.Hash
+	Mechanism pkcs11.Mechanism
+	Key       interface{}
+	EdDSA     *ed25519.Options
+	PSS       *rsa.PSSOptions
+}
+
+// MessageSignVerify implements the message-based sign and verify
+// operations.
+type MessageSignVerify struct {
 	Mechanism pkcs11.Mechanism
 	Key       interface{}
+	Sign      bool
+
+	// AlwaysAuth specifies that each message requires the
+	// context-specific login.
+	AlwaysAuth bool
+
+	// Message holds the state of the active multi-part message.
+	Message *SignVerify
 }
 
 // NewSignVerify creates a sign/verify object from the mechanism.
 func NewSignVerify(mechanism pkcs11.Mechanism) (*SignVerify, error) {
-	var hashAlg crypto.Hash
-	var digest hash.Hash
+	var digestMech pkcs11.MechanismType
 
 	switch mechanism.Mechanism {
 	case pkcs11.CkmRSAPKCS:
-		hashAlg = 0
-		digest = new(HashNone)
+		return &SignVerify{
+			Digest:    new(HashNone),
+			Mechanism: mechanism,
+		}, nil
+
+	case pkcs11.CkmEDDSA:
+		return newEdDSA(mechanism)
+
+	case pkcs11.CkmDSASHA1, pkcs11.CkmSHA1RSAPKCS,
+		pkcs11.CkmSHA1RSAPKCSPSS, pkcs11.CkmECDSASHA1:
+		digestMech = pkcs11.CkmSHA1
 
 	case pkcs11.CkmDSASHA224, pkcs11.CkmSHA224RSAPKCS,
 		pkcs11.CkmSHA224RSAPKCSPSS, pkcs11.CkmECDSASHA224:
-		hashAlg = crypto.SHA224
-		digest = sha256.New224()
+		digestMech = pkcs11.CkmSHA224
 
 	case pkcs11.CkmDSASHA256, pkcs11.CkmSHA256RSAPKCS,
 		pkcs11.CkmSHA256RSAPKCSPSS, pkcs11.CkmECDSASHA256:
-		hashAlg = crypto.SHA256
-		digest = sha256.New()
+		digestMech = pkcs11.CkmSHA256
 
 	case pkcs11.CkmDSASHA384, pkcs11.CkmSHA384RSAPKCS,
 		pkcs11.CkmSHA384RSAPKCSPSS, pkcs11.CkmECDSASHA384:
-		hashAlg = crypto.SHA384
-		digest = sha512.New384()
+		digestMech = pkcs11.CkmSHA384
 
 	case pkcs11.CkmDSASHA512, pkcs11.CkmSHA512RSAPKCS,
 		pkcs11.CkmSHA512RSAPKCSPSS, pkcs11.CkmECDSASHA512:
-		hashAlg = crypto.SHA512
-		digest = sha512.New()
+		digestMech = pkcs11.CkmSHA512
+
+	case pkcs11.CkmDSASHA3224, pkcs11.CkmSHA3224RSAPKCS,
+		pkcs11.CkmSHA3224RSAPKCSPSS, pkcs11.CkmECDSASHA3224:
+		digestMech = pkcs11.CkmSHA3224
+
+	case pkcs11.CkmDSASHA3256, pkcs11.CkmSHA3256RSAPKCS,
+		pkcs11.CkmSHA3256RSAPKCSPSS, pkcs11.CkmECDSASHA3256:
+		digestMech = pkcs11.CkmSHA3256
+
+	case pkcs11.CkmDSASHA3384, pkcs11.CkmSHA3384RSAPKCS,
+		pkcs11.CkmSHA3384RSAPKCSPSS, pkcs11.CkmECDSASHA3384:
+		digestMech = pkcs11.CkmSHA3384
+
+	case pkcs11.CkmDSASHA3512, pkcs11.CkmSHA3512RSAPKCS,
+		pkcs11.CkmSHA3512RSAPKCSPSS, pkcs11.CkmECDSASHA3512:
+		digestMech = pkcs11.CkmSHA3512
+
+	case pkcs11.CkmTLSMAC:
+		var params pkcs11.TlsMacParams
+		err := pkcs11.Unmarshal(mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		mac, err := newTLSMAC(&params)
+		if err != nil {
+			return nil, err
+		}
+		return &SignVerify{
+			MAC:       mac,
+			Mechanism: mechanism,
+		}, nil
 
 	default:
-		return nil, pkcs11.ErrMechanismInvalid
+		// The HMAC digest is created when the key is set.
+		m, ok := hmacs[mechanism.Mechanism]
+		if !ok {
+			return nil, pkcs11.ErrMechanismInvalid
+		}
+		h := digests[m].New
+		return &SignVerify{
+			Hash: digests[m].Hash,
+			MAC: func(key []byte) hash.Hash {
+				return hmac.New(h, key)
+			},
+			Mechanism: mechanism,
+		}, nil
 	}
 
-	return &SignVerify{
-		Hash:      hashAlg,
-		Digest:    digest,
+	sv := &SignVerify{
+		Hash:      digests[digestMech].Hash,
+		Digest:    digests[digestMech].New(),
 		Mechanism: mechanism,
-	}, nil
+	}
+	if isPSS(mechanism.Mechanism) {
+		opts, err := newPSSOptions(mechanism, digestMech)
+		if err != nil {
+			return nil, err
+		}
+		sv.PSS = opts
+	}
+	return sv, nil
+}
+
+// SetKey sets the sign/verify key. The sign operations require a
+// private key and the verify operations a public key of the
+// mechanism's key type. The HMAC and TLS MAC mechanisms require a
+// secret key for both operations.
+func (sv *SignVerify) SetKey(key interface{}, sign bool) error {
+	if sv.MAC != nil {
+		secret, ok := key.([]byte)
+		if !ok {
+			return pkcs11.ErrKeyTypeInconsistent
+		}
+		sv.Key = key
+		sv.Digest = sv.MAC(secret)
+		return nil
+	}
+	var ok bool
+	switch signKeyType(sv.Mechanism.Mechanism) {
+	case pkcs11.CkkRSA:
+		if sign {
+			_, ok = key.(*rsa.PrivateKey)
+		} else {
+			_, ok = key.(*rsa.PublicKey)
+		}
+
+	case pkcs11.CkkEC:
+		if sign {
+			_, ok = key.(*ecdsa.PrivateKey)
+		} else {
+			_, ok = key.(*ecdsa.PublicKey)
+		}
+
+	case pkcs11.CkkECEdwards:
+		if sign {
+			_, ok = key.(ed25519.PrivateKey)
+		} else {
+			_, ok = key.(ed25519.PublicKey)
+		}
+	}
+	if !ok {
+		return pkcs11.ErrKeyTypeInconsistent
+	}
+	sv.Key = key
+	return nil
+}
+
+// signKeyType returns the key type of the signature mechanism.
+func signKeyType(mech pkcs11.MechanismType) pkcs11.KeyType {
+	switch mech {
+	case pkcs11.CkmEDDSA:
+		return pkcs11.CkkECEdwards
+
+	case pkcs11.CkmDSASHA1, pkcs11.CkmDSASHA224, pkcs11.CkmDSASHA256,
+		pkcs11.CkmDSASHA384, pkcs11.CkmDSASHA512, pkcs11.CkmDSASHA3224,
+		pkcs11.CkmDSASHA3256, pkcs11.CkmDSASHA3384, pkcs11.CkmDSASHA3512:
+		return pkcs11.CkkDSA
+
+	case pkcs11.CkmECDSASHA1, pkcs11.CkmECDSASHA224, pkcs11.CkmECDSASHA256,
+		pkcs11.CkmECDSASHA384, pkcs11.CkmECDSASHA512,
+		pkcs11.CkmECDSASHA3224, pkcs11.CkmECDSASHA3256,
+		pkcs11.CkmECDSASHA3384, pkcs11.CkmECDSASHA3512:
+		return pkcs11.CkkEC
+
+	default:
+		return pkcs11.CkkRSA
+	}
 }
 
 // FindObjects implements find objects operation.
@@ -187,13 +428,34 @@ type FindObjects struct {
 	Handles []pkcs11.ObjectHandle
 }
 
-// NewSession creates a new session instance.
-func NewSession() (*Session, error) {
+// NewSession creates a new session instance for the owner
+// application. The function returns pkcs11.ErrSessionCount if the
+// slot token's session limits or the total session limit are reached
+// and pkcs11.ErrTokenNotPresent if the slot's token has been ejected.
+func NewSession(owner *Provider, slot *Slot, flags pkcs11.Flags) (
+	*Session, error) {
+
 	var buf [4]byte
 
 	m.Lock()
 	defer m.Unlock()
 
+	if !slot.Present {
+		return nil, pkcs11.ErrTokenNotPresent
+	}
+
+	if maxTotalSessions > 0 && len(sessions) >= maxTotalSessions {
+		return nil, pkcs11.ErrSessionCount
+	}
+	count, rwCount := countSessions(slot.ID)
+	if maxSessions > 0 && count >= maxSessions {
+		return nil, pkcs11.ErrSessionCount
+	}
+	if flags&pkcs11.CkfRWSession != 0 && maxRWSessions > 0 &&
+		rwCount >= maxRWSessions {
+		return nil, pkcs11.ErrSessionCount
+	}
+
 	for {
 		_, err := rand.Read(buf[:])
 		if err != nil {
@@ -206,14 +468,43 @@ func NewSession() (*Session, error) {
 			continue
 		}
 		session := &Session{
-			ID:      id,
-			Objects: make(map[pkcs11.ObjectHandle]pkcs11.Storage),
+			ID:           id,
+			SlotID:       slot.ID,
+			Flags:        flags,
+			Owner:        owner,
+			Objects:      make(map[pkcs11.ObjectHandle]pkcs11.Storage),
+			LastActivity: time.Now(),
 		}
 		sessions[id] = session
 		return session, nil
 	}
 }
 
+// countSessions returns the number of all sessions and the number of
+// read/write sessions with the slot's token. The global mutex must be
+// locked.
+func countSessions(slot pkcs11.SlotID) (count, rwCount int) {
+	for _, session := range sessions {
+		if session.SlotID != slot {
+			continue
+		}
+		count++
+		if session.Flags&pkcs11.CkfRWSession != 0 {
+			rwCount++
+		}
+	}
+	return
+}
+
+// SessionCounts returns the number of all sessions and the number of
+// read/write sessions with the slot's token.
+func SessionCounts(slot pkcs11.SlotID) (count, rwCount int) {
+	m.Lock()
+	defer m.Unlock()
+
+	return countSessions(slot)
+}
+
 // LookupSession finds a session by its id.
 func LookupSession(id pkcs11.SessionHandle) (*Session, error) {
 	m.Lock()
@@ -243,11 +534,55 @@ func CloseSession(id pkcs11.SessionHandle) error {
 
 func main() {
 	flag.BoolVar(&debug, "D", false, "enable debug output")
+	flag.BoolVar(&legacyCiphers, "legacy", false,
+		"enable legacy ciphers (DES3)")
+	aclFile := flag.String("acl", "", "access control rules file")
+	usersFile := flag.String("users", "", "user database file")
+	flag.IntVar(&maxSessions, "max-sessions", maxSessions,
+		"maximum number of sessions per token (0 for no limit)")
+	flag.IntVar(&maxRWSessions, "max-rw-sessions", maxRWSessions,
+		"maximum number of read/write sessions per token (0 for no limit)")
+	flag.IntVar(&maxAppSessions, "max-app-sessions", maxAppSessions,
+		"maximum number of sessions per application (0 for no limit)")
+	flag.IntVar(&maxTotalSessions, "max-total-sessions", maxTotalSessions,
+		"maximum number of sessions with all tokens (0 for no limit)")
+	flag.DurationVar(&sessionTimeout, "session-timeout", 0,
+		"close sessions idle longer than the timeout (0 to disable)")
+	flag.DurationVar(&loginTimeout, "login-timeout", 0,
+		"log out users idle longer than the timeout (0 to disable)")
+	virtualSlots := flag.Int("virtual-slots", 0,
+		"number of virtual slots with removable tokens")
+	adminPath := flag.String("admin", "/tmp/vp-admin.sock",
+		"admin socket for the virtual slots")
 	flag.Parse()
 	log.SetFlags(0)
 
+	if len(*aclFile) > 0 {
+		var err error
+		acl, err = LoadACL(*aclFile)
+		if err != nil {
+			log.Fatalf("failed to load ACL: %s", err)
+		}
+	}
+	if len(*usersFile) > 0 {
+		var err error
+		users, err = LoadUsers(*usersFile)
+		if err != nil {
+			log.Fatalf("failed to load users: %s", err)
+		}
+	}
+
 	log.Printf("Token starting\n")
 
+	initSlots(*virtualSlots)
+	if *virtualSlots > 0 {
+		err := startAdmin(*adminPath)
+		if err != nil {
+			log.Fatalf("failed to start admin interface: %s", err)
+		}
+	}
+	startExpiration()
+
 	os.RemoveAll(path)
 	listener, err := net.Listen("unix", path)
 	if err != nil {
@@ -274,6 +609,18 @@ func main() {
 func messageLoop(conn net.Conn) error {
 	var hdr [8]byte
 
+	peer, err := peerCredentials(conn)
+	if err != nil {
+		return err
+	}
+	var rule *ACLRule
+	if acl != nil {
+		rule = acl.Lookup(peer)
+		if rule == nil {
+			log.Printf("ACL: connection from %s not authorized", peer)
+		}
+	}
+
 	storage := pkcs11.NewMemoryStorage(func() (pkcs11.ObjectHandle, error) {
 		h, err := allocObjectHandle()
 		if err != nil {
@@ -283,10 +630,15 @@ func messageLoop(conn net.Conn) error {
 		return h, nil
 	})
 
-	provider, err := NewProvider(tokenStorage, storage)
+	provider, err := NewProvider(newACLStorage(tokenStorage, rule),
+		newACLStorage(storage, rule))
 	if err != nil {
 		return err
 	}
+	defer provider.Disconnect()
+
+	provider.peer = peer
+	provider.rule = rule
 
 	for {
 		_, err := conn.Read(hdr[:])
@@ -321,7 +673,24 @@ func messageLoop(conn net.Conn) error {
 			}
 		}
 
-		ret, data := pkcs11.Dispatch(provider, msgType, msg)
+		provider.validateSession()
+
+		var ret pkcs11.CKRV
+		var data []byte
+
+		err = provider.authorize()
+		if err == nil {
+			err = provider.checkRemoved(msgType)
+		}
+		if err == nil {
+			err = provider.checkLoginExpired(msgType)
+		}
+		provider.touch(time.Now())
+		if err != nil {
+			ret = err.(pkcs11.CKRV)
+		} else {
+			ret, data = pkcs11.Dispatch(provider, msgType, msg)
+		}
 		if len(data) > 32 {
 			if debug {
 				log.Printf("\u2514>%s: length=%d:\n%s",
@@ -0,0 +1,1489 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+var (
+	msgImplOpenSession      pkcs11.Type = 0xc0000101
+	msgImplWaitForSlotEvent pkcs11.Type = 0xc0000103
+	msgInitialize           pkcs11.Type = 0xc0050401
+	msgGetInfo              pkcs11.Type = 0xc0050403
+	msgGetSlotList          pkcs11.Type = 0xc0050501
+	msgGetSlotInfo          pkcs11.Type = 0xc0050502
+	msgGetTokenInfo         pkcs11.Type = 0xc0050503
+	msgOpenSession          pkcs11.Type = 0xc0050601
+	msgCloseSession         pkcs11.Type = 0xc0050602
+	msgCloseAllSessions     pkcs11.Type = 0xc0050603
+	msgGetSessionInfo       pkcs11.Type = 0xc0050604
+	msgSessionCancel        pkcs11.Type = 0xc0050605
+	msgGetOperationState    pkcs11.Type = 0xc0050606
+	msgSetOperationState    pkcs11.Type = 0xc0050607
+	msgLogin                pkcs11.Type = 0xc0050608
+	msgLoginUser            pkcs11.Type = 0xc0050609
+	msgLogout               pkcs11.Type = 0xc005060a
+	msgCreateObject         pkcs11.Type = 0xc0050701
+	msgCopyObject           pkcs11.Type = 0xc0050702
+	msgDestroyObject        pkcs11.Type = 0xc0050703
+	msgGetAttributeValue    pkcs11.Type = 0xc0050705
+	msgFindObjectsInit      pkcs11.Type = 0xc0050707
+	msgFindObjects          pkcs11.Type = 0xc0050708
+	msgFindObjectsFin       pkcs11.Type = 0xc0050709
+	msgEncryptInit          pkcs11.Type = 0xc0050801
+	msgEncryptUpdate        pkcs11.Type = 0xc0050803
+	msgEncryptFinal         pkcs11.Type = 0xc0050804
+	msgMessageEncryptInit   pkcs11.Type = 0xc0050901
+	msgDecryptInit          pkcs11.Type = 0xc0050a01
+	msgDecrypt              pkcs11.Type = 0xc0050a02
+	msgDecryptUpdate        pkcs11.Type = 0xc0050a03
+	msgDecryptFinal         pkcs11.Type = 0xc0050a04
+	msgMessageDecryptInit   pkcs11.Type = 0xc0050b01
+	msgDigestInit           pkcs11.Type = 0xc0050c01
+	msgDigestUpdate         pkcs11.Type = 0xc0050c03
+	msgDigestKey            pkcs11.Type = 0xc0050c04
+	msgDigestFinal          pkcs11.Type = 0xc0050c05
+	msgSignInit             pkcs11.Type = 0xc0050d01
+	msgSign                 pkcs11.Type = 0xc0050d02
+	msgSignUpdate           pkcs11.Type = 0xc0050d03
+	msgSignFinal            pkcs11.Type = 0xc0050d04
+	msgMessageSignInit      pkcs11.Type = 0xc0050e01
+	msgSignMessage          pkcs11.Type = 0xc0050e02
+	msgSignMessageBegin     pkcs11.Type = 0xc0050e03
+	msgSignMessageNext      pkcs11.Type = 0xc0050e04
+	msgMessageSignFinal     pkcs11.Type = 0xc0050e05
+	msgVerifyInit           pkcs11.Type = 0xc0050f01
+	msgVerify               pkcs11.Type = 0xc0050f02
+	msgVerifyFinal          pkcs11.Type = 0xc0050f04
+	msgMessageVerifyInit    pkcs11.Type = 0xc0051001
+	msgVerifyMessage        pkcs11.Type = 0xc0051002
+	msgVerifyMessageBegin   pkcs11.Type = 0xc0051003
+	msgVerifyMessageNext    pkcs11.Type = 0xc0051004
+	msgMessageVerifyFinal   pkcs11.Type = 0xc0051005
+	msgDigestEncryptUpdate  pkcs11.Type = 0xc0051101
+	msgDecryptDigestUpdate  pkcs11.Type = 0xc0051102
+	msgSignEncryptUpdate    pkcs11.Type = 0xc0051103
+	msgDecryptVerifyUpdate  pkcs11.Type = 0xc0051104
+	msgGenerateKey          pkcs11.Type = 0xc0051201
+	msgGenerateKeyPair      pkcs11.Type = 0xc0051202
+	msgWrapKey              pkcs11.Type = 0xc0051203
+	msgUnwrapKey            pkcs11.Type = 0xc0051204
+	msgDeriveKey            pkcs11.Type = 0xc0051205
+)
+
+// testClient implements an IPC client connected to the token's
+// message loop.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	done chan error
+}
+
+func newTestClient(t *testing.T) *testClient {
+	client, server := unixPipe(t)
+	c := &testClient{
+		t:    t,
+		conn: client,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := messageLoop(server)
+		server.Close()
+		c.done <- err
+	}()
+	return c
+}
+
+// unixPipe creates a connected pair of Unix domain sockets so that
+// the token sees the test process' peer credentials.
+func unixPipe(t *testing.T) (net.Conn, net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	var conns [2]net.Conn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("net.FileConn: %v", err)
+		}
+	}
+	return conns[0], conns[1]
+}
+
+func (c *testClient) call(msgType pkcs11.Type, req, resp interface{}) pkcs11.CKRV {
+	var data []byte
+	var err error
+
+	if req != nil {
+		data, err = pkcs11.Marshal(req)
+		if err != nil {
+			c.t.Fatalf("%s: pkcs11.Marshal: %v", msgType.Name(), err)
+		}
+	}
+	var hdr [8]byte
+	bo.PutUint32(hdr[0:4], uint32(msgType))
+	bo.PutUint32(hdr[4:8], uint32(len(data)))
+
+	_, err = c.conn.Write(hdr[:])
+	if err != nil {
+		c.t.Fatalf("%s: write: %v", msgType.Name(), err)
+	}
+	if len(data) > 0 {
+		_, err = c.conn.Write(data)
+		if err != nil {
+			c.t.Fatalf("%s: write: %v", msgType.Name(), err)
+		}
+	}
+
+	_, err = io.ReadFull(c.conn, hdr[:])
+	if err != nil {
+		c.t.Fatalf("%s: read: %v", msgType.Name(), err)
+	}
+	ret := pkcs11.CKRV(bo.Uint32(hdr[0:4]))
+	data = make([]byte, bo.Uint32(hdr[4:8]))
+	_, err = io.ReadFull(c.conn, data)
+	if err != nil {
+		c.t.Fatalf("%s: read: %v", msgType.Name(), err)
+	}
+	if ret == pkcs11.ErrOk && resp != nil {
+		err = pkcs11.Unmarshal(data, resp)
+		if err != nil {
+			c.t.Fatalf("%s: pkcs11.Unmarshal: %v", msgType.Name(), err)
+		}
+	}
+	return ret
+}
+
+func (c *testClient) mustCall(msgType pkcs11.Type, req, resp interface{}) {
+	ret := c.call(msgType, req, resp)
+	if ret != pkcs11.ErrOk {
+		c.t.Fatalf("%s: %s", msgType.Name(), ret)
+	}
+}
+
+// kill closes the client connection without closing its sessions and
+// waits until the token has processed the disconnect.
+func (c *testClient) kill() {
+	c.conn.Close()
+	select {
+	case err := <-c.done:
+		if err != nil {
+			c.t.Fatalf("messageLoop: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("messageLoop did not terminate")
+	}
+}
+
+// testApplication opens an application connection and the number of
+// sessions. The first session creates a session object, logs in,
+// and starts a multi-part digest operation.
+func testApplication(t *testing.T, numSessions int) (
+	app *testClient, provider *Provider, sessions []*testClient,
+	handles []pkcs11.SessionHandle, object pkcs11.ObjectHandle) {
+
+	app = newTestClient(t)
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+
+	for i := 0; i < numSessions; i++ {
+		session, handle := openSession(t, app, init.ProviderID,
+			pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+		sessions = append(sessions, session)
+		handles = append(handles, handle)
+	}
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, 16)
+
+	var key pkcs11.GenerateKeyResp
+	sessions[0].mustCall(msgGenerateKey, &pkcs11.GenerateKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmAESKeyGen,
+		},
+		Template: tmpl,
+	}, &key)
+
+	sessions[0].mustCall(msgLogin, &pkcs11.LoginReq{
+		UserType: pkcs11.CkuUser,
+	}, nil)
+
+	sessions[0].mustCall(msgDigestInit, &pkcs11.DigestInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSHA256,
+		},
+	}, nil)
+	sessions[0].mustCall(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+		Part: []byte("Hello, world!"),
+	}, nil)
+
+	return app, provider, sessions, handles, key.Key
+}
+
+// openSession opens a session for the application and connects a
+// session client to it.
+func openSession(t *testing.T, app *testClient, providerID pkcs11.Ulong,
+	flags pkcs11.Flags) (*testClient, pkcs11.SessionHandle) {
+
+	var open pkcs11.OpenSessionResp
+	app.mustCall(msgOpenSession, &pkcs11.OpenSessionReq{
+		Flags: flags,
+	}, &open)
+
+	session := newTestClient(t)
+	session.mustCall(msgImplOpenSession, &pkcs11.ImplOpenSessionReq{
+		ProviderID: providerID,
+		Session:    open.Session,
+	}, nil)
+
+	return session, open.Session
+}
+
+func checkClosed(t *testing.T, provider *Provider,
+	handles []pkcs11.SessionHandle, object pkcs11.ObjectHandle) {
+
+	for _, handle := range handles {
+		_, err := LookupSession(handle)
+		if err != pkcs11.ErrSessionHandleInvalid {
+			t.Errorf("session %08x not closed", handle)
+		}
+	}
+	_, err := provider.storage.Read(object)
+	if err == nil {
+		t.Errorf("session object %08x not deleted", object)
+	}
+	provider.Lock()
+	defer provider.Unlock()
+
+	if len(provider.logins) != 0 {
+		t.Errorf("application still logged in")
+	}
+	if len(provider.sessions) != 0 {
+		t.Errorf("application has %v sessions", len(provider.sessions))
+	}
+}
+
+func TestDisconnectSession(t *testing.T) {
+	app, provider, sessions, handles, object := testApplication(t, 1)
+
+	// Kill the session in the middle of the digest operation.
+	sessions[0].kill()
+
+	checkClosed(t, provider, handles, object)
+
+	var info pkcs11.GetInfoResp
+	app.mustCall(msgGetInfo, nil, &info)
+
+	app.kill()
+
+	_, err := LookupProvider(provider.id)
+	if err == nil {
+		t.Errorf("provider %08x not removed", provider.id)
+	}
+}
+
+func TestDisconnectApplication(t *testing.T) {
+	app, provider, sessions, handles, object := testApplication(t, 2)
+
+	// Kill the application while its sessions are active.
+	app.kill()
+
+	checkClosed(t, provider, handles, object)
+
+	_, err := LookupProvider(provider.id)
+	if err == nil {
+		t.Errorf("provider %08x not removed", provider.id)
+	}
+
+	for _, session := range sessions {
+		ret := session.call(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+			Part: []byte("Hello, world!"),
+		}, nil)
+		if ret != pkcs11.ErrSessionHandleInvalid {
+			t.Errorf("DigestUpdate on closed session: %s", ret)
+		}
+		session.kill()
+	}
+}
+
+func TestCloseAllSessions(t *testing.T) {
+	app, provider, sessions, handles, object := testApplication(t, 2)
+	defer app.kill()
+
+	ret := app.call(msgCloseAllSessions, &pkcs11.CloseAllSessionsReq{
+		SlotID: 0xffff,
+	}, nil)
+	if ret != pkcs11.ErrSlotIDInvalid {
+		t.Errorf("CloseAllSessions with invalid slot: %s", ret)
+	}
+
+	app.mustCall(msgCloseAllSessions, &pkcs11.CloseAllSessionsReq{}, nil)
+
+	checkClosed(t, provider, handles, object)
+
+	for _, session := range sessions {
+		ret := session.call(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+			Part: []byte("Hello, world!"),
+		}, nil)
+		if ret != pkcs11.ErrSessionHandleInvalid {
+			t.Errorf("DigestUpdate on closed session: %s", ret)
+		}
+		session.kill()
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	app, _, sessions, _, _ := testApplication(t, 1)
+	defer app.kill()
+	session := sessions[0]
+	defer session.kill()
+
+	aesKey := createSecretKey(session, pkcs11.CkkAES,
+		bytes.Repeat([]byte{0x42}, 16))
+	macKey := createSecretKey(session, pkcs11.CkkGenericSecret,
+		bytes.Repeat([]byte{0x17}, 32))
+
+	iv := bytes.Repeat([]byte{0x01}, 16)
+	hmacMech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmSHA256HMAC,
+	}
+
+	// The operations and the functions that initialize them. The
+	// digest operation is active from testApplication.
+	operations := []struct {
+		flag pkcs11.Flags
+		init func() pkcs11.CKRV
+	}{
+		{
+			flag: pkcs11.CkfEncrypt,
+			init: func() pkcs11.CKRV {
+				return session.call(msgEncryptInit, &pkcs11.EncryptInitReq{
+					Mechanism: pkcs11.Mechanism{
+						Mechanism: pkcs11.CkmAESCBC,
+						Parameter: iv,
+					},
+					Key: aesKey,
+				}, &pkcs11.EncryptInitResp{})
+			},
+		},
+		{
+			flag: pkcs11.CkfDecrypt,
+			init: func() pkcs11.CKRV {
+				return session.call(msgDecryptInit, &pkcs11.DecryptInitReq{
+					Mechanism: pkcs11.Mechanism{
+						Mechanism: pkcs11.CkmAESCBC,
+						Parameter: iv,
+					},
+					Key: aesKey,
+				}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfDigest,
+			init: func() pkcs11.CKRV {
+				return session.call(msgDigestInit, &pkcs11.DigestInitReq{
+					Mechanism: pkcs11.Mechanism{
+						Mechanism: pkcs11.CkmSHA256,
+					},
+				}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfSign,
+			init: func() pkcs11.CKRV {
+				return session.call(msgSignInit, &pkcs11.SignInitReq{
+					Mechanism: hmacMech,
+					Key:       macKey,
+				}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfVerify,
+			init: func() pkcs11.CKRV {
+				return session.call(msgVerifyInit, &pkcs11.VerifyInitReq{
+					Mechanism: hmacMech,
+					Key:       macKey,
+				}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfMessageEncrypt,
+			init: func() pkcs11.CKRV {
+				return session.call(msgMessageEncryptInit,
+					&pkcs11.MessageEncryptInitReq{
+						Mechanism: pkcs11.Mechanism{
+							Mechanism: pkcs11.CkmAESGCM,
+						},
+						Key: aesKey,
+					}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfMessageDecrypt,
+			init: func() pkcs11.CKRV {
+				return session.call(msgMessageDecryptInit,
+					&pkcs11.MessageDecryptInitReq{
+						Mechanism: pkcs11.Mechanism{
+							Mechanism: pkcs11.CkmAESGCM,
+						},
+						Key: aesKey,
+					}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfMessageSign,
+			init: func() pkcs11.CKRV {
+				return session.call(msgMessageSignInit,
+					&pkcs11.MessageSignInitReq{
+						Mechanism: hmacMech,
+						Key:       macKey,
+					}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfMessageVerify,
+			init: func() pkcs11.CKRV {
+				return session.call(msgMessageVerifyInit,
+					&pkcs11.MessageVerifyInitReq{
+						Mechanism: hmacMech,
+						Key:       macKey,
+					}, nil)
+			},
+		},
+		{
+			flag: pkcs11.CkfFindObjects,
+			init: func() pkcs11.CKRV {
+				return session.call(msgFindObjectsInit,
+					&pkcs11.FindObjectsInitReq{}, nil)
+			},
+		},
+	}
+	for _, op := range operations {
+		if op.flag == pkcs11.CkfDigest {
+			continue
+		}
+		ret := op.init()
+		if ret != pkcs11.ErrOk {
+			t.Fatalf("%04x init: %s", op.flag, ret)
+		}
+	}
+
+	// Cancel one operation at a time. The init functions report
+	// which operations are still active.
+	for i, cancel := range operations {
+		session.mustCall(msgSessionCancel, &pkcs11.SessionCancelReq{
+			Flags: cancel.flag,
+		}, nil)
+		for j, op := range operations {
+			expected := pkcs11.ErrOperationActive
+			if j == i {
+				expected = pkcs11.ErrOk
+			}
+			ret := op.init()
+			if ret != expected {
+				t.Errorf("%04x init after cancelling %04x: %s, expected %s",
+					op.flag, cancel.flag, ret, expected)
+			}
+		}
+	}
+
+	// Cancel all operations.
+	var all pkcs11.Flags
+	for _, op := range operations {
+		all |= op.flag
+	}
+	session.mustCall(msgSessionCancel, &pkcs11.SessionCancelReq{
+		Flags: all,
+	}, nil)
+	ret := session.call(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+		Part: []byte("Hello, world!"),
+	}, nil)
+	if ret != pkcs11.ErrOperationNotInitialized {
+		t.Errorf("DigestUpdate after SessionCancel: %s", ret)
+	}
+	for _, op := range operations {
+		ret := op.init()
+		if ret != pkcs11.ErrOk {
+			t.Errorf("%04x init after cancelling all: %s", op.flag, ret)
+		}
+	}
+}
+
+func TestCloseSessionObjects(t *testing.T) {
+	app, provider, sessions, _, object := testApplication(t, 1)
+	session := sessions[0]
+	defer session.kill()
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, 16)
+
+	// Create session objects while the application closes the
+	// session.
+	created := make(chan []pkcs11.ObjectHandle)
+	go func() {
+		objects := []pkcs11.ObjectHandle{object}
+		for {
+			var key pkcs11.GenerateKeyResp
+			ret := session.call(msgGenerateKey, &pkcs11.GenerateKeyReq{
+				Mechanism: pkcs11.Mechanism{
+					Mechanism: pkcs11.CkmAESKeyGen,
+				},
+				Template: tmpl,
+			}, &key)
+			if ret != pkcs11.ErrOk {
+				break
+			}
+			objects = append(objects, key.Key)
+		}
+		created <- objects
+	}()
+	time.Sleep(10 * time.Millisecond)
+	app.kill()
+
+	for _, object := range <-created {
+		_, err := provider.storage.Read(object)
+		if err == nil {
+			t.Errorf("session object %08x not deleted", object)
+		}
+	}
+}
+
+func checkState(t *testing.T, session *testClient, expected pkcs11.State) {
+	var info pkcs11.GetSessionInfoResp
+	session.mustCall(msgGetSessionInfo, nil, &info)
+	if info.Info.State != expected {
+		t.Errorf("session state %v, expected %v", info.Info.State, expected)
+	}
+	if info.Info.SlotID != 0 {
+		t.Errorf("session slot %v, expected 0", info.Info.SlotID)
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	ret := app.call(msgOpenSession, &pkcs11.OpenSessionReq{}, nil)
+	if ret != pkcs11.ErrSessionParallelNotSupported {
+		t.Errorf("OpenSession without CKF_SERIAL_SESSION: %s", ret)
+	}
+
+	ro, _ := openSession(t, app, init.ProviderID, pkcs11.CkfSerialSession)
+	defer ro.kill()
+	rw, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer rw.kill()
+
+	checkState(t, ro, pkcs11.CksROPublicSession)
+	checkState(t, rw, pkcs11.CksRWPublicSession)
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoData))
+	tmpl = tmpl.SetBool(pkcs11.CkaToken, true)
+
+	ret = ro.call(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl,
+	}, nil)
+	if ret != pkcs11.ErrSessionReadOnly {
+		t.Errorf("CreateObject token object in RO session: %s", ret)
+	}
+
+	ret = rw.call(msgLogin, &pkcs11.LoginReq{
+		UserType: pkcs11.CkuSO,
+	}, nil)
+	if ret != pkcs11.ErrSessionReadOnlyExists {
+		t.Errorf("SO Login with RO session: %s", ret)
+	}
+
+	rw.mustCall(msgLogin, &pkcs11.LoginReq{
+		UserType: pkcs11.CkuUser,
+	}, nil)
+
+	checkState(t, ro, pkcs11.CksROUserFunctions)
+	checkState(t, rw, pkcs11.CksRWUserFunctions)
+
+	ro.mustCall(msgLogout, nil, nil)
+
+	checkState(t, ro, pkcs11.CksROPublicSession)
+	checkState(t, rw, pkcs11.CksRWPublicSession)
+}
+
+func TestImplOpenSessionOwner(t *testing.T) {
+	app1 := newTestClient(t)
+	defer app1.kill()
+	app2 := newTestClient(t)
+	defer app2.kill()
+
+	var init1, init2 pkcs11.InitializeResp
+	app1.mustCall(msgInitialize, nil, &init1)
+	app2.mustCall(msgInitialize, nil, &init2)
+
+	var open pkcs11.OpenSessionResp
+	app1.mustCall(msgOpenSession, &pkcs11.OpenSessionReq{
+		Flags: pkcs11.CkfSerialSession,
+	}, &open)
+
+	session := newTestClient(t)
+	defer session.kill()
+
+	// Attach to the session with another application's provider.
+	ret := session.call(msgImplOpenSession, &pkcs11.ImplOpenSessionReq{
+		ProviderID: init2.ProviderID,
+		Session:    open.Session,
+	}, nil)
+	if ret != pkcs11.ErrSessionHandleInvalid {
+		t.Errorf("ImplOpenSession with another provider: %s", ret)
+	}
+
+	// Attach to the session from another process.
+	provider, err := LookupProvider(init1.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	provider.peer = &PeerCred{
+		UID: 1000,
+		GID: 1000,
+		PID: 4242,
+	}
+	ret = session.call(msgImplOpenSession, &pkcs11.ImplOpenSessionReq{
+		ProviderID: init1.ProviderID,
+		Session:    open.Session,
+	}, nil)
+	if ret != pkcs11.ErrSessionHandleInvalid {
+		t.Errorf("ImplOpenSession from another peer: %s", ret)
+	}
+
+	// Attach to the session from a peer with unknown credentials.
+	// The net.Pipe connections do not have peer credentials.
+	provider.peer = nil
+	client, server := net.Pipe()
+	unknown := &testClient{
+		t:    t,
+		conn: client,
+		done: make(chan error, 1),
+	}
+	go func() {
+		unknown.done <- messageLoop(server)
+		server.Close()
+	}()
+	defer unknown.kill()
+
+	ret = unknown.call(msgImplOpenSession, &pkcs11.ImplOpenSessionReq{
+		ProviderID: init1.ProviderID,
+		Session:    open.Session,
+	}, nil)
+	if ret != pkcs11.ErrSessionHandleInvalid {
+		t.Errorf("ImplOpenSession from unknown peer: %s", ret)
+	}
+}
+
+func utf8(val string) []pkcs11.UTF8Char {
+	return []pkcs11.UTF8Char(val)
+}
+
+func findObjects(session *testClient, tmpl pkcs11.Template) []pkcs11.ObjectHandle {
+	session.mustCall(msgFindObjectsInit, &pkcs11.FindObjectsInitReq{
+		Template: tmpl,
+	}, nil)
+	var resp pkcs11.FindObjectsResp
+	session.mustCall(msgFindObjects, &pkcs11.FindObjectsReq{
+		MaxObjectCount: 100,
+	}, &resp)
+	session.mustCall(msgFindObjectsFin, nil, nil)
+
+	return resp.Object
+}
+
+// createSecretKey creates a secret key object that can be used with
+// the encrypt, decrypt, sign, and verify operations.
+func createSecretKey(session *testClient, keyType pkcs11.KeyType,
+	value []byte) pkcs11.ObjectHandle {
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(keyType))
+	tmpl = tmpl.SetBool(pkcs11.CkaEncrypt, true)
+	tmpl = tmpl.SetBool(pkcs11.CkaDecrypt, true)
+	tmpl = tmpl.SetBool(pkcs11.CkaSign, true)
+	tmpl = tmpl.SetBool(pkcs11.CkaVerify, true)
+	tmpl = tmpl.Set(pkcs11.CkaValue, value)
+
+	var obj pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl,
+	}, &obj)
+	return obj.Object
+}
+
+func TestLoginUser(t *testing.T) {
+	var err error
+
+	file := filepath.Join(t.TempDir(), "users.json")
+	err = os.WriteFile(file, []byte(`{
+  "so_pin": "0000",
+  "users": [
+    {"name": "alice", "pin": "1111"},
+    {"name": "bob", "pin": "2222"}
+  ]
+}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err = LoadUsers(file)
+	if err != nil {
+		t.Fatalf("LoadUsers: %v", err)
+	}
+	defer func() {
+		users = nil
+	}()
+
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	ret := session.call(msgLoginUser, &pkcs11.LoginUserReq{
+		UserType: pkcs11.CkuUser,
+		Pin:      utf8("2222"),
+		Username: utf8("alice"),
+	}, nil)
+	if ret != pkcs11.ErrPinIncorrect {
+		t.Errorf("LoginUser with wrong PIN: %s", ret)
+	}
+	ret = session.call(msgLogin, &pkcs11.LoginReq{
+		UserType: pkcs11.CkuUser,
+		Pin:      utf8("1111"),
+	}, nil)
+	if ret != pkcs11.ErrPinIncorrect {
+		t.Errorf("Login without anonymous user: %s", ret)
+	}
+
+	session.mustCall(msgLoginUser, &pkcs11.LoginUserReq{
+		UserType: pkcs11.CkuUser,
+		Pin:      utf8("1111"),
+		Username: utf8("alice"),
+	}, nil)
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoData))
+	tmpl = tmpl.SetBool(pkcs11.CkaToken, true)
+	tmpl = tmpl.Set(pkcs11.CkaLabel, []byte("TestLoginUser"))
+
+	var private, shared pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl.SetBool(pkcs11.CkaPrivate, true),
+	}, &private)
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl.SetBool(pkcs11.CkaPrivate, true).
+			Set(CkaSharedWith, []byte("carol,bob")),
+	}, &shared)
+
+	handles := findObjects(session, tmpl)
+	if len(handles) != 2 {
+		t.Errorf("alice: found %v objects, expected 2", len(handles))
+	}
+
+	session.mustCall(msgLogout, nil, nil)
+
+	if len(findObjects(session, tmpl)) != 0 {
+		t.Errorf("private objects visible without login")
+	}
+
+	session.mustCall(msgLoginUser, &pkcs11.LoginUserReq{
+		UserType: pkcs11.CkuUser,
+		Pin:      utf8("2222"),
+		Username: utf8("bob"),
+	}, nil)
+
+	handles = findObjects(session, tmpl)
+	if len(handles) != 1 || handles[0] != shared.Object {
+		t.Errorf("bob: found %v, expected [%v]", handles, shared.Object)
+	}
+	ret = session.call(msgDestroyObject, &pkcs11.DestroyObjectReq{
+		Object: private.Object,
+	}, nil)
+	if ret != pkcs11.ErrObjectHandleInvalid {
+		t.Errorf("bob: DestroyObject of alice's object: %s", ret)
+	}
+
+	// Only the owner can share the object.
+	ret = session.call(msgCopyObject, &pkcs11.CopyObjectReq{
+		Object: shared.Object,
+		Template: pkcs11.Template(nil).Set(CkaSharedWith,
+			[]byte("bob,carol")),
+	}, nil)
+	if ret != pkcs11.ErrAttributeReadOnly {
+		t.Errorf("bob: CopyObject with CkaSharedWith: %s", ret)
+	}
+	var copied pkcs11.CopyObjectResp
+	session.mustCall(msgCopyObject, &pkcs11.CopyObjectReq{
+		Object: shared.Object,
+	}, &copied)
+
+	var attrs pkcs11.GetAttributeValueResp
+	session.mustCall(msgGetAttributeValue, &pkcs11.GetAttributeValueReq{
+		Object:   copied.NewObject,
+		Template: pkcs11.Template(nil).Set(CkaSharedWith, nil),
+	}, &attrs)
+	if len(attrs.Template) != 1 || len(attrs.Template[0].Value) != 0 {
+		t.Errorf("bob's copy is shared: %v", attrs.Template)
+	}
+
+	session.mustCall(msgLogout, nil, nil)
+	session.mustCall(msgLoginUser, &pkcs11.LoginUserReq{
+		UserType: pkcs11.CkuSO,
+		Pin:      utf8("0000"),
+		Username: utf8("ignored"),
+	}, nil)
+
+	for _, h := range []pkcs11.ObjectHandle{
+		private.Object, shared.Object, copied.NewObject,
+	} {
+		session.mustCall(msgDestroyObject, &pkcs11.DestroyObjectReq{
+			Object: h,
+		}, nil)
+	}
+	session.mustCall(msgLogout, nil, nil)
+
+	// The PIN is locked after too many failed logins.
+	tokenFlags := func() pkcs11.Flags {
+		var info pkcs11.GetTokenInfoResp
+		app.mustCall(msgGetTokenInfo, &pkcs11.GetTokenInfoReq{}, &info)
+		return info.Info.Flags & (pkcs11.CkfUserPINCountLow |
+			pkcs11.CkfUserPINFinalTry | pkcs11.CkfUserPINLocked)
+	}
+	if flags := tokenFlags(); flags != 0 {
+		t.Errorf("PIN flags after successful logins: %x", flags)
+	}
+	for i := 0; i < pinMaxFailures; i++ {
+		ret = session.call(msgLoginUser, &pkcs11.LoginUserReq{
+			UserType: pkcs11.CkuUser,
+			Pin:      utf8("0000"),
+			Username: utf8("bob"),
+		}, nil)
+		if ret != pkcs11.ErrPinIncorrect {
+			t.Errorf("LoginUser with wrong PIN: %s", ret)
+		}
+		var expected pkcs11.Flags
+		switch i {
+		case pinMaxFailures - 2:
+			expected = pkcs11.CkfUserPINCountLow | pkcs11.CkfUserPINFinalTry
+		case pinMaxFailures - 1:
+			expected = pkcs11.CkfUserPINLocked
+		default:
+			expected = pkcs11.CkfUserPINCountLow
+		}
+		if flags := tokenFlags(); flags != expected {
+			t.Errorf("PIN flags after %v failures: %x, expected %x",
+				i+1, flags, expected)
+		}
+	}
+	ret = session.call(msgLoginUser, &pkcs11.LoginUserReq{
+		UserType: pkcs11.CkuUser,
+		Pin:      utf8("2222"),
+		Username: utf8("bob"),
+	}, nil)
+	if ret != pkcs11.ErrPinLocked {
+		t.Errorf("LoginUser with locked PIN: %s", ret)
+	}
+}
+
+func TestContextSpecificLogin(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	session.mustCall(msgLogin, &pkcs11.LoginReq{
+		UserType: pkcs11.CkuUser,
+	}, nil)
+
+	contextLogin := func() pkcs11.CKRV {
+		return session.call(msgLogin, &pkcs11.LoginReq{
+			UserType: pkcs11.CkuContextSpecific,
+		}, nil)
+	}
+
+	ret := contextLogin()
+	if ret != pkcs11.ErrOperationNotInitialized {
+		t.Errorf("context-specific login without operation: %s", ret)
+	}
+
+	// Secret keys without CKA_ALWAYS_AUTHENTICATE don't need the
+	// context-specific login.
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, 16)
+	tmpl = tmpl.SetBool(pkcs11.CkaExtractable, true)
+
+	var aesKey pkcs11.GenerateKeyResp
+	session.mustCall(msgGenerateKey, &pkcs11.GenerateKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmAESKeyGen,
+		},
+		Template: tmpl,
+	}, &aesKey)
+
+	session.mustCall(msgDecryptInit, &pkcs11.DecryptInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmAESECB,
+		},
+		Key: aesKey.Key,
+	}, nil)
+	session.mustCall(msgDecrypt, &pkcs11.DecryptReq{
+		EncryptedData: make([]byte, 16),
+		DataSize:      16,
+	}, nil)
+
+	tmpl = nil
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkGenericSecret))
+	tmpl = tmpl.Set(pkcs11.CkaValue, make([]byte, 32))
+
+	var hmacKey pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: tmpl,
+	}, &hmacKey)
+
+	session.mustCall(msgSignInit, &pkcs11.SignInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSHA256HMAC,
+		},
+		Key: hmacKey.Object,
+	}, nil)
+	session.mustCall(msgSign, &pkcs11.SignReq{
+		Data:          []pkcs11.Byte("data"),
+		SignatureSize: 32,
+	}, nil)
+
+	// Private key with CKA_ALWAYS_AUTHENTICATE.
+	var pubTmpl, privTmpl pkcs11.Template
+	pubTmpl = pubTmpl.Set(pkcs11.CkaECParams, secp256r1)
+	privTmpl = privTmpl.SetBool(pkcs11.CkaAlwaysAuthenticate, true)
+
+	var ecKeys pkcs11.GenerateKeyPairResp
+	session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmECKeyPairGen,
+		},
+		PublicKeyTemplate:  pubTmpl,
+		PrivateKeyTemplate: privTmpl,
+	}, &ecKeys)
+
+	sign := func() pkcs11.CKRV {
+		return session.call(msgSign, &pkcs11.SignReq{
+			Data:          []pkcs11.Byte("data"),
+			SignatureSize: 128,
+		}, nil)
+	}
+	for i := 0; i < 2; i++ {
+		session.mustCall(msgSignInit, &pkcs11.SignInitReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: pkcs11.CkmECDSASHA3256,
+			},
+			Key: ecKeys.PrivateKey,
+		}, nil)
+
+		ret = sign()
+		if ret != pkcs11.ErrUserNotLoggedIn {
+			t.Errorf("Sign without context-specific login: %s", ret)
+		}
+		ret = contextLogin()
+		if ret != pkcs11.ErrOk {
+			t.Fatalf("context-specific login: %s", ret)
+		}
+		ret = sign()
+		if ret != pkcs11.ErrOk {
+			t.Errorf("Sign after context-specific login: %s", ret)
+		}
+	}
+
+	session.mustCall(msgMessageSignInit, &pkcs11.MessageSignInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmECDSASHA3256,
+		},
+		Key: ecKeys.PrivateKey,
+	}, nil)
+
+	signMessage := func() pkcs11.CKRV {
+		return session.call(msgSignMessage, &pkcs11.SignMessageReq{
+			Data:          []pkcs11.Byte("message"),
+			SignatureSize: 128,
+		}, nil)
+	}
+	for i := 0; i < 2; i++ {
+		ret = signMessage()
+		if ret != pkcs11.ErrUserNotLoggedIn {
+			t.Errorf("SignMessage without context-specific login: %s", ret)
+		}
+		ret = contextLogin()
+		if ret != pkcs11.ErrOk {
+			t.Fatalf("context-specific login: %s", ret)
+		}
+		ret = signMessage()
+		if ret != pkcs11.ErrOk {
+			t.Errorf("SignMessage after context-specific login: %s", ret)
+		}
+	}
+	session.mustCall(msgMessageSignFinal, nil, nil)
+
+	// Unwrapping key with CKA_ALWAYS_AUTHENTICATE.
+	pubTmpl = nil
+	pubTmpl = pubTmpl.SetInt(pkcs11.CkaModulusBits, 1024)
+	pubTmpl = pubTmpl.Set(pkcs11.CkaPublicExponent, []byte{1, 0, 1})
+	pubTmpl = pubTmpl.SetBool(pkcs11.CkaWrap, true)
+	privTmpl = nil
+	privTmpl = privTmpl.SetBool(pkcs11.CkaAlwaysAuthenticate, true)
+	privTmpl = privTmpl.SetBool(pkcs11.CkaUnwrap, true)
+
+	var rsaKeys pkcs11.GenerateKeyPairResp
+	session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmRSAPKCSKeyPairGen,
+		},
+		PublicKeyTemplate:  pubTmpl,
+		PrivateKeyTemplate: privTmpl,
+	}, &rsaKeys)
+
+	var wrapped pkcs11.WrapKeyResp
+	session.mustCall(msgWrapKey, &pkcs11.WrapKeyReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmRSAPKCS,
+		},
+		WrappingKey:    rsaKeys.PublicKey,
+		Key:            aesKey.Key,
+		WrappedKeySize: 128,
+	}, &wrapped)
+
+	unwrap := func() pkcs11.CKRV {
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+		tmpl = tmpl.SetInt(pkcs11.CkaValueLen, 16)
+		return session.call(msgUnwrapKey, &pkcs11.UnwrapKeyReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: pkcs11.CkmRSAPKCS,
+			},
+			UnwrappingKey: rsaKeys.PrivateKey,
+			WrappedKey:    wrapped.WrappedKey,
+			Template:      tmpl,
+		}, &pkcs11.UnwrapKeyResp{})
+	}
+	for i := 0; i < 2; i++ {
+		ret = unwrap()
+		if ret != pkcs11.ErrUserNotLoggedIn {
+			t.Errorf("UnwrapKey without context-specific login: %s", ret)
+		}
+		ret = contextLogin()
+		if ret != pkcs11.ErrOk {
+			t.Fatalf("context-specific login: %s", ret)
+		}
+		ret = unwrap()
+		if ret != pkcs11.ErrOk {
+			t.Errorf("UnwrapKey after context-specific login: %s", ret)
+		}
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	defer func(max, maxRW, maxApp int) {
+		maxSessions = max
+		maxRWSessions = maxRW
+		maxAppSessions = maxApp
+	}(maxSessions, maxRWSessions, maxAppSessions)
+
+	count, rwCount := SessionCounts(0)
+	maxSessions = count + 3
+	maxRWSessions = rwCount + 1
+	maxAppSessions = 2
+
+	app1 := newTestClient(t)
+	defer app1.kill()
+	app2 := newTestClient(t)
+	defer app2.kill()
+
+	var init pkcs11.InitializeResp
+	app1.mustCall(msgInitialize, nil, &init)
+	app2.mustCall(msgInitialize, nil, &init)
+
+	open := func(app *testClient, flags pkcs11.Flags) pkcs11.CKRV {
+		return app.call(msgOpenSession, &pkcs11.OpenSessionReq{
+			Flags: pkcs11.CkfSerialSession | flags,
+		}, &pkcs11.OpenSessionResp{})
+	}
+
+	app1.mustCall(msgOpenSession, &pkcs11.OpenSessionReq{
+		Flags: pkcs11.CkfSerialSession | pkcs11.CkfRWSession,
+	}, &pkcs11.OpenSessionResp{})
+
+	if ret := open(app2, pkcs11.CkfRWSession); ret != pkcs11.ErrSessionCount {
+		t.Errorf("RW session over the limit: %s", ret)
+	}
+	if ret := open(app1, 0); ret != pkcs11.ErrOk {
+		t.Errorf("OpenSession: %s", ret)
+	}
+	if ret := open(app1, 0); ret != pkcs11.ErrSessionCount {
+		t.Errorf("application session over the limit: %s", ret)
+	}
+	if ret := open(app2, 0); ret != pkcs11.ErrOk {
+		t.Errorf("OpenSession: %s", ret)
+	}
+	if ret := open(app2, 0); ret != pkcs11.ErrSessionCount {
+		t.Errorf("session over the global limit: %s", ret)
+	}
+
+	var info pkcs11.GetTokenInfoResp
+	app1.mustCall(msgGetTokenInfo, &pkcs11.GetTokenInfoReq{}, &info)
+
+	if info.Info.SessionCount != pkcs11.Ulong(count+3) ||
+		info.Info.RwSessionCount != pkcs11.Ulong(rwCount+1) {
+		t.Errorf("session counts %v/%v, expected %v/%v",
+			info.Info.SessionCount, info.Info.RwSessionCount,
+			count+3, rwCount+1)
+	}
+	if info.Info.MaxSessionCount != pkcs11.Ulong(maxSessions) ||
+		info.Info.MaxRwSessionCount != pkcs11.Ulong(maxRWSessions) {
+		t.Errorf("session limits %v/%v, expected %v/%v",
+			info.Info.MaxSessionCount, info.Info.MaxRwSessionCount,
+			maxSessions, maxRWSessions)
+	}
+
+	// The total session limit applies to the sessions with all
+	// tokens.
+	defer func(maxTotal int) {
+		maxTotalSessions = maxTotal
+	}(maxTotalSessions)
+	maxSessions = 0
+	maxRWSessions = 0
+	maxAppSessions = 0
+	m.Lock()
+	maxTotalSessions = len(sessions) + 1
+	m.Unlock()
+
+	if ret := open(app1, 0); ret != pkcs11.ErrOk {
+		t.Errorf("OpenSession: %s", ret)
+	}
+	if ret := open(app2, 0); ret != pkcs11.ErrSessionCount {
+		t.Errorf("session over the total limit: %s", ret)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	defer func() {
+		sessionTimeout = 0
+		loginTimeout = 0
+	}()
+
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session, handle := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	session.mustCall(msgLogin, &pkcs11.LoginReq{
+		UserType: pkcs11.CkuUser,
+	}, nil)
+	session.mustCall(msgDigestInit, &pkcs11.DigestInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSHA256,
+		},
+	}, nil)
+
+	// Login timeout logs out the user and cancels the operations.
+	loginTimeout = time.Minute
+	expireSessions(time.Now().Add(30 * time.Second))
+	checkState(t, session, pkcs11.CksRWUserFunctions)
+
+	expireSessions(time.Now().Add(2 * time.Minute))
+
+	ret := session.call(msgGetSessionInfo, nil, &pkcs11.GetSessionInfoResp{})
+	if ret != pkcs11.ErrUserNotLoggedIn {
+		t.Errorf("call after login timeout: %s", ret)
+	}
+	checkState(t, session, pkcs11.CksRWPublicSession)
+
+	ret = session.call(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+		Part: []byte("Hello, world!"),
+	}, nil)
+	if ret != pkcs11.ErrOperationNotInitialized {
+		t.Errorf("DigestUpdate after login timeout: %s", ret)
+	}
+
+	// Session timeout closes the session.
+	loginTimeout = 0
+	sessionTimeout = time.Minute
+	expireSessions(time.Now().Add(2 * time.Minute))
+
+	_, err := LookupSession(handle)
+	if err != pkcs11.ErrSessionHandleInvalid {
+		t.Errorf("idle session not closed")
+	}
+	ret = session.call(msgGetSessionInfo, nil, &pkcs11.GetSessionInfoResp{})
+	if ret != pkcs11.ErrSessionHandleInvalid {
+		t.Errorf("call after session timeout: %s", ret)
+	}
+}
+
+func TestSlotEvents(t *testing.T) {
+	saved := slots
+	defer func() {
+		slots = saved
+	}()
+	initSlots(1)
+
+	app := newTestClient(t)
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	var list pkcs11.GetSlotListResp
+	app.mustCall(msgGetSlotList, &pkcs11.GetSlotListReq{
+		TokenPresent: true,
+		SlotListSize: 8,
+	}, &list)
+	if len(list.SlotList) != 2 {
+		t.Errorf("GetSlotList: got %v, expected [0 1]", list.SlotList)
+	}
+
+	wait := &pkcs11.ImplWaitForSlotEventReq{
+		ProviderID: init.ProviderID,
+		Flags:      pkcs11.CkfDontBlock,
+	}
+	ret := app.call(msgImplWaitForSlotEvent, wait, nil)
+	if ret != pkcs11.ErrNoEvent {
+		t.Errorf("WaitForSlotEvent without events: %s", ret)
+	}
+
+	var open pkcs11.OpenSessionResp
+	openReq := &pkcs11.OpenSessionReq{
+		SlotID: 1,
+		Flags:  pkcs11.CkfSerialSession,
+	}
+	app.mustCall(msgOpenSession, openReq, &open)
+
+	session := newTestClient(t)
+	defer session.kill()
+	session.mustCall(msgImplOpenSession, &pkcs11.ImplOpenSessionReq{
+		ProviderID: init.ProviderID,
+		Session:    open.Session,
+	}, nil)
+
+	var info pkcs11.GetSessionInfoResp
+	session.mustCall(msgGetSessionInfo, nil, &info)
+	if info.Info.SlotID != 1 {
+		t.Errorf("session slot: got %v, expected 1", info.Info.SlotID)
+	}
+
+	// The session counts are reported per token.
+	count, _ := SessionCounts(0)
+	for slot, expected := range []int{count, 1} {
+		var tokenInfo pkcs11.GetTokenInfoResp
+		app.mustCall(msgGetTokenInfo, &pkcs11.GetTokenInfoReq{
+			SlotID: pkcs11.SlotID(slot),
+		}, &tokenInfo)
+		if tokenInfo.Info.SessionCount != pkcs11.Ulong(expected) {
+			t.Errorf("slot %v: session count %v, expected %v",
+				slot, tokenInfo.Info.SessionCount, expected)
+		}
+	}
+
+	// The login state is kept per token.
+	session0, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession)
+	defer session0.kill()
+
+	session.mustCall(msgLogin, &pkcs11.LoginReq{
+		UserType: pkcs11.CkuUser,
+	}, nil)
+	session0.mustCall(msgGetSessionInfo, nil, &info)
+	if info.Info.State != pkcs11.CksROPublicSession {
+		t.Errorf("slot 0 session state after slot 1 login: %v",
+			info.Info.State)
+	}
+	var object pkcs11.CreateObjectResp
+	session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+		Template: pkcs11.Template(nil).SetInt(pkcs11.CkaClass,
+			int(pkcs11.CkoData)),
+	}, &object)
+
+	if adminCommand("eject 0") == "ok" {
+		t.Errorf("builtin token ejected")
+	}
+	result := adminCommand("eject 1")
+	if result != "ok" {
+		t.Fatalf("eject 1: %s", result)
+	}
+
+	// The ejection logs out the user and deletes the session
+	// objects.
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	provider.Lock()
+	if provider.logins[1] != nil {
+		t.Errorf("logged in after eject")
+	}
+	provider.Unlock()
+	_, err = provider.storage.Read(object.Object)
+	if err == nil {
+		t.Errorf("session object not deleted after eject")
+	}
+
+	ret = session.call(msgGetSessionInfo, nil, &info)
+	if ret != pkcs11.ErrDeviceRemoved {
+		t.Errorf("call after eject: %s", ret)
+	}
+	ret = app.call(msgOpenSession, openReq, &open)
+	if ret != pkcs11.ErrTokenNotPresent {
+		t.Errorf("OpenSession after eject: %s", ret)
+	}
+	app.mustCall(msgGetSlotList, &pkcs11.GetSlotListReq{
+		TokenPresent: true,
+		SlotListSize: 8,
+	}, &list)
+	if len(list.SlotList) != 1 || list.SlotList[0] != 0 {
+		t.Errorf("GetSlotList after eject: got %v, expected [0]",
+			list.SlotList)
+	}
+	var slotInfo pkcs11.GetSlotInfoResp
+	app.mustCall(msgGetSlotInfo, &pkcs11.GetSlotInfoReq{
+		SlotID: 1,
+	}, &slotInfo)
+	if slotInfo.Info.Flags != pkcs11.CkfRemovableDevice {
+		t.Errorf("slot flags after eject: %v", slotInfo.Info.Flags)
+	}
+
+	var event pkcs11.ImplWaitForSlotEventResp
+	app.mustCall(msgImplWaitForSlotEvent, wait, &event)
+	if event.Slot != 1 {
+		t.Errorf("WaitForSlotEvent: got slot %v, expected 1", event.Slot)
+	}
+	ret = app.call(msgImplWaitForSlotEvent, wait, nil)
+	if ret != pkcs11.ErrNoEvent {
+		t.Errorf("WaitForSlotEvent after event: %s", ret)
+	}
+
+	// The removed session can be closed.
+	session.mustCall(msgCloseSession, nil, nil)
+
+	// Blocking wait returns when the token is inserted.
+	events := newTestClient(t)
+	defer events.kill()
+
+	waitBlocking := func() chan pkcs11.CKRV {
+		c := make(chan pkcs11.CKRV, 1)
+		go func() {
+			var resp pkcs11.ImplWaitForSlotEventResp
+			ret := events.call(msgImplWaitForSlotEvent,
+				&pkcs11.ImplWaitForSlotEventReq{
+					ProviderID: init.ProviderID,
+				}, &resp)
+			if ret == pkcs11.ErrOk && resp.Slot != 1 {
+				ret = pkcs11.ErrSlotIDInvalid
+			}
+			c <- ret
+		}()
+		return c
+	}
+	done := waitBlocking()
+
+	result = adminCommand("insert 1")
+	if result != "ok" {
+		t.Fatalf("insert 1: %s", result)
+	}
+	select {
+	case ret = <-done:
+		if ret != pkcs11.ErrOk {
+			t.Errorf("blocking WaitForSlotEvent: %s", ret)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocking WaitForSlotEvent not woken up")
+	}
+	app.mustCall(msgOpenSession, openReq, &open)
+
+	// Blocking wait is cancelled when the application disconnects.
+	done = waitBlocking()
+	app.kill()
+
+	select {
+	case ret = <-done:
+		if ret != pkcs11.ErrCryptokiNotInitialized {
+			t.Errorf("WaitForSlotEvent after disconnect: %s", ret)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocking WaitForSlotEvent not cancelled")
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	err := startAdmin(path)
+	if err != nil {
+		t.Fatalf("startAdmin: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("admin socket mode %v, expected 0600", fi.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("list\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf[:n], []byte("slot 0: present")) {
+		t.Errorf("list: %q", buf[:n])
+	}
+}
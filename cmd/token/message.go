@@ -0,0 +1,300 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"sync"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Message-based encryption parameters.
+const (
+	messageNonceLen = 12
+	messageTagLen   = 16
+)
+
+// MaxMessageLen limits the length of a multi-part message. The
+// message is kept in memory for computing the authentication tag at
+// the end of the message.
+const MaxMessageLen = 16 * 1024 * 1024
+
+// CkaIVCounter is the vendor-defined attribute holding the next IV
+// counter value of the message encryption key. The counter is stored
+// with the key object so that it is kept as long as the key.
+const CkaIVCounter = pkcs11.CkaVendorDefined | 0x00000002
+
+// ivCounterM serializes the IV counter updates of the key objects.
+var ivCounterM sync.Mutex
+
+// nextIVCounter returns the next IV counter value for the key object
+// h in the storage. The counter is stored in the key object's
+// CkaIVCounter attribute.
+func nextIVCounter(storage pkcs11.Storage, h pkcs11.ObjectHandle) (
+	uint64, error) {
+
+	ivCounterM.Lock()
+	defer ivCounterM.Unlock()
+
+	obj, err := storage.Read(h)
+	if err != nil {
+		return 0, pkcs11.ErrKeyHandleInvalid
+	}
+	var counter uint64
+
+	stored, err := obj.Attrs.OptBytes(CkaIVCounter)
+	if err == nil && len(stored) == 8 {
+		counter = bo.Uint64(stored)
+	}
+	var buf [8]byte
+	bo.PutUint64(buf[:], counter+1)
+
+	updated := *obj
+	updated.Attrs = obj.Attrs.Set(CkaIVCounter, buf[:])
+	err = storage.Update(h, &updated)
+	if err != nil {
+		return 0, err
+	}
+	return counter, nil
+}
+
+// aeadMessage holds the state of an active multi-part message. The
+// message parts are processed with the cipher's keystream as they
+// arrive and the complete message is kept for computing or verifying
+// the authentication tag at the end of the message.
+type aeadMessage struct {
+	Nonce  []byte
+	AAD    []byte
+	Stream cipher.Stream
+	Data   []byte
+}
+
+// newMessageCrypt creates the AEAD cipher for the message-based
+// encryption and decryption operations.
+func newMessageCrypt(mech *pkcs11.Mechanism, storage pkcs11.Storage,
+	h pkcs11.ObjectHandle, obj *pkcs11.Object, key []byte, encrypt bool) (
+	*MessageCrypt, error) {
+
+	if len(mech.Parameter) != 0 {
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	keyType := pkcs11.KeyType(obj.Attrs.OptInt(pkcs11.CkaKeyType, -1))
+
+	mc := &MessageCrypt{
+		Mechanism: mech.Mechanism,
+		Encrypt:   encrypt,
+		Key:       key,
+		Storage:   storage,
+		Handle:    h,
+	}
+	var err error
+
+	switch mech.Mechanism {
+	case pkcs11.CkmAESGCM:
+		if keyType != pkcs11.CkkAES {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		mc.Block, err = aes.NewCipher(key)
+		if err != nil {
+			return nil, pkcs11.ErrKeySizeRange
+		}
+		mc.AEAD, err = cipher.NewGCM(mc.Block)
+		if err != nil {
+			return nil, pkcs11.ErrDeviceError
+		}
+
+	case pkcs11.CkmChaCha20Poly1305:
+		if keyType != pkcs11.CkkChaCha20 {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		mc.AEAD, err = chacha20poly1305.New(key)
+		if err != nil {
+			return nil, pkcs11.ErrKeySizeRange
+		}
+
+	default:
+		Errorf("MessageCrypt: %s", mech.Mechanism)
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+	return mc, nil
+}
+
+// Params decodes the per-message parameters and returns the message
+// nonce and the authentication tag. If generate is true, the
+// function generates the token generated IVs. The generated value is
+// returned also in iv.
+func (mc *MessageCrypt) Params(data []byte, generate bool) (
+	nonce, iv, tag []byte, err error) {
+
+	switch mc.Mechanism {
+	case pkcs11.CkmAESGCM:
+		var params pkcs11.GcmMessageParams
+		err = pkcs11.Unmarshal(data, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if len(params.Iv) != messageNonceLen {
+			Errorf("%s: invalid IV length %v, expected %v",
+				mc.Mechanism, len(params.Iv), messageNonceLen)
+			return nil, nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if params.TagBits != messageTagLen*8 {
+			Errorf("invalid tag length %v, expected %v",
+				params.TagBits, messageTagLen*8)
+			return nil, nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if !mc.Encrypt || params.IvGenerator == pkcs11.CkgNoGenerate {
+			return params.Iv, nil, params.Tag, nil
+		}
+		// The generated part is at least 32 bits long. The random
+		// IVs must not have a fixed part since a shorter random
+		// part would make the IV collisions too likely.
+		fixedBits := params.IvFixedBits
+		if fixedBits%8 != 0 || fixedBits > 64 ||
+			(params.IvGenerator == pkcs11.CkgGenerateRandom && fixedBits != 0) {
+			Errorf("%s: invalid IV fixed bits %v", mc.Mechanism, fixedBits)
+			return nil, nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		iv = make([]byte, messageNonceLen)
+		fixed := int(fixedBits / 8)
+		copy(iv, params.Iv[:fixed])
+
+		switch params.IvGenerator {
+		case pkcs11.CkgGenerate, pkcs11.CkgGenerateCounter:
+			if generate {
+				counter, err := nextIVCounter(mc.Storage, mc.Handle)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				if counter>>(messageNonceLen*8-fixedBits) != 0 {
+					Errorf("%s: IV counter exhausted", mc.Mechanism)
+					return nil, nil, nil, pkcs11.ErrActionProhibited
+				}
+				for i := messageNonceLen - 1; i >= fixed; i-- {
+					iv[i] = byte(counter)
+					counter >>= 8
+				}
+			}
+
+		case pkcs11.CkgGenerateRandom:
+			if generate {
+				_, err = rand.Read(iv[fixed:])
+				if err != nil {
+					return nil, nil, nil, pkcs11.ErrDeviceError
+				}
+			}
+
+		default:
+			Errorf("%s: invalid IV generator %v", mc.Mechanism,
+				params.IvGenerator)
+			return nil, nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		return iv, iv, nil, nil
+
+	case pkcs11.CkmChaCha20Poly1305:
+		var params pkcs11.Salsa20Chacha20Poly1305MsgParams
+		err = pkcs11.Unmarshal(data, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if len(params.Nonce) != messageNonceLen {
+			Errorf("%s: invalid nonce length %v, expected %v",
+				mc.Mechanism, len(params.Nonce), messageNonceLen)
+			return nil, nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		return params.Nonce, nil, params.Tag, nil
+
+	default:
+		return nil, nil, nil, pkcs11.ErrMechanismInvalid
+	}
+}
+
+// Begin starts a multi-part message with the nonce and associated
+// data.
+func (mc *MessageCrypt) Begin(nonce, aad []byte) error {
+	msg := &aeadMessage{
+		Nonce: nonce,
+		AAD:   aad,
+	}
+	switch mc.Mechanism {
+	case pkcs11.CkmAESGCM:
+		// The GCM keystream starts from the counter block 2; the
+		// counter block 1 encrypts the tag.
+		var iv [aes.BlockSize]byte
+		copy(iv[:], nonce)
+		iv[aes.BlockSize-1] = 2
+		msg.Stream = cipher.NewCTR(mc.Block, iv[:])
+
+	case pkcs11.CkmChaCha20Poly1305:
+		// The ChaCha20 keystream starts from the block 1; the block
+		// 0 generates the Poly1305 key.
+		c, err := chacha20.NewUnauthenticatedCipher(mc.Key, nonce)
+		if err != nil {
+			return pkcs11.ErrMechanismParamInvalid
+		}
+		c.SetCounter(1)
+		msg.Stream = c
+
+	default:
+		return pkcs11.ErrMechanismInvalid
+	}
+	mc.Message = msg
+	return nil
+}
+
+// Next processes the next part of the active multi-part message. The
+// encrypt operations process plaintext and the decrypt operations
+// ciphertext. The message is terminated if its length exceeds
+// MaxMessageLen.
+func (mc *MessageCrypt) Next(part []byte) ([]byte, error) {
+	if len(mc.Message.Data)+len(part) > MaxMessageLen {
+		mc.Message = nil
+		if mc.Encrypt {
+			return nil, pkcs11.ErrDataLenRange
+		}
+		return nil, pkcs11.ErrEncryptedDataLenRange
+	}
+	mc.Message.Data = append(mc.Message.Data, part...)
+
+	result := make([]byte, len(part))
+	mc.Message.Stream.XORKeyStream(result, part)
+	return result, nil
+}
+
+// Seal completes the active multi-part encrypt message and returns
+// its authentication tag.
+func (mc *MessageCrypt) Seal() []byte {
+	msg := mc.Message
+	mc.Message = nil
+
+	sealed := mc.AEAD.Seal(nil, msg.Nonce, msg.Data, msg.AAD)
+	return sealed[len(msg.Data):]
+}
+
+// Open completes the active multi-part decrypt message and verifies
+// its authentication tag.
+func (mc *MessageCrypt) Open(tag []byte) error {
+	msg := mc.Message
+	mc.Message = nil
+
+	if len(tag) != messageTagLen {
+		return pkcs11.ErrMechanismParamInvalid
+	}
+	_, err := mc.AEAD.Open(nil, msg.Nonce, append(msg.Data, tag...),
+		msg.AAD)
+	if err != nil {
+		return pkcs11.ErrAeadDecryptFailed
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func newMessageKey(t *testing.T, storage pkcs11.Storage,
+	keyType pkcs11.KeyType, key []byte) (pkcs11.ObjectHandle, *pkcs11.Object) {
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(keyType))
+	obj := &pkcs11.Object{
+		Attrs:  tmpl.Set(pkcs11.CkaValue, key),
+		Native: key,
+	}
+	h, err := storage.Create(obj)
+	if err != nil {
+		t.Fatalf("storage.Create: %v", err)
+	}
+	return h, obj
+}
+
+func gcmMessageParams(t *testing.T, iv []byte, fixedBits int,
+	generator pkcs11.GeneratorFunction, tag []byte) []byte {
+
+	data, err := pkcs11.Marshal(&pkcs11.GcmMessageParams{
+		Iv:          iv,
+		IvFixedBits: pkcs11.Ulong(fixedBits),
+		IvGenerator: generator,
+		Tag:         tag,
+		TagBits:     messageTagLen * 8,
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	return data
+}
+
+// testMessageRoundTrip encrypts the message as a single part and as
+// multiple parts, and decrypts the multi-part ciphertext.
+func testMessageRoundTrip(t *testing.T, enc, dec *MessageCrypt,
+	nonce []byte) {
+
+	aad := []byte("associated data")
+	msg := []byte("The quick brown fox jumps over the lazy dog")
+
+	sealed := enc.AEAD.Seal(nil, nonce, msg, aad)
+
+	err := enc.Begin(nonce, aad)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	var ct []byte
+	for i := 0; i < len(msg); i += 10 {
+		end := i + 10
+		if end > len(msg) {
+			end = len(msg)
+		}
+		part, err := enc.Next(msg[i:end])
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		ct = append(ct, part...)
+	}
+	tag := enc.Seal()
+	if !bytes.Equal(append(ct, tag...), sealed) {
+		t.Errorf("multi-part encrypt mismatch:\ngot:  %x%x\nwant: %x",
+			ct, tag, sealed)
+	}
+
+	err = dec.Begin(nonce, aad)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	pt, err := dec.Next(ct)
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if !bytes.Equal(pt, msg) {
+		t.Errorf("decrypt mismatch: got %x, want %x", pt, msg)
+	}
+	err = dec.Open(tag)
+	if err != nil {
+		t.Errorf("Open: %v", err)
+	}
+
+	// Tampered ciphertext.
+	ct[0] ^= 0x01
+	dec.Begin(nonce, aad)
+	dec.Next(ct)
+	err = dec.Open(tag)
+	if err != pkcs11.ErrAeadDecryptFailed {
+		t.Errorf("Open with tampered ciphertext: %v", err)
+	}
+
+	// The message length is limited.
+	large := make([]byte, MaxMessageLen/2+1)
+	for _, test := range []struct {
+		mc  *MessageCrypt
+		ret error
+	}{
+		{enc, pkcs11.ErrDataLenRange},
+		{dec, pkcs11.ErrEncryptedDataLenRange},
+	} {
+		test.mc.Begin(nonce, aad)
+		_, err = test.mc.Next(large)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		_, err = test.mc.Next(large)
+		if err != test.ret {
+			t.Errorf("Next over MaxMessageLen: %v, expected %v", err,
+				test.ret)
+		}
+		if test.mc.Message != nil {
+			t.Errorf("message active after exceeding MaxMessageLen")
+		}
+	}
+}
+
+func TestMessageCryptGCM(t *testing.T) {
+	storage := newTokenStorage()
+	key := bytes.Repeat([]byte{0x42}, 16)
+	h, obj := newMessageKey(t, storage, pkcs11.CkkAES, key)
+
+	mech := &pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmAESGCM,
+	}
+	enc, err := newMessageCrypt(mech, storage, h, obj, key, true)
+	if err != nil {
+		t.Fatalf("newMessageCrypt: %v", err)
+	}
+	dec, err := newMessageCrypt(mech, storage, h, obj, key, false)
+	if err != nil {
+		t.Fatalf("newMessageCrypt: %v", err)
+	}
+
+	iv := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	nonce, _, _, err := enc.Params(gcmMessageParams(t, iv, 0,
+		pkcs11.CkgNoGenerate, nil), true)
+	if err != nil {
+		t.Fatalf("Params: %v", err)
+	}
+	if !bytes.Equal(nonce, iv) {
+		t.Errorf("nonce %x, expected %x", nonce, iv)
+	}
+	testMessageRoundTrip(t, enc, dec, nonce)
+
+	_, err = newMessageCrypt(mech, storage, h, obj, key[:15], true)
+	if err != pkcs11.ErrKeySizeRange {
+		t.Errorf("newMessageCrypt with invalid key size: %v", err)
+	}
+	_, err = newMessageCrypt(&pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmChaCha20Poly1305,
+	}, storage, h, obj, key, true)
+	if err != pkcs11.ErrKeyTypeInconsistent {
+		t.Errorf("newMessageCrypt with AES key: %v", err)
+	}
+}
+
+func TestMessageCryptChaCha20Poly1305(t *testing.T) {
+	storage := newTokenStorage()
+	key := bytes.Repeat([]byte{0x42}, 32)
+	h, obj := newMessageKey(t, storage, pkcs11.CkkChaCha20, key)
+
+	mech := &pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmChaCha20Poly1305,
+	}
+	enc, err := newMessageCrypt(mech, storage, h, obj, key, true)
+	if err != nil {
+		t.Fatalf("newMessageCrypt: %v", err)
+	}
+	dec, err := newMessageCrypt(mech, storage, h, obj, key, false)
+	if err != nil {
+		t.Fatalf("newMessageCrypt: %v", err)
+	}
+	params, err := pkcs11.Marshal(&pkcs11.Salsa20Chacha20Poly1305MsgParams{
+		Nonce: make([]byte, messageNonceLen),
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	nonce, iv, _, err := enc.Params(params, true)
+	if err != nil {
+		t.Fatalf("Params: %v", err)
+	}
+	if iv != nil {
+		t.Errorf("ChaCha20-Poly1305 generated IV %x", iv)
+	}
+	testMessageRoundTrip(t, enc, dec, nonce)
+}
+
+func TestMessageIVCounter(t *testing.T) {
+	storage := newTokenStorage()
+	key := bytes.Repeat([]byte{0x17}, 16)
+	h, obj := newMessageKey(t, storage, pkcs11.CkkAES, key)
+
+	mc, err := newMessageCrypt(&pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmAESGCM,
+	}, storage, h, obj, key, true)
+	if err != nil {
+		t.Fatalf("newMessageCrypt: %v", err)
+	}
+	fixed := []byte{0xf0, 0xf1, 0xf2, 0xf3, 0, 0, 0, 0, 0, 0, 0, 0}
+	params := gcmMessageParams(t, fixed, 32, pkcs11.CkgGenerateCounter, nil)
+
+	generate := func(expected uint64) {
+		t.Helper()
+		nonce, iv, _, err := mc.Params(params, true)
+		if err != nil {
+			t.Fatalf("Params: %v", err)
+		}
+		if !bytes.Equal(nonce, iv) {
+			t.Errorf("nonce %x, IV %x", nonce, iv)
+		}
+		if !bytes.Equal(iv[:4], fixed[:4]) {
+			t.Errorf("IV fixed part %x, expected %x", iv[:4], fixed[:4])
+		}
+		if c := bo.Uint64(iv[4:]); c != expected {
+			t.Errorf("IV counter %v, expected %v", c, expected)
+		}
+	}
+	generate(0)
+	generate(1)
+
+	// The size query does not consume counter values.
+	_, _, _, err = mc.Params(params, false)
+	if err != nil {
+		t.Fatalf("Params: %v", err)
+	}
+	generate(2)
+
+	stored, err := storage.Read(h)
+	if err != nil {
+		t.Fatalf("storage.Read: %v", err)
+	}
+	value, err := stored.Attrs.OptBytes(CkaIVCounter)
+	if err != nil || len(value) != 8 || bo.Uint64(value) != 3 {
+		t.Errorf("stored IV counter %x (%v), expected 3", value, err)
+	}
+
+	// The counter is exhausted when it overflows the generated part.
+	var buf [8]byte
+	bo.PutUint64(buf[:], 1<<32)
+	updated := *stored
+	updated.Attrs = stored.Attrs.Set(CkaIVCounter, buf[:])
+	storage.Update(h, &updated)
+
+	params = gcmMessageParams(t, fixed, 64, pkcs11.CkgGenerateCounter, nil)
+	_, _, _, err = mc.Params(params, true)
+	if err != pkcs11.ErrActionProhibited {
+		t.Errorf("exhausted IV counter: %v", err)
+	}
+}
+
+func TestMessageIVRandom(t *testing.T) {
+	storage := newTokenStorage()
+	key := bytes.Repeat([]byte{0x99}, 16)
+	h, obj := newMessageKey(t, storage, pkcs11.CkkAES, key)
+
+	mc, err := newMessageCrypt(&pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmAESGCM,
+	}, storage, h, obj, key, true)
+	if err != nil {
+		t.Fatalf("newMessageCrypt: %v", err)
+	}
+	iv := make([]byte, messageNonceLen)
+
+	for _, fixedBits := range []int{32, 64} {
+		_, _, _, err = mc.Params(gcmMessageParams(t, iv, fixedBits,
+			pkcs11.CkgGenerateRandom, nil), true)
+		if err != pkcs11.ErrMechanismParamInvalid {
+			t.Errorf("random IV with %v fixed bits: %v", fixedBits, err)
+		}
+	}
+	params := gcmMessageParams(t, iv, 0, pkcs11.CkgGenerateRandom, nil)
+	_, iv1, _, err := mc.Params(params, true)
+	if err != nil {
+		t.Fatalf("Params: %v", err)
+	}
+	_, iv2, _, err := mc.Params(params, true)
+	if err != nil {
+		t.Fatalf("Params: %v", err)
+	}
+	if len(iv1) != messageNonceLen || bytes.Equal(iv1, iv2) {
+		t.Errorf("random IVs %x and %x", iv1, iv2)
+	}
+}
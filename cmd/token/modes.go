@@ -0,0 +1,568 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding"
+	"encoding/binary"
+	"errors"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// StealingMode implements block cipher modes which use ciphertext
+// stealing to process data which is not a multiple of the block
+// size. The last one or two blocks of the data must be processed
+// with CryptFinal.
+type StealingMode interface {
+	// BlockSize returns the mode's block size.
+	BlockSize() int
+
+	// CryptBlocks processes full blocks which are not part of the
+	// final blocks of data.
+	CryptBlocks(dst, src []byte)
+
+	// CryptFinal processes the final data. The length of the data
+	// must be between BlockSize and 2*BlockSize bytes.
+	CryptFinal(dst, src []byte)
+}
+
+// Mode state errors.
+var (
+	errModeState = errors.New("invalid mode state")
+)
+
+// Cipher modes that can be saved and restored with the
+// C_GetOperationState and C_SetOperationState functions.
+var (
+	_ encoding.BinaryMarshaler   = &cbc{}
+	_ encoding.BinaryUnmarshaler = &cbc{}
+	_ encoding.BinaryMarshaler   = &ctr{}
+	_ encoding.BinaryUnmarshaler = &ctr{}
+	_ encoding.BinaryMarshaler   = &ofb{}
+	_ encoding.BinaryUnmarshaler = &ofb{}
+	_ encoding.BinaryMarshaler   = &cfb{}
+	_ encoding.BinaryUnmarshaler = &cfb{}
+	_ encoding.BinaryMarshaler   = &cts{}
+	_ encoding.BinaryUnmarshaler = &cts{}
+	_ encoding.BinaryMarshaler   = &xts{}
+	_ encoding.BinaryUnmarshaler = &xts{}
+)
+
+// stealingLen returns the number of bytes the ciphertext stealing
+// mode can process from the n pending bytes. The remaining
+// BlockSize+1 to 2*BlockSize bytes are kept for CryptFinal.
+func stealingLen(n, blockSize int) int {
+	if n <= 2*blockSize {
+		return 0
+	}
+	return (n - blockSize - 1) / blockSize * blockSize
+}
+
+// newModeEncDec creates the encrypt or decrypt operation for the
+// AES OFB, CFB, CTS, and XTS modes.
+func newModeEncDec(mech pkcs11.MechanismType, obj *pkcs11.Object,
+	key, iv []byte, decrypt bool) (*EncDec, error) {
+
+	if mech == pkcs11.CkmAESXTS {
+		keyType := obj.Attrs.OptInt(pkcs11.CkaKeyType, -1)
+		if pkcs11.KeyType(keyType) != pkcs11.CkkAESXTS {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		if len(key) != 32 && len(key) != 64 {
+			return nil, pkcs11.ErrKeySizeRange
+		}
+		if len(iv) != aes.BlockSize {
+			Errorf("%s: invalid tweak length %v, expected %v",
+				mech, len(iv), aes.BlockSize)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		xts, err := newXTS(key, iv, decrypt)
+		if err != nil {
+			return nil, err
+		}
+		return &EncDec{
+			Mechanism: mech,
+			Stealing:  xts,
+			Buffer:    make([]byte, 0, 2*aes.BlockSize),
+		}, nil
+	}
+
+	b, err := newBlockCipher(mech, obj, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != b.BlockSize() {
+		Errorf("%s: invalid IV length %v, expected %v",
+			mech, len(iv), b.BlockSize())
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	ed := &EncDec{
+		Mechanism: mech,
+	}
+
+	switch mech {
+	case pkcs11.CkmAESOFB:
+		ed.Stream = newOFB(b, iv)
+
+	case pkcs11.CkmAESCFB8:
+		ed.Stream = newCFB(b, iv, 1, decrypt)
+
+	case pkcs11.CkmAESCFB64:
+		ed.Stream = newCFB(b, iv, 8, decrypt)
+
+	case pkcs11.CkmAESCFB128:
+		ed.Stream = newCFB(b, iv, b.BlockSize(), decrypt)
+
+	case pkcs11.CkmAESCTS:
+		ed.Stealing = newCTS(b, iv, decrypt)
+		ed.Buffer = make([]byte, 0, 2*b.BlockSize())
+
+	default:
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+	return ed, nil
+}
+
+// cbc implements the CBC mode. It keeps track of the chaining value
+// so that the mode can be saved and restored.
+type cbc struct {
+	b       cipher.Block
+	mode    cipher.BlockMode
+	iv      []byte
+	decrypt bool
+}
+
+func newCBC(b cipher.Block, iv []byte, decrypt bool) *cbc {
+	c := &cbc{
+		b:       b,
+		iv:      make([]byte, len(iv)),
+		decrypt: decrypt,
+	}
+	c.setIV(iv)
+	return c
+}
+
+func (c *cbc) setIV(iv []byte) {
+	copy(c.iv, iv)
+	if c.decrypt {
+		c.mode = cipher.NewCBCDecrypter(c.b, c.iv)
+	} else {
+		c.mode = cipher.NewCBCEncrypter(c.b, c.iv)
+	}
+}
+
+func (c *cbc) BlockSize() int {
+	return c.mode.BlockSize()
+}
+
+func (c *cbc) CryptBlocks(dst, src []byte) {
+	if len(src) == 0 {
+		return
+	}
+	last := len(src) - c.mode.BlockSize()
+	if c.decrypt {
+		copy(c.iv, src[last:])
+		c.mode.CryptBlocks(dst, src)
+	} else {
+		c.mode.CryptBlocks(dst, src)
+		copy(c.iv, dst[last:])
+	}
+}
+
+func (c *cbc) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), c.iv...), nil
+}
+
+func (c *cbc) UnmarshalBinary(data []byte) error {
+	if len(data) != len(c.iv) {
+		return errModeState
+	}
+	c.setIV(data)
+	return nil
+}
+
+// ctr implements the CTR mode. It keeps track of the initial counter
+// block and the number of processed bytes so that the mode can be
+// saved and restored.
+type ctr struct {
+	b       cipher.Block
+	stream  cipher.Stream
+	counter []byte
+	pos     uint64
+}
+
+func newCTR(b cipher.Block, counter []byte) *ctr {
+	c := &ctr{
+		b:       b,
+		counter: make([]byte, len(counter)),
+	}
+	copy(c.counter, counter)
+	c.seek(0)
+	return c
+}
+
+// seek positions the keystream to the byte offset pos.
+func (c *ctr) seek(pos uint64) {
+	bs := c.b.BlockSize()
+
+	block := make([]byte, bs)
+	copy(block, c.counter)
+
+	// Add the number of full blocks to the big-endian counter block.
+	carry := pos / uint64(bs)
+	for i := bs - 1; i >= 0 && carry != 0; i-- {
+		sum := uint64(block[i]) + carry&0xff
+		block[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	c.stream = cipher.NewCTR(c.b, block)
+	c.pos = pos
+
+	skip := make([]byte, pos%uint64(bs))
+	c.stream.XORKeyStream(skip, skip)
+}
+
+func (c *ctr) XORKeyStream(dst, src []byte) {
+	c.stream.XORKeyStream(dst, src)
+	c.pos += uint64(len(src))
+}
+
+func (c *ctr) MarshalBinary() ([]byte, error) {
+	data := append([]byte(nil), c.counter...)
+	return binary.BigEndian.AppendUint64(data, c.pos), nil
+}
+
+func (c *ctr) UnmarshalBinary(data []byte) error {
+	if len(data) != len(c.counter)+8 {
+		return errModeState
+	}
+	copy(c.counter, data)
+	c.seek(binary.BigEndian.Uint64(data[len(c.counter):]))
+	return nil
+}
+
+// ofb implements the output feedback mode.
+type ofb struct {
+	b   cipher.Block
+	out []byte
+	pos int
+}
+
+func newOFB(b cipher.Block, iv []byte) *ofb {
+	out := make([]byte, len(iv))
+	copy(out, iv)
+
+	return &ofb{
+		b:   b,
+		out: out,
+		pos: len(out),
+	}
+}
+
+func (o *ofb) XORKeyStream(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("ofb: output smaller than input")
+	}
+	for i, in := range src {
+		if o.pos == len(o.out) {
+			o.b.Encrypt(o.out, o.out)
+			o.pos = 0
+		}
+		dst[i] = in ^ o.out[o.pos]
+		o.pos++
+	}
+}
+
+func (o *ofb) MarshalBinary() ([]byte, error) {
+	return append(append([]byte(nil), o.out...), byte(o.pos)), nil
+}
+
+func (o *ofb) UnmarshalBinary(data []byte) error {
+	if len(data) != len(o.out)+1 || int(data[len(o.out)]) > len(o.out) {
+		return errModeState
+	}
+	copy(o.out, data)
+	o.pos = int(data[len(o.out)])
+	return nil
+}
+
+// cfb implements the cipher feedback mode with segment sizes up to
+// the cipher block size.
+type cfb struct {
+	b        cipher.Block
+	register []byte
+	out      []byte
+	next     []byte
+	segment  int
+	pos      int
+	decrypt  bool
+}
+
+func newCFB(b cipher.Block, iv []byte, segment int, decrypt bool) cipher.Stream {
+	register := make([]byte, len(iv))
+	copy(register, iv)
+
+	return &cfb{
+		b:        b,
+		register: register,
+		out:      make([]byte, b.BlockSize()),
+		next:     make([]byte, segment),
+		segment:  segment,
+		decrypt:  decrypt,
+	}
+}
+
+func (c *cfb) XORKeyStream(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("cfb: output smaller than input")
+	}
+	for i, in := range src {
+		if c.pos == 0 {
+			c.b.Encrypt(c.out, c.register)
+		}
+		out := in ^ c.out[c.pos]
+		dst[i] = out
+
+		// Feed back the ciphertext.
+		if c.decrypt {
+			c.next[c.pos] = in
+		} else {
+			c.next[c.pos] = out
+		}
+		c.pos++
+		if c.pos == c.segment {
+			copy(c.register, c.register[c.segment:])
+			copy(c.register[len(c.register)-c.segment:], c.next)
+			c.pos = 0
+		}
+	}
+}
+
+func (c *cfb) MarshalBinary() ([]byte, error) {
+	data := append([]byte(nil), c.register...)
+	data = append(data, c.next...)
+	return append(data, byte(c.pos)), nil
+}
+
+func (c *cfb) UnmarshalBinary(data []byte) error {
+	n := len(c.register)
+	if len(data) != n+c.segment+1 || int(data[n+c.segment]) >= c.segment {
+		return errModeState
+	}
+	copy(c.register, data)
+	copy(c.next, data[n:])
+	c.pos = int(data[n+c.segment])
+	if c.pos != 0 {
+		c.b.Encrypt(c.out, c.register)
+	}
+	return nil
+}
+
+// cts implements the CBC mode with ciphertext stealing. The
+// implementation uses the CS3 variant of NIST SP 800-38A Addendum
+// where the last two blocks are always swapped.
+type cts struct {
+	b       cipher.Block
+	iv      []byte
+	decrypt bool
+}
+
+func newCTS(b cipher.Block, iv []byte, decrypt bool) *cts {
+	chain := make([]byte, len(iv))
+	copy(chain, iv)
+
+	return &cts{
+		b:       b,
+		iv:      chain,
+		decrypt: decrypt,
+	}
+}
+
+func (c *cts) BlockSize() int {
+	return c.b.BlockSize()
+}
+
+func (c *cts) CryptBlocks(dst, src []byte) {
+	bs := c.b.BlockSize()
+	block := make([]byte, bs)
+
+	for i := 0; i < len(src); i += bs {
+		if c.decrypt {
+			copy(block, src[i:i+bs])
+			c.b.Decrypt(dst[i:i+bs], src[i:i+bs])
+			xorBytes(dst[i:i+bs], c.iv)
+			copy(c.iv, block)
+		} else {
+			copy(block, src[i:i+bs])
+			xorBytes(block, c.iv)
+			c.b.Encrypt(dst[i:i+bs], block)
+			copy(c.iv, dst[i:i+bs])
+		}
+	}
+}
+
+func (c *cts) CryptFinal(dst, src []byte) {
+	bs := c.b.BlockSize()
+	if len(src) == bs {
+		c.CryptBlocks(dst, src)
+		return
+	}
+	d := len(src) - bs
+
+	x := make([]byte, bs)
+	y := make([]byte, bs)
+
+	if c.decrypt {
+		// Recover the last plaintext block and the ciphertext
+		// block that was stolen.
+		z := make([]byte, bs)
+		c.b.Decrypt(z, src[:bs])
+		copy(x, src[bs:])
+		copy(x[d:], z[d:])
+		copy(y, src[bs:])
+		xorBytes(y[:d], z[:d])
+
+		c.CryptBlocks(x, x)
+		copy(dst[:bs], x)
+		copy(dst[bs:], y[:d])
+	} else {
+		c.CryptBlocks(x, src[:bs])
+		copy(y, src[bs:])
+		c.CryptBlocks(y, y)
+		copy(dst[:bs], y)
+		copy(dst[bs:], x[:d])
+	}
+}
+
+func (c *cts) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), c.iv...), nil
+}
+
+func (c *cts) UnmarshalBinary(data []byte) error {
+	if len(data) != len(c.iv) {
+		return errModeState
+	}
+	copy(c.iv, data)
+	return nil
+}
+
+// xts implements the XTS-AES mode (IEEE 1619) with ciphertext
+// stealing. All data processed with the mode is one data unit.
+type xts struct {
+	k1      cipher.Block
+	k2      cipher.Block
+	tweak   []byte
+	decrypt bool
+}
+
+func newXTS(key, iv []byte, decrypt bool) (*xts, error) {
+	k1, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, pkcs11.ErrKeySizeRange
+	}
+	k2, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, pkcs11.ErrKeySizeRange
+	}
+	tweak := make([]byte, aes.BlockSize)
+	k2.Encrypt(tweak, iv)
+
+	return &xts{
+		k1:      k1,
+		k2:      k2,
+		tweak:   tweak,
+		decrypt: decrypt,
+	}, nil
+}
+
+func (x *xts) BlockSize() int {
+	return aes.BlockSize
+}
+
+func (x *xts) cryptBlock(dst, src, tweak []byte) {
+	var block [aes.BlockSize]byte
+
+	copy(block[:], src)
+	xorBytes(block[:], tweak)
+	if x.decrypt {
+		x.k1.Decrypt(block[:], block[:])
+	} else {
+		x.k1.Encrypt(block[:], block[:])
+	}
+	xorBytes(block[:], tweak)
+	copy(dst, block[:])
+}
+
+// mulAlpha multiplies the tweak by the primitive element alpha of
+// GF(2^128).
+func mulAlpha(tweak []byte) {
+	carry := tweak[15] >> 7
+	for i := 15; i > 0; i-- {
+		tweak[i] = tweak[i]<<1 | tweak[i-1]>>7
+	}
+	tweak[0] <<= 1
+	if carry != 0 {
+		tweak[0] ^= 0x87
+	}
+}
+
+func (x *xts) CryptBlocks(dst, src []byte) {
+	for i := 0; i < len(src); i += aes.BlockSize {
+		x.cryptBlock(dst[i:], src[i:i+aes.BlockSize], x.tweak)
+		mulAlpha(x.tweak)
+	}
+}
+
+func (x *xts) CryptFinal(dst, src []byte) {
+	bs := aes.BlockSize
+	if len(src)%bs == 0 {
+		x.CryptBlocks(dst, src)
+		return
+	}
+	d := len(src) - bs
+
+	t1 := make([]byte, bs)
+	copy(t1, x.tweak)
+	mulAlpha(x.tweak)
+	t2 := x.tweak
+
+	if x.decrypt {
+		t1, t2 = t2, t1
+	}
+
+	cc := make([]byte, bs)
+	x.cryptBlock(cc, src[:bs], t1)
+
+	pp := make([]byte, bs)
+	copy(pp, src[bs:])
+	copy(pp[d:], cc[d:])
+	x.cryptBlock(pp, pp, t2)
+
+	copy(dst[:bs], pp)
+	copy(dst[bs:], cc[:d])
+}
+
+func (x *xts) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), x.tweak...), nil
+}
+
+func (x *xts) UnmarshalBinary(data []byte) error {
+	if len(data) != len(x.tweak) {
+		return errModeState
+	}
+	copy(x.tweak, data)
+	return nil
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
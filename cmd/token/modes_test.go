@@ -0,0 +1,345 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// NIST SP 800-38A F.3 and F.4, IEEE 1619 XTS-AES, and RFC 3962 CS3
+// test vectors.
+var modeTests = []struct {
+	mech    pkcs11.MechanismType
+	keyType pkcs11.KeyType
+	key     string
+	iv      string
+	pt      string
+	ct      string
+}{
+	{
+		mech:    pkcs11.CkmAESOFB,
+		keyType: pkcs11.CkkAES,
+		key:     "2b7e151628aed2a6abf7158809cf4f3c",
+		iv:      "000102030405060708090a0b0c0d0e0f",
+		pt: "6bc1bee22e409f96e93d7e117393172a" +
+			"ae2d8a571e03ac9c9eb76fac45af8e51" +
+			"30c81c46a35ce411e5fbc1191a0a52ef" +
+			"f69f2445df4f9b17ad2b417be66c3710",
+		ct: "3b3fd92eb72dad20333449f8e83cfb4a" +
+			"7789508d16918f03f53c52dac54ed825" +
+			"9740051e9c5fecf64344f7a82260edcc" +
+			"304c6528f659c77866a510d9c1d6ae5e",
+	},
+	{
+		mech:    pkcs11.CkmAESCFB128,
+		keyType: pkcs11.CkkAES,
+		key:     "2b7e151628aed2a6abf7158809cf4f3c",
+		iv:      "000102030405060708090a0b0c0d0e0f",
+		pt: "6bc1bee22e409f96e93d7e117393172a" +
+			"ae2d8a571e03ac9c9eb76fac45af8e51" +
+			"30c81c46a35ce411e5fbc1191a0a52ef" +
+			"f69f2445df4f9b17ad2b417be66c3710",
+		ct: "3b3fd92eb72dad20333449f8e83cfb4a" +
+			"c8a64537a0b3a93fcde3cdad9f1ce58b" +
+			"26751f67a3cbb140b1808cf187a4f4df" +
+			"c04b05357c5d1c0eeac4c66f9ff7f2e6",
+	},
+	{
+		mech:    pkcs11.CkmAESCFB8,
+		keyType: pkcs11.CkkAES,
+		key:     "2b7e151628aed2a6abf7158809cf4f3c",
+		iv:      "000102030405060708090a0b0c0d0e0f",
+		pt:      "6bc1bee22e409f96e93d7e117393172aae2d",
+		ct:      "3b79424c9c0dd436bace9e0ed4586a4f32b9",
+	},
+	{
+		mech:    pkcs11.CkmAESCTS,
+		keyType: pkcs11.CkkAES,
+		key:     "636869636b656e207465726979616b69",
+		iv:      "00000000000000000000000000000000",
+		pt:      "4920776f756c64206c696b652074686520",
+		ct:      "c6353568f2bf8cb4d8a580362da7ff7f97",
+	},
+	{
+		mech:    pkcs11.CkmAESCTS,
+		keyType: pkcs11.CkkAES,
+		key:     "636869636b656e207465726979616b69",
+		iv:      "00000000000000000000000000000000",
+		pt: "4920776f756c64206c696b652074686520" +
+			"47656e6572616c20476175277320",
+		ct: "fc00783e0efdb2c1d445d4c8eff7ed22" +
+			"97687268d6ecccc0c07b25e25ecfe5",
+	},
+	{
+		mech:    pkcs11.CkmAESCTS,
+		keyType: pkcs11.CkkAES,
+		key:     "636869636b656e207465726979616b69",
+		iv:      "00000000000000000000000000000000",
+		pt: "4920776f756c64206c696b6520746865" +
+			"2047656e6572616c2047617527732043" +
+			"6869636b656e2c20706c656173652c20" +
+			"616e6420776f6e746f6e20736f75702e",
+		ct: "97687268d6ecccc0c07b25e25ecfe584" +
+			"39312523a78662d5be7fcbcc98ebf5a8" +
+			"4807efe836ee89a526730dbc2f7bc840" +
+			"9dad8bbb96c4cdc03bc103e1a194bbd8",
+	},
+	{
+		mech:    pkcs11.CkmAESXTS,
+		keyType: pkcs11.CkkAESXTS,
+		key: "00000000000000000000000000000000" +
+			"00000000000000000000000000000000",
+		iv: "00000000000000000000000000000000",
+		pt: "00000000000000000000000000000000" +
+			"00000000000000000000000000000000",
+		ct: "917cf69ebd68b2ec9b9fe9a3eadda692" +
+			"cd43d2f59598ed858c02c2652fbf922e",
+	},
+	{
+		mech:    pkcs11.CkmAESXTS,
+		keyType: pkcs11.CkkAESXTS,
+		key: "11111111111111111111111111111111" +
+			"22222222222222222222222222222222",
+		iv: "33333333330000000000000000000000",
+		pt: "44444444444444444444444444444444" +
+			"44444444444444444444444444444444",
+		ct: "c454185e6a16936e39334038acef838b" +
+			"fb186fff7480adc4289382ecd6d394f0",
+	},
+	{
+		mech:    pkcs11.CkmAESXTS,
+		keyType: pkcs11.CkkAESXTS,
+		key: "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0" +
+			"bfbebdbcbbbab9b8b7b6b5b4b3b2b1b0",
+		iv: "9a785634120000000000000000000000",
+		pt: "000102030405060708090a0b0c0d0e0f10",
+		ct: "6c1625db4671522d3d7599601de7ca09ed",
+	},
+}
+
+// modeCrypt processes the data with the mode. The stream modes
+// process the data in parts and the stealing modes keep the final
+// blocks for CryptFinal.
+func modeCrypt(ed *EncDec, data []byte) []byte {
+	result := make([]byte, len(data))
+	if ed.Stream != nil {
+		for i := 0; i < len(data); i += 7 {
+			end := i + 7
+			if end > len(data) {
+				end = len(data)
+			}
+			ed.Stream.XORKeyStream(result[i:end], data[i:end])
+		}
+		return result
+	}
+	n := stealingLen(len(data), ed.Stealing.BlockSize())
+	ed.Stealing.CryptBlocks(result, data[:n])
+	ed.Stealing.CryptFinal(result[n:], data[n:])
+	return result
+}
+
+func TestModes(t *testing.T) {
+	for idx, test := range modeTests {
+		key := unhex(t, test.key)
+		iv := unhex(t, test.iv)
+		pt := unhex(t, test.pt)
+		ct := unhex(t, test.ct)
+
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(test.keyType))
+		obj := &pkcs11.Object{
+			Attrs:  tmpl,
+			Native: key,
+		}
+
+		enc, err := newModeEncDec(test.mech, obj, key, iv, false)
+		if err != nil {
+			t.Fatalf("test %d: %s: newModeEncDec: %v", idx, test.mech, err)
+		}
+		result := modeCrypt(enc, pt)
+		if !bytes.Equal(result, ct) {
+			t.Errorf("test %d: %s encrypt:\ngot:  %x\nwant: %x",
+				idx, test.mech, result, ct)
+		}
+
+		dec, err := newModeEncDec(test.mech, obj, key, iv, true)
+		if err != nil {
+			t.Fatalf("test %d: %s: newModeEncDec: %v", idx, test.mech, err)
+		}
+		result = modeCrypt(dec, ct)
+		if !bytes.Equal(result, pt) {
+			t.Errorf("test %d: %s decrypt:\ngot:  %x\nwant: %x",
+				idx, test.mech, result, pt)
+		}
+	}
+}
+
+func TestModeCFB64(t *testing.T) {
+	key := unhex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	iv := unhex(t, "000102030405060708090a0b0c0d0e0f")
+	pt := bytes.Repeat([]byte("CFB64 segments."), 5)
+
+	var tmpl pkcs11.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+	obj := &pkcs11.Object{
+		Attrs:  tmpl,
+		Native: key,
+	}
+	enc, err := newModeEncDec(pkcs11.CkmAESCFB64, obj, key, iv, false)
+	if err != nil {
+		t.Fatalf("newModeEncDec: %v", err)
+	}
+	ct := modeCrypt(enc, pt)
+
+	// The first segment is the same for all CFB segment sizes.
+	cfb128, err := newModeEncDec(pkcs11.CkmAESCFB128, obj, key, iv, false)
+	if err != nil {
+		t.Fatalf("newModeEncDec: %v", err)
+	}
+	ct128 := modeCrypt(cfb128, pt)
+	if !bytes.Equal(ct[:8], ct128[:8]) || bytes.Equal(ct[8:16], ct128[8:16]) {
+		t.Errorf("CFB64: %x, CFB128: %x", ct[:16], ct128[:16])
+	}
+
+	dec, err := newModeEncDec(pkcs11.CkmAESCFB64, obj, key, iv, true)
+	if err != nil {
+		t.Fatalf("newModeEncDec: %v", err)
+	}
+	result := modeCrypt(dec, ct)
+	if !bytes.Equal(result, pt) {
+		t.Errorf("CFB64 decrypt: got %x, expected %x", result, pt)
+	}
+}
+
+func TestModeParams(t *testing.T) {
+	tests := []struct {
+		mech    pkcs11.MechanismType
+		keyType pkcs11.KeyType
+		keyLen  int
+		ivLen   int
+		err     error
+	}{
+		{pkcs11.CkmAESOFB, pkcs11.CkkAES, 16, 8, pkcs11.ErrMechanismParamInvalid},
+		{pkcs11.CkmAESCTS, pkcs11.CkkAES, 15, 16, pkcs11.ErrKeySizeRange},
+		{pkcs11.CkmAESXTS, pkcs11.CkkAESXTS, 48, 16, pkcs11.ErrKeySizeRange},
+		{pkcs11.CkmAESXTS, pkcs11.CkkAESXTS, 32, 12, pkcs11.ErrMechanismParamInvalid},
+		{pkcs11.CkmAESXTS, pkcs11.CkkAES, 32, 16, pkcs11.ErrKeyTypeInconsistent},
+		{pkcs11.CkmAESXTS, pkcs11.CkkAESXTS, 64, 16, nil},
+	}
+	for idx, test := range tests {
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(test.keyType))
+		key := make([]byte, test.keyLen)
+		obj := &pkcs11.Object{
+			Attrs:  tmpl,
+			Native: key,
+		}
+		_, err := newModeEncDec(test.mech, obj, key, make([]byte, test.ivLen),
+			false)
+		if err != test.err {
+			t.Errorf("test %d: %s: newModeEncDec: %v, expected %v",
+				idx, test.mech, err, test.err)
+		}
+	}
+}
+
+func TestModeUpdate(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	for idx, test := range modeTests {
+		key := unhex(t, test.key)
+		pt := unhex(t, test.pt)
+		ct := unhex(t, test.ct)
+
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(test.keyType))
+		tmpl = tmpl.SetBool(pkcs11.CkaEncrypt, true)
+		tmpl = tmpl.SetBool(pkcs11.CkaDecrypt, true)
+		tmpl = tmpl.Set(pkcs11.CkaValue, key)
+
+		var obj pkcs11.CreateObjectResp
+		session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+			Template: tmpl,
+		}, &obj)
+
+		mech := pkcs11.Mechanism{
+			Mechanism: test.mech,
+			Parameter: unhex(t, test.iv),
+		}
+
+		// Encrypt the data in 5 byte parts.
+		session.mustCall(msgEncryptInit, &pkcs11.EncryptInitReq{
+			Mechanism: mech,
+			Key:       obj.Object,
+		}, &pkcs11.EncryptInitResp{})
+
+		var result []byte
+		for i := 0; i < len(pt); i += 5 {
+			end := i + 5
+			if end > len(pt) {
+				end = len(pt)
+			}
+			var resp pkcs11.EncryptUpdateResp
+			session.mustCall(msgEncryptUpdate, &pkcs11.EncryptUpdateReq{
+				Part:              pt[i:end],
+				EncryptedPartSize: 1024,
+			}, &resp)
+			result = append(result, resp.EncryptedPart...)
+		}
+		var final pkcs11.EncryptFinalResp
+		session.mustCall(msgEncryptFinal, &pkcs11.EncryptFinalReq{
+			LastEncryptedPartSize: 1024,
+		}, &final)
+		result = append(result, final.LastEncryptedPart...)
+		if !bytes.Equal(result, ct) {
+			t.Errorf("test %d: %s EncryptUpdate:\ngot:  %x\nwant: %x",
+				idx, test.mech, result, ct)
+		}
+
+		// Decrypt the data in 5 byte parts.
+		session.mustCall(msgDecryptInit, &pkcs11.DecryptInitReq{
+			Mechanism: mech,
+			Key:       obj.Object,
+		}, nil)
+
+		result = nil
+		for i := 0; i < len(ct); i += 5 {
+			end := i + 5
+			if end > len(ct) {
+				end = len(ct)
+			}
+			var resp pkcs11.DecryptUpdateResp
+			session.mustCall(msgDecryptUpdate, &pkcs11.DecryptUpdateReq{
+				EncryptedPart: ct[i:end],
+				PartSize:      1024,
+			}, &resp)
+			result = append(result, resp.Part...)
+		}
+		var last pkcs11.DecryptFinalResp
+		session.mustCall(msgDecryptFinal, &pkcs11.DecryptFinalReq{
+			LastPartSize: 1024,
+		}, &last)
+		result = append(result, last.LastPart...)
+		if !bytes.Equal(result, pt) {
+			t.Errorf("test %d: %s DecryptUpdate:\ngot:  %x\nwant: %x",
+				idx, test.mech, result, pt)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"fmt"
+)
+
+// PeerCred defines the credentials of the process connected to the
+// token's Unix socket.
+type PeerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+func (cred *PeerCred) String() string {
+	if cred == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("uid=%v gid=%v pid=%v", cred.UID, cred.GID, cred.PID)
+}
+
+// Equal tests if the credentials belong to the same process. The
+// unknown credentials are not equal to any credentials.
+func (cred *PeerCred) Equal(o *PeerCred) bool {
+	if cred == nil || o == nil {
+		return false
+	}
+	return cred.UID == o.UID && cred.GID == o.GID && cred.PID == o.PID
+}
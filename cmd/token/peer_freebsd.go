@@ -0,0 +1,54 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the credentials of the connection's peer
+// process. The function returns nil credentials if the connection is
+// not a Unix domain socket.
+func peerCredentials(conn net.Conn) (*PeerCred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var xucred *unix.Xucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		xucred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL,
+			unix.LOCAL_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	if xucred.Ngroups < 1 {
+		return nil, unix.EINVAL
+	}
+	// The peer's PID is in the cr_pid member of the union that ends
+	// the struct xucred. The unix.Xucred does not export the union.
+	pid := *(*int32)(unsafe.Add(unsafe.Pointer(xucred),
+		unsafe.Sizeof(*xucred)-unsafe.Sizeof(uintptr(0))))
+
+	return &PeerCred{
+		UID: xucred.Uid,
+		GID: xucred.Groups[0],
+		PID: pid,
+	}, nil
+}
@@ -0,0 +1,23 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"net"
+)
+
+// peerCredentials returns the credentials of the connection's peer
+// process. The peer credentials are not supported on this platform
+// and the function always returns nil credentials. The connections
+// with unknown credentials can't attach to sessions or wait for slot
+// events.
+func peerCredentials(conn net.Conn) (*PeerCred, error) {
+	return nil, nil
+}
@@ -10,12 +10,12 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/des"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"log"
@@ -23,10 +23,12 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/markkurossi/crypto/pkcs7"
 	"github.com/markkurossi/go-libs/uuid"
 	"github.com/markkurossi/pkcs11-provider/pkcs11"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 var (
@@ -37,19 +39,33 @@ var (
 		Minor: 1,
 	}
 	manufacturerID = []pkcs11.UTF8Char("mtr@iki.fi")
-	defaultState   = pkcs11.CksRWPublicSession
 )
 
 // Mechanimsm parameters.
 const (
-	RSAMinKeySize = 512
-	RSAMaxKeySize = 8192
-	ECMinKeySize  = 224
-	ECMaxKeySize  = 521
-	AESMinKeySize = 16
-	AESMaxKeySize = 32
+	RSAMinKeySize   = 512
+	RSAMaxKeySize   = 8192
+	ECMinKeySize    = 224
+	ECMaxKeySize    = 521
+	AESMinKeySize   = 16
+	AESMaxKeySize   = 32
+	XTSMinKeySize   = 2 * AESMinKeySize
+	XTSMaxKeySize   = 2 * AESMaxKeySize
+	DES3KeySize     = pkcs11.DES3KeySize
+	HKDFMinKeySize  = 16
+	HKDFMaxKeySize  = 64
+	ChaCha20KeySize = chacha20poly1305.KeySize
+	EdDSAKeySize    = 255
 )
 
+// PBKDF2MaxIterations limits the PBKDF2 iteration count so that a
+// single key generation can't block the token for a long time.
+const PBKDF2MaxIterations = 1000000
+
+// MaxDerivedKeyLen limits the length of the derived keying material
+// so that a single key derivation can't exhaust the token's memory.
+const MaxDerivedKeyLen = 1024
+
 var (
 	/* {1 3 132 0 33} */
 	secp224r1 = []byte{
@@ -94,6 +110,21 @@ var mechanisms = map[pkcs11.MechanismType]pkcs11.MechanismInfo{
 		MaxKeySize: RSAMaxKeySize,
 		Flags:      pkcs11.CkfGenerateKeyPair,
 	},
+	pkcs11.CkmRSAPKCS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags:      pkcs11.CkfWrap | pkcs11.CkfUnwrap,
+	},
+	pkcs11.CkmRSAPKCSOAEP: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags:      pkcs11.CkfWrap | pkcs11.CkfUnwrap,
+	},
+	pkcs11.CkmRSAAESKeyWrap: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags:      pkcs11.CkfWrap | pkcs11.CkfUnwrap,
+	},
 	pkcs11.CkmSHA224RSAPKCS: {
 		MinKeySize: RSAMinKeySize,
 		MaxKeySize: RSAMaxKeySize,
@@ -126,6 +157,93 @@ var mechanisms = map[pkcs11.MechanismType]pkcs11.MechanismInfo{
 			pkcs11.CkfEncrypt | pkcs11.CkfDecrypt | pkcs11.CkfSign |
 			pkcs11.CkfVerify,
 	},
+	pkcs11.CkmSHA1RSAPKCS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3224RSAPKCS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3256RSAPKCS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3384RSAPKCS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3512RSAPKCS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA1RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA224RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA256RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA384RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA512RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3224RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3256RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3384RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3512RSAPKCSPSS: {
+		MinKeySize: RSAMinKeySize,
+		MaxKeySize: RSAMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA1: {
+		Flags: pkcs11.CkfDigest,
+	},
 	pkcs11.CkmSHA224: {
 		Flags: pkcs11.CkfDigest,
 	},
@@ -138,11 +256,142 @@ var mechanisms = map[pkcs11.MechanismType]pkcs11.MechanismInfo{
 	pkcs11.CkmSHA512: {
 		Flags: pkcs11.CkfDigest,
 	},
+	pkcs11.CkmSHA512224: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmSHA512256: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmSHA3224: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmSHA3256: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmSHA3384: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmSHA3512: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmBlake2b160: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmBlake2b256: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmBlake2b384: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmBlake2b512: {
+		Flags: pkcs11.CkfDigest,
+	},
+	pkcs11.CkmSHA1HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA224HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA256HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA384HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA512HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA512224HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA512256HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3224HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3256HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3384HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmSHA3512HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmBlake2b160HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmBlake2b256HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmBlake2b384HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmBlake2b512HMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
 	pkcs11.CkmECKeyPairGen: {
 		MinKeySize: ECMinKeySize,
 		MaxKeySize: ECMaxKeySize,
 		Flags:      pkcs11.CkfGenerateKeyPair,
 	},
+	pkcs11.CkmECDSASHA1: {
+		MinKeySize: ECMinKeySize,
+		MaxKeySize: ECMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmECDSASHA3224: {
+		MinKeySize: ECMinKeySize,
+		MaxKeySize: ECMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmECDSASHA3256: {
+		MinKeySize: ECMinKeySize,
+		MaxKeySize: ECMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmECDSASHA3384: {
+		MinKeySize: ECMinKeySize,
+		MaxKeySize: ECMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmECDSASHA3512: {
+		MinKeySize: ECMinKeySize,
+		MaxKeySize: ECMaxKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
+	pkcs11.CkmECEdwardsKeyPairGen: {
+		MinKeySize: EdDSAKeySize,
+		MaxKeySize: EdDSAKeySize,
+		Flags:      pkcs11.CkfGenerateKeyPair,
+	},
+	pkcs11.CkmEDDSA: {
+		MinKeySize: EdDSAKeySize,
+		MaxKeySize: EdDSAKeySize,
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify,
+	},
 	pkcs11.CkmAESKeyGen: {
 		MinKeySize: AESMinKeySize,
 		MaxKeySize: AESMaxKeySize,
@@ -156,7 +405,9 @@ var mechanisms = map[pkcs11.MechanismType]pkcs11.MechanismInfo{
 	pkcs11.CkmAESGCM: {
 		MinKeySize: AESMinKeySize,
 		MaxKeySize: AESMaxKeySize,
-		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt | pkcs11.CkfGenerate,
+		Flags: pkcs11.CkfEncrypt | pkcs11.CkfDecrypt | pkcs11.CkfGenerate |
+			pkcs11.CkfWrap | pkcs11.CkfUnwrap | pkcs11.CkfMessageEncrypt |
+			pkcs11.CkfMessageDecrypt,
 	},
 	pkcs11.CkmAESCTR: {
 		MinKeySize: AESMinKeySize,
@@ -168,6 +419,148 @@ var mechanisms = map[pkcs11.MechanismType]pkcs11.MechanismInfo{
 		MaxKeySize: AESMaxKeySize,
 		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt | pkcs11.CkfGenerate,
 	},
+	pkcs11.CkmAESOFB: {
+		MinKeySize: AESMinKeySize,
+		MaxKeySize: AESMaxKeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmAESCFB8: {
+		MinKeySize: AESMinKeySize,
+		MaxKeySize: AESMaxKeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmAESCFB64: {
+		MinKeySize: AESMinKeySize,
+		MaxKeySize: AESMaxKeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmAESCFB128: {
+		MinKeySize: AESMinKeySize,
+		MaxKeySize: AESMaxKeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmAESCTS: {
+		MinKeySize: AESMinKeySize,
+		MaxKeySize: AESMaxKeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmAESXTSKeyGen: {
+		MinKeySize: XTSMinKeySize,
+		MaxKeySize: XTSMaxKeySize,
+		Flags:      pkcs11.CkfGenerate,
+	},
+	pkcs11.CkmAESXTS: {
+		MinKeySize: XTSMinKeySize,
+		MaxKeySize: XTSMaxKeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmDES3KeyGen: {
+		MinKeySize: DES3KeySize,
+		MaxKeySize: DES3KeySize,
+		Flags:      pkcs11.CkfGenerate,
+	},
+	pkcs11.CkmDES3ECB: {
+		MinKeySize: DES3KeySize,
+		MaxKeySize: DES3KeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmDES3CBC: {
+		MinKeySize: DES3KeySize,
+		MaxKeySize: DES3KeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmDES3CBCPad: {
+		MinKeySize: DES3KeySize,
+		MaxKeySize: DES3KeySize,
+		Flags:      pkcs11.CkfEncrypt | pkcs11.CkfDecrypt,
+	},
+	pkcs11.CkmChaCha20KeyGen: {
+		MinKeySize: ChaCha20KeySize,
+		MaxKeySize: ChaCha20KeySize,
+		Flags:      pkcs11.CkfGenerate,
+	},
+	pkcs11.CkmChaCha20Poly1305: {
+		MinKeySize: ChaCha20KeySize,
+		MaxKeySize: ChaCha20KeySize,
+		Flags:      pkcs11.CkfMessageEncrypt | pkcs11.CkfMessageDecrypt,
+	},
+	pkcs11.CkmHKDFKeyGen: {
+		MinKeySize: HKDFMinKeySize,
+		MaxKeySize: HKDFMaxKeySize,
+		Flags:      pkcs11.CkfGenerate,
+	},
+	pkcs11.CkmPKCS5PBKD2: {
+		Flags: pkcs11.CkfGenerate,
+	},
+	pkcs11.CkmHKDFDerive: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmHKDFData: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmConcatenateBaseAndKey: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmConcatenateBaseAndData: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmConcatenateDataAndBase: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmXORBaseAndData: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmExtractKeyFromKey: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmTLS12MasterKeyDerive: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmTLS12MasterKeyDeriveDH: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmTLS12KeyAndMACDerive: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmTLS12KDF: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmTLSMAC: {
+		Flags: pkcs11.CkfSign | pkcs11.CkfVerify,
+	},
+	pkcs11.CkmSP800108CounterKDF: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmSP800108FeedbackKDF: {
+		Flags: pkcs11.CkfDerive,
+	},
+	pkcs11.CkmSP800108DoublePipelineKDF: {
+		Flags: pkcs11.CkfDerive,
+	},
+}
+
+// isLegacy tests if the mechanism is a legacy mechanism. The legacy
+// mechanisms are disabled unless enabled by the token policy.
+func isLegacy(mech pkcs11.MechanismType) bool {
+	switch mech {
+	case pkcs11.CkmDES3KeyGen, pkcs11.CkmDES3ECB, pkcs11.CkmDES3CBC,
+		pkcs11.CkmDES3CBCPad:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// lookupMechanism returns the mechanism information for the
+// mechanism. Legacy mechanisms are not available if they are
+// disabled by the token policy.
+func lookupMechanism(mech pkcs11.MechanismType) (pkcs11.MechanismInfo, bool) {
+	if isLegacy(mech) && !legacyCiphers {
+		return pkcs11.MechanismInfo{}, false
+	}
+	info, ok := mechanisms[mech]
+	return info, ok
 }
 
 func goVersion() pkcs11.Version {
@@ -193,18 +586,47 @@ type Provider struct {
 	tokenStorage pkcs11.Storage
 	storage      pkcs11.Storage
 	session      *Session
+	peer         *PeerCred
+	rule         *ACLRule
 	m            sync.Mutex
 
-	// Just a single slot.
-	loggedIn   bool
-	loggedUser pkcs11.UserType
-	state      pkcs11.State
+	// Sessions opened by the application.
+	sessions map[pkcs11.SessionHandle]*Session
+
+	// Slot events not yet reported with C_WaitForSlotEvent. The
+	// slotEventCh wakes up the waiting call and done is closed when
+	// the application disconnects.
+	slotEvents  []pkcs11.SlotID
+	slotEventCh chan struct{}
+	done        chan struct{}
+
+	// The login states of the slot tokens.
+	logins map[pkcs11.SlotID]*loginState
+}
+
+// loginState holds the application's login state with a slot's
+// token.
+type loginState struct {
+	User     pkcs11.UserType
+	Name     string
+	LastAuth time.Time
+}
+
+// sessionLogin returns the login state of the session's slot token or
+// nil if the user is not logged in to the token. The parent provider
+// must be locked.
+func (p *Provider) sessionLogin() *loginState {
+	if p.session == nil {
+		return nil
+	}
+	return p.parent.logins[p.session.SlotID]
 }
 
 // Initialize implements pkcs11.Provider.Initialize().
 func (p *Provider) Initialize() (*pkcs11.InitializeResp, error) {
-	p.loggedIn = false
-	p.state = defaultState
+	p.Lock()
+	p.logins = make(map[pkcs11.SlotID]*loginState)
+	p.Unlock()
 
 	return &pkcs11.InitializeResp{
 		ProviderID: p.id,
@@ -241,24 +663,46 @@ func (p *Provider) GetInfo() (*pkcs11.GetInfoResp, error) {
 
 // GetSlotList implements the Provider.GetSlotList().
 func (p *Provider) GetSlotList(req *pkcs11.GetSlotListReq) (*pkcs11.GetSlotListResp, error) {
+	var result []pkcs11.SlotID
+	for _, slot := range slots {
+		if !p.rule.SlotVisible(slot.ID) {
+			continue
+		}
+		if bool(req.TokenPresent) && !slot.TokenPresent() {
+			continue
+		}
+		result = append(result, slot.ID)
+	}
 	return &pkcs11.GetSlotListResp{
-		SlotListLen: 1,
-		SlotList:    []pkcs11.SlotID{0},
+		SlotListLen: len(result),
+		SlotList:    result,
 	}, nil
 }
 
 // GetSlotInfo implements the Provider.GetSlotInfo().
 func (p *Provider) GetSlotInfo(req *pkcs11.GetSlotInfoReq) (*pkcs11.GetSlotInfoResp, error) {
-	if req.SlotID != 0 {
-		return nil, pkcs11.ErrSlotIDInvalid
+	err := p.checkSlot(req.SlotID)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := LookupSlot(req.SlotID)
+	if err != nil {
+		return nil, err
 	}
 
 	info := pkcs11.SlotInfo{
-		Flags:           pkcs11.CkfTokenPresent,
 		HardwareVersion: goVersion(),
 		FirmwareVersion: fwVersion,
 	}
-	copy(info.SlotDescription[:], []pkcs11.UTF8Char("Go crypto library"))
+	if slot.TokenPresent() {
+		info.Flags |= pkcs11.CkfTokenPresent
+	}
+	if slot.Removable {
+		info.Flags |= pkcs11.CkfRemovableDevice
+		copy(info.SlotDescription[:], []pkcs11.UTF8Char("Virtual slot"))
+	} else {
+		copy(info.SlotDescription[:], []pkcs11.UTF8Char("Go crypto library"))
+	}
 	copy(info.ManufacturerID[:], manufacturerID)
 
 	return &pkcs11.GetSlotInfoResp{
@@ -268,14 +712,25 @@ func (p *Provider) GetSlotInfo(req *pkcs11.GetSlotInfoReq) (*pkcs11.GetSlotInfoR
 
 // GetTokenInfo implements the Provider.GetTokenInfo().
 func (p *Provider) GetTokenInfo(req *pkcs11.GetTokenInfoReq) (*pkcs11.GetTokenInfoResp, error) {
-	if req.SlotID != 0 {
-		return nil, pkcs11.ErrSlotIDInvalid
+	_, err := p.checkToken(req.SlotID)
+	if err != nil {
+		return nil, err
+	}
+
+	count, rwCount := SessionCounts(req.SlotID)
+	maxRW := maxRWSessions
+	if maxRW == 0 || (maxSessions > 0 && maxSessions < maxRW) {
+		maxRW = maxSessions
 	}
 
 	info := pkcs11.TokenInfo{
-		Flags:           pkcs11.CkfRNG | pkcs11.CkfClockOnToken,
-		HardwareVersion: goVersion(),
-		FirmwareVersion: fwVersion,
+		Flags:             pkcs11.CkfRNG | pkcs11.CkfClockOnToken | users.Flags(),
+		MaxSessionCount:   pkcs11.Ulong(maxSessions),
+		SessionCount:      pkcs11.Ulong(count),
+		MaxRwSessionCount: pkcs11.Ulong(maxRW),
+		RwSessionCount:    pkcs11.Ulong(rwCount),
+		HardwareVersion:   goVersion(),
+		FirmwareVersion:   fwVersion,
 	}
 	copy(info.ManufacturerID[:], []pkcs11.UTF8Char("www.golang.org"))
 	copy(info.Model[:], []pkcs11.UTF8Char("Software"))
@@ -289,7 +744,17 @@ func (p *Provider) GetTokenInfo(req *pkcs11.GetTokenInfoReq) (*pkcs11.GetTokenIn
 func (p *Provider) GetMechanismList(req *pkcs11.GetMechanismListReq) (*pkcs11.GetMechanismListResp, error) {
 	var result []pkcs11.MechanismType
 
+	_, err := p.checkToken(req.SlotID)
+	if err != nil {
+		return nil, err
+	}
 	for k := range mechanisms {
+		if isLegacy(k) && !legacyCiphers {
+			continue
+		}
+		if !p.rule.MechanismAllowed(k) {
+			continue
+		}
 		result = append(result, k)
 	}
 
@@ -301,10 +766,15 @@ func (p *Provider) GetMechanismList(req *pkcs11.GetMechanismListReq) (*pkcs11.Ge
 
 // GetMechanismInfo implements the Provider.GetMechanismInfo().
 func (p *Provider) GetMechanismInfo(req *pkcs11.GetMechanismInfoReq) (*pkcs11.GetMechanismInfoResp, error) {
-	if req.SlotID != 0 {
-		return nil, pkcs11.ErrSlotIDInvalid
+	_, err := p.checkToken(req.SlotID)
+	if err != nil {
+		return nil, err
+	}
+	err = p.checkMechanism(req.Type)
+	if err != nil {
+		return nil, err
 	}
-	info, ok := mechanisms[req.Type]
+	info, ok := lookupMechanism(req.Type)
 	if !ok {
 		return nil, pkcs11.ErrMechanismInvalid
 	}
@@ -315,38 +785,173 @@ func (p *Provider) GetMechanismInfo(req *pkcs11.GetMechanismInfoReq) (*pkcs11.Ge
 
 // OpenSession implements the Provider.OpenSession().
 func (p *Provider) OpenSession(req *pkcs11.OpenSessionReq) (*pkcs11.OpenSessionResp, error) {
-	if req.SlotID != 0 {
-		return nil, pkcs11.ErrSlotIDInvalid
+	slot, err := p.checkToken(req.SlotID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Flags&pkcs11.CkfSerialSession == 0 {
+		return nil, pkcs11.ErrSessionParallelNotSupported
 	}
-	session, err := NewSession()
+	p.Lock()
+	defer p.Unlock()
+
+	login := p.logins[req.SlotID]
+	if req.Flags&pkcs11.CkfRWSession == 0 && login != nil &&
+		login.User == pkcs11.CkuSO {
+		return nil, pkcs11.ErrSessionReadWriteSoExists
+	}
+	if maxAppSessions > 0 && len(p.sessions) >= maxAppSessions {
+		return nil, pkcs11.ErrSessionCount
+	}
+	session, err := NewSession(p, slot, req.Flags)
 	if err != nil {
 		return nil, err
 	}
-	session.Flags = req.Flags
+	p.sessions[session.ID] = session
 
 	return &pkcs11.OpenSessionResp{
 		Session: session.ID,
 	}, nil
 }
 
+// closeSession closes the application's session. The user is logged
+// out from the token when the application's last session with the
+// token is closed.
+func (p *Provider) closeSession(session *Session) error {
+	err := CloseSession(session.ID)
+	if err != nil {
+		return err
+	}
+
+	// Delete session objects created by this session. The objects
+	// created after this are deleted by storeObject.
+	session.objectsM.Lock()
+	session.Closed = true
+	session.objectsM.Unlock()
+
+	p.deleteSessionObjects(session)
+
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.sessions, session.ID)
+	for _, s := range p.sessions {
+		if s.SlotID == session.SlotID {
+			return nil
+		}
+	}
+	delete(p.logins, session.SlotID)
+
+	return nil
+}
+
+// deleteSessionObjects deletes the session objects created by the
+// application's session.
+func (p *Provider) deleteSessionObjects(session *Session) {
+	session.objectsM.Lock()
+	objects := session.Objects
+	session.Objects = make(map[pkcs11.ObjectHandle]pkcs11.Storage)
+	session.objectsM.Unlock()
+
+	for handle, storage := range objects {
+		if storage == p.storage {
+			storage.Delete(handle)
+		}
+	}
+}
+
+// ejectToken logs the user out from the ejected token and deletes the
+// session objects of the application's sessions with the token.
+func (p *Provider) ejectToken(id pkcs11.SlotID) {
+	var removed []*Session
+
+	p.Lock()
+	delete(p.logins, id)
+	for _, session := range p.sessions {
+		if session.SlotID == id {
+			removed = append(removed, session)
+		}
+	}
+	p.Unlock()
+
+	for _, session := range removed {
+		p.deleteSessionObjects(session)
+	}
+}
+
+// Disconnect releases the provider's resources when its IPC
+// connection is closed. The session of a session connection is
+// closed. For an application connection, all sessions of the
+// application are closed, which deletes the session objects and logs
+// out the user.
+func (p *Provider) Disconnect() {
+	if p.session != nil && p.parent != nil {
+		err := p.parent.closeSession(p.session)
+		if err != nil {
+			Infof("Disconnect: session %08x: %s", p.session.ID, err)
+		}
+		p.session = nil
+	}
+
+	p.Lock()
+	var sessions []*Session
+	for _, session := range p.sessions {
+		sessions = append(sessions, session)
+	}
+	p.Unlock()
+
+	for _, session := range sessions {
+		err := p.closeSession(session)
+		if err != nil {
+			Infof("Disconnect: session %08x: %s", session.ID, err)
+		}
+	}
+
+	p.Lock()
+	p.sessions = make(map[pkcs11.SessionHandle]*Session)
+	p.logins = make(map[pkcs11.SlotID]*loginState)
+	p.Unlock()
+
+	close(p.done)
+	RemoveProvider(p.id)
+}
+
 // CloseSession implements the Provider.CloseSession().
 func (p *Provider) CloseSession() error {
 	if p.session == nil {
 		return pkcs11.ErrSessionHandleInvalid
 	}
-	err := CloseSession(p.session.ID)
+	err := p.parent.closeSession(p.session)
 	if err != nil {
 		return err
 	}
+	p.session = nil
 
-	// Delete session objects created by this session.
-	for handle, storage := range p.session.Objects {
-		if storage == p.parent.storage {
-			storage.Delete(handle)
+	return nil
+}
+
+// CloseAllSessions implements the Provider.CloseAllSessions().
+func (p *Provider) CloseAllSessions(req *pkcs11.CloseAllSessionsReq) error {
+	err := p.checkSlot(req.SlotID)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	var sessions []*Session
+	for _, session := range p.sessions {
+		if session.SlotID == req.SlotID {
+			sessions = append(sessions, session)
 		}
 	}
+	p.Unlock()
 
-	p.session = nil
+	for _, session := range sessions {
+		err := p.closeSession(session)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -361,29 +966,328 @@ func (p *Provider) GetSessionInfo() (*pkcs11.GetSessionInfoResp, error) {
 
 	return &pkcs11.GetSessionInfoResp{
 		Info: pkcs11.SessionInfo{
-			SlotID: pkcs11.Ulong(p.session.ID),
-			State:  p.parent.state,
+			SlotID: pkcs11.Ulong(p.session.SlotID),
+			State:  p.parent.sessionState(p.session),
 			Flags:  pkcs11.Ulong(p.session.Flags),
 		},
 	}, nil
 }
 
-// ImplOpenSession implements the Provider.ImplOpenSession().
+// sessionState returns the state of the application's session. The
+// state is derived from the application's login state with the
+// session's token and the session's read/write flag. The provider
+// must be locked.
+func (p *Provider) sessionState(session *Session) pkcs11.State {
+	rw := session.Flags&pkcs11.CkfRWSession != 0
+	login := p.logins[session.SlotID]
+
+	switch {
+	case login != nil && login.User == pkcs11.CkuSO:
+		return pkcs11.CksRWSOFunctions
+
+	case login != nil && rw:
+		return pkcs11.CksRWUserFunctions
+
+	case login != nil:
+		return pkcs11.CksROUserFunctions
+
+	case rw:
+		return pkcs11.CksRWPublicSession
+
+	default:
+		return pkcs11.CksROPublicSession
+	}
+}
+
+// objectStorage returns the storage for a new token or session
+// object. Token objects can't be created in read-only sessions.
+func (p *Provider) objectStorage(token bool) (pkcs11.Storage, error) {
+	if !token {
+		return p.parent.storage, nil
+	}
+	if p.session.Flags&pkcs11.CkfRWSession == 0 {
+		return nil, pkcs11.ErrSessionReadOnly
+	}
+	return p.tokenStorage, nil
+}
+
+// SessionCancel implements the Provider.SessionCancel().
+func (p *Provider) SessionCancel(req *pkcs11.SessionCancelReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	session := p.session
+
+	if req.Flags&pkcs11.CkfMessageEncrypt != 0 {
+		session.MsgEncrypt = nil
+	}
+	if req.Flags&pkcs11.CkfMessageDecrypt != 0 {
+		session.MsgDecrypt = nil
+	}
+	if req.Flags&pkcs11.CkfMessageSign != 0 {
+		session.MsgSign = nil
+	}
+	if req.Flags&pkcs11.CkfMessageVerify != 0 {
+		session.MsgVerify = nil
+	}
+	if req.Flags&pkcs11.CkfFindObjects != 0 {
+		session.FindObjects = nil
+	}
+	if req.Flags&pkcs11.CkfEncrypt != 0 {
+		session.Encrypt = nil
+	}
+	if req.Flags&pkcs11.CkfDecrypt != 0 {
+		session.Decrypt = nil
+	}
+	if req.Flags&pkcs11.CkfDigest != 0 {
+		session.Digest = nil
+	}
+	if req.Flags&pkcs11.CkfSign != 0 {
+		session.Sign = nil
+	}
+	if req.Flags&pkcs11.CkfVerify != 0 {
+		session.Verify = nil
+	}
+
+	return nil
+}
+
+// GetOperationState implements the Provider.GetOperationState().
+func (p *Provider) GetOperationState(req *pkcs11.GetOperationStateReq) (*pkcs11.GetOperationStateResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	session := p.session
+	if session.MsgEncrypt != nil || session.MsgDecrypt != nil ||
+		session.MsgSign != nil || session.MsgVerify != nil {
+		return nil, pkcs11.ErrStateUnsaveable
+	}
+
+	var state operationState
+	var active bool
+	var err error
+
+	if session.Digest != nil {
+		active = true
+		state.Digest.Active = true
+		state.Digest.Mechanism = session.DigestMech
+		state.Digest.State, err = marshalHash(session.Digest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if session.Encrypt != nil {
+		active = true
+		state.Encrypt, err = session.Encrypt.SaveState(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if session.Decrypt != nil {
+		active = true
+		state.Decrypt, err = session.Decrypt.SaveState(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if session.Sign != nil {
+		active = true
+		state.Sign, err = session.Sign.SaveState()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if session.Verify != nil {
+		active = true
+		state.Verify, err = session.Verify.SaveState()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !active {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+
+	sealed, err := sealOperationState(p.session.SlotID, &state)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pkcs11.GetOperationStateResp{
+		OperationStateLen: len(sealed),
+	}
+	if req.OperationStateSize < uint32(len(sealed)) {
+		// Querying output buffer size.
+		return resp, nil
+	}
+	resp.OperationState = sealed
+
+	return resp, nil
+}
+
+// SetOperationState implements the Provider.SetOperationState().
+func (p *Provider) SetOperationState(req *pkcs11.SetOperationStateReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	state, err := openOperationState(p.session.SlotID, req.OperationState)
+	if err != nil {
+		return err
+	}
+
+	// Check the keys.
+	if state.Encrypt.Active || state.Decrypt.Active {
+		if req.EncryptionKey == 0 {
+			return pkcs11.ErrKeyNeeded
+		}
+	} else if req.EncryptionKey != 0 {
+		return pkcs11.ErrKeyNotNeeded
+	}
+	if state.Sign.Active || state.Verify.Active {
+		if req.AuthenticationKey == 0 {
+			return pkcs11.ErrKeyNeeded
+		}
+	} else if req.AuthenticationKey != 0 {
+		return pkcs11.ErrKeyNotNeeded
+	}
+
+	// Restore the operations. The current operations are kept if
+	// the state can't be restored.
+	session := p.session
+	digest, digestMech := session.Digest, session.DigestMech
+	encrypt, decrypt := session.Encrypt, session.Decrypt
+	sign, verify := session.Sign, session.Verify
+
+	session.Digest = nil
+	session.Encrypt = nil
+	session.Decrypt = nil
+	session.Sign = nil
+	session.Verify = nil
+
+	err = p.restoreOperationState(state, req)
+	if err != nil {
+		session.Digest, session.DigestMech = digest, digestMech
+		session.Encrypt, session.Decrypt = encrypt, decrypt
+		session.Sign, session.Verify = sign, verify
+		return err
+	}
+	return nil
+}
+
+func (p *Provider) restoreOperationState(state *operationState,
+	req *pkcs11.SetOperationStateReq) error {
+
+	if state.Digest.Active {
+		digest, ok := digests[state.Digest.Mechanism]
+		if !ok {
+			return pkcs11.ErrSavedStateInvalid
+		}
+		h := digest.New()
+		err := unmarshalHash(h, state.Digest.State)
+		if err != nil {
+			return err
+		}
+		p.session.Digest = h
+		p.session.DigestMech = state.Digest.Mechanism
+	}
+	if state.Encrypt.Active {
+		_, err := p.EncryptInit(&pkcs11.EncryptInitReq{
+			Mechanism: state.Encrypt.Mechanism,
+			Key:       req.EncryptionKey,
+		})
+		if err != nil {
+			return err
+		}
+		err = p.session.Encrypt.RestoreState(&state.Encrypt)
+		if err != nil {
+			return err
+		}
+	}
+	if state.Decrypt.Active {
+		err := p.DecryptInit(&pkcs11.DecryptInitReq{
+			Mechanism: state.Decrypt.Mechanism,
+			Key:       req.EncryptionKey,
+		})
+		if err != nil {
+			return err
+		}
+		err = p.session.Decrypt.RestoreState(&state.Decrypt)
+		if err != nil {
+			return err
+		}
+	}
+	if state.Sign.Active {
+		err := p.SignInit(&pkcs11.SignInitReq{
+			Mechanism: state.Sign.Mechanism,
+			Key:       req.AuthenticationKey,
+		})
+		if err != nil {
+			return err
+		}
+		err = p.session.Sign.RestoreState(&state.Sign)
+		if err != nil {
+			return err
+		}
+	}
+	if state.Verify.Active {
+		err := p.VerifyInit(&pkcs11.VerifyInitReq{
+			Mechanism: state.Verify.Mechanism,
+			Key:       req.AuthenticationKey,
+		})
+		if err != nil {
+			return err
+		}
+		err = p.session.Verify.RestoreState(&state.Verify)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImplOpenSession implements the Provider.ImplOpenSession().
 func (p *Provider) ImplOpenSession(req *pkcs11.ImplOpenSessionReq) error {
 	parent, err := LookupProvider(req.ProviderID)
 	if err != nil {
 		return err
 	}
-	p.parent = parent
-
 	session, err := LookupSession(req.Session)
 	if err != nil {
 		return err
 	}
+	if session.Owner != parent {
+		Errorf("ImplOpenSession: session %08x not owned by provider %08x: %s",
+			session.ID, parent.id, p.peer)
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	if !p.peer.Equal(parent.peer) {
+		Errorf("ImplOpenSession: session %08x: peer %s, owner %s",
+			session.ID, p.peer, parent.peer)
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	slot, err := LookupSlot(session.SlotID)
+	if err != nil {
+		return err
+	}
+	p.parent = parent
 	p.session = session
+	p.tokenStorage = newACLStorage(slot.Storage, p.rule)
+
 	return nil
 }
 
+// validateSession clears the provider's session if the session has
+// been closed by another connection, for example, with
+// C_CloseAllSessions.
+func (p *Provider) validateSession() {
+	if p.session == nil {
+		return
+	}
+	_, err := LookupSession(p.session.ID)
+	if err != nil {
+		p.session = nil
+	}
+}
+
 func mask(val string) string {
 	var result string
 
@@ -398,42 +1302,126 @@ func mask(val string) string {
 func (p *Provider) Login(req *pkcs11.LoginReq) error {
 	log.Printf("Login: UserType=%v, Pin=%v",
 		req.UserType, mask(string(req.Pin)))
+	return p.login(req.UserType, req.Pin, "")
+}
+
+// LoginUser implements the Provider.LoginUser().
+func (p *Provider) LoginUser(req *pkcs11.LoginUserReq) error {
+	name := string(utf8Bytes(req.Username))
+	log.Printf("LoginUser: UserType=%v, Pin=%v, Username=%v",
+		req.UserType, mask(string(req.Pin)), name)
+
+	// The username is ignored for the SO.
+	if req.UserType == pkcs11.CkuSO {
+		name = ""
+	}
+	return p.login(req.UserType, req.Pin, name)
+}
+
+func (p *Provider) login(userType pkcs11.UserType, pin []pkcs11.UTF8Char,
+	name string) error {
+
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
 	p.parent.Lock()
 	defer p.parent.Unlock()
 
-	if p.parent.loggedIn {
-		if p.parent.loggedUser == req.UserType {
+	switch userType {
+	case pkcs11.CkuSO, pkcs11.CkuUser:
+
+	case pkcs11.CkuContextSpecific:
+		return p.contextLogin(pin)
+
+	default:
+		return pkcs11.ErrUserTypeInvalid
+	}
+	if login := p.sessionLogin(); login != nil {
+		if login.User == userType && login.Name == name {
 			return pkcs11.ErrUserAlreadyLoggedIn
 		}
 		return pkcs11.ErrUserAnotherAlreadyLoggedIn
 	}
-	p.parent.loggedIn = true
-	p.parent.loggedUser = req.UserType
-
-	switch req.UserType {
-	case pkcs11.CkuSO:
-		p.parent.state = pkcs11.CksRWSOFunctions
+	if userType == pkcs11.CkuSO {
+		for _, session := range p.parent.sessions {
+			if session.SlotID == p.session.SlotID &&
+				session.Flags&pkcs11.CkfRWSession == 0 {
+				return pkcs11.ErrSessionReadOnlyExists
+			}
+		}
+	}
+	err := users.Verify(userType, name, pin)
+	if err != nil {
+		return err
+	}
+	p.parent.logins[p.session.SlotID] = &loginState{
+		User:     userType,
+		Name:     name,
+		LastAuth: time.Now(),
+	}
 
-	case pkcs11.CkuUser:
-		p.parent.state = pkcs11.CksRWUserFunctions
+	return nil
+}
 
+// contextLogin authorizes the session's pending operation that uses a
+// CKA_ALWAYS_AUTHENTICATE key. The PIN is verified against the
+// logged-in user and the authorization is consumed by one
+// operation. The pending operations are authorized in the order:
+// sign, decrypt, message sign, message decrypt, and unwrap. The
+// parent provider must be locked.
+func (p *Provider) contextLogin(pin []pkcs11.UTF8Char) error {
+	login := p.sessionLogin()
+	if login == nil {
+		return pkcs11.ErrUserNotLoggedIn
+	}
+	s := p.session
+
+	var pending *bool
+	switch {
+	case s.Sign != nil && s.SignAuth:
+		pending = &s.SignAuth
+	case s.Decrypt != nil && s.DecryptAuth:
+		pending = &s.DecryptAuth
+	case s.MsgSign != nil && s.MsgSignAuth:
+		pending = &s.MsgSignAuth
+	case s.MsgDecrypt != nil && s.MsgDecryptAuth:
+		pending = &s.MsgDecryptAuth
+	case s.UnwrapAuth:
+		pending = &s.UnwrapAuth
 	default:
-		p.parent.state = pkcs11.CksROPublicSession
+		return pkcs11.ErrOperationNotInitialized
 	}
-
+	err := users.Verify(login.User, login.Name, pin)
+	if err != nil {
+		return err
+	}
+	*pending = false
 	return nil
 }
 
+// alwaysAuthenticate tests if the key requires the context-specific
+// login for each use. The CKA_ALWAYS_AUTHENTICATE attribute applies
+// only to private keys.
+func alwaysAuthenticate(obj *pkcs11.Object) (bool, error) {
+	cls := pkcs11.ObjectClass(obj.Attrs.OptInt(pkcs11.CkaClass, -1))
+	if cls != pkcs11.CkoPrivateKey {
+		return false, nil
+	}
+	return obj.Attrs.OptBool(pkcs11.CkaAlwaysAuthenticate)
+}
+
 // Logout implements the Provider.Logout().
 func (p *Provider) Logout() error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
 	p.parent.Lock()
 	defer p.parent.Unlock()
 
-	if !p.parent.loggedIn {
+	if p.sessionLogin() == nil {
 		return pkcs11.ErrUserNotLoggedIn
 	}
-	p.parent.loggedIn = false
-	p.parent.state = defaultState
+	delete(p.parent.logins, p.session.SlotID)
 
 	return nil
 }
@@ -451,15 +1439,18 @@ func (p *Provider) CreateObject(req *pkcs11.CreateObjectReq) (*pkcs11.CreateObje
 			}
 		}
 	}
+	for _, attr := range req.Template {
+		if attr.Type == CkaIVCounter {
+			return nil, pkcs11.ErrAttributeReadOnly
+		}
+	}
 	token, err := req.Template.OptBool(pkcs11.CkaToken)
 	if err != nil {
 		return nil, err
 	}
-	var storage pkcs11.Storage
-	if token {
-		storage = p.tokenStorage
-	} else {
-		storage = p.parent.storage
+	storage, err := p.objectStorage(token)
+	if err != nil {
+		return nil, err
 	}
 
 	obj := &pkcs11.Object{
@@ -480,11 +1471,10 @@ func (p *Provider) CreateObject(req *pkcs11.CreateObjectReq) (*pkcs11.CreateObje
 	if err != nil {
 		return nil, err
 	}
-	handle, err := storage.Create(obj)
+	handle, err := p.storeObject(storage, obj)
 	if err != nil {
 		return nil, err
 	}
-	p.session.Objects[handle] = storage
 
 	return &pkcs11.CreateObjectResp{
 		Object: handle,
@@ -501,7 +1491,13 @@ func (p *Provider) CopyObject(req *pkcs11.CopyObjectReq) (*pkcs11.CopyObjectResp
 		Errorf("failed to read object %v: %s", req.Object, err)
 		return nil, err
 	}
+	// Only the owner can share the object with other users.
+	owner := p.ownsObject(obj)
+
 	attrs := obj.Attrs
+	if !owner {
+		attrs = withoutSharing(attrs)
+	}
 	for _, a := range req.Template {
 		if debug {
 			fmt.Printf("\u251c\u2500\u2500\u2500\u2500\u2574%s:\n", a.Type)
@@ -526,6 +1522,12 @@ func (p *Provider) CopyObject(req *pkcs11.CopyObjectReq) (*pkcs11.CopyObjectResp
 			if extractable {
 				attrs = attrs.SetBool(pkcs11.CkaNeverExtractable, false)
 			}
+		case CkaIVCounter:
+			return nil, pkcs11.ErrAttributeReadOnly
+		case CkaSharedWith:
+			if !owner {
+				return nil, pkcs11.ErrAttributeReadOnly
+			}
 		}
 		attrs = attrs.Set(a.Type, a.Value)
 	}
@@ -533,11 +1535,9 @@ func (p *Provider) CopyObject(req *pkcs11.CopyObjectReq) (*pkcs11.CopyObjectResp
 	if err != nil {
 		return nil, err
 	}
-	var storage pkcs11.Storage
-	if token {
-		storage = p.tokenStorage
-	} else {
-		storage = p.parent.storage
+	storage, err := p.objectStorage(token)
+	if err != nil {
+		return nil, err
 	}
 
 	// 4.4.1 The CKA_UNIQUE_ID attribute
@@ -553,16 +1553,16 @@ func (p *Provider) CopyObject(req *pkcs11.CopyObjectReq) (*pkcs11.CopyObjectResp
 	nobj := &pkcs11.Object{
 		Attrs:  attrs,
 		Native: obj.Native,
+		Owner:  obj.Owner,
 	}
 	err = nobj.Inflate()
 	if err != nil {
 		return nil, err
 	}
-	handle, err := storage.Create(nobj)
+	handle, err := p.storeObject(storage, nobj)
 	if err != nil {
 		return nil, err
 	}
-	p.session.Objects[handle] = storage
 
 	Infof("handle: %v", handle)
 	req.Template.Print("\u2502 ")
@@ -574,7 +1574,17 @@ func (p *Provider) CopyObject(req *pkcs11.CopyObjectReq) (*pkcs11.CopyObjectResp
 
 // DestroyObject implements the Provider.DestroyObject().
 func (p *Provider) DestroyObject(req *pkcs11.DestroyObjectReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	_, err := p.readObject(req.Object, pkcs11.ErrObjectHandleInvalid)
+	if err != nil {
+		return err
+	}
 	if req.Object&FlagToken != 0 {
+		if p.session.Flags&pkcs11.CkfRWSession == 0 {
+			return pkcs11.ErrSessionReadOnly
+		}
 		return p.tokenStorage.Delete(req.Object)
 	}
 	return p.parent.storage.Delete(req.Object)
@@ -583,23 +1593,27 @@ func (p *Provider) DestroyObject(req *pkcs11.DestroyObjectReq) error {
 func (p *Provider) readObject(h pkcs11.ObjectHandle, errNotFound error) (
 	*pkcs11.Object, error) {
 
-	var storage pkcs11.Storage
-	if h&FlagToken != 0 {
-		storage = p.tokenStorage
-	} else {
-		storage = p.parent.storage
-	}
-
-	obj, err := storage.Read(h)
+	obj, err := p.handleStorage(h).Read(h)
 	if err != nil {
 		if err == pkcs11.ErrObjectHandleInvalid {
 			return nil, errNotFound
 		}
 		return nil, err
 	}
+	if !p.objectVisible(obj) {
+		return nil, errNotFound
+	}
 	return obj, nil
 }
 
+// handleStorage returns the storage of the object handle.
+func (p *Provider) handleStorage(h pkcs11.ObjectHandle) pkcs11.Storage {
+	if h&FlagToken != 0 {
+		return p.tokenStorage
+	}
+	return p.parent.storage
+}
+
 // GetAttributeValue implements the Provider.GetAttributeValue().
 func (p *Provider) GetAttributeValue(req *pkcs11.GetAttributeValueReq) (*pkcs11.GetAttributeValueResp, error) {
 	obj, err := p.readObject(req.Object, pkcs11.ErrObjectHandleInvalid)
@@ -645,8 +1659,16 @@ func (p *Provider) FindObjectsInit(req *pkcs11.FindObjectsInitReq) error {
 		return err
 	}
 	Infof("token  : %v\n", tokenHandles)
+
+	var handles []pkcs11.ObjectHandle
+	for _, h := range append(sessionHandles, tokenHandles...) {
+		_, err := p.readObject(h, pkcs11.ErrObjectHandleInvalid)
+		if err == nil {
+			handles = append(handles, h)
+		}
+	}
 	p.session.FindObjects = &FindObjects{
-		Handles: append(sessionHandles, tokenHandles...),
+		Handles: handles,
 	}
 
 	return nil
@@ -686,11 +1708,104 @@ func (p *Provider) FindObjectsFinal() error {
 	return nil
 }
 
+// newGCM creates an AES-GCM operation from the key and the
+// CK_GCM_PARAMS mechanism parameters. For encryption, the IV can be
+// generated by the token. In that case, the generated IV is returned
+// as the second return value.
+func newGCM(mech *pkcs11.Mechanism, key []byte, encrypt bool) (
+	*EncDec, []byte, error) {
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, pkcs11.ErrKeySizeRange
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, nil, pkcs11.ErrDeviceError
+	}
+	var params pkcs11.GcmParams
+	err = pkcs11.Unmarshal(mech.Parameter, &params)
+	if err != nil {
+		Errorf("pkcs11.Unmarshal: %v", err)
+		return nil, nil, pkcs11.ErrMechanismParamInvalid
+	}
+	var generated []byte
+	if encrypt {
+		if len(params.Iv) != 12 {
+			Errorf("%s: invalid IV length %v, expected 12",
+				mech.Mechanism, len(params.Iv))
+			return nil, nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if params.IvBits == 0 {
+			// Token generated IV.
+			_, err = rand.Read(params.Iv)
+			if err != nil {
+				return nil, nil, pkcs11.ErrDeviceError
+			}
+			generated = params.Iv
+		}
+	} else if params.IvBits != 96 {
+		Errorf("%s: invalid IV length %v, expected 96",
+			mech.Mechanism, params.IvBits)
+		return nil, nil, pkcs11.ErrMechanismParamInvalid
+	}
+	if params.TagBits != 128 {
+		Errorf("invalid tag length %v, expected 128", params.TagBits)
+		return nil, nil, pkcs11.ErrMechanismParamInvalid
+	}
+
+	return &EncDec{
+		Mechanism: mech.Mechanism,
+		AEAD:      aead,
+		IV:        params.Iv,
+		AAD:       params.AAD,
+	}, generated, nil
+}
+
+// newBlockCipher creates the block cipher for the ECB and CBC
+// mechanisms. The legacy DES3 mechanisms are available only if they
+// are enabled by the token policy.
+func newBlockCipher(mech pkcs11.MechanismType, obj *pkcs11.Object,
+	key []byte) (cipher.Block, error) {
+
+	switch mech {
+	case pkcs11.CkmDES3ECB, pkcs11.CkmDES3CBC, pkcs11.CkmDES3CBCPad:
+		if _, ok := lookupMechanism(mech); !ok {
+			Errorf("%s: legacy ciphers disabled", mech)
+			return nil, pkcs11.ErrMechanismInvalid
+		}
+		keyType := obj.Attrs.OptInt(pkcs11.CkaKeyType, -1)
+		if pkcs11.KeyType(keyType) != pkcs11.CkkDES3 {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		b, err := des.NewTripleDESCipher(key)
+		if err != nil {
+			return nil, pkcs11.ErrKeySizeRange
+		}
+		return b, nil
+
+	default:
+		keyType := obj.Attrs.OptInt(pkcs11.CkaKeyType, -1)
+		if pkcs11.KeyType(keyType) != pkcs11.CkkAES {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, pkcs11.ErrKeySizeRange
+		}
+		return b, nil
+	}
+}
+
 // EncryptInit implements the Provider.EncryptInit().
 func (p *Provider) EncryptInit(req *pkcs11.EncryptInitReq) (*pkcs11.EncryptInitResp, error) {
 	if p.session == nil {
 		return nil, pkcs11.ErrSessionHandleInvalid
 	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return nil, err
+	}
 	if p.session.Encrypt != nil {
 		return nil, pkcs11.ErrOperationActive
 	}
@@ -707,31 +1822,37 @@ func (p *Provider) EncryptInit(req *pkcs11.EncryptInitReq) (*pkcs11.EncryptInitR
 	Infof("mechanism: %v", req.Mechanism.Mechanism)
 
 	resp := &pkcs11.EncryptInitResp{}
+	var encrypt *EncDec
 
 	switch req.Mechanism.Mechanism {
-	case pkcs11.CkmAESECB:
-		b, err := aes.NewCipher(key)
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
+		b, err := newBlockCipher(req.Mechanism.Mechanism, obj, key)
 		if err != nil {
-			return nil, pkcs11.ErrKeySizeRange
+			return nil, err
 		}
-		p.session.Encrypt = &EncDec{
+		encrypt = &EncDec{
 			Mechanism: req.Mechanism.Mechanism,
 			Block:     b,
 			Buffer:    make([]byte, 0, b.BlockSize()),
 		}
-		return resp, nil
 
-	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad:
-		b, err := aes.NewCipher(key)
+	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBC,
+		pkcs11.CkmDES3CBCPad:
+		b, err := newBlockCipher(req.Mechanism.Mechanism, obj, key)
 		if err != nil {
-			return nil, pkcs11.ErrKeySizeRange
+			return nil, err
 		}
-		p.session.Encrypt = &EncDec{
-			Mechanism: req.Mechanism.Mechanism,
-			BlockMode: cipher.NewCBCEncrypter(b, req.Mechanism.Parameter),
-			Buffer:    make([]byte, 0, b.BlockSize()),
+		if len(req.Mechanism.Parameter) != b.BlockSize() {
+			Errorf("%s: invalid IV length %v, expected %v",
+				req.Mechanism.Mechanism, len(req.Mechanism.Parameter),
+				b.BlockSize())
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		encrypt = &EncDec{
+			Mechanism: req.Mechanism.Mechanism,
+			BlockMode: newCBC(b, req.Mechanism.Parameter, false),
+			Buffer:    make([]byte, 0, b.BlockSize()),
 		}
-		return resp, nil
 
 	case pkcs11.CkmAESCTR:
 		var params pkcs11.AesCtrParams
@@ -751,59 +1872,37 @@ func (p *Provider) EncryptInit(req *pkcs11.EncryptInitReq) (*pkcs11.EncryptInitR
 			return nil, pkcs11.ErrMechanismParamInvalid
 		}
 
-		p.session.Encrypt = &EncDec{
+		encrypt = &EncDec{
 			Mechanism: req.Mechanism.Mechanism,
-			Stream:    cipher.NewCTR(b, params.Cb[:]),
+			Stream:    newCTR(b, params.Cb[:]),
 		}
-		return resp, nil
 
-	case pkcs11.CkmAESGCM:
-		b, err := aes.NewCipher(key)
-		if err != nil {
-			return nil, pkcs11.ErrKeySizeRange
-		}
-		aead, err := cipher.NewGCM(b)
-		if err != nil {
-			return nil, pkcs11.ErrDeviceError
-		}
-		var params pkcs11.GcmParams
-		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+	case pkcs11.CkmAESOFB, pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64,
+		pkcs11.CkmAESCFB128, pkcs11.CkmAESCTS, pkcs11.CkmAESXTS:
+		encrypt, err = newModeEncDec(req.Mechanism.Mechanism, obj, key,
+			req.Mechanism.Parameter, false)
 		if err != nil {
-			Errorf("pkcs11.Unmarshal: %v", err)
-			return nil, pkcs11.ErrMechanismParamInvalid
-		}
-		if len(params.Iv) != 12 {
-			Errorf("%s: invalid IV length %v, expected 12",
-				req.Mechanism.Mechanism, len(params.Iv))
-			return nil, pkcs11.ErrMechanismParamInvalid
-		}
-		if params.IvBits == 0 {
-			// Token generated IV.
-			_, err = rand.Read(params.Iv)
-			if err != nil {
-				return nil, pkcs11.ErrDeviceError
-			}
-			resp.Iv = params.Iv
-		}
-
-		if params.TagBits != 128 {
-			Errorf("invalid tag length %v, expected 128", params.TagBits)
-			return nil, pkcs11.ErrMechanismParamInvalid
+			return nil, err
 		}
 
-		p.session.Encrypt = &EncDec{
-			Mechanism: req.Mechanism.Mechanism,
-			AEAD:      aead,
-			IV:        params.Iv,
-			AAD:       params.AAD,
+	case pkcs11.CkmAESGCM:
+		var iv []byte
+		encrypt, iv, err = newGCM(&req.Mechanism, key, true)
+		if err != nil {
+			return nil, err
 		}
-		return resp, nil
+		resp.Iv = iv
 
 	default:
 		Errorf("unsupported mechanism %v, key=%x",
 			req.Mechanism.Mechanism, req.Key)
 		return nil, pkcs11.ErrMechanismInvalid
 	}
+	encrypt.Init = req.Mechanism
+	encrypt.Key = key
+	p.session.Encrypt = encrypt
+
+	return resp, nil
 }
 
 // Encrypt implements the Provider.Encrypt().
@@ -820,7 +1919,7 @@ func (p *Provider) Encrypt(req *pkcs11.EncryptReq) (*pkcs11.EncryptResp, error)
 	}
 	// Block size alignment is checked below based on the algorithm.
 	switch p.session.Encrypt.Mechanism {
-	case pkcs11.CkmAESECB:
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
 		blockSize := enc.Block.BlockSize()
 		if len(req.Data)%blockSize != 0 {
 			p.session.Encrypt = nil
@@ -835,7 +1934,7 @@ func (p *Provider) Encrypt(req *pkcs11.EncryptReq) (*pkcs11.EncryptResp, error)
 		}
 		resp.EncryptedData = req.Data
 
-	case pkcs11.CkmAESCBC:
+	case pkcs11.CkmAESCBC, pkcs11.CkmDES3CBC:
 		if len(req.Data)%enc.BlockMode.BlockSize() != 0 {
 			p.session.Encrypt = nil
 			return nil, pkcs11.ErrDataLenRange
@@ -847,7 +1946,7 @@ func (p *Provider) Encrypt(req *pkcs11.EncryptReq) (*pkcs11.EncryptResp, error)
 		p.session.Encrypt.BlockMode.CryptBlocks(req.Data, req.Data)
 		resp.EncryptedData = req.Data
 
-	case pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBCPad:
 		blockSize := p.session.Encrypt.BlockMode.BlockSize()
 
 		_, paddedLen := pkcs7.PadLen(len(req.Data), blockSize)
@@ -861,7 +1960,8 @@ func (p *Provider) Encrypt(req *pkcs11.EncryptReq) (*pkcs11.EncryptResp, error)
 		p.session.Encrypt.BlockMode.CryptBlocks(resp.EncryptedData,
 			resp.EncryptedData)
 
-	case pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		if req.EncryptedDataSize == 0 {
 			// Querying output buffer size.
 			return resp, nil
@@ -869,6 +1969,21 @@ func (p *Provider) Encrypt(req *pkcs11.EncryptReq) (*pkcs11.EncryptResp, error)
 		p.session.Encrypt.Stream.XORKeyStream(req.Data, req.Data)
 		resp.EncryptedData = req.Data
 
+	case pkcs11.CkmAESCTS, pkcs11.CkmAESXTS:
+		blockSize := enc.Stealing.BlockSize()
+		if len(req.Data) < blockSize {
+			p.session.Encrypt = nil
+			return nil, pkcs11.ErrDataLenRange
+		}
+		if req.EncryptedDataSize == 0 {
+			// Querying output buffer size.
+			return resp, nil
+		}
+		n := stealingLen(len(req.Data), blockSize)
+		enc.Stealing.CryptBlocks(req.Data[:n], req.Data[:n])
+		enc.Stealing.CryptFinal(req.Data[n:], req.Data[n:])
+		resp.EncryptedData = req.Data
+
 	case pkcs11.CkmAESGCM:
 		Debugf("AEAD: IV: %x (%d), AAD: %x (%d)",
 			p.session.Encrypt.IV, len(p.session.Encrypt.IV),
@@ -901,17 +2016,36 @@ func (p *Provider) EncryptUpdate(req *pkcs11.EncryptUpdateReq) (*pkcs11.EncryptU
 	if enc == nil {
 		return nil, pkcs11.ErrOperationNotInitialized
 	}
+	if enc.Stealing != nil {
+		// Keep the final blocks for EncryptFinal.
+		pending := append(enc.Buffer, req.Part...)
+		n := stealingLen(len(pending), enc.Stealing.BlockSize())
+		resp := &pkcs11.EncryptUpdateResp{
+			EncryptedPartLen: n,
+		}
+		if req.EncryptedPartSize == 0 {
+			// Querying output buffer size.
+			return resp, nil
+		}
+		resp.EncryptedPart = make([]byte, n)
+		enc.Stealing.CryptBlocks(resp.EncryptedPart, pending[:n])
+		enc.Buffer = append(enc.Buffer[:0], pending[n:]...)
+
+		return resp, nil
+	}
 
 	// Resolve output length.
 	var blockSize int
 	switch enc.Mechanism {
-	case pkcs11.CkmAESECB:
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
 		blockSize = enc.Block.BlockSize()
 
-	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBC,
+		pkcs11.CkmDES3CBCPad:
 		blockSize = enc.BlockMode.BlockSize()
 
-	case pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		blockSize = 1
 
 	default:
@@ -928,25 +2062,25 @@ func (p *Provider) EncryptUpdate(req *pkcs11.EncryptUpdateReq) (*pkcs11.EncryptU
 	}
 
 	// Create output buffer.
+	pending := append(enc.Buffer, req.Part...)
 	resp.EncryptedPart = make([]byte, resp.EncryptedPartLen)
-	n := copy(resp.EncryptedPart, enc.Buffer)
-	limit := resp.EncryptedPartLen - n
-	copy(resp.EncryptedPart[n:], req.Part[:limit])
+	copy(resp.EncryptedPart, pending)
 
 	// Save any trailing data.
-	n = copy(enc.Buffer[0:cap(enc.Buffer)], req.Part[limit:])
-	enc.Buffer = enc.Buffer[:n]
+	enc.Buffer = append(enc.Buffer[:0], pending[resp.EncryptedPartLen:]...)
 
 	switch enc.Mechanism {
-	case pkcs11.CkmAESECB:
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
 		for i := 0; i < resp.EncryptedPartLen; i += blockSize {
 			enc.Block.Encrypt(resp.EncryptedPart[i:], resp.EncryptedPart[i:])
 		}
 
-	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBC,
+		pkcs11.CkmDES3CBCPad:
 		enc.BlockMode.CryptBlocks(resp.EncryptedPart, resp.EncryptedPart)
 
-	case pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		enc.Stream.XORKeyStream(resp.EncryptedPart, resp.EncryptedPart)
 
 	default:
@@ -969,13 +2103,28 @@ func (p *Provider) EncryptFinal(req *pkcs11.EncryptFinalReq) (*pkcs11.EncryptFin
 	resp := &pkcs11.EncryptFinalResp{}
 
 	switch enc.Mechanism {
-	case pkcs11.CkmAESECB, pkcs11.CkmAESCBC, pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESECB, pkcs11.CkmAESCBC, pkcs11.CkmDES3ECB,
+		pkcs11.CkmDES3CBC, pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		if len(enc.Buffer) != 0 {
 			p.session.Encrypt = nil
 			return nil, pkcs11.ErrDataLenRange
 		}
 
-	case pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCTS, pkcs11.CkmAESXTS:
+		if len(enc.Buffer) < enc.Stealing.BlockSize() {
+			p.session.Encrypt = nil
+			return nil, pkcs11.ErrDataLenRange
+		}
+		resp.LastEncryptedPartLen = len(enc.Buffer)
+		if req.LastEncryptedPartSize == 0 {
+			// Querying buffer size.
+			return resp, nil
+		}
+		resp.LastEncryptedPart = make([]byte, len(enc.Buffer))
+		enc.Stealing.CryptFinal(resp.LastEncryptedPart, enc.Buffer)
+
+	case pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBCPad:
 		blockSize := enc.BlockMode.BlockSize()
 		resp.LastEncryptedPartLen = blockSize
 		if req.LastEncryptedPartSize == 0 {
@@ -994,11 +2143,148 @@ func (p *Provider) EncryptFinal(req *pkcs11.EncryptFinalReq) (*pkcs11.EncryptFin
 	return resp, nil
 }
 
+// MessageEncryptInit implements the Provider.MessageEncryptInit().
+func (p *Provider) MessageEncryptInit(req *pkcs11.MessageEncryptInitReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
+	if p.session.MsgEncrypt != nil {
+		return pkcs11.ErrOperationActive
+	}
+	obj, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
+	if err != nil {
+		Errorf("readObject failed: key=%x, %v\n", req.Key, err)
+		return err
+	}
+	key, ok := obj.Native.([]byte)
+	if !ok {
+		Errorf("!key: obj.Native=%v(%T)", obj.Native, obj.Native)
+		return pkcs11.ErrKeyHandleInvalid
+	}
+	Infof("mechanism: %v", req.Mechanism.Mechanism)
+
+	mc, err := newMessageCrypt(&req.Mechanism, p.handleStorage(req.Key),
+		req.Key, obj, key, true)
+	if err != nil {
+		return err
+	}
+	p.session.MsgEncrypt = mc
+	return nil
+}
+
+// EncryptMessage implements the Provider.EncryptMessage().
+func (p *Provider) EncryptMessage(req *pkcs11.EncryptMessageReq) (*pkcs11.EncryptMessageResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	enc := p.session.MsgEncrypt
+	if enc == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	if enc.Message != nil {
+		return nil, pkcs11.ErrOperationActive
+	}
+	resp := &pkcs11.EncryptMessageResp{
+		CiphertextLen: len(req.Plaintext),
+	}
+	// The IV is generated only when the message is encrypted.
+	query := req.CiphertextSize < uint32(resp.CiphertextLen)
+
+	nonce, iv, _, err := enc.Params(req.Params.Parameter, !query)
+	if err != nil {
+		return nil, err
+	}
+	if query {
+		// Querying output buffer size.
+		return resp, nil
+	}
+	sealed := enc.AEAD.Seal(nil, nonce, req.Plaintext, req.AssociatedData)
+
+	resp.Ciphertext = sealed[:len(req.Plaintext)]
+	resp.Iv = iv
+	resp.Tag = sealed[len(req.Plaintext):]
+
+	return resp, nil
+}
+
+// EncryptMessageBegin implements the Provider.EncryptMessageBegin().
+func (p *Provider) EncryptMessageBegin(req *pkcs11.EncryptMessageBeginReq) (*pkcs11.EncryptMessageBeginResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	enc := p.session.MsgEncrypt
+	if enc == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	if enc.Message != nil {
+		return nil, pkcs11.ErrOperationActive
+	}
+	nonce, iv, _, err := enc.Params(req.Params.Parameter, true)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.Begin(nonce, req.AssociatedData)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11.EncryptMessageBeginResp{
+		Iv: iv,
+	}, nil
+}
+
+// EncryptMessageNext implements the Provider.EncryptMessageNext().
+func (p *Provider) EncryptMessageNext(req *pkcs11.EncryptMessageNextReq) (*pkcs11.EncryptMessageNextResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	enc := p.session.MsgEncrypt
+	if enc == nil || enc.Message == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	resp := &pkcs11.EncryptMessageNextResp{
+		CiphertextPartLen: len(req.PlaintextPart),
+	}
+	if req.CiphertextPartSize < uint32(resp.CiphertextPartLen) {
+		// Querying output buffer size.
+		return resp, nil
+	}
+	var err error
+	resp.CiphertextPart, err = enc.Next(req.PlaintextPart)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Flags&pkcs11.CkfEndOfMessage != 0 {
+		resp.Tag = enc.Seal()
+	}
+	return resp, nil
+}
+
+// MessageEncryptFinal implements the Provider.MessageEncryptFinal().
+func (p *Provider) MessageEncryptFinal() error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	if p.session.MsgEncrypt == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	p.session.MsgEncrypt = nil
+	return nil
+}
+
 // DecryptInit implements the Provider.DecryptInit().
 func (p *Provider) DecryptInit(req *pkcs11.DecryptInitReq) error {
 	if p.session == nil {
 		return pkcs11.ErrSessionHandleInvalid
 	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
 	if p.session.Decrypt != nil {
 		return pkcs11.ErrOperationActive
 	}
@@ -1014,28 +2300,35 @@ func (p *Provider) DecryptInit(req *pkcs11.DecryptInitReq) error {
 	}
 	Infof("mechanism: %v", req.Mechanism.Mechanism)
 
+	var decrypt *EncDec
+
 	switch req.Mechanism.Mechanism {
-	case pkcs11.CkmAESECB:
-		b, err := aes.NewCipher(key)
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
+		b, err := newBlockCipher(req.Mechanism.Mechanism, obj, key)
 		if err != nil {
-			return pkcs11.ErrKeySizeRange
+			return err
 		}
-		p.session.Decrypt = &EncDec{
+		decrypt = &EncDec{
 			Mechanism: req.Mechanism.Mechanism,
 			Block:     b,
 		}
-		return nil
 
-	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad:
-		b, err := aes.NewCipher(key)
+	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBC,
+		pkcs11.CkmDES3CBCPad:
+		b, err := newBlockCipher(req.Mechanism.Mechanism, obj, key)
 		if err != nil {
-			return pkcs11.ErrKeySizeRange
+			return err
+		}
+		if len(req.Mechanism.Parameter) != b.BlockSize() {
+			Errorf("%s: invalid IV length %v, expected %v",
+				req.Mechanism.Mechanism, len(req.Mechanism.Parameter),
+				b.BlockSize())
+			return pkcs11.ErrMechanismParamInvalid
 		}
-		p.session.Decrypt = &EncDec{
+		decrypt = &EncDec{
 			Mechanism: req.Mechanism.Mechanism,
-			BlockMode: cipher.NewCBCDecrypter(b, req.Mechanism.Parameter),
+			BlockMode: newCBC(b, req.Mechanism.Parameter, true),
 		}
-		return nil
 
 	case pkcs11.CkmAESCTR:
 		var params pkcs11.AesCtrParams
@@ -1055,50 +2348,40 @@ func (p *Provider) DecryptInit(req *pkcs11.DecryptInitReq) error {
 			return pkcs11.ErrMechanismParamInvalid
 		}
 
-		p.session.Decrypt = &EncDec{
+		decrypt = &EncDec{
 			Mechanism: req.Mechanism.Mechanism,
-			Stream:    cipher.NewCTR(b, params.Cb[:]),
+			Stream:    newCTR(b, params.Cb[:]),
 		}
-		return nil
 
-	case pkcs11.CkmAESGCM:
-		b, err := aes.NewCipher(key)
-		if err != nil {
-			return pkcs11.ErrKeySizeRange
-		}
-		aead, err := cipher.NewGCM(b)
-		if err != nil {
-			return pkcs11.ErrDeviceError
-		}
-		var params pkcs11.GcmParams
-		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+	case pkcs11.CkmAESOFB, pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64,
+		pkcs11.CkmAESCFB128, pkcs11.CkmAESCTS, pkcs11.CkmAESXTS:
+		decrypt, err = newModeEncDec(req.Mechanism.Mechanism, obj, key,
+			req.Mechanism.Parameter, true)
 		if err != nil {
-			Errorf("pkcs11.Unmarshal: %v", err)
-			return pkcs11.ErrMechanismParamInvalid
-		}
-		if params.IvBits != 96 {
-			Errorf("%s: invalid IV length %v, expected 96",
-				req.Mechanism.Mechanism, params.IvBits)
-			return pkcs11.ErrMechanismParamInvalid
-		}
-		if params.TagBits != 128 {
-			Errorf("invalid tag length %v, expected 128", params.TagBits)
-			return pkcs11.ErrMechanismParamInvalid
+			return err
 		}
 
-		p.session.Decrypt = &EncDec{
-			Mechanism: req.Mechanism.Mechanism,
-			AEAD:      aead,
-			IV:        params.Iv,
-			AAD:       params.AAD,
+	case pkcs11.CkmAESGCM:
+		decrypt, _, err = newGCM(&req.Mechanism, key, false)
+		if err != nil {
+			return err
 		}
-		return nil
 
 	default:
 		Errorf("unsupported mechanism %v, key=%x",
 			req.Mechanism.Mechanism, req.Key)
 		return pkcs11.ErrMechanismInvalid
 	}
+	auth, err := alwaysAuthenticate(obj)
+	if err != nil {
+		return err
+	}
+	decrypt.Init = req.Mechanism
+	decrypt.Key = key
+	p.session.Decrypt = decrypt
+	p.session.DecryptAuth = auth
+
+	return nil
 }
 
 // Decrypt implements the Provider.Decrypt().
@@ -1110,12 +2393,15 @@ func (p *Provider) Decrypt(req *pkcs11.DecryptReq) (*pkcs11.DecryptResp, error)
 	if dec == nil {
 		return nil, pkcs11.ErrOperationNotInitialized
 	}
+	if p.session.DecryptAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
 	resp := &pkcs11.DecryptResp{
 		DataLen: len(req.EncryptedData),
 	}
 	// Block size alignment is checked below based on the algorithm.
 	switch dec.Mechanism {
-	case pkcs11.CkmAESECB:
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
 		blockSize := dec.Block.BlockSize()
 		if len(req.EncryptedData)%blockSize != 0 {
 			p.session.Decrypt = nil
@@ -1130,7 +2416,7 @@ func (p *Provider) Decrypt(req *pkcs11.DecryptReq) (*pkcs11.DecryptResp, error)
 		}
 		resp.Data = req.EncryptedData
 
-	case pkcs11.CkmAESCBC:
+	case pkcs11.CkmAESCBC, pkcs11.CkmDES3CBC:
 		if len(req.EncryptedData)%p.session.Decrypt.BlockMode.BlockSize() != 0 {
 			p.session.Decrypt = nil
 			return nil, pkcs11.ErrDataLenRange
@@ -1143,7 +2429,7 @@ func (p *Provider) Decrypt(req *pkcs11.DecryptReq) (*pkcs11.DecryptResp, error)
 			req.EncryptedData)
 		resp.Data = req.EncryptedData
 
-	case pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBCPad:
 		blockSize := p.session.Decrypt.BlockMode.BlockSize()
 
 		if len(req.EncryptedData) == 0 ||
@@ -1165,7 +2451,8 @@ func (p *Provider) Decrypt(req *pkcs11.DecryptReq) (*pkcs11.DecryptResp, error)
 		resp.DataLen = len(data)
 		resp.Data = data
 
-	case pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		if req.DataSize == 0 {
 			// Querying output buffer size.
 			return resp, nil
@@ -1174,6 +2461,21 @@ func (p *Provider) Decrypt(req *pkcs11.DecryptReq) (*pkcs11.DecryptResp, error)
 			req.EncryptedData)
 		resp.Data = req.EncryptedData
 
+	case pkcs11.CkmAESCTS, pkcs11.CkmAESXTS:
+		blockSize := dec.Stealing.BlockSize()
+		if len(req.EncryptedData) < blockSize {
+			p.session.Decrypt = nil
+			return nil, pkcs11.ErrDataLenRange
+		}
+		if req.DataSize == 0 {
+			// Querying output buffer size.
+			return resp, nil
+		}
+		n := stealingLen(len(req.EncryptedData), blockSize)
+		dec.Stealing.CryptBlocks(req.EncryptedData[:n], req.EncryptedData[:n])
+		dec.Stealing.CryptFinal(req.EncryptedData[n:], req.EncryptedData[n:])
+		resp.Data = req.EncryptedData
+
 	case pkcs11.CkmAESGCM:
 		Debugf("AEAD: IV: %x (%d), AAD: %x (%d)",
 			p.session.Decrypt.IV, len(p.session.Decrypt.IV),
@@ -1209,17 +2511,39 @@ func (p *Provider) DecryptUpdate(req *pkcs11.DecryptUpdateReq) (*pkcs11.DecryptU
 	if dec == nil {
 		return nil, pkcs11.ErrOperationNotInitialized
 	}
+	if p.session.DecryptAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
+	if dec.Stealing != nil {
+		// Keep the final blocks for DecryptFinal.
+		pending := append(dec.Buffer, req.EncryptedPart...)
+		n := stealingLen(len(pending), dec.Stealing.BlockSize())
+		resp := &pkcs11.DecryptUpdateResp{
+			PartLen: n,
+		}
+		if req.PartSize == 0 {
+			// Querying output buffer size.
+			return resp, nil
+		}
+		resp.Part = make([]byte, n)
+		dec.Stealing.CryptBlocks(resp.Part, pending[:n])
+		dec.Buffer = append(dec.Buffer[:0], pending[n:]...)
+
+		return resp, nil
+	}
 
 	// Resolve output length.
 	var blockSize int
 	switch dec.Mechanism {
-	case pkcs11.CkmAESECB:
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
 		blockSize = dec.Block.BlockSize()
 
-	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBC,
+		pkcs11.CkmDES3CBCPad:
 		blockSize = dec.BlockMode.BlockSize()
 
-	case pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		blockSize = 1
 
 	default:
@@ -1236,25 +2560,25 @@ func (p *Provider) DecryptUpdate(req *pkcs11.DecryptUpdateReq) (*pkcs11.DecryptU
 	}
 
 	// Create output buffer.
+	pending := append(dec.Buffer, req.EncryptedPart...)
 	resp.Part = make([]byte, resp.PartLen)
-	n := copy(resp.Part, dec.Buffer)
-	limit := resp.PartLen - n
-	copy(resp.Part[n:], req.EncryptedPart[:limit])
+	copy(resp.Part, pending)
 
 	// Save any trailing data.
-	n = copy(dec.Buffer[0:cap(dec.Buffer)], req.EncryptedPart[limit:])
-	dec.Buffer = dec.Buffer[:n]
+	dec.Buffer = append(dec.Buffer[:0], pending[resp.PartLen:]...)
 
 	switch dec.Mechanism {
-	case pkcs11.CkmAESECB:
+	case pkcs11.CkmAESECB, pkcs11.CkmDES3ECB:
 		for i := 0; i < resp.PartLen; i += blockSize {
 			dec.Block.Decrypt(resp.Part[i:], resp.Part[i:])
 		}
 
-	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCBC, pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBC,
+		pkcs11.CkmDES3CBCPad:
 		dec.BlockMode.CryptBlocks(resp.Part, resp.Part)
 
-	case pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		dec.Stream.XORKeyStream(resp.Part, resp.Part)
 
 	default:
@@ -1273,17 +2597,35 @@ func (p *Provider) DecryptFinal(req *pkcs11.DecryptFinalReq) (*pkcs11.DecryptFin
 	if dec == nil {
 		return nil, pkcs11.ErrOperationNotInitialized
 	}
+	if p.session.DecryptAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
 
 	resp := &pkcs11.DecryptFinalResp{}
 
 	switch dec.Mechanism {
-	case pkcs11.CkmAESECB, pkcs11.CkmAESCBC, pkcs11.CkmAESCTR:
+	case pkcs11.CkmAESECB, pkcs11.CkmAESCBC, pkcs11.CkmDES3ECB,
+		pkcs11.CkmDES3CBC, pkcs11.CkmAESCTR, pkcs11.CkmAESOFB,
+		pkcs11.CkmAESCFB8, pkcs11.CkmAESCFB64, pkcs11.CkmAESCFB128:
 		if len(dec.Buffer) != 0 {
 			p.session.Decrypt = nil
 			return nil, pkcs11.ErrDataLenRange
 		}
 
-	case pkcs11.CkmAESCBCPad:
+	case pkcs11.CkmAESCTS, pkcs11.CkmAESXTS:
+		if len(dec.Buffer) < dec.Stealing.BlockSize() {
+			p.session.Decrypt = nil
+			return nil, pkcs11.ErrDataLenRange
+		}
+		resp.LastPartLen = len(dec.Buffer)
+		if req.LastPartSize == 0 {
+			// Querying buffer size.
+			return resp, nil
+		}
+		resp.LastPart = make([]byte, len(dec.Buffer))
+		dec.Stealing.CryptFinal(resp.LastPart, dec.Buffer)
+
+	case pkcs11.CkmAESCBCPad, pkcs11.CkmDES3CBCPad:
 		blockSize := dec.BlockMode.BlockSize()
 		resp.LastPartLen = blockSize
 		if req.LastPartSize == 0 {
@@ -1301,42 +2643,190 @@ func (p *Provider) DecryptFinal(req *pkcs11.DecryptFinalReq) (*pkcs11.DecryptFin
 	return resp, nil
 }
 
-// DigestInit implements the Provider.DigestInit().
-func (p *Provider) DigestInit(req *pkcs11.DigestInitReq) error {
+// MessageDecryptInit implements the Provider.MessageDecryptInit().
+func (p *Provider) MessageDecryptInit(req *pkcs11.MessageDecryptInitReq) error {
 	if p.session == nil {
 		return pkcs11.ErrSessionHandleInvalid
 	}
-	if p.session.Digest != nil {
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
+	if p.session.MsgDecrypt != nil {
 		return pkcs11.ErrOperationActive
 	}
-
-	switch req.Mechanism.Mechanism {
-	case pkcs11.CkmSHA224:
-		p.session.Digest = sha256.New224()
-		return nil
-
-	case pkcs11.CkmSHA256:
-		p.session.Digest = sha256.New()
-		return nil
-
-	case pkcs11.CkmSHA384:
-		p.session.Digest = sha512.New384()
-		return nil
-
-	case pkcs11.CkmSHA512:
-		p.session.Digest = sha512.New()
-		return nil
-
-	default:
-		Errorf("DigestInit: mechanism=%v", req.Mechanism.Mechanism)
-		return pkcs11.ErrMechanismInvalid
+	obj, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
+	if err != nil {
+		Errorf("readObject failed: key=%x, %v\n", req.Key, err)
+		return err
 	}
-}
-
-// Digest implements the Provider.Digest().
-func (p *Provider) Digest(req *pkcs11.DigestReq) (*pkcs11.DigestResp, error) {
-	if p.session == nil {
-		return nil, pkcs11.ErrSessionHandleInvalid
+	key, ok := obj.Native.([]byte)
+	if !ok {
+		Errorf("!key: obj.Native=%v(%T)", obj.Native, obj.Native)
+		return pkcs11.ErrKeyHandleInvalid
+	}
+	Infof("mechanism: %v", req.Mechanism.Mechanism)
+
+	mc, err := newMessageCrypt(&req.Mechanism, p.handleStorage(req.Key),
+		req.Key, obj, key, false)
+	if err != nil {
+		return err
+	}
+	mc.AlwaysAuth, err = alwaysAuthenticate(obj)
+	if err != nil {
+		return err
+	}
+	p.session.MsgDecrypt = mc
+	p.session.MsgDecryptAuth = mc.AlwaysAuth
+	return nil
+}
+
+// DecryptMessage implements the Provider.DecryptMessage().
+func (p *Provider) DecryptMessage(req *pkcs11.DecryptMessageReq) (*pkcs11.DecryptMessageResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	dec := p.session.MsgDecrypt
+	if dec == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	if dec.Message != nil {
+		return nil, pkcs11.ErrOperationActive
+	}
+	if p.session.MsgDecryptAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
+	nonce, _, tag, err := dec.Params(req.Params.Parameter, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(tag) != messageTagLen {
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	resp := &pkcs11.DecryptMessageResp{
+		PlaintextLen: len(req.Ciphertext),
+	}
+	if req.PlaintextSize < uint32(resp.PlaintextLen) {
+		// Querying output buffer size.
+		return resp, nil
+	}
+	p.session.MsgDecryptAuth = dec.AlwaysAuth
+	resp.Plaintext, err = dec.AEAD.Open(nil, nonce,
+		append(req.Ciphertext, tag...), req.AssociatedData)
+	if err != nil {
+		return nil, pkcs11.ErrAeadDecryptFailed
+	}
+	return resp, nil
+}
+
+// DecryptMessageBegin implements the Provider.DecryptMessageBegin().
+func (p *Provider) DecryptMessageBegin(req *pkcs11.DecryptMessageBeginReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	dec := p.session.MsgDecrypt
+	if dec == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	if dec.Message != nil {
+		return pkcs11.ErrOperationActive
+	}
+	if p.session.MsgDecryptAuth {
+		return pkcs11.ErrUserNotLoggedIn
+	}
+	nonce, _, _, err := dec.Params(req.Params.Parameter, false)
+	if err != nil {
+		return err
+	}
+	err = dec.Begin(nonce, req.AssociatedData)
+	if err != nil {
+		return err
+	}
+	p.session.MsgDecryptAuth = dec.AlwaysAuth
+	return nil
+}
+
+// DecryptMessageNext implements the Provider.DecryptMessageNext().
+func (p *Provider) DecryptMessageNext(req *pkcs11.DecryptMessageNextReq) (*pkcs11.DecryptMessageNextResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	dec := p.session.MsgDecrypt
+	if dec == nil || dec.Message == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	last := req.Flags&pkcs11.CkfEndOfMessage != 0
+
+	var tag []byte
+	if last {
+		var err error
+		_, _, tag, err = dec.Params(req.Params.Parameter, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp := &pkcs11.DecryptMessageNextResp{
+		PlaintextLen: len(req.Ciphertext),
+	}
+	if req.PlaintextSize < uint32(resp.PlaintextLen) {
+		// Querying output buffer size.
+		return resp, nil
+	}
+	var err error
+	resp.Plaintext, err = dec.Next(req.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if last {
+		err := dec.Open(tag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// MessageDecryptFinal implements the Provider.MessageDecryptFinal().
+func (p *Provider) MessageDecryptFinal() error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	if p.session.MsgDecrypt == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	p.session.MsgDecrypt = nil
+	return nil
+}
+
+// DigestInit implements the Provider.DigestInit().
+func (p *Provider) DigestInit(req *pkcs11.DigestInitReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
+	if p.session.Digest != nil {
+		return pkcs11.ErrOperationActive
+	}
+
+	digest, ok := digests[req.Mechanism.Mechanism]
+	if !ok {
+		Errorf("DigestInit: mechanism=%v", req.Mechanism.Mechanism)
+		return pkcs11.ErrMechanismInvalid
+	}
+	p.session.Digest = digest.New()
+	p.session.DigestMech = req.Mechanism.Mechanism
+
+	return nil
+}
+
+// Digest implements the Provider.Digest().
+func (p *Provider) Digest(req *pkcs11.DigestReq) (*pkcs11.DigestResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
 	}
 	hash := p.session.Digest
 	if hash == nil {
@@ -1369,6 +2859,33 @@ func (p *Provider) DigestUpdate(req *pkcs11.DigestUpdateReq) error {
 	return nil
 }
 
+// DigestKey implements the Provider.DigestKey().
+func (p *Provider) DigestKey(req *pkcs11.DigestKeyReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	hash := p.session.Digest
+	if hash == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	obj, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
+	if err != nil {
+		return err
+	}
+	cls := pkcs11.ObjectClass(obj.Attrs.OptInt(pkcs11.CkaClass, -1))
+	if cls != pkcs11.CkoSecretKey {
+		Errorf("DigestKey: invalid key class %v", cls)
+		return pkcs11.ErrKeyIndigestible
+	}
+	key, err := secretKeyValue(obj)
+	if err != nil {
+		return pkcs11.ErrKeyIndigestible
+	}
+	hash.Write(key)
+
+	return nil
+}
+
 // DigestFinal implements the Provider.DigestFinal().
 func (p *Provider) DigestFinal(req *pkcs11.DigestFinalReq) (*pkcs11.DigestFinalResp, error) {
 	if p.session == nil {
@@ -1395,6 +2912,10 @@ func (p *Provider) SignInit(req *pkcs11.SignInitReq) error {
 	if p.session == nil {
 		return pkcs11.ErrSessionHandleInvalid
 	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
 	if p.session.Sign != nil {
 		return pkcs11.ErrOperationActive
 	}
@@ -1408,10 +2929,17 @@ func (p *Provider) SignInit(req *pkcs11.SignInitReq) error {
 	if err != nil {
 		return err
 	}
-	// XXX Check object is valid for the operation.
-	sign.Key = obj.Native
+	err = sign.SetKey(obj.Native, true)
+	if err != nil {
+		return err
+	}
+	auth, err := alwaysAuthenticate(obj)
+	if err != nil {
+		return err
+	}
 
 	p.session.Sign = sign
+	p.session.SignAuth = auth
 
 	return nil
 }
@@ -1425,49 +2953,30 @@ func (p *Provider) Sign(req *pkcs11.SignReq) (*pkcs11.SignResp, error) {
 	if sign == nil {
 		return nil, pkcs11.ErrOperationNotInitialized
 	}
+	if p.session.SignAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
 
 	resp := new(pkcs11.SignResp)
-	var signature []byte
-	var err error
-
-	switch priv := sign.Key.(type) {
-	case *rsa.PrivateKey:
-		if req.SignatureSize == 0 {
-			resp.SignatureLen = signatureLen(priv)
-			return resp, nil
-		}
-		sign.Digest.Write(req.Data)
-		digest := sign.Digest.Sum(nil)
-		signature, err = rsa.SignPKCS1v15(rand.Reader, priv, sign.Hash, digest)
-		if err != nil {
-			Errorf("Sign: rsa.SignPKCS1v15: %s", err)
-			p.session.Sign = nil
-			return nil, pkcs11.ErrFunctionFailed
-		}
 
-	case *ecdsa.PrivateKey:
-		if req.SignatureSize == 0 {
-			resp.SignatureLen = signatureLen(priv)
-			return resp, nil
-		}
-		sign.Digest.Write(req.Data)
-		digest := sign.Digest.Sum(nil)
-		signature, err = ecdsa.SignASN1(rand.Reader, priv, digest)
+	if req.SignatureSize == 0 {
+		l, err := sign.SignatureLen()
 		if err != nil {
-			Errorf("Sign: ecdsa.SignASN1: %s", err)
 			p.session.Sign = nil
-			return nil, pkcs11.ErrFunctionFailed
+			return nil, err
 		}
-
-	default:
-		Errorf("Sign: sign not supported for key %T", priv)
-		p.session.Sign = nil
-		return nil, pkcs11.ErrDeviceError
+		resp.SignatureLen = l
+		return resp, nil
+	}
+	sign.Digest.Write(req.Data)
+	signature, err := sign.Sign()
+	p.session.Sign = nil
+	if err != nil {
+		return nil, err
 	}
 
 	resp.Signature = signature
 	resp.SignatureLen = len(signature)
-	p.session.Sign = nil
 
 	return resp, nil
 }
@@ -1481,6 +2990,9 @@ func (p *Provider) SignUpdate(req *pkcs11.SignUpdateReq) error {
 	if sign == nil {
 		return pkcs11.ErrOperationNotInitialized
 	}
+	if p.session.SignAuth {
+		return pkcs11.ErrUserNotLoggedIn
+	}
 	sign.Digest.Write(req.Part)
 	return nil
 }
@@ -1494,130 +3006,238 @@ func (p *Provider) SignFinal(req *pkcs11.SignFinalReq) (*pkcs11.SignFinalResp, e
 	if sign == nil {
 		return nil, pkcs11.ErrOperationNotInitialized
 	}
+	if p.session.SignAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
 
 	resp := new(pkcs11.SignFinalResp)
-	var signature []byte
-	var err error
-
-	switch priv := sign.Key.(type) {
-	case *rsa.PrivateKey:
-		if req.SignatureSize == 0 {
-			resp.SignatureLen = signatureLen(priv)
-			return resp, nil
-		}
-		digest := sign.Digest.Sum(nil)
-		signature, err = rsa.SignPKCS1v15(rand.Reader, priv, sign.Hash, digest)
-		if err != nil {
-			Errorf("SignFinal: rsa.SignPKCS1v15: %s", err)
-			p.session.Sign = nil
-			return nil, pkcs11.ErrFunctionFailed
-		}
 
-	case *ecdsa.PrivateKey:
-		if req.SignatureSize == 0 {
-			resp.SignatureLen = signatureLen(priv)
-			return resp, nil
-		}
-		digest := sign.Digest.Sum(nil)
-		signature, err = ecdsa.SignASN1(rand.Reader, priv, digest)
+	if req.SignatureSize == 0 {
+		l, err := sign.SignatureLen()
 		if err != nil {
-			Errorf("Sign: ecdsa.SignASN1: %s", err)
 			p.session.Sign = nil
-			return nil, pkcs11.ErrFunctionFailed
+			return nil, err
 		}
-
-	default:
-		Errorf("SignFinal: sign not supported for key %T", priv)
-		p.session.Sign = nil
-		return nil, pkcs11.ErrDeviceError
+		resp.SignatureLen = l
+		return resp, nil
+	}
+	signature, err := sign.Sign()
+	p.session.Sign = nil
+	if err != nil {
+		return nil, err
 	}
 
 	resp.Signature = signature
 	resp.SignatureLen = len(signature)
-	p.session.Sign = nil
 
 	return resp, nil
 }
 
-// VerifyInit implements the Provider.VerifyInit().
-func (p *Provider) VerifyInit(req *pkcs11.VerifyInitReq) error {
+// MessageSignInit implements the Provider.MessageSignInit().
+func (p *Provider) MessageSignInit(req *pkcs11.MessageSignInitReq) error {
 	if p.session == nil {
 		return pkcs11.ErrSessionHandleInvalid
 	}
-	if p.session.Verify != nil {
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
+	if p.session.MsgSign != nil {
 		return pkcs11.ErrOperationActive
 	}
-
-	verify, err := NewSignVerify(req.Mechanism)
+	obj, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
 	if err != nil {
 		return err
 	}
-
-	obj, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
+	msv, err := newMessageSignVerify(req.Mechanism, obj.Native, true)
 	if err != nil {
 		return err
 	}
-	// XXX Check object is valid for the operation.
-	verify.Key = obj.Native
-
-	p.session.Verify = verify
-
+	msv.AlwaysAuth, err = alwaysAuthenticate(obj)
+	if err != nil {
+		return err
+	}
+	p.session.MsgSign = msv
+	p.session.MsgSignAuth = msv.AlwaysAuth
 	return nil
 }
 
-// Verify implements the Provider.Verify().
-func (p *Provider) Verify(req *pkcs11.VerifyReq) error {
+// SignMessage implements the Provider.SignMessage().
+func (p *Provider) SignMessage(req *pkcs11.SignMessageReq) (*pkcs11.SignMessageResp, error) {
 	if p.session == nil {
-		return pkcs11.ErrSessionHandleInvalid
+		return nil, pkcs11.ErrSessionHandleInvalid
 	}
-	verify := p.session.Verify
-	if verify == nil {
-		return pkcs11.ErrOperationNotInitialized
+	msv := p.session.MsgSign
+	if msv == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
 	}
-
-	switch pub := verify.Key.(type) {
-	case *rsa.PublicKey:
-		verify.Digest.Write(req.Data)
-		digest := verify.Digest.Sum(nil)
-		err := rsa.VerifyPKCS1v15(pub, verify.Hash, digest, req.Signature)
-		if err != nil {
-			Errorf("Verify: rsa.VerifyPKCS1v15: %s", err)
-			p.session.Verify = nil
-			return pkcs11.ErrSignatureInvalid
-		}
-
-	case *ecdsa.PublicKey:
-		verify.Digest.Write(req.Data)
-		digest := verify.Digest.Sum(nil)
-		if !ecdsa.VerifyASN1(pub, digest, req.Signature) {
-			Errorf("Verify: ecdsa.VerifyASN1 failed")
-			p.session.Verify = nil
-			return pkcs11.ErrSignatureInvalid
-		}
-
-	default:
-		Errorf("Verify: verify not supported for key %T", pub)
-		p.session.Verify = nil
-		return pkcs11.ErrDeviceError
+	if msv.Message != nil {
+		return nil, pkcs11.ErrOperationActive
 	}
+	if p.session.MsgSignAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
+	sign, err := msv.NewMessage(req.Params.Parameter)
+	if err != nil {
+		return nil, err
+	}
+	l, err := sign.SignatureLen()
+	if err != nil {
+		return nil, err
+	}
+	resp := &pkcs11.SignMessageResp{
+		SignatureLen: l,
+	}
+	if req.SignatureSize < uint32(l) {
+		// Querying output buffer size.
+		return resp, nil
+	}
+	p.session.MsgSignAuth = msv.AlwaysAuth
+	sign.Digest.Write(req.Data)
+	resp.Signature, err = sign.Sign()
+	if err != nil {
+		return nil, err
+	}
+	resp.SignatureLen = len(resp.Signature)
 
-	p.session.Verify = nil
-
-	return nil
+	return resp, nil
 }
 
-// VerifyUpdate implements the Provider.VerifyUpdate().
-func (p *Provider) VerifyUpdate(req *pkcs11.VerifyUpdateReq) error {
+// SignMessageBegin implements the Provider.SignMessageBegin().
+func (p *Provider) SignMessageBegin(req *pkcs11.SignMessageBeginReq) error {
 	if p.session == nil {
 		return pkcs11.ErrSessionHandleInvalid
 	}
-	verify := p.session.Verify
-	if verify == nil {
+	msv := p.session.MsgSign
+	if msv == nil {
 		return pkcs11.ErrOperationNotInitialized
 	}
-
-	verify.Digest.Write(req.Part)
-
+	if msv.Message != nil {
+		return pkcs11.ErrOperationActive
+	}
+	if p.session.MsgSignAuth {
+		return pkcs11.ErrUserNotLoggedIn
+	}
+	sign, err := msv.NewMessage(req.Params.Parameter)
+	if err != nil {
+		return err
+	}
+	msv.Message = sign
+	p.session.MsgSignAuth = msv.AlwaysAuth
+	return nil
+}
+
+// SignMessageNext implements the Provider.SignMessageNext().
+func (p *Provider) SignMessageNext(req *pkcs11.SignMessageNextReq) (*pkcs11.SignMessageNextResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	msv := p.session.MsgSign
+	if msv == nil || msv.Message == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	sign := msv.Message
+	resp := new(pkcs11.SignMessageNextResp)
+
+	if !req.Last {
+		sign.Digest.Write(req.Data)
+		return resp, nil
+	}
+	l, err := sign.SignatureLen()
+	if err != nil {
+		msv.Message = nil
+		return nil, err
+	}
+	if req.SignatureSize < uint32(l) {
+		// Querying output buffer size. The data is processed when
+		// the signature is returned.
+		resp.SignatureLen = l
+		return resp, nil
+	}
+	msv.Message = nil
+
+	sign.Digest.Write(req.Data)
+	resp.Signature, err = sign.Sign()
+	if err != nil {
+		return nil, err
+	}
+	resp.SignatureLen = len(resp.Signature)
+
+	return resp, nil
+}
+
+// MessageSignFinal implements the Provider.MessageSignFinal().
+func (p *Provider) MessageSignFinal() error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	if p.session.MsgSign == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	p.session.MsgSign = nil
+	return nil
+}
+
+// VerifyInit implements the Provider.VerifyInit().
+func (p *Provider) VerifyInit(req *pkcs11.VerifyInitReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
+	if p.session.Verify != nil {
+		return pkcs11.ErrOperationActive
+	}
+
+	verify, err := NewSignVerify(req.Mechanism)
+	if err != nil {
+		return err
+	}
+
+	obj, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
+	if err != nil {
+		return err
+	}
+	err = verify.SetKey(obj.Native, false)
+	if err != nil {
+		return err
+	}
+
+	p.session.Verify = verify
+
+	return nil
+}
+
+// Verify implements the Provider.Verify().
+func (p *Provider) Verify(req *pkcs11.VerifyReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	verify := p.session.Verify
+	if verify == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	p.session.Verify = nil
+
+	verify.Digest.Write(req.Data)
+
+	return verify.Verify(req.Signature)
+}
+
+// VerifyUpdate implements the Provider.VerifyUpdate().
+func (p *Provider) VerifyUpdate(req *pkcs11.VerifyUpdateReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	verify := p.session.Verify
+	if verify == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+
+	verify.Digest.Write(req.Part)
+
 	return nil
 }
 
@@ -1630,39 +3250,219 @@ func (p *Provider) VerifyFinal(req *pkcs11.VerifyFinalReq) error {
 	if verify == nil {
 		return pkcs11.ErrOperationNotInitialized
 	}
+	p.session.Verify = nil
 
-	switch pub := verify.Key.(type) {
-	case *rsa.PublicKey:
-		digest := verify.Digest.Sum(nil)
-		err := rsa.VerifyPKCS1v15(pub, verify.Hash, digest, req.Signature)
-		if err != nil {
-			Errorf("rsa.VerifyPKCS1v15: %s", err)
-			p.session.Verify = nil
-			return pkcs11.ErrSignatureInvalid
-		}
+	return verify.Verify(req.Signature)
+}
 
-	case *ecdsa.PublicKey:
-		digest := verify.Digest.Sum(nil)
-		if !ecdsa.VerifyASN1(pub, digest, req.Signature) {
-			Errorf("ecdsa.VerifyASN1 failed")
-			p.session.Verify = nil
-			return pkcs11.ErrSignatureInvalid
-		}
+// MessageVerifyInit implements the Provider.MessageVerifyInit().
+func (p *Provider) MessageVerifyInit(req *pkcs11.MessageVerifyInitReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return err
+	}
+	if p.session.MsgVerify != nil {
+		return pkcs11.ErrOperationActive
+	}
+	obj, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
+	if err != nil {
+		return err
+	}
+	msv, err := newMessageSignVerify(req.Mechanism, obj.Native, false)
+	if err != nil {
+		return err
+	}
+	p.session.MsgVerify = msv
+	return nil
+}
 
-	default:
-		Errorf("verify not supported for key %T", pub)
-		p.session.Verify = nil
-		return pkcs11.ErrDeviceError
+// VerifyMessage implements the Provider.VerifyMessage().
+func (p *Provider) VerifyMessage(req *pkcs11.VerifyMessageReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	msv := p.session.MsgVerify
+	if msv == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	if msv.Message != nil {
+		return pkcs11.ErrOperationActive
+	}
+	verify, err := msv.NewMessage(req.Params.Parameter)
+	if err != nil {
+		return err
 	}
+	verify.Digest.Write(req.Data)
 
-	p.session.Verify = nil
+	return verify.Verify(req.Signature)
+}
+
+// VerifyMessageBegin implements the Provider.VerifyMessageBegin().
+func (p *Provider) VerifyMessageBegin(req *pkcs11.VerifyMessageBeginReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	msv := p.session.MsgVerify
+	if msv == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	if msv.Message != nil {
+		return pkcs11.ErrOperationActive
+	}
+	verify, err := msv.NewMessage(req.Params.Parameter)
+	if err != nil {
+		return err
+	}
+	msv.Message = verify
+	return nil
+}
+
+// VerifyMessageNext implements the Provider.VerifyMessageNext().
+func (p *Provider) VerifyMessageNext(req *pkcs11.VerifyMessageNextReq) error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	msv := p.session.MsgVerify
+	if msv == nil || msv.Message == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	verify := msv.Message
+
+	verify.Digest.Write(req.Data)
+	if !req.Last {
+		return nil
+	}
+	msv.Message = nil
+
+	return verify.Verify(req.Signature)
+}
 
+// MessageVerifyFinal implements the Provider.MessageVerifyFinal().
+func (p *Provider) MessageVerifyFinal() error {
+	if p.session == nil {
+		return pkcs11.ErrSessionHandleInvalid
+	}
+	if p.session.MsgVerify == nil {
+		return pkcs11.ErrOperationNotInitialized
+	}
+	p.session.MsgVerify = nil
 	return nil
 }
 
+// DigestEncryptUpdate implements the Provider.DigestEncryptUpdate().
+func (p *Provider) DigestEncryptUpdate(req *pkcs11.DigestEncryptUpdateReq) (*pkcs11.DigestEncryptUpdateResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	hash := p.session.Digest
+	if hash == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	resp, err := p.EncryptUpdate(&pkcs11.EncryptUpdateReq{
+		Part:              req.Part,
+		EncryptedPartSize: req.EncryptedPartSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if req.EncryptedPartSize != 0 {
+		hash.Write(req.Part)
+	}
+	return &pkcs11.DigestEncryptUpdateResp{
+		EncryptedPartLen: resp.EncryptedPartLen,
+		EncryptedPart:    resp.EncryptedPart,
+	}, nil
+}
+
+// DecryptDigestUpdate implements the Provider.DecryptDigestUpdate().
+func (p *Provider) DecryptDigestUpdate(req *pkcs11.DecryptDigestUpdateReq) (*pkcs11.DecryptDigestUpdateResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	hash := p.session.Digest
+	if hash == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	resp, err := p.DecryptUpdate(&pkcs11.DecryptUpdateReq{
+		EncryptedPart: req.EncryptedPart,
+		PartSize:      req.PartSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(resp.Part)
+
+	return &pkcs11.DecryptDigestUpdateResp{
+		PartLen: resp.PartLen,
+		Part:    resp.Part,
+	}, nil
+}
+
+// SignEncryptUpdate implements the Provider.SignEncryptUpdate().
+func (p *Provider) SignEncryptUpdate(req *pkcs11.SignEncryptUpdateReq) (*pkcs11.SignEncryptUpdateResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	sign := p.session.Sign
+	if sign == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	if p.session.SignAuth {
+		return nil, pkcs11.ErrUserNotLoggedIn
+	}
+	resp, err := p.EncryptUpdate(&pkcs11.EncryptUpdateReq{
+		Part:              req.Part,
+		EncryptedPartSize: req.EncryptedPartSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if req.EncryptedPartSize != 0 {
+		sign.Digest.Write(req.Part)
+	}
+	return &pkcs11.SignEncryptUpdateResp{
+		EncryptedPartLen: resp.EncryptedPartLen,
+		EncryptedPart:    resp.EncryptedPart,
+	}, nil
+}
+
+// DecryptVerifyUpdate implements the Provider.DecryptVerifyUpdate().
+func (p *Provider) DecryptVerifyUpdate(req *pkcs11.DecryptVerifyUpdateReq) (*pkcs11.DecryptVerifyUpdateResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	verify := p.session.Verify
+	if verify == nil {
+		return nil, pkcs11.ErrOperationNotInitialized
+	}
+	resp, err := p.DecryptUpdate(&pkcs11.DecryptUpdateReq{
+		EncryptedPart: req.EncryptedPart,
+		PartSize:      req.PartSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	verify.Digest.Write(resp.Part)
+
+	return &pkcs11.DecryptVerifyUpdateResp{
+		PartLen: resp.PartLen,
+		Part:    resp.Part,
+	}, nil
+}
+
 // GenerateKey implements the Provider.GenerateKey().
 func (p *Provider) GenerateKey(req *pkcs11.GenerateKeyReq) (*pkcs11.GenerateKeyResp, error) {
-	info, ok := mechanisms[req.Mechanism.Mechanism]
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := lookupMechanism(req.Mechanism.Mechanism)
 	if !ok {
 		return nil, pkcs11.ErrMechanismInvalid
 	}
@@ -1672,257 +3472,1191 @@ func (p *Provider) GenerateKey(req *pkcs11.GenerateKeyReq) (*pkcs11.GenerateKeyR
 		return nil, pkcs11.ErrTemplateIncomplete
 	}
 
-	switch req.Mechanism.Mechanism {
-	case pkcs11.CkmAESKeyGen:
-		size, err := req.Template.Int(pkcs11.CkaValueLen)
+	var key []byte
+	var keyType pkcs11.KeyType
+
+	switch req.Mechanism.Mechanism {
+	case pkcs11.CkmAESKeyGen:
+		size, err := req.Template.Int(pkcs11.CkaValueLen)
+		if err != nil {
+			return nil, err
+		}
+		if size < int(info.MinKeySize) || size > int(info.MaxKeySize) {
+			return nil, pkcs11.ErrTemplateIncomplete
+		}
+		key = make([]byte, size)
+		_, err = rand.Read(key)
+		if err != nil {
+			Errorf("rand.Read failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+		keyType = pkcs11.CkkAES
+
+	case pkcs11.CkmAESXTSKeyGen:
+		size, err := req.Template.Int(pkcs11.CkaValueLen)
+		if err != nil {
+			return nil, err
+		}
+		if size != int(info.MinKeySize) && size != int(info.MaxKeySize) {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		key = make([]byte, size)
+		_, err = rand.Read(key)
+		if err != nil {
+			Errorf("rand.Read failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+		keyType = pkcs11.CkkAESXTS
+
+	case pkcs11.CkmDES3KeyGen:
+		size := req.Template.OptInt(pkcs11.CkaValueLen, DES3KeySize)
+		if size != DES3KeySize {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		key = make([]byte, size)
+		_, err := rand.Read(key)
+		if err != nil {
+			Errorf("rand.Read failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+		pkcs11.DES3SetParity(key)
+		keyType = pkcs11.CkkDES3
+
+	case pkcs11.CkmChaCha20KeyGen:
+		size := req.Template.OptInt(pkcs11.CkaValueLen, ChaCha20KeySize)
+		if size != ChaCha20KeySize {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		key = make([]byte, size)
+		_, err := rand.Read(key)
+		if err != nil {
+			Errorf("rand.Read failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+		keyType = pkcs11.CkkChaCha20
+
+	case pkcs11.CkmHKDFKeyGen:
+		size, err := req.Template.Int(pkcs11.CkaValueLen)
+		if err != nil {
+			return nil, err
+		}
+		if size < int(info.MinKeySize) || size > int(info.MaxKeySize) {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		key = make([]byte, size)
+		_, err = rand.Read(key)
+		if err != nil {
+			Errorf("rand.Read failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+		keyType = pkcs11.CkkHKDF
+
+	case pkcs11.CkmPKCS5PBKD2:
+		var params pkcs11.Pkcs5Pbkd2Params2
+		err := pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		keyType = pkcs11.KeyType(req.Template.OptInt(pkcs11.CkaKeyType,
+			int(pkcs11.CkkGenericSecret)))
+		if keyType != pkcs11.CkkAES && keyType != pkcs11.CkkGenericSecret {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		size, err := derivedKeyLen(req.Template, 0)
+		if err != nil {
+			return nil, err
+		}
+		key, err = pbkdf2Derive(&params, size)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		Infof("GenerateKey: %s", req.Mechanism)
+		Infof("Template:")
+		req.Template.Print("\u2502 ")
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+
+	token, err := req.Template.OptBool(pkcs11.CkaToken)
+	if err != nil {
+		return nil, err
+	}
+	sensitive, err := req.Template.OptBool(pkcs11.CkaSensitive)
+	if err != nil {
+		return nil, err
+	}
+	extractable, err := req.Template.OptBool(pkcs11.CkaExtractable)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := p.objectStorage(token)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := req.Template
+	tmpl = tmpl.SetInt(pkcs11.CkaClass, cls)
+	tmpl = tmpl.SetBool(pkcs11.CkaToken, token)
+	tmpl = tmpl.SetBool(pkcs11.CkaSensitive, sensitive)
+	tmpl = tmpl.SetBool(pkcs11.CkaAlwaysSensitive, sensitive)
+	tmpl = tmpl.SetBool(pkcs11.CkaExtractable, extractable)
+	tmpl = tmpl.SetBool(pkcs11.CkaNeverExtractable, !extractable)
+	tmpl = tmpl.SetInt(pkcs11.CkaValueLen, len(key))
+	tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(keyType))
+
+	obj := &pkcs11.Object{
+		Attrs:  tmpl,
+		Native: key,
+	}
+	err = obj.Inflate()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := p.storeObject(storage, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkcs11.GenerateKeyResp{
+		Key: handle,
+	}, nil
+}
+
+// GenerateKeyPair implements the Provider.GenerateKeyPair().
+func (p *Provider) GenerateKeyPair(req *pkcs11.GenerateKeyPairReq) (*pkcs11.GenerateKeyPairResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := lookupMechanism(req.Mechanism.Mechanism)
+	if !ok {
+		Errorf("%s: unknown mechanism", req.Mechanism.Mechanism)
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+	token, err := req.PrivateKeyTemplate.OptBool(pkcs11.CkaToken)
+	if err != nil {
+		return nil, err
+	}
+	pubToken, err := req.PublicKeyTemplate.OptBool(pkcs11.CkaToken)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := p.objectStorage(token || pubToken)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Mechanism.Mechanism {
+	case pkcs11.CkmRSAPKCSKeyPairGen, pkcs11.CkmRSAX931KeyPairGen:
+		bits, err := req.PublicKeyTemplate.Int(pkcs11.CkaModulusBits)
+		if err != nil {
+			return nil, err
+		}
+		e, err := req.PublicKeyTemplate.BigInt(pkcs11.CkaPublicExponent)
+		if err != nil {
+			return nil, err
+		}
+		if false {
+			Infof("bits:\t%d\n", bits)
+			Infof("e:\t%s\n", e)
+			Infof("token:\t%v\n", token)
+		}
+		if bits < int(info.MinKeySize) || bits > int(info.MaxKeySize) {
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, int(bits))
+		if err != nil {
+			Errorf("rsa.GenerateKey failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+
+		// Store private key prime factors.
+		if len(key.Primes) != 2 {
+			Errorf("rsa.GenerateKey: #primes != 2: %d", len(key.Primes))
+			return nil, pkcs11.ErrDeviceError
+		}
+
+		privTmpl := req.PrivateKeyTemplate
+		privTmpl = privTmpl.Set(pkcs11.CkaPrime1, key.Primes[0].Bytes())
+		privTmpl = privTmpl.Set(pkcs11.CkaPrime2, key.Primes[1].Bytes())
+		privTmpl = privTmpl.Set(pkcs11.CkaModulus, key.PublicKey.N.Bytes())
+		privTmpl = privTmpl.Set(pkcs11.CkaPublicExponent, e.Bytes())
+		privTmpl = privTmpl.Set(pkcs11.CkaPrivateExponent, key.D.Bytes())
+		privTmpl = privTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPrivateKey))
+		privTmpl = privTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkRSA))
+
+		privObj := &pkcs11.Object{
+			Attrs: privTmpl,
+		}
+		err = privObj.Inflate()
+		if err != nil {
+			return nil, err
+		}
+		privHandle, err := p.storeObject(storage, privObj)
+		if err != nil {
+			return nil, err
+		}
+
+		pubTmpl := req.PublicKeyTemplate
+		pubTmpl = pubTmpl.Set(pkcs11.CkaModulus, key.PublicKey.N.Bytes())
+		pubTmpl = pubTmpl.Set(pkcs11.CkaPublicExponent, e.Bytes())
+		pubTmpl = pubTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPublicKey))
+		pubTmpl = pubTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkRSA))
+
+		pubObj := &pkcs11.Object{
+			Attrs: pubTmpl,
+		}
+		err = pubObj.Inflate()
+		if err != nil {
+			storage.Delete(privHandle)
+			return nil, err
+		}
+		pubHandle, err := p.storeObject(storage, pubObj)
+		if err != nil {
+			storage.Delete(privHandle)
+			return nil, err
+		}
+
+		return &pkcs11.GenerateKeyPairResp{
+			PublicKey:  pubHandle,
+			PrivateKey: privHandle,
+		}, nil
+
+	case pkcs11.CkmECKeyPairGen:
+		params, err := req.PublicKeyTemplate.OptBytes(pkcs11.CkaECParams)
+		if err != nil {
+			return nil, err
+		}
+		var curve elliptic.Curve
+		if bytes.Compare(params, secp224r1) == 0 {
+			curve = elliptic.P224()
+		} else if bytes.Compare(params, secp256r1) == 0 {
+			curve = elliptic.P256()
+		} else if bytes.Compare(params, secp384r1) == 0 {
+			curve = elliptic.P384()
+		} else if bytes.Compare(params, secp521r1) == 0 {
+			curve = elliptic.P521()
+		} else {
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			Errorf("ecdsa.GenerateKey failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+		privTmpl := req.PrivateKeyTemplate
+		privTmpl = privTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPrivateKey))
+		privTmpl = privTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkEC))
+		privTmpl = privTmpl.Set(pkcs11.CkaECParams, params)
+		privTmpl = privTmpl.Set(pkcs11.CkaValue, key.D.Bytes())
+
+		privObj := &pkcs11.Object{
+			Attrs:  privTmpl,
+			Native: key,
+		}
+		err = privObj.Inflate()
+		if err != nil {
+			return nil, err
+		}
+		privHandle, err := p.storeObject(storage, privObj)
+		if err != nil {
+			return nil, err
+		}
+
+		q := elliptic.Marshal(curve, key.X, key.Y)
+
+		pubTmpl := req.PublicKeyTemplate
+		pubTmpl = pubTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPublicKey))
+		pubTmpl = pubTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkEC))
+		pubTmpl = pubTmpl.Set(pkcs11.CkaECPoint, q)
+
+		pubObj := &pkcs11.Object{
+			Attrs:  pubTmpl,
+			Native: &key.PublicKey,
+		}
+		err = pubObj.Inflate()
+		if err != nil {
+			storage.Delete(privHandle)
+			return nil, err
+		}
+		pubHandle, err := p.storeObject(storage, pubObj)
+		if err != nil {
+			storage.Delete(privHandle)
+			return nil, err
+		}
+		if false {
+			Infof("GenerateKey: %s", req.Mechanism)
+			Infof(" - PublicKey:")
+			pubObj.Attrs.Print("\u2502 ")
+			Infof(" - PrivateKey:")
+			privObj.Attrs.Print("\u2502 ")
+		}
+
+		return &pkcs11.GenerateKeyPairResp{
+			PublicKey:  pubHandle,
+			PrivateKey: privHandle,
+		}, nil
+
+	case pkcs11.CkmECEdwardsKeyPairGen:
+		params, err := req.PublicKeyTemplate.OptBytes(pkcs11.CkaECParams)
+		if err != nil {
+			return nil, err
+		}
+		if pkcs11.CheckEdwardsParams(params) != nil {
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			Errorf("ed25519.GenerateKey failed: %s", err)
+			return nil, pkcs11.ErrDeviceError
+		}
+		privTmpl := req.PrivateKeyTemplate
+		privTmpl = privTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPrivateKey))
+		privTmpl = privTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkECEdwards))
+		privTmpl = privTmpl.Set(pkcs11.CkaECParams, params)
+		privTmpl = privTmpl.Set(pkcs11.CkaValue, priv.Seed())
+
+		privObj := &pkcs11.Object{
+			Attrs: privTmpl,
+		}
+		err = privObj.Inflate()
+		if err != nil {
+			return nil, err
+		}
+		privHandle, err := p.storeObject(storage, privObj)
+		if err != nil {
+			return nil, err
+		}
+
+		pubTmpl := req.PublicKeyTemplate
+		pubTmpl = pubTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPublicKey))
+		pubTmpl = pubTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkECEdwards))
+		pubTmpl = pubTmpl.Set(pkcs11.CkaECPoint, []byte(pub))
+
+		pubObj := &pkcs11.Object{
+			Attrs: pubTmpl,
+		}
+		err = pubObj.Inflate()
+		if err != nil {
+			storage.Delete(privHandle)
+			return nil, err
+		}
+		pubHandle, err := p.storeObject(storage, pubObj)
+		if err != nil {
+			storage.Delete(privHandle)
+			return nil, err
+		}
+
+		return &pkcs11.GenerateKeyPairResp{
+			PublicKey:  pubHandle,
+			PrivateKey: privHandle,
+		}, nil
+
+	default:
+		Infof("GenerateKeyPair: %s", req.Mechanism)
+		Infof("PublicKeyTemplate:")
+		req.PublicKeyTemplate.Print("\u2502 ")
+		Infof("PrivateKeyTemplate:")
+		req.PrivateKeyTemplate.Print("\u2502 ")
+
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+}
+
+// WrapKey implements the Provider.WrapKey().
+func (p *Provider) WrapKey(req *pkcs11.WrapKeyReq) (*pkcs11.WrapKeyResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return nil, err
+	}
+	wrappingKey, err := p.readObject(req.WrappingKey,
+		pkcs11.ErrWrappingKeyHandleInvalid)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.readObject(req.Key, pkcs11.ErrKeyHandleInvalid)
+	if err != nil {
+		return nil, err
+	}
+	extractable, err := key.Attrs.OptBool(pkcs11.CkaExtractable)
+	if err != nil {
+		return nil, err
+	}
+	if !extractable {
+		return nil, pkcs11.ErrKeyUnextractable
+	}
+	wrap, err := wrappingKey.Attrs.OptBool(pkcs11.CkaWrap)
+	if err != nil {
+		return nil, err
+	}
+	if !wrap {
+		return nil, pkcs11.ErrKeyFunctionNotPermitted
+	}
+	withTrusted, err := key.Attrs.OptBool(pkcs11.CkaWrapWithTrusted)
+	if err != nil {
+		return nil, err
+	}
+	if withTrusted {
+		trusted, err := wrappingKey.Attrs.Bool(pkcs11.CkaTrusted)
+		if err != nil || !trusted {
+			return nil, pkcs11.ErrKeyNotWrappable
+		}
+	}
+	var pub *rsa.PublicKey
+	var kek []byte
+	var ok bool
+
+	switch req.Mechanism.Mechanism {
+	case pkcs11.CkmAESGCM:
+		kek, ok = aesKeyValue(wrappingKey)
+	default:
+		pub, ok = rsaPublicKey(wrappingKey)
+	}
+	if !ok {
+		Errorf("WrapKey: wrapping key: %T", wrappingKey.Native)
+		return nil, pkcs11.ErrWrappingKeyTypeInconsistent
+	}
+	data, cls, err := wrapKeyData(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapped []byte
+	var iv []byte
+
+	switch req.Mechanism.Mechanism {
+	case pkcs11.CkmRSAPKCS:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrKeyNotWrappable
+		}
+		if req.WrappedKeySize == 0 {
+			// Querying output buffer size.
+			return &pkcs11.WrapKeyResp{
+				WrappedKeyLen: pub.Size(),
+			}, nil
+		}
+		wrapped, err = rsa.EncryptPKCS1v15(rand.Reader, pub, data)
+		if err != nil {
+			Errorf("rsa.EncryptPKCS1v15: %s", err)
+			return nil, pkcs11.ErrKeySizeRange
+		}
+
+	case pkcs11.CkmRSAPKCSOAEP:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrKeyNotWrappable
+		}
+		var params pkcs11.RsaPkcsOaepParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		h, label, err := oaepHash(&params)
+		if err != nil {
+			return nil, err
+		}
+		if req.WrappedKeySize == 0 {
+			// Querying output buffer size.
+			return &pkcs11.WrapKeyResp{
+				WrappedKeyLen: pub.Size(),
+			}, nil
+		}
+		wrapped, err = rsa.EncryptOAEP(h, rand.Reader, pub, data, label)
+		if err != nil {
+			Errorf("rsa.EncryptOAEP: %s", err)
+			return nil, pkcs11.ErrKeySizeRange
+		}
+
+	case pkcs11.CkmRSAAESKeyWrap:
+		var params pkcs11.RsaAesKeyWrapParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if req.WrappedKeySize == 0 {
+			// Querying output buffer size.
+			return &pkcs11.WrapKeyResp{
+				WrappedKeyLen: pub.Size() + kwpLen(len(data)),
+			}, nil
+		}
+		wrapped, err = rsaAESKeyWrap(pub, &params, data)
+		if err != nil {
+			return nil, err
+		}
+
+	case pkcs11.CkmAESGCM:
+		gcm, generated, err := newGCM(&req.Mechanism, kek, true)
+		if err != nil {
+			return nil, err
+		}
+		// The wrapped key is the ciphertext and the tag. The IV is
+		// returned in the mechanism parameters.
+		size := len(data) + gcm.AEAD.Overhead()
+		if int(req.WrappedKeySize) < size {
+			// Querying output buffer size. The generated IV is
+			// returned only when the key is wrapped.
+			return &pkcs11.WrapKeyResp{
+				WrappedKeyLen: size,
+			}, nil
+		}
+		iv = generated
+		wrapped = gcm.AEAD.Seal(nil, gcm.IV, data, gcm.AAD)
+
+	default:
+		Errorf("WrapKey: %s", req.Mechanism.Mechanism)
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+
+	return &pkcs11.WrapKeyResp{
+		Iv:            iv,
+		WrappedKeyLen: len(wrapped),
+		WrappedKey:    wrapped,
+	}, nil
+}
+
+// UnwrapKey implements the Provider.UnwrapKey().
+func (p *Provider) UnwrapKey(req *pkcs11.UnwrapKeyReq) (*pkcs11.UnwrapKeyResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return nil, err
+	}
+	unwrappingKey, err := p.readObject(req.UnwrappingKey,
+		pkcs11.ErrUnwrappingKeyHandleInvalid)
+	if err != nil {
+		return nil, err
+	}
+	unwrap, err := unwrappingKey.Attrs.OptBool(pkcs11.CkaUnwrap)
+	if err != nil {
+		return nil, err
+	}
+	if !unwrap {
+		return nil, pkcs11.ErrKeyFunctionNotPermitted
+	}
+	var priv *rsa.PrivateKey
+	var kek []byte
+	var ok bool
+
+	switch req.Mechanism.Mechanism {
+	case pkcs11.CkmAESGCM:
+		kek, ok = aesKeyValue(unwrappingKey)
+	default:
+		priv, ok = unwrappingKey.Native.(*rsa.PrivateKey)
+	}
+	if !ok {
+		Errorf("UnwrapKey: unwrapping key: %T", unwrappingKey.Native)
+		return nil, pkcs11.ErrUnwrappingKeyTypeInconsistent
+	}
+	err = p.unwrapAuthorized(req.UnwrappingKey, unwrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	cls := pkcs11.ObjectClass(req.Template.OptInt(pkcs11.CkaClass,
+		int(pkcs11.CkoSecretKey)))
+
+	var data []byte
+
+	switch req.Mechanism.Mechanism {
+	case pkcs11.CkmRSAPKCS:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		data, err = rsaPKCSUnwrap(priv, req.Template, req.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+
+	case pkcs11.CkmRSAPKCSOAEP:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		var params pkcs11.RsaPkcsOaepParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		h, label, err := oaepHash(&params)
+		if err != nil {
+			return nil, err
+		}
+		data, err = rsa.DecryptOAEP(h, nil, priv, req.WrappedKey, label)
+		if err != nil {
+			return nil, pkcs11.ErrWrappedKeyInvalid
+		}
+
+	case pkcs11.CkmRSAAESKeyWrap:
+		var params pkcs11.RsaAesKeyWrapParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		data, err = rsaAESKeyUnwrap(priv, &params, req.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+
+	case pkcs11.CkmAESGCM:
+		gcm, _, err := newGCM(&req.Mechanism, kek, false)
+		if err != nil {
+			return nil, err
+		}
+		data, err = gcm.AEAD.Open(nil, gcm.IV, req.WrappedKey, gcm.AAD)
+		if err != nil {
+			return nil, pkcs11.ErrWrappedKeyInvalid
+		}
+
+	default:
+		Errorf("UnwrapKey: %s", req.Mechanism.Mechanism)
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+
+	return p.createUnwrappedKey(req.Template, data)
+}
+
+// unwrapAuthorized checks the context-specific login of the
+// CKA_ALWAYS_AUTHENTICATE unwrapping key. The first C_UnwrapKey with
+// the key fails with pkcs11.ErrUserNotLoggedIn and waits for the
+// login. The login authorizes one C_UnwrapKey with the key.
+func (p *Provider) unwrapAuthorized(h pkcs11.ObjectHandle,
+	obj *pkcs11.Object) error {
+
+	auth, err := alwaysAuthenticate(obj)
+	if err != nil || !auth {
+		return err
+	}
+	s := p.session
+	if s.UnwrapAuthKey == h && !s.UnwrapAuth {
+		s.UnwrapAuthKey = 0
+		return nil
+	}
+	s.UnwrapAuthKey = h
+	s.UnwrapAuth = true
+
+	return pkcs11.ErrUserNotLoggedIn
+}
+
+// createUnwrappedKey creates a new key object from the unwrapped
+// key data.
+func (p *Provider) createUnwrappedKey(tmpl pkcs11.Template, data []byte) (
+	*pkcs11.UnwrapKeyResp, error) {
+
+	tmpl, err := unwrapKeyTemplate(tmpl, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key was not generated on the token and its value has been
+	// outside of the token.
+	tmpl = tmpl.SetBool(pkcs11.CkaLocal, false)
+	tmpl = tmpl.SetBool(pkcs11.CkaAlwaysSensitive, false)
+	tmpl = tmpl.SetBool(pkcs11.CkaNeverExtractable, false)
+
+	handle, err := p.createObject(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11.UnwrapKeyResp{
+		Key: handle,
+	}, nil
+}
+
+// DeriveKey implements the Provider.DeriveKey().
+func (p *Provider) DeriveKey(req *pkcs11.DeriveKeyReq) (*pkcs11.DeriveKeyResp, error) {
+	if p.session == nil {
+		return nil, pkcs11.ErrSessionHandleInvalid
+	}
+	err := p.checkMechanism(req.Mechanism.Mechanism)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := lookupMechanism(req.Mechanism.Mechanism)
+	if !ok {
+		return nil, pkcs11.ErrMechanismInvalid
+	}
+	base, err := p.readObject(req.BaseKey, pkcs11.ErrKeyHandleInvalid)
+	if err != nil {
+		return nil, err
+	}
+	derive, err := base.Attrs.OptBool(pkcs11.CkaDerive)
+	if err != nil {
+		return nil, err
+	}
+	if !derive {
+		return nil, pkcs11.ErrKeyFunctionNotPermitted
+	}
+	key, err := secretKeyValue(base)
+	if err != nil {
+		return nil, pkcs11.ErrKeyTypeInconsistent
+	}
+	keyType := pkcs11.KeyType(base.Attrs.OptInt(pkcs11.CkaKeyType, -1))
+	cls := pkcs11.ObjectClass(req.Template.OptInt(pkcs11.CkaClass,
+		int(pkcs11.CkoSecretKey)))
+
+	var data []byte
+	var additional []pkcs11.Template
+	bases := []*pkcs11.Object{base}
+	resp := new(pkcs11.DeriveKeyResp)
+
+	switch req.Mechanism.Mechanism {
+	case pkcs11.CkmHKDFDerive, pkcs11.CkmHKDFData:
+		if keyType != pkcs11.CkkHKDF && keyType != pkcs11.CkkGenericSecret {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		if req.Mechanism.Mechanism == pkcs11.CkmHKDFData {
+			if cls != pkcs11.CkoData {
+				return nil, pkcs11.ErrTemplateInconsistent
+			}
+		} else if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		var params pkcs11.HkdfParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		var salt []byte
+
+		switch params.SaltType {
+		case pkcs11.CkfHKDFSaltNull:
+
+		case pkcs11.CkfHKDFSaltData:
+			salt = params.Salt
+
+		case pkcs11.CkfHKDFSaltKey:
+			obj, err := p.readObject(params.SaltKey,
+				pkcs11.ErrMechanismParamInvalid)
+			if err != nil {
+				return nil, err
+			}
+			salt, err = secretKeyValue(obj)
+			if err != nil {
+				return nil, pkcs11.ErrMechanismParamInvalid
+			}
+
+		default:
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		data, err = hkdfDerive(&params, key, salt, req.Template)
 		if err != nil {
 			return nil, err
 		}
-		token, err := req.Template.OptBool(pkcs11.CkaToken)
+
+	case pkcs11.CkmSP800108CounterKDF, pkcs11.CkmSP800108FeedbackKDF,
+		pkcs11.CkmSP800108DoublePipelineKDF:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		var params pkcs11.Sp800108FeedbackKdfParams
+		var mode kbkdfMode
+
+		if req.Mechanism.Mechanism == pkcs11.CkmSP800108FeedbackKDF {
+			mode = kbkdfFeedback
+			err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		} else {
+			if req.Mechanism.Mechanism == pkcs11.CkmSP800108CounterKDF {
+				mode = kbkdfCounter
+			} else {
+				mode = kbkdfDoublePipeline
+			}
+			var kdfParams pkcs11.Sp800108KdfParams
+			err = pkcs11.Unmarshal(req.Mechanism.Parameter, &kdfParams)
+			params.PrfType = kdfParams.PrfType
+			params.DataParams = kdfParams.DataParams
+			params.AdditionalDerivedKeys = kdfParams.AdditionalDerivedKeys
+		}
 		if err != nil {
-			return nil, err
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
 		}
-		sensitive, err := req.Template.OptBool(pkcs11.CkaSensitive)
+		prf, err := newPRF(params.PrfType, keyType, key)
 		if err != nil {
 			return nil, err
 		}
-		extractable, err := req.Template.OptBool(pkcs11.CkaExtractable)
+
+		// The primary key is followed by the additional keys in the
+		// derived keying material.
+		templates := []pkcs11.Template{req.Template}
+		for _, dk := range params.AdditionalDerivedKeys {
+			templates = append(templates, dk.Template)
+		}
+		var sizes []int
+		var total int
+		for _, tmpl := range templates {
+			c := pkcs11.ObjectClass(tmpl.OptInt(pkcs11.CkaClass,
+				int(pkcs11.CkoSecretKey)))
+			if c != pkcs11.CkoSecretKey {
+				return nil, pkcs11.ErrTemplateInconsistent
+			}
+			size, err := derivedKeyLen(tmpl, 0)
+			if err != nil {
+				return nil, err
+			}
+			sizes = append(sizes, size)
+			total += size
+		}
+		dkm, err := kbkdfDerive(mode, prf, params.DataParams, params.IV,
+			total)
 		if err != nil {
 			return nil, err
 		}
-		if size < int(info.MinKeySize) || size > int(info.MaxKeySize) {
-			return nil, pkcs11.ErrTemplateIncomplete
+		data = dkm[:sizes[0]]
+		dkm = dkm[sizes[0]:]
+
+		for i := 1; i < len(templates); i++ {
+			tmpl, err := derivedKeyTemplate(templates[i], dkm[:sizes[i]],
+				base)
+			if err != nil {
+				return nil, err
+			}
+			additional = append(additional, tmpl)
+			dkm = dkm[sizes[i]:]
 		}
-		var storage pkcs11.Storage
-		if token {
-			storage = p.tokenStorage
-		} else {
-			storage = p.parent.storage
+
+	case pkcs11.CkmConcatenateBaseAndKey:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
 		}
-		key := make([]byte, size)
-		_, err = rand.Read(key)
+		var handle pkcs11.ObjectHandle
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &handle)
 		if err != nil {
-			Errorf("rand.Read failed: %s", err)
-			return nil, pkcs11.ErrDeviceError
-		}
-		tmpl := req.Template
-		tmpl = tmpl.SetInt(pkcs11.CkaClass, cls)
-		tmpl = tmpl.SetBool(pkcs11.CkaToken, token)
-		tmpl = tmpl.SetBool(pkcs11.CkaSensitive, sensitive)
-		tmpl = tmpl.SetBool(pkcs11.CkaAlwaysSensitive, sensitive)
-		tmpl = tmpl.SetBool(pkcs11.CkaExtractable, extractable)
-		tmpl = tmpl.SetBool(pkcs11.CkaNeverExtractable, !extractable)
-		tmpl = tmpl.SetInt(pkcs11.CkaValueLen, size)
-		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
-
-		obj := &pkcs11.Object{
-			Attrs:  tmpl,
-			Native: key,
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
 		}
-		err = obj.Inflate()
+		other, err := p.readObject(handle, pkcs11.ErrKeyHandleInvalid)
 		if err != nil {
 			return nil, err
 		}
-		handle, err := storage.Create(obj)
+		// The second key must also be a secret key that can be used
+		// for key derivation. Its type is either the base key's type
+		// or a generic secret.
+		derive, err := other.Attrs.OptBool(pkcs11.CkaDerive)
 		if err != nil {
 			return nil, err
 		}
-		p.session.Objects[handle] = storage
-
-		return &pkcs11.GenerateKeyResp{
-			Key: handle,
-		}, nil
-
-	default:
-		Infof("GenerateKey: %s", req.Mechanism)
-		Infof("Template:")
-		req.Template.Print("\u2502 ")
-		return nil, pkcs11.ErrMechanismInvalid
-	}
-}
-
-// GenerateKeyPair implements the Provider.GenerateKeyPair().
-func (p *Provider) GenerateKeyPair(req *pkcs11.GenerateKeyPairReq) (*pkcs11.GenerateKeyPairResp, error) {
-	info, ok := mechanisms[req.Mechanism.Mechanism]
-	if !ok {
-		Errorf("%s: unknown mechanism", req.Mechanism.Mechanism)
-		return nil, pkcs11.ErrMechanismInvalid
-	}
-	token, err := req.PrivateKeyTemplate.OptBool(pkcs11.CkaToken)
-	if err != nil {
-		return nil, err
-	}
-	var storage pkcs11.Storage
-	if token {
-		storage = p.tokenStorage
-	} else {
-		storage = p.parent.storage
-	}
-
-	switch req.Mechanism.Mechanism {
-	case pkcs11.CkmRSAPKCSKeyPairGen, pkcs11.CkmRSAX931KeyPairGen:
-		bits, err := req.PublicKeyTemplate.Int(pkcs11.CkaModulusBits)
+		if !derive {
+			return nil, pkcs11.ErrKeyFunctionNotPermitted
+		}
+		otherClass := pkcs11.ObjectClass(other.Attrs.OptInt(pkcs11.CkaClass,
+			-1))
+		otherType := pkcs11.KeyType(other.Attrs.OptInt(pkcs11.CkaKeyType, -1))
+		if otherClass != pkcs11.CkoSecretKey ||
+			(otherType != keyType && otherType != pkcs11.CkkGenericSecret) {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		otherKey, err := secretKeyValue(other)
 		if err != nil {
-			return nil, err
+			return nil, pkcs11.ErrKeyTypeInconsistent
 		}
-		e, err := req.PublicKeyTemplate.BigInt(pkcs11.CkaPublicExponent)
+		bases = append(bases, other)
+		value := append(append([]byte{}, key...), otherKey...)
+		data, err = truncateKey(req.Template, value)
 		if err != nil {
 			return nil, err
 		}
-		if false {
-			Infof("bits:\t%d\n", bits)
-			Infof("e:\t%s\n", e)
-			Infof("token:\t%v\n", token)
+		req.Template = inheritKeyAttrs(req.Template, bases...)
+
+	case pkcs11.CkmConcatenateBaseAndData, pkcs11.CkmConcatenateDataAndBase,
+		pkcs11.CkmXORBaseAndData:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
 		}
-		if bits < int(info.MinKeySize) || bits > int(info.MaxKeySize) {
+		var params pkcs11.KeyDerivationStringData
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
 			return nil, pkcs11.ErrMechanismParamInvalid
 		}
-
-		key, err := rsa.GenerateKey(rand.Reader, int(bits))
-		if err != nil {
-			Errorf("rsa.GenerateKey failed: %s", err)
-			return nil, pkcs11.ErrDeviceError
+		var value []byte
+		switch req.Mechanism.Mechanism {
+		case pkcs11.CkmConcatenateBaseAndData:
+			value = append(append(value, key...), params.Data...)
+
+		case pkcs11.CkmConcatenateDataAndBase:
+			value = append(append(value, params.Data...), key...)
+
+		default:
+			value = make([]byte, len(key))
+			copy(value, key)
+			if len(params.Data) < len(value) {
+				value = value[:len(params.Data)]
+			}
+			xorBytes(value, params.Data)
 		}
-
-		// Store private key prime factors.
-		if len(key.Primes) != 2 {
-			Errorf("rsa.GenerateKey: #primes != 2: %d", len(key.Primes))
-			return nil, pkcs11.ErrDeviceError
+		data, err = truncateKey(req.Template, value)
+		if err != nil {
+			return nil, err
 		}
+		req.Template = inheritKeyAttrs(req.Template, bases...)
 
-		privTmpl := req.PrivateKeyTemplate
-		privTmpl = privTmpl.Set(pkcs11.CkaPrime1, key.Primes[0].Bytes())
-		privTmpl = privTmpl.Set(pkcs11.CkaPrime2, key.Primes[1].Bytes())
-		privTmpl = privTmpl.Set(pkcs11.CkaModulus, key.PublicKey.N.Bytes())
-		privTmpl = privTmpl.Set(pkcs11.CkaPublicExponent, e.Bytes())
-		privTmpl = privTmpl.Set(pkcs11.CkaPrivateExponent, key.D.Bytes())
-		privTmpl = privTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPrivateKey))
-		privTmpl = privTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkRSA))
-
-		privObj := &pkcs11.Object{
-			Attrs: privTmpl,
+	case pkcs11.CkmExtractKeyFromKey:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
 		}
-		err = privObj.Inflate()
+		var pos pkcs11.Ulong
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &pos)
 		if err != nil {
-			return nil, err
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if int(pos) >= len(key)*8 {
+			return nil, pkcs11.ErrMechanismParamInvalid
 		}
-		privHandle, err := storage.Create(privObj)
+		size, err := derivedKeyLen(req.Template, 0)
 		if err != nil {
 			return nil, err
 		}
-		p.session.Objects[privHandle] = storage
-
-		pubTmpl := req.PublicKeyTemplate
-		pubTmpl = pubTmpl.Set(pkcs11.CkaModulus, key.PublicKey.N.Bytes())
-		pubTmpl = pubTmpl.Set(pkcs11.CkaPublicExponent, e.Bytes())
-		pubTmpl = pubTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPublicKey))
-		pubTmpl = pubTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkRSA))
+		if size > len(key) {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		data = extractKey(key, int(pos), size)
+		req.Template = inheritKeyAttrs(req.Template, bases...)
 
-		pubObj := &pkcs11.Object{
-			Attrs: pubTmpl,
+	case pkcs11.CkmTLS12MasterKeyDerive, pkcs11.CkmTLS12MasterKeyDeriveDH:
+		if keyType != pkcs11.CkkGenericSecret {
+			return nil, pkcs11.ErrKeyTypeInconsistent
 		}
-		err = pubObj.Inflate()
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
+		}
+		var params pkcs11.Tls12MasterKeyDeriveParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		err = tlsRandoms(&params.RandomInfo)
 		if err != nil {
-			storage.Delete(privHandle)
 			return nil, err
 		}
-		pubHandle, err := storage.Create(pubObj)
+		prf, err := tlsPRFHash(params.PrfHashMechanism)
 		if err != nil {
-			storage.Delete(privHandle)
 			return nil, err
 		}
-		p.session.Objects[pubHandle] = storage
-
-		return &pkcs11.GenerateKeyPairResp{
-			PublicKey:  pubHandle,
-			PrivateKey: privHandle,
-		}, nil
-
-	case pkcs11.CkmECKeyPairGen:
-		params, err := req.PublicKeyTemplate.OptBytes(pkcs11.CkaECParams)
+		if req.Mechanism.Mechanism == pkcs11.CkmTLS12MasterKeyDerive {
+			// The RSA premaster secret starts with the client
+			// version.
+			if len(key) != tlsPremasterSecretLen {
+				return nil, pkcs11.ErrKeySizeRange
+			}
+			resp.Version = key[:2]
+		}
+		size, err := derivedKeyLen(req.Template, tlsMasterSecretLen)
 		if err != nil {
 			return nil, err
 		}
-		var curve elliptic.Curve
-		if bytes.Compare(params, secp224r1) == 0 {
-			curve = elliptic.P224()
-		} else if bytes.Compare(params, secp256r1) == 0 {
-			curve = elliptic.P256()
-		} else if bytes.Compare(params, secp384r1) == 0 {
-			curve = elliptic.P384()
-		} else if bytes.Compare(params, secp521r1) == 0 {
-			curve = elliptic.P521()
-		} else {
-			return nil, pkcs11.ErrMechanismParamInvalid
+		if size != tlsMasterSecretLen {
+			return nil, pkcs11.ErrTemplateInconsistent
 		}
-		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		var seed []byte
+		seed = append(seed, params.RandomInfo.ClientRandom...)
+		seed = append(seed, params.RandomInfo.ServerRandom...)
+		data = tlsPRF(prf, key, tlsLabelMasterSecret, seed, size)
+
+	case pkcs11.CkmTLS12KeyAndMACDerive:
+		// The base key is the master secret derived with
+		// CKM_TLS12_MASTER_KEY_DERIVE.
+		if keyType != pkcs11.CkkGenericSecret {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		if len(key) != tlsMasterSecretLen {
+			return nil, pkcs11.ErrKeySizeRange
+		}
+		var params pkcs11.Tls12KeyMatParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
 		if err != nil {
-			Errorf("ecdsa.GenerateKey failed: %s", err)
-			return nil, pkcs11.ErrDeviceError
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
 		}
-		privTmpl := req.PrivateKeyTemplate
-		privTmpl = privTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPrivateKey))
-		privTmpl = privTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkEC))
-		privTmpl = privTmpl.Set(pkcs11.CkaECParams, params)
-
-		privObj := &pkcs11.Object{
-			Attrs:  privTmpl,
-			Native: key,
+		if params.IsExport || params.MacSizeInBits%8 != 0 ||
+			params.KeySizeInBits%8 != 0 || params.IVSizeInBits%8 != 0 ||
+			params.MacSizeInBits > MaxDerivedKeyLen*8 ||
+			params.KeySizeInBits > MaxDerivedKeyLen*8 ||
+			params.IVSizeInBits > MaxDerivedKeyLen*8 {
+			return nil, pkcs11.ErrMechanismParamInvalid
 		}
-		err = privObj.Inflate()
+		err = tlsRandoms(&params.RandomInfo)
 		if err != nil {
 			return nil, err
 		}
-		privHandle, err := storage.Create(privObj)
+		prf, err := tlsPRFHash(params.PrfHashMechanism)
 		if err != nil {
 			return nil, err
 		}
-		p.session.Objects[privHandle] = storage
-
-		q := elliptic.Marshal(curve, key.X, key.Y)
+		macLen := int(params.MacSizeInBits / 8)
+		keyLen := int(params.KeySizeInBits / 8)
+		ivLen := int(params.IVSizeInBits / 8)
+
+		// The MAC secrets are generic secret keys and the template
+		// specifies the cipher keys.
+		macTmpl := req.Template.SetInt(pkcs11.CkaKeyType,
+			int(pkcs11.CkkGenericSecret))
+		macTmpl = macTmpl.SetInt(pkcs11.CkaValueLen, macLen)
+		macTmpl = macTmpl.SetBool(pkcs11.CkaSign, true)
+		macTmpl = macTmpl.SetBool(pkcs11.CkaVerify, true)
+		macTmpl = macTmpl.SetBool(pkcs11.CkaEncrypt, false)
+		macTmpl = macTmpl.SetBool(pkcs11.CkaDecrypt, false)
+
+		keyTmpl := req.Template.SetInt(pkcs11.CkaValueLen, keyLen)
+		if keyLen > 0 {
+			size, err := derivedKeyLen(keyTmpl, keyLen)
+			if err != nil {
+				return nil, err
+			}
+			if size != keyLen {
+				return nil, pkcs11.ErrTemplateInconsistent
+			}
+		}
 
-		pubTmpl := req.PublicKeyTemplate
-		pubTmpl = pubTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoPublicKey))
-		pubTmpl = pubTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkEC))
-		pubTmpl = pubTmpl.Set(pkcs11.CkaECPoint, q)
+		var seed []byte
+		seed = append(seed, params.RandomInfo.ServerRandom...)
+		seed = append(seed, params.RandomInfo.ClientRandom...)
+		block := tlsPRF(prf, key, tlsLabelKeyExpansion, seed,
+			2*(macLen+keyLen+ivLen))
+
+		// The key block contains the client and server MAC secrets,
+		// keys, and IVs.
+		templates := make([]pkcs11.Template, 4)
+		for i := range templates {
+			t := macTmpl
+			size := macLen
+			if i >= 2 {
+				t = keyTmpl
+				size = keyLen
+			}
+			if size == 0 {
+				block = block[size:]
+				continue
+			}
+			templates[i], err = derivedKeyTemplate(t, block[:size], base)
+			if err != nil {
+				return nil, err
+			}
+			block = block[size:]
+		}
+		resp.Iv = block
+		resp.KeyMaterial = make([]pkcs11.ObjectHandle, len(templates))
+		for i, tmpl := range templates {
+			if tmpl == nil {
+				continue
+			}
+			resp.KeyMaterial[i], err = p.createObject(tmpl)
+			if err != nil {
+				p.deleteObjects(resp.KeyMaterial[:i]...)
+				return nil, err
+			}
+		}
+		return resp, nil
 
-		pubObj := &pkcs11.Object{
-			Attrs:  pubTmpl,
-			Native: &key.PublicKey,
+	case pkcs11.CkmTLS12KDF:
+		if cls != pkcs11.CkoSecretKey {
+			return nil, pkcs11.ErrTemplateInconsistent
 		}
-		err = pubObj.Inflate()
+		var params pkcs11.TlsKdfParams
+		err = pkcs11.Unmarshal(req.Mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		err = tlsRandoms(&params.RandomInfo)
 		if err != nil {
-			storage.Delete(privHandle)
 			return nil, err
 		}
-		pubHandle, err := storage.Create(pubObj)
+		prf, err := tlsPRFHash(params.PrfMechanism)
 		if err != nil {
-			storage.Delete(privHandle)
 			return nil, err
 		}
-		p.session.Objects[pubHandle] = storage
-		if false {
-			Infof("GenerateKey: %s", req.Mechanism)
-			Infof(" - PublicKey:")
-			pubObj.Attrs.Print("\u2502 ")
-			Infof(" - PrivateKey:")
-			privObj.Attrs.Print("\u2502 ")
+		size, err := derivedKeyLen(req.Template, 0)
+		if err != nil {
+			return nil, err
 		}
-
-		return &pkcs11.GenerateKeyPairResp{
-			PublicKey:  pubHandle,
-			PrivateKey: privHandle,
-		}, nil
+		data = tlsKDF(prf, key, &params, size)
 
 	default:
-		Infof("GenerateKeyPair: %s", req.Mechanism)
-		Infof("PublicKeyTemplate:")
-		req.PublicKeyTemplate.Print("\u2502 ")
-		Infof("PrivateKeyTemplate:")
-		req.PrivateKeyTemplate.Print("\u2502 ")
-
+		Errorf("DeriveKey: %s", req.Mechanism.Mechanism)
 		return nil, pkcs11.ErrMechanismInvalid
 	}
+
+	tmpl, err := derivedKeyTemplate(req.Template, data, bases...)
+	if err != nil {
+		return nil, err
+	}
+	resp.Key, err = p.createObject(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpl := range additional {
+		handle, err := p.createObject(tmpl)
+		if err != nil {
+			p.deleteObjects(resp.Key)
+			p.deleteObjects(resp.AdditionalKeys...)
+			return nil, err
+		}
+		resp.AdditionalKeys = append(resp.AdditionalKeys, handle)
+	}
+	return resp, nil
+}
+
+// deleteObjects deletes the objects that an operation created before
+// it failed. Zero handles are skipped.
+func (p *Provider) deleteObjects(handles ...pkcs11.ObjectHandle) {
+	for _, h := range handles {
+		if h == 0 {
+			continue
+		}
+		err := p.handleStorage(h).Delete(h)
+		if err != nil {
+			Errorf("delete object %v: %v", h, err)
+		}
+	}
+}
+
+// createObject creates a new object from the template. The object is
+// stored in the token or session storage based on the CKA_TOKEN
+// attribute.
+func (p *Provider) createObject(tmpl pkcs11.Template) (
+	pkcs11.ObjectHandle, error) {
+
+	token, err := tmpl.OptBool(pkcs11.CkaToken)
+	if err != nil {
+		return 0, err
+	}
+	storage, err := p.objectStorage(token)
+	if err != nil {
+		return 0, err
+	}
+	uuid, err := uuid.New()
+	if err != nil {
+		return 0, pkcs11.ErrDeviceError
+	}
+	tmpl = tmpl.Set(pkcs11.CkaUniqueID, []byte(uuid.String()))
+
+	obj := &pkcs11.Object{
+		Attrs: tmpl,
+	}
+	err = obj.Inflate()
+	if err != nil {
+		return 0, err
+	}
+	handle, err := p.storeObject(storage, obj)
+	if err != nil {
+		return 0, err
+	}
+
+	return handle, nil
 }
 
 // SeedRandom implements the Provider.SeedRandom().
@@ -0,0 +1,270 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func TestNewBlockCipher(t *testing.T) {
+	defer func(legacy bool) {
+		legacyCiphers = legacy
+	}(legacyCiphers)
+	legacyCiphers = true
+
+	key := make([]byte, 24)
+
+	tests := []struct {
+		mech    pkcs11.MechanismType
+		keyType pkcs11.KeyType
+		err     error
+	}{
+		{pkcs11.CkmAESECB, pkcs11.CkkAES, nil},
+		{pkcs11.CkmAESCBC, pkcs11.CkkAES, nil},
+		{pkcs11.CkmAESECB, pkcs11.CkkGenericSecret, pkcs11.ErrKeyTypeInconsistent},
+		{pkcs11.CkmAESCBC, pkcs11.CkkDES3, pkcs11.ErrKeyTypeInconsistent},
+		{pkcs11.CkmAESCBCPad, pkcs11.CkkChaCha20, pkcs11.ErrKeyTypeInconsistent},
+		{pkcs11.CkmDES3ECB, pkcs11.CkkDES3, nil},
+		{pkcs11.CkmDES3CBC, pkcs11.CkkAES, pkcs11.ErrKeyTypeInconsistent},
+	}
+	for idx, test := range tests {
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(test.keyType))
+		obj := &pkcs11.Object{
+			Attrs:  tmpl,
+			Native: key,
+		}
+		_, err := newBlockCipher(test.mech, obj, key)
+		if err != test.err {
+			t.Errorf("test %d: newBlockCipher(%s, %s): %v, expected %v",
+				idx, test.mech, test.keyType, err, test.err)
+		}
+	}
+}
+
+func TestDualFunction(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	aesKey := bytes.Repeat([]byte{0x42}, 16)
+	hmacKey := bytes.Repeat([]byte{0x17}, 32)
+	iv := bytes.Repeat([]byte{0x01}, aes.BlockSize)
+	pt := []byte("The quick brown fox jumps over the lazy dog.....")
+
+	encKey := createSecretKey(session, pkcs11.CkkAES, aesKey)
+	macKey := createSecretKey(session, pkcs11.CkkGenericSecret, hmacKey)
+
+	// The results of the separate operations.
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	ct := make([]byte, len(pt))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ct, pt)
+	digest := sha256.Sum256(pt)
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(pt)
+	signature := mac.Sum(nil)
+
+	encMech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmAESCBC,
+		Parameter: iv,
+	}
+	digestMech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmSHA256,
+	}
+	macMech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmSHA256HMAC,
+	}
+
+	// The dual-function operations process the data in 7 byte parts.
+	parts := func(data []byte, f func(part []byte) []byte) []byte {
+		var result []byte
+		for i := 0; i < len(data); i += 7 {
+			end := i + 7
+			if end > len(data) {
+				end = len(data)
+			}
+			result = append(result, f(data[i:end])...)
+		}
+		return result
+	}
+
+	// DigestEncryptUpdate.
+	ret := session.call(msgDigestEncryptUpdate,
+		&pkcs11.DigestEncryptUpdateReq{
+			Part:              pt,
+			EncryptedPartSize: 1024,
+		}, nil)
+	if ret != pkcs11.ErrOperationNotInitialized {
+		t.Errorf("DigestEncryptUpdate without operations: %s", ret)
+	}
+	session.mustCall(msgDigestInit, &pkcs11.DigestInitReq{
+		Mechanism: digestMech,
+	}, nil)
+	session.mustCall(msgEncryptInit, &pkcs11.EncryptInitReq{
+		Mechanism: encMech,
+		Key:       encKey,
+	}, &pkcs11.EncryptInitResp{})
+
+	// The size query does not digest the part.
+	session.mustCall(msgDigestEncryptUpdate, &pkcs11.DigestEncryptUpdateReq{
+		Part: pt[:7],
+	}, &pkcs11.DigestEncryptUpdateResp{})
+
+	result := parts(pt, func(part []byte) []byte {
+		var resp pkcs11.DigestEncryptUpdateResp
+		session.mustCall(msgDigestEncryptUpdate,
+			&pkcs11.DigestEncryptUpdateReq{
+				Part:              part,
+				EncryptedPartSize: 1024,
+			}, &resp)
+		return resp.EncryptedPart
+	})
+	var encFinal pkcs11.EncryptFinalResp
+	session.mustCall(msgEncryptFinal, &pkcs11.EncryptFinalReq{
+		LastEncryptedPartSize: 1024,
+	}, &encFinal)
+	result = append(result, encFinal.LastEncryptedPart...)
+	if !bytes.Equal(result, ct) {
+		t.Errorf("DigestEncryptUpdate ciphertext:\ngot:  %x\nwant: %x",
+			result, ct)
+	}
+	var digestFinal pkcs11.DigestFinalResp
+	session.mustCall(msgDigestFinal, &pkcs11.DigestFinalReq{
+		DigestSize: 1024,
+	}, &digestFinal)
+	if !bytes.Equal(digestFinal.Digest, digest[:]) {
+		t.Errorf("DigestEncryptUpdate digest:\ngot:  %x\nwant: %x",
+			digestFinal.Digest, digest)
+	}
+
+	// DecryptDigestUpdate.
+	session.mustCall(msgDigestInit, &pkcs11.DigestInitReq{
+		Mechanism: digestMech,
+	}, nil)
+	session.mustCall(msgDecryptInit, &pkcs11.DecryptInitReq{
+		Mechanism: encMech,
+		Key:       encKey,
+	}, nil)
+	result = parts(ct, func(part []byte) []byte {
+		var resp pkcs11.DecryptDigestUpdateResp
+		session.mustCall(msgDecryptDigestUpdate,
+			&pkcs11.DecryptDigestUpdateReq{
+				EncryptedPart: part,
+				PartSize:      1024,
+			}, &resp)
+		return resp.Part
+	})
+	var decFinal pkcs11.DecryptFinalResp
+	session.mustCall(msgDecryptFinal, &pkcs11.DecryptFinalReq{
+		LastPartSize: 1024,
+	}, &decFinal)
+	result = append(result, decFinal.LastPart...)
+	if !bytes.Equal(result, pt) {
+		t.Errorf("DecryptDigestUpdate plaintext:\ngot:  %x\nwant: %x",
+			result, pt)
+	}
+	session.mustCall(msgDigestFinal, &pkcs11.DigestFinalReq{
+		DigestSize: 1024,
+	}, &digestFinal)
+	if !bytes.Equal(digestFinal.Digest, digest[:]) {
+		t.Errorf("DecryptDigestUpdate digest:\ngot:  %x\nwant: %x",
+			digestFinal.Digest, digest)
+	}
+
+	// SignEncryptUpdate.
+	session.mustCall(msgSignInit, &pkcs11.SignInitReq{
+		Mechanism: macMech,
+		Key:       macKey,
+	}, nil)
+	session.mustCall(msgEncryptInit, &pkcs11.EncryptInitReq{
+		Mechanism: encMech,
+		Key:       encKey,
+	}, &pkcs11.EncryptInitResp{})
+	result = parts(pt, func(part []byte) []byte {
+		var resp pkcs11.SignEncryptUpdateResp
+		session.mustCall(msgSignEncryptUpdate, &pkcs11.SignEncryptUpdateReq{
+			Part:              part,
+			EncryptedPartSize: 1024,
+		}, &resp)
+		return resp.EncryptedPart
+	})
+	session.mustCall(msgEncryptFinal, &pkcs11.EncryptFinalReq{
+		LastEncryptedPartSize: 1024,
+	}, &encFinal)
+	result = append(result, encFinal.LastEncryptedPart...)
+	if !bytes.Equal(result, ct) {
+		t.Errorf("SignEncryptUpdate ciphertext:\ngot:  %x\nwant: %x",
+			result, ct)
+	}
+	var signFinal pkcs11.SignFinalResp
+	session.mustCall(msgSignFinal, &pkcs11.SignFinalReq{
+		SignatureSize: 1024,
+	}, &signFinal)
+	if !bytes.Equal(signFinal.Signature, signature) {
+		t.Errorf("SignEncryptUpdate signature:\ngot:  %x\nwant: %x",
+			signFinal.Signature, signature)
+	}
+
+	// DecryptVerifyUpdate with the correct and a modified signature.
+	for _, tampered := range []bool{false, true} {
+		session.mustCall(msgVerifyInit, &pkcs11.VerifyInitReq{
+			Mechanism: macMech,
+			Key:       macKey,
+		}, nil)
+		session.mustCall(msgDecryptInit, &pkcs11.DecryptInitReq{
+			Mechanism: encMech,
+			Key:       encKey,
+		}, nil)
+		result = parts(ct, func(part []byte) []byte {
+			var resp pkcs11.DecryptVerifyUpdateResp
+			session.mustCall(msgDecryptVerifyUpdate,
+				&pkcs11.DecryptVerifyUpdateReq{
+					EncryptedPart: part,
+					PartSize:      1024,
+				}, &resp)
+			return resp.Part
+		})
+		session.mustCall(msgDecryptFinal, &pkcs11.DecryptFinalReq{
+			LastPartSize: 1024,
+		}, &decFinal)
+		result = append(result, decFinal.LastPart...)
+		if !bytes.Equal(result, pt) {
+			t.Errorf("DecryptVerifyUpdate plaintext:\ngot:  %x\nwant: %x",
+				result, pt)
+		}
+		sig := append([]byte(nil), signature...)
+		expected := pkcs11.ErrOk
+		if tampered {
+			sig[0] ^= 0x01
+			expected = pkcs11.ErrSignatureInvalid
+		}
+		ret = session.call(msgVerifyFinal, &pkcs11.VerifyFinalReq{
+			Signature: sig,
+		}, nil)
+		if ret != expected {
+			t.Errorf("DecryptVerifyUpdate tampered=%v: %s, expected %s",
+				tampered, ret, expected)
+		}
+	}
+}
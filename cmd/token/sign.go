@@ -0,0 +1,275 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// newEdDSA creates the EdDSA sign/verify object. The optional
+// mechanism parameter selects the Ed25519ph pre-hash variant and the
+// Ed25519ctx context data.
+func newEdDSA(mechanism pkcs11.Mechanism) (*SignVerify, error) {
+	opts := new(ed25519.Options)
+
+	if len(mechanism.Parameter) != 0 {
+		var params pkcs11.EddsaParams
+		err := pkcs11.Unmarshal(mechanism.Parameter, &params)
+		if err != nil {
+			Errorf("pkcs11.Unmarshal: %v", err)
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if len(params.ContextData) > 255 {
+			return nil, pkcs11.ErrMechanismParamInvalid
+		}
+		if params.Flag {
+			opts.Hash = crypto.SHA512
+		}
+		opts.Context = string(params.ContextData)
+	}
+	sv := &SignVerify{
+		Mechanism: mechanism,
+		EdDSA:     opts,
+	}
+	if opts.Hash == crypto.SHA512 {
+		sv.Hash = crypto.SHA512
+		sv.Digest = sha512.New()
+	} else {
+		sv.Digest = new(HashNone)
+	}
+	return sv, nil
+}
+
+// pssMGFs maps the PSS hash mechanisms to their MGF1 mask generation
+// functions. The crypto/rsa uses the same hash function for the
+// message and for the MGF1.
+var pssMGFs = map[pkcs11.MechanismType]pkcs11.RsaPkcsMgfType{
+	pkcs11.CkmSHA1:    pkcs11.CkgMGF1SHA1,
+	pkcs11.CkmSHA224:  pkcs11.CkgMGF1SHA224,
+	pkcs11.CkmSHA256:  pkcs11.CkgMGF1SHA256,
+	pkcs11.CkmSHA384:  pkcs11.CkgMGF1SHA384,
+	pkcs11.CkmSHA512:  pkcs11.CkgMGF1SHA512,
+	pkcs11.CkmSHA3224: pkcs11.CkgMGF1SHA3224,
+	pkcs11.CkmSHA3256: pkcs11.CkgMGF1SHA3256,
+	pkcs11.CkmSHA3384: pkcs11.CkgMGF1SHA3384,
+	pkcs11.CkmSHA3512: pkcs11.CkgMGF1SHA3512,
+}
+
+// isPSS tests if the mechanism is one of the hashed RSA PKCS #1 PSS
+// signature mechanisms.
+func isPSS(mech pkcs11.MechanismType) bool {
+	switch mech {
+	case pkcs11.CkmSHA1RSAPKCSPSS, pkcs11.CkmSHA224RSAPKCSPSS,
+		pkcs11.CkmSHA256RSAPKCSPSS, pkcs11.CkmSHA384RSAPKCSPSS,
+		pkcs11.CkmSHA512RSAPKCSPSS, pkcs11.CkmSHA3224RSAPKCSPSS,
+		pkcs11.CkmSHA3256RSAPKCSPSS, pkcs11.CkmSHA3384RSAPKCSPSS,
+		pkcs11.CkmSHA3512RSAPKCSPSS:
+		return true
+	default:
+		return false
+	}
+}
+
+// newPSSOptions creates the PSS options from the CK_RSA_PKCS_PSS_PARAMS
+// mechanism parameter. The parameter's hash must match the mechanism's
+// digest and the MGF1 must use the same hash. The crypto/rsa can't
+// create signatures with an empty salt so the salt length must be
+// positive.
+func newPSSOptions(mechanism pkcs11.Mechanism,
+	digestMech pkcs11.MechanismType) (*rsa.PSSOptions, error) {
+
+	var params pkcs11.RsaPkcsPssParams
+	err := pkcs11.Unmarshal(mechanism.Parameter, &params)
+	if err != nil {
+		Errorf("pkcs11.Unmarshal: %v", err)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	if params.HashAlg != digestMech {
+		Errorf("PSS: hash %v does not match mechanism %v",
+			params.HashAlg, mechanism.Mechanism)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	if params.Mgf != pssMGFs[digestMech] {
+		Errorf("PSS: MGF %v does not match hash %v",
+			params.Mgf, params.HashAlg)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	if params.SLen == 0 {
+		Errorf("PSS: invalid salt length %v", params.SLen)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	return &rsa.PSSOptions{
+		SaltLength: int(params.SLen),
+		Hash:       digests[digestMech].Hash,
+	}, nil
+}
+
+// SignatureLen returns the length of the signature that Sign will
+// create.
+func (sv *SignVerify) SignatureLen() (int, error) {
+	switch priv := sv.Key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return signatureLen(priv), nil
+
+	case ed25519.PrivateKey:
+		return ed25519.SignatureSize, nil
+
+	case []byte:
+		return sv.Digest.Size(), nil
+
+	default:
+		Errorf("sign not supported for key %T", priv)
+		return 0, pkcs11.ErrDeviceError
+	}
+}
+
+// Sign signs the data written to the Digest.
+func (sv *SignVerify) Sign() ([]byte, error) {
+	switch priv := sv.Key.(type) {
+	case *rsa.PrivateKey:
+		if sv.PSS != nil {
+			signature, err := rsa.SignPSS(rand.Reader, priv, sv.Hash,
+				sv.Digest.Sum(nil), sv.PSS)
+			if err != nil {
+				Errorf("rsa.SignPSS: %s", err)
+				return nil, pkcs11.ErrFunctionFailed
+			}
+			return signature, nil
+		}
+		signature, err := rsa.SignPKCS1v15(rand.Reader, priv, sv.Hash,
+			sv.Digest.Sum(nil))
+		if err != nil {
+			Errorf("rsa.SignPKCS1v15: %s", err)
+			return nil, pkcs11.ErrFunctionFailed
+		}
+		return signature, nil
+
+	case *ecdsa.PrivateKey:
+		signature, err := ecdsa.SignASN1(rand.Reader, priv, sv.Digest.Sum(nil))
+		if err != nil {
+			Errorf("ecdsa.SignASN1: %s", err)
+			return nil, pkcs11.ErrFunctionFailed
+		}
+		return signature, nil
+
+	case ed25519.PrivateKey:
+		if sv.EdDSA == nil {
+			return nil, pkcs11.ErrKeyTypeInconsistent
+		}
+		signature, err := priv.Sign(nil, sv.Digest.Sum(nil), sv.EdDSA)
+		if err != nil {
+			Errorf("ed25519.Sign: %s", err)
+			return nil, pkcs11.ErrFunctionFailed
+		}
+		return signature, nil
+
+	case []byte:
+		return sv.Digest.Sum(nil), nil
+
+	default:
+		Errorf("sign not supported for key %T", priv)
+		return nil, pkcs11.ErrDeviceError
+	}
+}
+
+// Verify verifies the signature of the data written to the Digest.
+func (sv *SignVerify) Verify(signature []byte) error {
+	switch pub := sv.Key.(type) {
+	case *rsa.PublicKey:
+		if sv.PSS != nil {
+			err := rsa.VerifyPSS(pub, sv.Hash, sv.Digest.Sum(nil), signature,
+				sv.PSS)
+			if err != nil {
+				Errorf("rsa.VerifyPSS: %s", err)
+				return pkcs11.ErrSignatureInvalid
+			}
+			return nil
+		}
+		err := rsa.VerifyPKCS1v15(pub, sv.Hash, sv.Digest.Sum(nil), signature)
+		if err != nil {
+			Errorf("rsa.VerifyPKCS1v15: %s", err)
+			return pkcs11.ErrSignatureInvalid
+		}
+
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, sv.Digest.Sum(nil), signature) {
+			Errorf("ecdsa.VerifyASN1 failed")
+			return pkcs11.ErrSignatureInvalid
+		}
+
+	case ed25519.PublicKey:
+		if sv.EdDSA == nil {
+			return pkcs11.ErrKeyTypeInconsistent
+		}
+		if len(signature) != ed25519.SignatureSize {
+			return pkcs11.ErrSignatureLenRange
+		}
+		err := ed25519.VerifyWithOptions(pub, sv.Digest.Sum(nil), signature,
+			sv.EdDSA)
+		if err != nil {
+			Errorf("ed25519.VerifyWithOptions: %s", err)
+			return pkcs11.ErrSignatureInvalid
+		}
+
+	case []byte:
+		if !hmac.Equal(sv.Digest.Sum(nil), signature) {
+			Errorf("HMAC verification failed")
+			return pkcs11.ErrSignatureInvalid
+		}
+
+	default:
+		Errorf("verify not supported for key %T", pub)
+		return pkcs11.ErrDeviceError
+	}
+	return nil
+}
+
+// newMessageSignVerify creates the message-based sign/verify object
+// for the mechanism and key. The sign argument specifies if the
+// object is used for signing or for verification.
+func newMessageSignVerify(mechanism pkcs11.Mechanism, key interface{},
+	sign bool) (*MessageSignVerify, error) {
+
+	msv := &MessageSignVerify{
+		Mechanism: mechanism,
+		Key:       key,
+		Sign:      sign,
+	}
+	// Validate mechanism and key.
+	_, err := msv.NewMessage(nil)
+	if err != nil {
+		return nil, err
+	}
+	return msv, nil
+}
+
+// NewMessage creates the sign/verify object for a message. The
+// non-empty per-message parameters override the mechanism parameters
+// given in the init.
+func (msv *MessageSignVerify) NewMessage(params []byte) (*SignVerify, error) {
+	mechanism := msv.Mechanism
+	if len(params) != 0 {
+		mechanism.Parameter = params
+	}
+	sv, err := NewSignVerify(mechanism)
+	if err != nil {
+		return nil, err
+	}
+	err = sv.SetKey(msv.Key, msv.Sign)
+	if err != nil {
+		return nil, err
+	}
+	return sv, nil
+}
@@ -0,0 +1,566 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func TestSignVerifyKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 32)
+
+	tests := []struct {
+		mech pkcs11.MechanismType
+		key  interface{}
+		sign bool
+		ok   bool
+	}{
+		{pkcs11.CkmSHA256RSAPKCS, rsaKey, true, true},
+		{pkcs11.CkmSHA256RSAPKCS, &rsaKey.PublicKey, false, true},
+		{pkcs11.CkmSHA256RSAPKCS, &rsaKey.PublicKey, true, false},
+		{pkcs11.CkmSHA256RSAPKCS, rsaKey, false, false},
+		{pkcs11.CkmSHA256RSAPKCS, secret, true, false},
+		{pkcs11.CkmSHA256RSAPKCS, secret, false, false},
+		{pkcs11.CkmSHA256RSAPKCS, ecKey, true, false},
+		{pkcs11.CkmRSAPKCS, secret, true, false},
+		{pkcs11.CkmECDSASHA256, ecKey, true, true},
+		{pkcs11.CkmECDSASHA256, &ecKey.PublicKey, false, true},
+		{pkcs11.CkmECDSASHA256, rsaKey, true, false},
+		{pkcs11.CkmECDSASHA256, secret, false, false},
+		{pkcs11.CkmDSASHA256, ecKey, true, false},
+		{pkcs11.CkmSHA256HMAC, secret, true, true},
+		{pkcs11.CkmSHA256HMAC, secret, false, true},
+		{pkcs11.CkmSHA256HMAC, rsaKey, true, false},
+	}
+	for idx, test := range tests {
+		sv, err := NewSignVerify(pkcs11.Mechanism{
+			Mechanism: test.mech,
+		})
+		if err != nil {
+			t.Fatalf("test %d: NewSignVerify(%s): %s", idx, test.mech, err)
+		}
+		err = sv.SetKey(test.key, test.sign)
+		if test.ok {
+			if err != nil {
+				t.Errorf("test %d: %s: SetKey(%T): %s",
+					idx, test.mech, test.key, err)
+			}
+		} else if err != pkcs11.ErrKeyTypeInconsistent {
+			t.Errorf("test %d: %s: SetKey(%T) succeeded",
+				idx, test.mech, test.key)
+		}
+	}
+}
+
+func TestSignVerifyDigests(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("HMAC key")
+
+	tests := []struct {
+		mech pkcs11.MechanismType
+		priv interface{}
+		pub  interface{}
+	}{
+		{pkcs11.CkmSHA1RSAPKCS, rsaKey, &rsaKey.PublicKey},
+		{pkcs11.CkmSHA3256RSAPKCS, rsaKey, &rsaKey.PublicKey},
+		{pkcs11.CkmSHA3512RSAPKCS, rsaKey, &rsaKey.PublicKey},
+		{pkcs11.CkmECDSASHA1, ecKey, &ecKey.PublicKey},
+		{pkcs11.CkmECDSASHA3256, ecKey, &ecKey.PublicKey},
+		{pkcs11.CkmECDSASHA3384, ecKey, &ecKey.PublicKey},
+		{pkcs11.CkmSHA1HMAC, secret, secret},
+		{pkcs11.CkmSHA512256HMAC, secret, secret},
+		{pkcs11.CkmSHA3256HMAC, secret, secret},
+		{pkcs11.CkmBlake2b160HMAC, secret, secret},
+		{pkcs11.CkmBlake2b512HMAC, secret, secret},
+	}
+	msg := []byte("The quick brown fox jumps over the lazy dog")
+
+	for _, test := range tests {
+		mech := pkcs11.Mechanism{
+			Mechanism: test.mech,
+		}
+		signer, err := NewSignVerify(mech)
+		if err != nil {
+			t.Fatalf("%s: NewSignVerify: %v", test.mech, err)
+		}
+		err = signer.SetKey(test.priv, true)
+		if err != nil {
+			t.Fatalf("%s: SetKey: %v", test.mech, err)
+		}
+		signer.Digest.Write(msg)
+		signature, err := signer.Sign()
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", test.mech, err)
+		}
+		size, err := signer.SignatureLen()
+		if err != nil || len(signature) > size {
+			t.Errorf("%s: signature length %v, SignatureLen %v",
+				test.mech, len(signature), size)
+		}
+
+		for i, data := range [][]byte{msg, msg[1:]} {
+			verifier, err := NewSignVerify(mech)
+			if err != nil {
+				t.Fatalf("%s: NewSignVerify: %v", test.mech, err)
+			}
+			err = verifier.SetKey(test.pub, false)
+			if err != nil {
+				t.Fatalf("%s: SetKey: %v", test.mech, err)
+			}
+			verifier.Digest.Write(data)
+			err = verifier.Verify(signature)
+			if i == 0 && err != nil {
+				t.Errorf("%s: Verify: %v", test.mech, err)
+			} else if i != 0 && err != pkcs11.ErrSignatureInvalid {
+				t.Errorf("%s: Verify modified data: %v", test.mech, err)
+			}
+		}
+	}
+}
+
+func TestRSAPSS(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	provider, err := LookupProvider(init.ProviderID)
+	if err != nil {
+		t.Fatalf("LookupProvider: %v", err)
+	}
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	var pubTmpl, privTmpl pkcs11.Template
+	pubTmpl = pubTmpl.SetInt(pkcs11.CkaModulusBits, 2048)
+	pubTmpl = pubTmpl.Set(pkcs11.CkaPublicExponent, []byte{1, 0, 1})
+	pubTmpl = pubTmpl.SetBool(pkcs11.CkaVerify, true)
+	privTmpl = privTmpl.SetBool(pkcs11.CkaSign, true)
+
+	var keys pkcs11.GenerateKeyPairResp
+	session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmRSAPKCSKeyPairGen,
+		},
+		PublicKeyTemplate:  pubTmpl,
+		PrivateKeyTemplate: privTmpl,
+	}, &keys)
+
+	obj, err := provider.storage.Read(keys.PublicKey)
+	if err != nil {
+		t.Fatalf("storage.Read: %v", err)
+	}
+	pub := obj.Native.(*rsa.PublicKey)
+
+	pssMech := func(mech, hashAlg pkcs11.MechanismType,
+		mgf pkcs11.RsaPkcsMgfType, sLen int) pkcs11.Mechanism {
+
+		params, err := pkcs11.Marshal(&pkcs11.RsaPkcsPssParams{
+			HashAlg: hashAlg,
+			Mgf:     mgf,
+			SLen:    pkcs11.Ulong(sLen),
+		})
+		if err != nil {
+			t.Fatalf("pkcs11.Marshal: %v", err)
+		}
+		return pkcs11.Mechanism{
+			Mechanism: mech,
+			Parameter: params,
+		}
+	}
+	msg := []byte("The quick brown fox jumps over the lazy dog")
+
+	tests := []struct {
+		mech    pkcs11.MechanismType
+		hashAlg pkcs11.MechanismType
+		mgf     pkcs11.RsaPkcsMgfType
+		hash    crypto.Hash
+		sLen    int
+	}{
+		{pkcs11.CkmSHA256RSAPKCSPSS, pkcs11.CkmSHA256, pkcs11.CkgMGF1SHA256,
+			crypto.SHA256, 32},
+		{pkcs11.CkmSHA384RSAPKCSPSS, pkcs11.CkmSHA384, pkcs11.CkgMGF1SHA384,
+			crypto.SHA384, 20},
+		{pkcs11.CkmSHA3256RSAPKCSPSS, pkcs11.CkmSHA3256, pkcs11.CkgMGF1SHA3256,
+			crypto.SHA3_256, 32},
+	}
+	for _, test := range tests {
+		mech := pssMech(test.mech, test.hashAlg, test.mgf, test.sLen)
+
+		session.mustCall(msgSignInit, &pkcs11.SignInitReq{
+			Mechanism: mech,
+			Key:       keys.PrivateKey,
+		}, nil)
+		var sig pkcs11.SignResp
+		session.mustCall(msgSign, &pkcs11.SignReq{
+			Data:          msg,
+			SignatureSize: 256,
+		}, &sig)
+
+		h := test.hash.New()
+		h.Write(msg)
+		err = rsa.VerifyPSS(pub, test.hash, h.Sum(nil), sig.Signature,
+			&rsa.PSSOptions{
+				SaltLength: test.sLen,
+			})
+		if err != nil {
+			t.Errorf("%s: rsa.VerifyPSS: %v", test.mech, err)
+		}
+		err = rsa.VerifyPKCS1v15(pub, test.hash, h.Sum(nil), sig.Signature)
+		if err == nil {
+			t.Errorf("%s: PKCS #1 v1.5 signature", test.mech)
+		}
+
+		session.mustCall(msgVerifyInit, &pkcs11.VerifyInitReq{
+			Mechanism: mech,
+			Key:       keys.PublicKey,
+		}, nil)
+		session.mustCall(msgVerify, &pkcs11.VerifyReq{
+			Data:      msg,
+			Signature: sig.Signature,
+		}, nil)
+
+		// The salt length must match the signature.
+		session.mustCall(msgVerifyInit, &pkcs11.VerifyInitReq{
+			Mechanism: pssMech(test.mech, test.hashAlg, test.mgf,
+				test.sLen+1),
+			Key: keys.PublicKey,
+		}, nil)
+		ret := session.call(msgVerify, &pkcs11.VerifyReq{
+			Data:      msg,
+			Signature: sig.Signature,
+		}, nil)
+		if ret != pkcs11.ErrSignatureInvalid {
+			t.Errorf("%s: Verify with wrong salt length: %s", test.mech, ret)
+		}
+	}
+
+	// Invalid parameters.
+	for _, mech := range []pkcs11.Mechanism{
+		{
+			Mechanism: pkcs11.CkmSHA256RSAPKCSPSS,
+		},
+		pssMech(pkcs11.CkmSHA256RSAPKCSPSS, pkcs11.CkmSHA1,
+			pkcs11.CkgMGF1SHA1, 20),
+		pssMech(pkcs11.CkmSHA256RSAPKCSPSS, pkcs11.CkmSHA256,
+			pkcs11.CkgMGF1SHA1, 32),
+		pssMech(pkcs11.CkmSHA256RSAPKCSPSS, pkcs11.CkmSHA256,
+			pkcs11.CkgMGF1SHA256, 0),
+	} {
+		ret := session.call(msgSignInit, &pkcs11.SignInitReq{
+			Mechanism: mech,
+			Key:       keys.PrivateKey,
+		}, nil)
+		if ret != pkcs11.ErrMechanismParamInvalid {
+			t.Errorf("SignInit with invalid PSS parameters: %s", ret)
+		}
+	}
+}
+
+// RFC 8032 section 7.1, 7.2 and 7.3 test vectors.
+var eddsaTests = []struct {
+	seed      string
+	pub       string
+	msg       string
+	context   string
+	prehash   bool
+	signature string
+}{
+	{
+		seed: "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60",
+		pub:  "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		signature: "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e06522490155" +
+			"5fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b",
+	},
+	{
+		seed: "4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb",
+		pub:  "3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+		msg:  "72",
+		signature: "92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da" +
+			"085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00",
+	},
+	{
+		seed:    "0305334e381af78f141cb666f6199f57bc3495335a256a95bd2a55bf546663f6",
+		pub:     "dfc9425e4f968f7f0c29f0259cf5f9aed6851c2bb4ad8bfb860cfee0ab248292",
+		msg:     "f726936d19c800494e3fdaff20b276a8",
+		context: "666f6f",
+		signature: "55a4cc2f70a54e04288c5f4cd1e45a7bb520b36292911876cada7323198dd87a" +
+			"8b36950b95130022907a7fb7c4e9b2d5f6cca685a587b4b21f4b888e4e7edb0d",
+	},
+	{
+		seed:    "833fe62409237b9d62ec77587520911e9a759cec1d19755b7da901b96dca3d42",
+		pub:     "ec172b93ad5e563bf4932c70e1245034c35467ef2efd4d64ebf819683467e2bf",
+		msg:     "616263",
+		prehash: true,
+		signature: "98a70222f0b8121aa9d30f813d683f809e462b469c7ff87639499bb94e6dae41" +
+			"31f85042463c2a355a2003d062adf5aaa10b8c61e636062aaad11c2a26083406",
+	},
+}
+
+func TestEdDSA(t *testing.T) {
+	for idx, test := range eddsaTests {
+		priv := ed25519.NewKeyFromSeed(unhex(t, test.seed))
+		pub := ed25519.PublicKey(unhex(t, test.pub))
+		msg := unhex(t, test.msg)
+		expected := unhex(t, test.signature)
+
+		mech := pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmEDDSA,
+		}
+		if test.prehash || len(test.context) > 0 {
+			params, err := pkcs11.Marshal(&pkcs11.EddsaParams{
+				Flag:        pkcs11.Bbool(test.prehash),
+				ContextData: unhex(t, test.context),
+			})
+			if err != nil {
+				t.Fatalf("pkcs11.Marshal: %v", err)
+			}
+			mech.Parameter = params
+		}
+
+		signer, err := NewSignVerify(mech)
+		if err != nil {
+			t.Fatalf("test %d: NewSignVerify: %v", idx, err)
+		}
+		err = signer.SetKey(priv, true)
+		if err != nil {
+			t.Fatalf("test %d: SetKey: %v", idx, err)
+		}
+		signer.Digest.Write(msg)
+		signature, err := signer.Sign()
+		if err != nil {
+			t.Fatalf("test %d: Sign: %v", idx, err)
+		}
+		if !bytes.Equal(signature, expected) {
+			t.Errorf("test %d: signature:\ngot:  %x\nwant: %x",
+				idx, signature, expected)
+		}
+
+		verifier, err := NewSignVerify(mech)
+		if err != nil {
+			t.Fatalf("test %d: NewSignVerify: %v", idx, err)
+		}
+		err = verifier.SetKey(pub, false)
+		if err != nil {
+			t.Fatalf("test %d: SetKey: %v", idx, err)
+		}
+		verifier.Digest.Write(msg)
+		err = verifier.Verify(expected)
+		if err != nil {
+			t.Errorf("test %d: Verify: %v", idx, err)
+		}
+		err = verifier.Verify(expected[1:])
+		if err != pkcs11.ErrSignatureLenRange {
+			t.Errorf("test %d: Verify short signature: %v", idx, err)
+		}
+	}
+
+	// The context data is limited to 255 bytes.
+	params, err := pkcs11.Marshal(&pkcs11.EddsaParams{
+		ContextData: make([]byte, 256),
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	_, err = NewSignVerify(pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmEDDSA,
+		Parameter: params,
+	})
+	if err != pkcs11.ErrMechanismParamInvalid {
+		t.Errorf("NewSignVerify with 256 byte context: %v", err)
+	}
+}
+
+func TestMessageSignVerify(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	// Ed25519 keypair with the curve's object identifier.
+	var pubTmpl pkcs11.Template
+	pubTmpl = pubTmpl.Set(pkcs11.CkaECParams,
+		[]byte{0x06, 0x03, 0x2b, 0x65, 0x70})
+
+	var keys pkcs11.GenerateKeyPairResp
+	session.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmECEdwardsKeyPairGen,
+		},
+		PublicKeyTemplate: pubTmpl,
+	}, &keys)
+
+	ctxParams := func(context string) []byte {
+		params, err := pkcs11.Marshal(&pkcs11.EddsaParams{
+			ContextData: []byte(context),
+		})
+		if err != nil {
+			t.Fatalf("pkcs11.Marshal: %v", err)
+		}
+		return params
+	}
+	mech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmEDDSA,
+	}
+	messages := [][]byte{
+		[]byte("first log record"),
+		[]byte("second log record"),
+		[]byte("third log record"),
+	}
+
+	session.mustCall(msgMessageSignInit, &pkcs11.MessageSignInitReq{
+		Mechanism: mech,
+		Key:       keys.PrivateKey,
+	}, nil)
+
+	// Sign messages with one init. The second message uses a
+	// per-message context.
+	var signatures [][]byte
+	for i, msg := range messages {
+		var params []byte
+		if i == 1 {
+			params = ctxParams("ctx")
+		}
+		var resp pkcs11.SignMessageResp
+		session.mustCall(msgSignMessage, &pkcs11.SignMessageReq{
+			Params: pkcs11.SignMessageParams{
+				Parameter: params,
+			},
+			Data:          msg,
+			SignatureSize: ed25519.SignatureSize,
+		}, &resp)
+		signatures = append(signatures, resp.Signature)
+	}
+
+	// Multi-part message.
+	session.mustCall(msgSignMessageBegin, &pkcs11.SignMessageBeginReq{}, nil)
+	ret := session.call(msgSignMessage, &pkcs11.SignMessageReq{
+		Data:          messages[0],
+		SignatureSize: ed25519.SignatureSize,
+	}, nil)
+	if ret != pkcs11.ErrOperationActive {
+		t.Errorf("SignMessage during multi-part message: %s", ret)
+	}
+	session.mustCall(msgSignMessageNext, &pkcs11.SignMessageNextReq{
+		Data: messages[2][:5],
+	}, nil)
+	var next pkcs11.SignMessageNextResp
+	session.mustCall(msgSignMessageNext, &pkcs11.SignMessageNextReq{
+		Data:          messages[2][5:],
+		Last:          true,
+		SignatureSize: ed25519.SignatureSize,
+	}, &next)
+	if !bytes.Equal(next.Signature, signatures[2]) {
+		t.Errorf("multi-part signature %x, expected %x",
+			next.Signature, signatures[2])
+	}
+	session.mustCall(msgMessageSignFinal, nil, nil)
+
+	ret = session.call(msgSignMessage, &pkcs11.SignMessageReq{
+		Data:          messages[0],
+		SignatureSize: ed25519.SignatureSize,
+	}, nil)
+	if ret != pkcs11.ErrOperationNotInitialized {
+		t.Errorf("SignMessage after MessageSignFinal: %s", ret)
+	}
+
+	session.mustCall(msgMessageVerifyInit, &pkcs11.MessageVerifyInitReq{
+		Mechanism: mech,
+		Key:       keys.PublicKey,
+	}, nil)
+	for i, msg := range messages {
+		var params []byte
+		if i == 1 {
+			params = ctxParams("ctx")
+		}
+		session.mustCall(msgVerifyMessage, &pkcs11.VerifyMessageReq{
+			Params: pkcs11.SignMessageParams{
+				Parameter: params,
+			},
+			Data:      msg,
+			Signature: signatures[i],
+		}, nil)
+	}
+
+	// The context is part of the signature.
+	ret = session.call(msgVerifyMessage, &pkcs11.VerifyMessageReq{
+		Data:      messages[1],
+		Signature: signatures[1],
+	}, nil)
+	if ret != pkcs11.ErrSignatureInvalid {
+		t.Errorf("VerifyMessage without context: %s", ret)
+	}
+	ret = session.call(msgVerifyMessage, &pkcs11.VerifyMessageReq{
+		Data:      messages[0],
+		Signature: signatures[2],
+	}, nil)
+	if ret != pkcs11.ErrSignatureInvalid {
+		t.Errorf("VerifyMessage with another signature: %s", ret)
+	}
+
+	session.mustCall(msgVerifyMessageBegin, &pkcs11.VerifyMessageBeginReq{},
+		nil)
+	session.mustCall(msgVerifyMessageNext, &pkcs11.VerifyMessageNextReq{
+		Data: messages[2][:5],
+	}, nil)
+	session.mustCall(msgVerifyMessageNext, &pkcs11.VerifyMessageNextReq{
+		Data:      messages[2][5:],
+		Signature: signatures[2],
+		Last:      true,
+	}, nil)
+	session.mustCall(msgMessageVerifyFinal, nil, nil)
+
+	// The message-based and single-part operations are independent.
+	session.mustCall(msgVerifyInit, &pkcs11.VerifyInitReq{
+		Mechanism: mech,
+		Key:       keys.PublicKey,
+	}, nil)
+	session.mustCall(msgVerify, &pkcs11.VerifyReq{
+		Data:      messages[0],
+		Signature: signatures[0],
+	}, nil)
+
+	// The private key can't verify messages.
+	ret = session.call(msgMessageVerifyInit, &pkcs11.MessageVerifyInitReq{
+		Mechanism: mech,
+		Key:       keys.PrivateKey,
+	}, nil)
+	if ret != pkcs11.ErrKeyTypeInconsistent {
+		t.Errorf("MessageVerifyInit with private key: %s", ret)
+	}
+}
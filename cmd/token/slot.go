@@ -0,0 +1,221 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// Slot implements a token slot. Slot 0 holds the builtin software
+// token that is always present. The virtual slots hold removable
+// tokens that can be ejected and inserted with the admin interface.
+type Slot struct {
+	ID        pkcs11.SlotID
+	Removable bool
+	Storage   pkcs11.Storage
+
+	// Present specifies if the slot's token is present. The field is
+	// guarded by the global mutex.
+	Present bool
+}
+
+var (
+	slots = []*Slot{
+		{
+			ID:      0,
+			Storage: tokenStorage,
+			Present: true,
+		},
+	}
+)
+
+// initSlots creates the virtual removable slots. Each virtual token
+// has its own token object storage which is kept over the token's
+// removal.
+func initSlots(count int) {
+	for i := 1; i <= count; i++ {
+		slots = append(slots, &Slot{
+			ID:        pkcs11.SlotID(i),
+			Removable: true,
+			Storage:   newTokenStorage(),
+			Present:   true,
+		})
+	}
+}
+
+// LookupSlot finds a slot by its ID.
+func LookupSlot(id pkcs11.SlotID) (*Slot, error) {
+	if int(id) >= len(slots) {
+		return nil, pkcs11.ErrSlotIDInvalid
+	}
+	return slots[id], nil
+}
+
+// TokenPresent tests if the slot's token is present.
+func (slot *Slot) TokenPresent() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return slot.Present
+}
+
+// EjectToken removes the token from the virtual slot. The sessions
+// with the token are marked removed and all their calls, except
+// C_CloseSession, fail with pkcs11.ErrDeviceRemoved. The
+// applications are logged out from the token and their session
+// objects with the token are deleted.
+func EjectToken(id pkcs11.SlotID) error {
+	return setTokenPresent(id, false)
+}
+
+// InsertToken inserts the token into the virtual slot.
+func InsertToken(id pkcs11.SlotID) error {
+	return setTokenPresent(id, true)
+}
+
+func setTokenPresent(id pkcs11.SlotID, present bool) error {
+	slot, err := LookupSlot(id)
+	if err != nil || !slot.Removable {
+		return fmt.Errorf("slot %d is not a virtual slot", id)
+	}
+
+	m.Lock()
+	if slot.Present == present {
+		m.Unlock()
+		if present {
+			return fmt.Errorf("slot %d: token already present", id)
+		}
+		return fmt.Errorf("slot %d: token not present", id)
+	}
+	slot.Present = present
+	if !present {
+		for _, session := range sessions {
+			if session.SlotID == id {
+				session.Removed = true
+			}
+		}
+	}
+	var list []*Provider
+	for _, provider := range providers {
+		list = append(list, provider)
+	}
+	m.Unlock()
+
+	if present {
+		log.Printf("slot %d: token inserted", id)
+	} else {
+		log.Printf("slot %d: token ejected", id)
+	}
+	for _, provider := range list {
+		if !present {
+			provider.ejectToken(id)
+		}
+		provider.postSlotEvent(id)
+	}
+	return nil
+}
+
+// postSlotEvent queues the slot event for the provider and wakes up
+// its C_WaitForSlotEvent. The slot is queued only once until it is
+// reported.
+func (p *Provider) postSlotEvent(id pkcs11.SlotID) {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, event := range p.slotEvents {
+		if event == id {
+			return
+		}
+	}
+	p.slotEvents = append(p.slotEvents, id)
+
+	select {
+	case p.slotEventCh <- struct{}{}:
+	default:
+	}
+}
+
+// nextSlotEvent returns the next slot event that is visible for the
+// provider's peer.
+func (p *Provider) nextSlotEvent() (pkcs11.SlotID, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	for len(p.slotEvents) > 0 {
+		id := p.slotEvents[0]
+		p.slotEvents = p.slotEvents[1:]
+		if p.rule.SlotVisible(id) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// checkToken checks that the slot is valid and its token is present.
+func (p *Provider) checkToken(id pkcs11.SlotID) (*Slot, error) {
+	err := p.checkSlot(id)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := LookupSlot(id)
+	if err != nil {
+		return nil, err
+	}
+	if !slot.TokenPresent() {
+		return nil, pkcs11.ErrTokenNotPresent
+	}
+	return slot, nil
+}
+
+// checkRemoved checks if the token of the provider's session has been
+// ejected. The session can only be closed after the token removal.
+func (p *Provider) checkRemoved(msgType pkcs11.Type) error {
+	if p.session == nil {
+		return nil
+	}
+	m.Lock()
+	removed := p.session.Removed
+	m.Unlock()
+
+	if removed && msgType != pkcs11.MsgCloseSession {
+		return pkcs11.ErrDeviceRemoved
+	}
+	return nil
+}
+
+// ImplWaitForSlotEvent implements the Provider.ImplWaitForSlotEvent().
+func (p *Provider) ImplWaitForSlotEvent(req *pkcs11.ImplWaitForSlotEventReq) (*pkcs11.ImplWaitForSlotEventResp, error) {
+	parent, err := LookupProvider(req.ProviderID)
+	if err != nil {
+		// The application has disconnected.
+		return nil, pkcs11.ErrCryptokiNotInitialized
+	}
+	if !p.peer.Equal(parent.peer) {
+		Errorf("ImplWaitForSlotEvent: peer %s, provider %s",
+			p.peer, parent.peer)
+		return nil, pkcs11.ErrArgumentsBad
+	}
+	for {
+		id, ok := parent.nextSlotEvent()
+		if ok {
+			return &pkcs11.ImplWaitForSlotEventResp{
+				Slot: id,
+			}, nil
+		}
+		if req.Flags&pkcs11.CkfDontBlock != 0 {
+			return nil, pkcs11.ErrNoEvent
+		}
+		select {
+		case <-parent.slotEventCh:
+		case <-parent.done:
+			return nil, pkcs11.ErrCryptokiNotInitialized
+		}
+	}
+}
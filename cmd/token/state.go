@@ -0,0 +1,291 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding"
+	"hash"
+	"sync"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+var (
+	stateKeyOnce sync.Once
+	stateAEAD    cipher.AEAD
+	stateAEADErr error
+)
+
+// stateCipher returns the token-internal cipher that protects the
+// saved operation states. The key is created when the first state is
+// saved or restored and it is never exported from the token. This
+// binds the saved states to the token instance.
+func stateCipher() (cipher.AEAD, error) {
+	stateKeyOnce.Do(func() {
+		var key [32]byte
+
+		_, err := rand.Read(key[:])
+		if err != nil {
+			stateAEADErr = pkcs11.ErrDeviceError
+			return
+		}
+		b, err := aes.NewCipher(key[:])
+		if err != nil {
+			stateAEADErr = pkcs11.ErrDeviceError
+			return
+		}
+		stateAEAD, err = cipher.NewGCM(b)
+		if err != nil {
+			stateAEADErr = pkcs11.ErrDeviceError
+		}
+	})
+	return stateAEAD, stateAEADErr
+}
+
+// operationState defines the saved state of the session's
+// cryptographic operations.
+type operationState struct {
+	Digest  digestState
+	Encrypt encDecState
+	Decrypt encDecState
+	Sign    signVerifyState
+	Verify  signVerifyState
+}
+
+// digestState defines the saved state of a digest operation.
+type digestState struct {
+	Active    bool
+	Mechanism pkcs11.MechanismType
+	State     []byte
+}
+
+// encDecState defines the saved state of an encrypt or decrypt
+// operation. The key is not saved but it must be provided when the
+// state is restored.
+type encDecState struct {
+	Active    bool
+	Mechanism pkcs11.Mechanism
+	KeyID     []byte
+	IV        []byte
+	AAD       []byte
+	Mode      []byte
+	Buffer    []byte
+}
+
+// signVerifyState defines the saved state of a sign or verify
+// operation. The key is not saved but it must be provided when the
+// state is restored.
+type signVerifyState struct {
+	Active    bool
+	Mechanism pkcs11.Mechanism
+	KeyID     []byte
+	Digest    []byte
+}
+
+// stateAAD returns the additional data that binds the saved state to
+// the slot's token.
+func stateAAD(slot pkcs11.SlotID) []byte {
+	var aad [4]byte
+	bo.PutUint32(aad[:], uint32(slot))
+	return aad[:]
+}
+
+// sealOperationState encodes and encrypts the operation state of a
+// session with the slot's token.
+func sealOperationState(slot pkcs11.SlotID, state *operationState) (
+	[]byte, error) {
+
+	data, err := pkcs11.Marshal(state)
+	if err != nil {
+		Errorf("pkcs11.Marshal: %v", err)
+		return nil, pkcs11.ErrDeviceError
+	}
+	aead, err := stateCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, pkcs11.ErrDeviceError
+	}
+	return aead.Seal(nonce, nonce, data, stateAAD(slot)), nil
+}
+
+// openOperationState decrypts and decodes the operation state. The
+// state must have been saved from a session with the slot's token.
+func openOperationState(slot pkcs11.SlotID, sealed []byte) (
+	*operationState, error) {
+
+	aead, err := stateCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, pkcs11.ErrSavedStateInvalid
+	}
+	n := aead.NonceSize()
+	data, err := aead.Open(nil, sealed[:n], sealed[n:], stateAAD(slot))
+	if err != nil {
+		Errorf("invalid operation state: %v", err)
+		return nil, pkcs11.ErrSavedStateInvalid
+	}
+	state := new(operationState)
+	err = pkcs11.Unmarshal(data, state)
+	if err != nil {
+		Errorf("pkcs11.Unmarshal: %v", err)
+		return nil, pkcs11.ErrSavedStateInvalid
+	}
+	return state, nil
+}
+
+// keyID returns an identifier for the key value. The identifier is
+// used to verify that the operation state is restored with the same
+// key that was used when the state was saved.
+func keyID(key interface{}) []byte {
+	var data []byte
+
+	switch k := key.(type) {
+	case []byte:
+		data = k
+
+	case interface{ Public() crypto.PublicKey }:
+		data, _ = x509.MarshalPKIXPublicKey(k.Public())
+
+	default:
+		data, _ = x509.MarshalPKIXPublicKey(k)
+	}
+	id := sha256.Sum256(data)
+	return id[:]
+}
+
+// marshalHash returns the internal state of the hash function.
+func marshalHash(h hash.Hash) ([]byte, error) {
+	m, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		Errorf("hash %T state can't be saved", h)
+		return nil, pkcs11.ErrStateUnsaveable
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, pkcs11.ErrStateUnsaveable
+	}
+	return data, nil
+}
+
+// unmarshalHash restores the internal state of the hash function.
+func unmarshalHash(h hash.Hash, data []byte) error {
+	m, ok := h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return pkcs11.ErrSavedStateInvalid
+	}
+	if m.UnmarshalBinary(data) != nil {
+		return pkcs11.ErrSavedStateInvalid
+	}
+	return nil
+}
+
+// mode returns the operation's cipher mode.
+func (ed *EncDec) mode() interface{} {
+	switch {
+	case ed.BlockMode != nil:
+		return ed.BlockMode
+	case ed.Stream != nil:
+		return ed.Stream
+	case ed.Stealing != nil:
+		return ed.Stealing
+	default:
+		return nil
+	}
+}
+
+// SaveState returns the state of the encrypt or decrypt operation.
+// The states of the AEAD and stream mode encrypt operations are not
+// saved since restoring them would encrypt more data with the same
+// IV and keystream.
+func (ed *EncDec) SaveState(encrypt bool) (encDecState, error) {
+	if encrypt && (ed.AEAD != nil || ed.Stream != nil) {
+		Errorf("%s: encrypt state can't be saved", ed.Mechanism)
+		return encDecState{}, pkcs11.ErrStateUnsaveable
+	}
+	state := encDecState{
+		Active:    true,
+		Mechanism: ed.Init,
+		KeyID:     keyID(ed.Key),
+		IV:        ed.IV,
+		AAD:       ed.AAD,
+		Buffer:    ed.Buffer,
+	}
+	mode := ed.mode()
+	if mode != nil {
+		m, ok := mode.(encoding.BinaryMarshaler)
+		if !ok {
+			Errorf("%s: mode %T state can't be saved", ed.Mechanism, mode)
+			return state, pkcs11.ErrStateUnsaveable
+		}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return state, pkcs11.ErrStateUnsaveable
+		}
+		state.Mode = data
+	}
+	return state, nil
+}
+
+// RestoreState restores the state of the encrypt or decrypt
+// operation. The operation must be initialized with the state's
+// mechanism.
+func (ed *EncDec) RestoreState(state *encDecState) error {
+	if !bytes.Equal(keyID(ed.Key), state.KeyID) {
+		return pkcs11.ErrKeyChanged
+	}
+	mode := ed.mode()
+	if mode != nil {
+		m, ok := mode.(encoding.BinaryUnmarshaler)
+		if !ok || m.UnmarshalBinary(state.Mode) != nil {
+			return pkcs11.ErrSavedStateInvalid
+		}
+	} else if len(state.Mode) != 0 {
+		return pkcs11.ErrSavedStateInvalid
+	}
+	if ed.AEAD != nil {
+		ed.IV = state.IV
+		ed.AAD = state.AAD
+	}
+	ed.Buffer = append(ed.Buffer[:0], state.Buffer...)
+
+	return nil
+}
+
+// SaveState returns the state of the sign or verify operation.
+func (sv *SignVerify) SaveState() (signVerifyState, error) {
+	state := signVerifyState{
+		Active:    true,
+		Mechanism: sv.Mechanism,
+		KeyID:     keyID(sv.Key),
+	}
+	var err error
+	state.Digest, err = marshalHash(sv.Digest)
+	return state, err
+}
+
+// RestoreState restores the state of the sign or verify
+// operation. The operation must be initialized with the state's
+// mechanism.
+func (sv *SignVerify) RestoreState(state *signVerifyState) error {
+	if !bytes.Equal(keyID(sv.Key), state.KeyID) {
+		return pkcs11.ErrKeyChanged
+	}
+	return unmarshalHash(sv.Digest, state.Digest)
+}
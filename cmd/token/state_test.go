@@ -0,0 +1,369 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+func TestOperationStateSlot(t *testing.T) {
+	state := &operationState{
+		Digest: digestState{
+			Active:    true,
+			Mechanism: pkcs11.CkmSHA256,
+			State:     []byte("digest state"),
+		},
+	}
+	sealed, err := sealOperationState(1, state)
+	if err != nil {
+		t.Fatalf("sealOperationState: %v", err)
+	}
+	opened, err := openOperationState(1, sealed)
+	if err != nil {
+		t.Fatalf("openOperationState: %v", err)
+	}
+	if !opened.Digest.Active || opened.Digest.Mechanism != pkcs11.CkmSHA256 ||
+		string(opened.Digest.State) != "digest state" {
+		t.Errorf("openOperationState: got %v", opened.Digest)
+	}
+
+	_, err = openOperationState(2, sealed)
+	if err != pkcs11.ErrSavedStateInvalid {
+		t.Errorf("openOperationState with another slot: %v", err)
+	}
+}
+
+func TestOperationState(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session1, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session1.kill()
+	session2, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session2.kill()
+
+	aesKey := bytes.Repeat([]byte{0x42}, 16)
+	iv := bytes.Repeat([]byte{0x01}, aes.BlockSize)
+	msg := []byte("The quick brown fox jumps over the lazy dog.....")
+	split := 21
+
+	encKey := createSecretKey(session1, pkcs11.CkkAES, aesKey)
+	otherKey := createSecretKey(session1, pkcs11.CkkAES,
+		bytes.Repeat([]byte{0x43}, 16))
+	macKey := createSecretKey(session1, pkcs11.CkkGenericSecret,
+		bytes.Repeat([]byte{0x17}, 32))
+
+	var pubTmpl pkcs11.Template
+	pubTmpl = pubTmpl.Set(pkcs11.CkaECParams, secp256r1)
+
+	var ecKeys, otherECKeys pkcs11.GenerateKeyPairResp
+	for _, keys := range []*pkcs11.GenerateKeyPairResp{&ecKeys, &otherECKeys} {
+		session1.mustCall(msgGenerateKeyPair, &pkcs11.GenerateKeyPairReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: pkcs11.CkmECKeyPairGen,
+			},
+			PublicKeyTemplate: pubTmpl,
+		}, keys)
+	}
+	signMech := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmECDSASHA256,
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	ct := make([]byte, len(msg))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ct, msg)
+	digest := sha256.Sum256(msg)
+
+	ret := session1.call(msgGetOperationState, &pkcs11.GetOperationStateReq{
+		OperationStateSize: 1024,
+	}, nil)
+	if ret != pkcs11.ErrOperationNotInitialized {
+		t.Errorf("GetOperationState without operations: %s", ret)
+	}
+
+	// Start the operations and process the first part of the message
+	// in session1. The encryption keeps a partial block buffered.
+	session1.mustCall(msgDigestInit, &pkcs11.DigestInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSHA256,
+		},
+	}, nil)
+	session1.mustCall(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+		Part: msg[:split],
+	}, nil)
+	session1.mustCall(msgEncryptInit, &pkcs11.EncryptInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmAESCBC,
+			Parameter: iv,
+		},
+		Key: encKey,
+	}, &pkcs11.EncryptInitResp{})
+	var encUpdate pkcs11.EncryptUpdateResp
+	session1.mustCall(msgEncryptUpdate, &pkcs11.EncryptUpdateReq{
+		Part:              msg[:split],
+		EncryptedPartSize: 1024,
+	}, &encUpdate)
+	result := encUpdate.EncryptedPart
+	session1.mustCall(msgSignInit, &pkcs11.SignInitReq{
+		Mechanism: signMech,
+		Key:       ecKeys.PrivateKey,
+	}, nil)
+	session1.mustCall(msgSignUpdate, &pkcs11.SignUpdateReq{
+		Part: msg[:split],
+	}, nil)
+
+	var size pkcs11.GetOperationStateResp
+	session1.mustCall(msgGetOperationState, &pkcs11.GetOperationStateReq{},
+		&size)
+	if size.OperationStateLen == 0 || len(size.OperationState) != 0 {
+		t.Fatalf("GetOperationState size query: len=%v, state=%x",
+			size.OperationStateLen, size.OperationState)
+	}
+	var saved pkcs11.GetOperationStateResp
+	session1.mustCall(msgGetOperationState, &pkcs11.GetOperationStateReq{
+		OperationStateSize: uint32(size.OperationStateLen),
+	}, &saved)
+	state := []byte(saved.OperationState)
+
+	// Tampered and truncated states.
+	tampered := append([]byte(nil), state...)
+	tampered[len(tampered)-1] ^= 0x01
+	for _, invalid := range [][]byte{tampered, state[:len(state)-1], nil} {
+		ret = session2.call(msgSetOperationState,
+			&pkcs11.SetOperationStateReq{
+				OperationState:    invalid,
+				EncryptionKey:     encKey,
+				AuthenticationKey: ecKeys.PrivateKey,
+			}, nil)
+		if ret != pkcs11.ErrSavedStateInvalid {
+			t.Errorf("SetOperationState with invalid state: %s", ret)
+		}
+	}
+
+	// Missing and mismatching keys.
+	ret = session2.call(msgSetOperationState, &pkcs11.SetOperationStateReq{
+		OperationState:    state,
+		AuthenticationKey: ecKeys.PrivateKey,
+	}, nil)
+	if ret != pkcs11.ErrKeyNeeded {
+		t.Errorf("SetOperationState without encryption key: %s", ret)
+	}
+	ret = session2.call(msgSetOperationState, &pkcs11.SetOperationStateReq{
+		OperationState: state,
+		EncryptionKey:  encKey,
+	}, nil)
+	if ret != pkcs11.ErrKeyNeeded {
+		t.Errorf("SetOperationState without authentication key: %s", ret)
+	}
+	ret = session2.call(msgSetOperationState, &pkcs11.SetOperationStateReq{
+		OperationState:    state,
+		EncryptionKey:     otherKey,
+		AuthenticationKey: ecKeys.PrivateKey,
+	}, nil)
+	if ret != pkcs11.ErrKeyChanged {
+		t.Errorf("SetOperationState with another encryption key: %s", ret)
+	}
+	ret = session2.call(msgSetOperationState, &pkcs11.SetOperationStateReq{
+		OperationState:    state,
+		EncryptionKey:     encKey,
+		AuthenticationKey: otherECKeys.PrivateKey,
+	}, nil)
+	if ret != pkcs11.ErrKeyChanged {
+		t.Errorf("SetOperationState with another authentication key: %s",
+			ret)
+	}
+
+	// The failed restores did not leave operations active.
+	ret = session2.call(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+		Part: msg,
+	}, nil)
+	if ret != pkcs11.ErrOperationNotInitialized {
+		t.Errorf("DigestUpdate after failed SetOperationState: %s", ret)
+	}
+
+	// Restore the state into session2 and finish the operations.
+	session2.mustCall(msgSetOperationState, &pkcs11.SetOperationStateReq{
+		OperationState:    state,
+		EncryptionKey:     encKey,
+		AuthenticationKey: ecKeys.PrivateKey,
+	}, nil)
+
+	session2.mustCall(msgDigestUpdate, &pkcs11.DigestUpdateReq{
+		Part: msg[split:],
+	}, nil)
+	var digestFinal pkcs11.DigestFinalResp
+	session2.mustCall(msgDigestFinal, &pkcs11.DigestFinalReq{
+		DigestSize: 1024,
+	}, &digestFinal)
+	if !bytes.Equal(digestFinal.Digest, digest[:]) {
+		t.Errorf("restored digest:\ngot:  %x\nwant: %x",
+			digestFinal.Digest, digest)
+	}
+
+	session2.mustCall(msgEncryptUpdate, &pkcs11.EncryptUpdateReq{
+		Part:              msg[split:],
+		EncryptedPartSize: 1024,
+	}, &encUpdate)
+	result = append(result, encUpdate.EncryptedPart...)
+	var encFinal pkcs11.EncryptFinalResp
+	session2.mustCall(msgEncryptFinal, &pkcs11.EncryptFinalReq{
+		LastEncryptedPartSize: 1024,
+	}, &encFinal)
+	result = append(result, encFinal.LastEncryptedPart...)
+	if !bytes.Equal(result, ct) {
+		t.Errorf("restored encryption:\ngot:  %x\nwant: %x", result, ct)
+	}
+
+	session2.mustCall(msgSignUpdate, &pkcs11.SignUpdateReq{
+		Part: msg[split:],
+	}, nil)
+	var signFinal pkcs11.SignFinalResp
+	session2.mustCall(msgSignFinal, &pkcs11.SignFinalReq{
+		SignatureSize: 1024,
+	}, &signFinal)
+	session2.mustCall(msgVerifyInit, &pkcs11.VerifyInitReq{
+		Mechanism: signMech,
+		Key:       ecKeys.PublicKey,
+	}, nil)
+	ret = session2.call(msgVerify, &pkcs11.VerifyReq{
+		Data:      msg,
+		Signature: signFinal.Signature,
+	}, nil)
+	if ret != pkcs11.ErrOk {
+		t.Errorf("restored signature: %s", ret)
+	}
+
+	// The saved operations are still active in session1.
+	session1.mustCall(msgDigestFinal, &pkcs11.DigestFinalReq{
+		DigestSize: 1024,
+	}, &digestFinal)
+	partial := sha256.Sum256(msg[:split])
+	if !bytes.Equal(digestFinal.Digest, partial[:]) {
+		t.Errorf("session1 digest:\ngot:  %x\nwant: %x",
+			digestFinal.Digest, partial)
+	}
+
+	// A digest-only state does not take keys.
+	session2.mustCall(msgDigestInit, &pkcs11.DigestInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSHA256,
+		},
+	}, nil)
+	session2.mustCall(msgGetOperationState, &pkcs11.GetOperationStateReq{
+		OperationStateSize: 1024,
+	}, &saved)
+	ret = session2.call(msgSetOperationState, &pkcs11.SetOperationStateReq{
+		OperationState: saved.OperationState,
+		EncryptionKey:  encKey,
+	}, nil)
+	if ret != pkcs11.ErrKeyNotNeeded {
+		t.Errorf("SetOperationState with unneeded key: %s", ret)
+	}
+	session2.mustCall(msgSetOperationState, &pkcs11.SetOperationStateReq{
+		OperationState: saved.OperationState,
+	}, nil)
+
+	// The HMAC state is not saved.
+	session2.mustCall(msgSignInit, &pkcs11.SignInitReq{
+		Mechanism: pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmSHA256HMAC,
+		},
+		Key: macKey,
+	}, nil)
+	ret = session2.call(msgGetOperationState, &pkcs11.GetOperationStateReq{
+		OperationStateSize: 1024,
+	}, nil)
+	if ret != pkcs11.ErrStateUnsaveable {
+		t.Errorf("GetOperationState with HMAC: %s", ret)
+	}
+}
+
+func TestOperationStateAEAD(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	key := bytes.Repeat([]byte{0x42}, 16)
+
+	params, err := pkcs11.Marshal(&pkcs11.GcmParams{
+		Iv:      bytes.Repeat([]byte{0x01}, 12),
+		IvBits:  96,
+		AAD:     []byte("AAD"),
+		TagBits: 128,
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	gcm := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmAESGCM,
+		Parameter: params,
+	}
+	params, err = pkcs11.Marshal(&pkcs11.AesCtrParams{
+		CounterBits: 32,
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	ctr := pkcs11.Mechanism{
+		Mechanism: pkcs11.CkmAESCTR,
+		Parameter: params,
+	}
+
+	// The AEAD and stream mode encrypt states can't be saved.
+	for _, mech := range []pkcs11.Mechanism{gcm, ctr} {
+		session, _ := openSession(t, app, init.ProviderID,
+			pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+		encKey := createSecretKey(session, pkcs11.CkkAES, key)
+
+		session.mustCall(msgEncryptInit, &pkcs11.EncryptInitReq{
+			Mechanism: mech,
+			Key:       encKey,
+		}, &pkcs11.EncryptInitResp{})
+		ret := session.call(msgGetOperationState,
+			&pkcs11.GetOperationStateReq{
+				OperationStateSize: 1024,
+			}, nil)
+		if ret != pkcs11.ErrStateUnsaveable {
+			t.Errorf("GetOperationState with %s encrypt: %s",
+				mech.Mechanism, ret)
+		}
+		session.kill()
+	}
+
+	// The decrypt states can be saved.
+	for _, mech := range []pkcs11.Mechanism{gcm, ctr} {
+		session, _ := openSession(t, app, init.ProviderID,
+			pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+		decKey := createSecretKey(session, pkcs11.CkkAES, key)
+
+		session.mustCall(msgDecryptInit, &pkcs11.DecryptInitReq{
+			Mechanism: mech,
+			Key:       decKey,
+		}, nil)
+		session.mustCall(msgGetOperationState,
+			&pkcs11.GetOperationStateReq{
+				OperationStateSize: 1024,
+			}, &pkcs11.GetOperationStateResp{})
+		session.kill()
+	}
+}
@@ -0,0 +1,148 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+var (
+	// Idle timeouts. The value 0 disables the timeout.
+	sessionTimeout time.Duration
+	loginTimeout   time.Duration
+)
+
+// startExpiration starts the goroutine that closes idle sessions and
+// logs out idle users.
+func startExpiration() {
+	var interval time.Duration
+	for _, timeout := range []time.Duration{sessionTimeout, loginTimeout} {
+		if timeout > 0 && (interval == 0 || timeout < interval) {
+			interval = timeout
+		}
+	}
+	if interval == 0 {
+		return
+	}
+	interval /= 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			expireSessions(now)
+		}
+	}()
+}
+
+// expireSessions expires the idle sessions and logins of all
+// applications.
+func expireSessions(now time.Time) {
+	m.Lock()
+	var list []*Provider
+	for _, provider := range providers {
+		list = append(list, provider)
+	}
+	m.Unlock()
+
+	for _, provider := range list {
+		provider.expire(now)
+	}
+}
+
+// expire closes the application's sessions that have been idle longer
+// than the session timeout. If the application has not made any
+// user-authenticated calls within the login timeout, the user is
+// logged out. The sessions see the logout as CKR_USER_NOT_LOGGED_IN
+// on their next call.
+func (p *Provider) expire(now time.Time) {
+	var idle []*Session
+
+	p.Lock()
+	if sessionTimeout > 0 {
+		for _, session := range p.sessions {
+			if now.Sub(session.LastActivity) > sessionTimeout {
+				idle = append(idle, session)
+			}
+		}
+	}
+	for slot, login := range p.logins {
+		if loginTimeout == 0 || now.Sub(login.LastAuth) <= loginTimeout {
+			continue
+		}
+		log.Printf("login timeout: provider %08x: slot %d: user %v logged out",
+			p.id, slot, login.User)
+		delete(p.logins, slot)
+		for _, session := range p.sessions {
+			if session.SlotID == slot {
+				session.LoginExpired = true
+			}
+		}
+	}
+	p.Unlock()
+
+	for _, session := range idle {
+		log.Printf("session timeout: provider %08x: session %08x closed",
+			p.id, session.ID)
+		err := p.closeSession(session)
+		if err != nil {
+			log.Printf("session timeout: session %08x: %s", session.ID, err)
+		}
+	}
+}
+
+// touch records the activity of the provider's session. The calls
+// made while the user is logged in extend the login.
+func (p *Provider) touch(now time.Time) {
+	if p.session == nil || p.parent == nil {
+		return
+	}
+	p.parent.Lock()
+	defer p.parent.Unlock()
+
+	p.session.LastActivity = now
+	if login := p.sessionLogin(); login != nil {
+		login.LastAuth = now
+	}
+}
+
+// checkLoginExpired checks if the user was logged out because of the
+// login timeout. The function cancels the session's active operations
+// and returns pkcs11.ErrUserNotLoggedIn for the first call after the
+// logout, unless the call is a new login.
+func (p *Provider) checkLoginExpired(msgType pkcs11.Type) error {
+	if p.session == nil || p.parent == nil {
+		return nil
+	}
+	p.parent.Lock()
+	expired := p.session.LoginExpired
+	p.session.LoginExpired = false
+	p.parent.Unlock()
+
+	if !expired {
+		return nil
+	}
+	log.Printf("login timeout: session %08x: operations cancelled",
+		p.session.ID)
+	p.SessionCancel(&pkcs11.SessionCancelReq{
+		Flags: pkcs11.CkfMessageEncrypt | pkcs11.CkfMessageDecrypt |
+			pkcs11.CkfMessageSign | pkcs11.CkfMessageVerify |
+			pkcs11.CkfFindObjects | pkcs11.CkfEncrypt | pkcs11.CkfDecrypt |
+			pkcs11.CkfDigest | pkcs11.CkfSign | pkcs11.CkfVerify,
+	})
+
+	switch msgType {
+	case pkcs11.MsgLogin, pkcs11.MsgLoginUser:
+		return nil
+	default:
+		return pkcs11.ErrUserNotLoggedIn
+	}
+}
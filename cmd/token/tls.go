@@ -0,0 +1,159 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"hash"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// TLS 1.2 key derivation parameters.
+const (
+	tlsPremasterSecretLen = 48
+	tlsMasterSecretLen    = 48
+	tlsRandomLen          = 32
+)
+
+// TLS 1.2 PRF labels.
+var (
+	tlsLabelMasterSecret   = []byte("master secret")
+	tlsLabelKeyExpansion   = []byte("key expansion")
+	tlsLabelClientFinished = []byte("client finished")
+	tlsLabelServerFinished = []byte("server finished")
+)
+
+// tlsPRFHash returns the TLS 1.2 PRF hash function for the digest
+// mechanism.
+func tlsPRFHash(mech pkcs11.MechanismType) (func() hash.Hash, error) {
+	switch mech {
+	case pkcs11.CkmSHA224, pkcs11.CkmSHA256, pkcs11.CkmSHA384,
+		pkcs11.CkmSHA512:
+		return digests[mech].New, nil
+
+	default:
+		Errorf("TLS: invalid PRF hash %v", mech)
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+}
+
+// tlsRandoms validates the client and server random values.
+func tlsRandoms(random *pkcs11.Ssl3RandomData) error {
+	if len(random.ClientRandom) != tlsRandomLen ||
+		len(random.ServerRandom) != tlsRandomLen {
+		return pkcs11.ErrMechanismParamInvalid
+	}
+	return nil
+}
+
+// tlsPRF computes size bytes of the TLS 1.2 PRF (RFC 5246 section 5)
+// output.
+func tlsPRF(h func() hash.Hash, secret, label, seed []byte,
+	size int) []byte {
+
+	mac := hmac.New(h, secret)
+
+	var input []byte
+	input = append(input, label...)
+	input = append(input, seed...)
+
+	var result []byte
+	a := input
+	for len(result) < size {
+		// A(i) = HMAC_hash(secret, A(i-1))
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(input)
+		result = mac.Sum(result)
+	}
+	return result[:size]
+}
+
+// tlsKDF derives size bytes of keying material with the TLS 1.2 PRF
+// from the label, random values, and the optional context data (RFC
+// 5705).
+func tlsKDF(h func() hash.Hash, secret []byte, params *pkcs11.TlsKdfParams,
+	size int) []byte {
+
+	var seed []byte
+	seed = append(seed, params.RandomInfo.ClientRandom...)
+	seed = append(seed, params.RandomInfo.ServerRandom...)
+	if len(params.ContextData) > 0 {
+		seed = append(seed, byte(len(params.ContextData)>>8),
+			byte(len(params.ContextData)))
+		seed = append(seed, params.ContextData...)
+	}
+	return tlsPRF(h, secret, params.Label, seed, size)
+}
+
+// tlsMAC implements the TLS 1.2 finished message verify data
+// computation as a hash.Hash. The input data is the hash of the
+// handshake messages.
+type tlsMAC struct {
+	prf    func() hash.Hash
+	secret []byte
+	label  []byte
+	size   int
+	data   []byte
+}
+
+// newTLSMAC creates the TLS MAC for the parameters.
+func newTLSMAC(params *pkcs11.TlsMacParams) (func(key []byte) hash.Hash,
+	error) {
+
+	prf, err := tlsPRFHash(params.PrfHashMechanism)
+	if err != nil {
+		return nil, err
+	}
+	var label []byte
+	switch params.ServerOrClient {
+	case 1:
+		label = tlsLabelServerFinished
+	case 2:
+		label = tlsLabelClientFinished
+	default:
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	if params.MacLength == 0 {
+		return nil, pkcs11.ErrMechanismParamInvalid
+	}
+	return func(key []byte) hash.Hash {
+		return &tlsMAC{
+			prf:    prf,
+			secret: key,
+			label:  label,
+			size:   int(params.MacLength),
+		}
+	}, nil
+}
+
+func (mac *tlsMAC) Write(p []byte) (int, error) {
+	mac.data = append(mac.data, p...)
+	return len(p), nil
+}
+
+func (mac *tlsMAC) Sum(b []byte) []byte {
+	return append(b, tlsPRF(mac.prf, mac.secret, mac.label, mac.data,
+		mac.size)...)
+}
+
+func (mac *tlsMAC) Reset() {
+	mac.data = nil
+}
+
+func (mac *tlsMAC) Size() int {
+	return mac.size
+}
+
+func (mac *tlsMAC) BlockSize() int {
+	return mac.prf().BlockSize()
+}
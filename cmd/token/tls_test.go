@@ -0,0 +1,343 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+)
+
+// helloRecorder records the client and server random values from the
+// TLS handshake messages.
+type helloRecorder struct {
+	net.Conn
+	random *[]byte
+}
+
+func (c *helloRecorder) Write(p []byte) (int, error) {
+	// Record header (5), handshake header (4), and version (2) are
+	// followed by the hello random.
+	if *c.random == nil && len(p) >= 11+tlsRandomLen && p[0] == 22 &&
+		(p[5] == 1 || p[5] == 2) {
+		*c.random = append([]byte(nil), p[11:11+tlsRandomLen]...)
+	}
+	return c.Conn.Write(p)
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "test",
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestTLSKDF(t *testing.T) {
+	var clientRandom, serverRandom []byte
+	var keyLog bytes.Buffer
+
+	c, s := net.Pipe()
+	client := tls.Client(&helloRecorder{
+		Conn:   c,
+		random: &clientRandom,
+	}, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		KeyLogWriter: &keyLog,
+	})
+	server := tls.Server(&helloRecorder{
+		Conn:   s,
+		random: &serverRandom,
+	}, &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+
+	// CLIENT_RANDOM <client random> <master secret>
+	fields := strings.Fields(keyLog.String())
+	if len(fields) != 3 || fields[0] != "CLIENT_RANDOM" {
+		t.Fatalf("unexpected key log: %q", keyLog.String())
+	}
+	master, err := hex.DecodeString(fields[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields[1] != hex.EncodeToString(clientRandom) {
+		t.Fatalf("client random mismatch")
+	}
+
+	prf, err := tlsPRFHash(pkcs11.CkmSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, context := range [][]byte{nil, []byte("context")} {
+		state := client.ConnectionState()
+		expected, err := state.ExportKeyingMaterial("EXPORTER-test",
+			context, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := tlsKDF(prf, master, &pkcs11.TlsKdfParams{
+			PrfMechanism: pkcs11.CkmSHA256,
+			Label:        []byte("EXPORTER-test"),
+			RandomInfo: pkcs11.Ssl3RandomData{
+				ClientRandom: clientRandom,
+				ServerRandom: serverRandom,
+			},
+			ContextData: context,
+		}, 42)
+		if !bytes.Equal(got, expected) {
+			t.Errorf("TLS KDF mismatch:\ngot %x\nexp %x", got, expected)
+		}
+	}
+}
+
+// TLS 1.2 PRF test vectors for SHA-256 and SHA-384.
+var tlsPRFTests = []struct {
+	hash   pkcs11.MechanismType
+	secret string
+	seed   string
+	output string
+}{
+	{
+		hash:   pkcs11.CkmSHA256,
+		secret: "9bbe436ba940f017b17652849a71db35",
+		seed:   "a0ba9f936cda311827a6f796ffd5198c",
+		output: "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+			"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+			"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+			"87347b66",
+	},
+	{
+		hash:   pkcs11.CkmSHA384,
+		secret: "b80b733d6ceefcdc71566ea48e5567df",
+		seed:   "cd665cf6a8447dd6ff8b27555edb7465",
+		output: "7b0c18e9ced410ed1804f2cfa34a336a1c14dffb4900bb5fd7942107e81c83cd" +
+			"e9ca0faa60be9fe34f82b1233c9146a0e534cb400fed2700884f9dc236f80edd" +
+			"8bfa961144c9e8d792eca722a7b32fc3d416d473ebc2c5fd4abfdad05d918425" +
+			"9b5bf8cd4d90fa0d31e2dec479e4f1a26066f2eea9a69236a3e52655c9e9aee6" +
+			"91c8f3a26854308d5eaa3be85e0990703d73e56f",
+	},
+}
+
+func TestTLSPRF(t *testing.T) {
+	for idx, test := range tlsPRFTests {
+		prf, err := tlsPRFHash(test.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := unhex(t, test.output)
+		got := tlsPRF(prf, unhex(t, test.secret), []byte("test label"),
+			unhex(t, test.seed), len(expected))
+		if !bytes.Equal(got, expected) {
+			t.Errorf("test %d: tlsPRF:\ngot %x\nexp %x", idx, got, expected)
+		}
+	}
+	_, err := tlsPRFHash(pkcs11.CkmSHA1)
+	if err != pkcs11.ErrMechanismParamInvalid {
+		t.Errorf("tlsPRFHash(CKM_SHA_1): %v", err)
+	}
+}
+
+func TestTLSMAC(t *testing.T) {
+	master := bytes.Repeat([]byte{0x4d}, tlsMasterSecretLen)
+	handshake := []byte("handshake messages hash")
+
+	prf, err := tlsPRFHash(pkcs11.CkmSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		serverOrClient int
+		label          []byte
+	}{
+		{1, tlsLabelServerFinished},
+		{2, tlsLabelClientFinished},
+	} {
+		params, err := pkcs11.Marshal(&pkcs11.TlsMacParams{
+			PrfHashMechanism: pkcs11.CkmSHA256,
+			MacLength:        12,
+			ServerOrClient:   pkcs11.Ulong(test.serverOrClient),
+		})
+		if err != nil {
+			t.Fatalf("pkcs11.Marshal: %v", err)
+		}
+		mech := pkcs11.Mechanism{
+			Mechanism: pkcs11.CkmTLSMAC,
+			Parameter: params,
+		}
+		expected := tlsPRF(prf, master, test.label, handshake, 12)
+
+		signer, err := NewSignVerify(mech)
+		if err != nil {
+			t.Fatalf("NewSignVerify: %v", err)
+		}
+		err = signer.SetKey(master, true)
+		if err != nil {
+			t.Fatalf("SetKey: %v", err)
+		}
+		signer.Digest.Write(handshake[:10])
+		signer.Digest.Write(handshake[10:])
+		verifyData, err := signer.Sign()
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		if !bytes.Equal(verifyData, expected) {
+			t.Errorf("%s: got %x, expected %x", test.label, verifyData,
+				expected)
+		}
+
+		verifier, err := NewSignVerify(mech)
+		if err != nil {
+			t.Fatalf("NewSignVerify: %v", err)
+		}
+		err = verifier.SetKey(master, false)
+		if err != nil {
+			t.Fatalf("SetKey: %v", err)
+		}
+		verifier.Digest.Write(handshake)
+		if err := verifier.Verify(verifyData); err != nil {
+			t.Errorf("%s: Verify: %v", test.label, err)
+		}
+		verifyData[0] ^= 0x01
+		verifier.Digest.Reset()
+		verifier.Digest.Write(handshake)
+		if verifier.Verify(verifyData) != pkcs11.ErrSignatureInvalid {
+			t.Errorf("%s: Verify accepted modified verify data", test.label)
+		}
+	}
+
+	for _, params := range []pkcs11.TlsMacParams{
+		{PrfHashMechanism: pkcs11.CkmSHA256, MacLength: 12},
+		{PrfHashMechanism: pkcs11.CkmSHA256, ServerOrClient: 1},
+		{PrfHashMechanism: pkcs11.CkmMD5, MacLength: 12, ServerOrClient: 1},
+	} {
+		_, err := newTLSMAC(&params)
+		if err != pkcs11.ErrMechanismParamInvalid {
+			t.Errorf("newTLSMAC(%+v): %v", params, err)
+		}
+	}
+}
+
+func TestTLS12KeyAndMACDerive(t *testing.T) {
+	app := newTestClient(t)
+	defer app.kill()
+
+	var init pkcs11.InitializeResp
+	app.mustCall(msgInitialize, nil, &init)
+
+	session, _ := openSession(t, app, init.ProviderID,
+		pkcs11.CkfSerialSession|pkcs11.CkfRWSession)
+	defer session.kill()
+
+	createKey := func(keyType pkcs11.KeyType, value []byte) pkcs11.ObjectHandle {
+		var tmpl pkcs11.Template
+		tmpl = tmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+		tmpl = tmpl.SetInt(pkcs11.CkaKeyType, int(keyType))
+		tmpl = tmpl.SetBool(pkcs11.CkaDerive, true)
+		tmpl = tmpl.Set(pkcs11.CkaValue, value)
+
+		var obj pkcs11.CreateObjectResp
+		session.mustCall(msgCreateObject, &pkcs11.CreateObjectReq{
+			Template: tmpl,
+		}, &obj)
+		return obj.Object
+	}
+	params, err := pkcs11.Marshal(&pkcs11.Tls12KeyMatParams{
+		MacSizeInBits: 256,
+		KeySizeInBits: 128,
+		IVSizeInBits:  32,
+		RandomInfo: pkcs11.Ssl3RandomData{
+			ClientRandom: make([]byte, tlsRandomLen),
+			ServerRandom: make([]byte, tlsRandomLen),
+		},
+		PrfHashMechanism: pkcs11.CkmSHA256,
+	})
+	if err != nil {
+		t.Fatalf("pkcs11.Marshal: %v", err)
+	}
+	var keyTmpl pkcs11.Template
+	keyTmpl = keyTmpl.SetInt(pkcs11.CkaClass, int(pkcs11.CkoSecretKey))
+	keyTmpl = keyTmpl.SetInt(pkcs11.CkaKeyType, int(pkcs11.CkkAES))
+
+	master := bytes.Repeat([]byte{0x4d}, tlsMasterSecretLen)
+
+	for _, test := range []struct {
+		key pkcs11.ObjectHandle
+		ret pkcs11.CKRV
+	}{
+		{createKey(pkcs11.CkkGenericSecret, master), pkcs11.ErrOk},
+		{createKey(pkcs11.CkkGenericSecret, master[:32]),
+			pkcs11.ErrKeySizeRange},
+		{createKey(pkcs11.CkkAES, master[:32]),
+			pkcs11.ErrKeyTypeInconsistent},
+	} {
+		var resp pkcs11.DeriveKeyResp
+		ret := session.call(msgDeriveKey, &pkcs11.DeriveKeyReq{
+			Mechanism: pkcs11.Mechanism{
+				Mechanism: pkcs11.CkmTLS12KeyAndMACDerive,
+				Parameter: params,
+			},
+			BaseKey:  test.key,
+			Template: keyTmpl,
+		}, &resp)
+		if ret != test.ret {
+			t.Errorf("CKM_TLS12_KEY_AND_MAC_DERIVE: %s, expected %s",
+				ret, test.ret)
+			continue
+		}
+		if ret != pkcs11.ErrOk {
+			continue
+		}
+		if len(resp.KeyMaterial) != 4 || len(resp.Iv) != 8 {
+			t.Errorf("unexpected key material: %v, IV %x",
+				resp.KeyMaterial, resp.Iv)
+		}
+	}
+}
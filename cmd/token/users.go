@@ -0,0 +1,312 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/markkurossi/pkcs11-provider/pkcs11"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	pinSaltLen     = 16
+	pinIterations  = 100000
+	pinMaxFailures = 10
+)
+
+// CkaSharedWith is a vendor-defined attribute that lists the names of
+// the users the private object is shared with. The value is a
+// comma-separated list of user names.
+const CkaSharedWith = pkcs11.CkaVendorDefined | 0x00000001
+
+// pinHash holds the salted hash of a PIN and the number of
+// consecutive failed logins with the PIN.
+type pinHash struct {
+	salt     []byte
+	hash     []byte
+	failures int
+}
+
+func newPinHash(pin string) (*pinHash, error) {
+	salt := make([]byte, pinSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &pinHash{
+		salt: salt,
+		hash: pbkdf2.Key([]byte(pin), salt, pinIterations, sha256.Size,
+			sha256.New),
+	}, nil
+}
+
+// Verify tests if the PIN matches the hash.
+func (h *pinHash) Verify(pin []pkcs11.UTF8Char) bool {
+	hash := pbkdf2.Key(utf8Bytes(pin), h.salt, pinIterations, sha256.Size,
+		sha256.New)
+	return subtle.ConstantTimeCompare(hash, h.hash) == 1
+}
+
+func utf8Bytes(val []pkcs11.UTF8Char) []byte {
+	result := make([]byte, len(val))
+	for i, ch := range val {
+		result[i] = byte(ch)
+	}
+	return result
+}
+
+// Users implements the token's user database. The anonymous user of
+// C_Login has an empty name.
+type Users struct {
+	m     sync.Mutex
+	so    *pinHash
+	users map[string]*pinHash
+}
+
+type usersConfig struct {
+	SOPin string `json:"so_pin"`
+	Users []struct {
+		Name string `json:"name"`
+		Pin  string `json:"pin"`
+	} `json:"users"`
+}
+
+// LoadUsers loads the user database from the JSON file. The PINs are
+// stored in the token as salted hashes.
+func LoadUsers(file string) (*Users, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config usersConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	users := &Users{
+		users: make(map[string]*pinHash),
+	}
+	if len(config.SOPin) > 0 {
+		users.so, err = newPinHash(config.SOPin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, user := range config.Users {
+		if strings.ContainsRune(user.Name, ',') {
+			return nil, fmt.Errorf("%s: invalid user name: %s",
+				file, user.Name)
+		}
+		if _, ok := users.users[user.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate user: %s", file, user.Name)
+		}
+		users.users[user.Name], err = newPinHash(user.Pin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// Verify verifies the user's PIN. If the token does not have a user
+// database, all PINs of the SO and the anonymous user are
+// accepted. The SO PIN is accepted if the database does not define
+// it. The PIN is locked after pinMaxFailures consecutive failed
+// logins.
+func (u *Users) Verify(userType pkcs11.UserType, name string,
+	pin []pkcs11.UTF8Char) error {
+
+	if u == nil {
+		if userType == pkcs11.CkuUser && len(name) > 0 {
+			return pkcs11.ErrPinIncorrect
+		}
+		return nil
+	}
+	u.m.Lock()
+	var hash *pinHash
+	if userType == pkcs11.CkuSO {
+		hash = u.so
+	} else {
+		var ok bool
+		hash, ok = u.users[name]
+		if !ok {
+			u.m.Unlock()
+			return pkcs11.ErrPinIncorrect
+		}
+	}
+	if hash == nil {
+		u.m.Unlock()
+		return nil
+	}
+	if hash.failures >= pinMaxFailures {
+		u.m.Unlock()
+		return pkcs11.ErrPinLocked
+	}
+	u.m.Unlock()
+
+	// The PIN hash is immutable and it is computed without holding
+	// the lock.
+	ok := hash.Verify(pin)
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if hash.failures >= pinMaxFailures {
+		return pkcs11.ErrPinLocked
+	}
+	if !ok {
+		hash.failures++
+		return pkcs11.ErrPinIncorrect
+	}
+	hash.failures = 0
+	return nil
+}
+
+// Flags returns the token's PIN status flags. The user flags reflect
+// the user with the most failed logins.
+func (u *Users) Flags() pkcs11.Flags {
+	if u == nil {
+		return 0
+	}
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	var flags pkcs11.Flags
+	if u.so != nil {
+		flags |= pinFlags(u.so.failures, pkcs11.CkfSOPINCountLow,
+			pkcs11.CkfSOPINFinalTry, pkcs11.CkfSOPINLocked)
+	}
+	var failures int
+	for _, hash := range u.users {
+		if hash.failures > failures {
+			failures = hash.failures
+		}
+	}
+	flags |= pinFlags(failures, pkcs11.CkfUserPINCountLow,
+		pkcs11.CkfUserPINFinalTry, pkcs11.CkfUserPINLocked)
+
+	return flags
+}
+
+// pinFlags returns the PIN status flags for the number of failed
+// logins.
+func pinFlags(failures int, countLow, finalTry, locked pkcs11.Flags) pkcs11.Flags {
+	switch {
+	case failures >= pinMaxFailures:
+		return locked
+	case failures == pinMaxFailures-1:
+		return countLow | finalTry
+	case failures > 0:
+		return countLow
+	default:
+		return 0
+	}
+}
+
+// storeObject stores the object in the storage and records it as the
+// session's object. A private object created by a named user is owned
+// by the user.
+func (p *Provider) storeObject(storage pkcs11.Storage, obj *pkcs11.Object) (
+	pkcs11.ObjectHandle, error) {
+
+	private, err := obj.Attrs.OptBool(pkcs11.CkaPrivate)
+	if err != nil {
+		return 0, err
+	}
+	if private {
+		p.parent.Lock()
+		if login := p.sessionLogin(); login != nil &&
+			login.User == pkcs11.CkuUser {
+			obj.Owner = login.Name
+		}
+		p.parent.Unlock()
+	}
+	handle, err := storage.Create(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	session := p.session
+	session.objectsM.Lock()
+	defer session.objectsM.Unlock()
+
+	if session.Closed {
+		// The session was closed while the object was created.
+		storage.Delete(handle)
+		return 0, pkcs11.ErrSessionClosed
+	}
+	session.Objects[handle] = storage
+
+	return handle, nil
+}
+
+// objectVisible tests if the object is visible for the logged-in
+// user. The objects without an owner are visible for all users. The
+// owned objects are visible for the SO, the owner, and the users the
+// object is shared with.
+func (p *Provider) objectVisible(obj *pkcs11.Object) bool {
+	if len(obj.Owner) == 0 {
+		return true
+	}
+	p.parent.Lock()
+	login := p.sessionLogin()
+	if login == nil {
+		p.parent.Unlock()
+		return false
+	}
+	userType := login.User
+	name := login.Name
+	p.parent.Unlock()
+
+	if userType == pkcs11.CkuSO || name == obj.Owner {
+		return true
+	}
+	shared, err := obj.Attrs.OptBytes(CkaSharedWith)
+	if err != nil {
+		return false
+	}
+	for _, user := range strings.Split(string(shared), ",") {
+		if user == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsObject tests if the logged-in user owns the object. The objects
+// without an owner are owned by all users.
+func (p *Provider) ownsObject(obj *pkcs11.Object) bool {
+	if len(obj.Owner) == 0 {
+		return true
+	}
+	p.parent.Lock()
+	defer p.parent.Unlock()
+
+	login := p.sessionLogin()
+	return login != nil && login.User == pkcs11.CkuUser &&
+		login.Name == obj.Owner
+}
+
+// withoutSharing returns the template without the CkaSharedWith
+// attribute.
+func withoutSharing(tmpl pkcs11.Template) pkcs11.Template {
+	var result pkcs11.Template
+	for _, attr := range tmpl {
+		if attr.Type != CkaSharedWith {
+			result = append(result, attr)
+		}
+	}
+	return result
+}
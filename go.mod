@@ -1,10 +1,12 @@
 module github.com/markkurossi/pkcs11-provider
 
-go 1.16
+go 1.20
 
 require (
 	github.com/markkurossi/crypto v0.0.0-20230320090745-b923f1c5109e
 	github.com/markkurossi/go-libs v0.0.0-20230221114805-99434bc3be1b
 	github.com/markkurossi/tabulate v0.0.0-20230223130100-d4965869b123
-	golang.org/x/text v0.8.0 // indirect
+	golang.org/x/crypto v0.8.0
+	golang.org/x/sys v0.7.0
+	golang.org/x/text v0.9.0 // indirect
 )
@@ -2021,7 +2021,7 @@ typedef struct CK_GCM_MESSAGE_PARAMS {
     CK_ULONG          ulTagBits;
 } CK_GCM_MESSAGE_PARAMS;
 
-typedef CK_GCM_MESSAGE_PARAMS CK_GCM_MESSAGE_PARAMS_PTR;
+typedef CK_GCM_MESSAGE_PARAMS CK_PTR CK_GCM_MESSAGE_PARAMS_PTR;
 
 typedef struct CK_CCM_PARAMS {
     CK_ULONG          ulDataLen;
@@ -2226,6 +2226,8 @@ typedef struct CK_SP800_108_COUNTER_FORMAT
 typedef CK_SP800_108_COUNTER_FORMAT CK_PTR CK_SP800_108_COUNTER_FORMAT_PTR;
 
 typedef CK_ULONG CK_SP800_108_DKM_LENGTH_METHOD;
+#define CK_SP800_108_DKM_LENGTH_SUM_OF_KEYS     0x00000001UL
+#define CK_SP800_108_DKM_LENGTH_SUM_OF_SEGMENTS 0x00000002UL
 
 typedef struct CK_SP800_108_DKM_LENGTH_FORMAT
 { 
@@ -2252,7 +2254,7 @@ typedef struct CK_SP800_108_KDF_PARAMS
    CK_ULONG               ulNumberOfDataParams;
    CK_PRF_DATA_PARAM_PTR  pDataParams;
    CK_ULONG             ulAdditionalDerivedKeys;
-   CK_DERIVED_KEY       pAdditionalDerivedKeys;
+   CK_DERIVED_KEY_PTR   pAdditionalDerivedKeys;
 } CK_SP800_108_KDF_PARAMS;
 
 typedef CK_SP800_108_KDF_PARAMS CK_PTR CK_SP800_108_KDF_PARAMS_PTR;
@@ -2265,7 +2267,7 @@ typedef struct CK_SP800_108_FEEDBACK_KDF_PARAMS
    CK_ULONG               ulIVLen;
    CK_BYTE_PTR            pIV;
    CK_ULONG             ulAdditionalDerivedKeys;
-   CK_DERIVED_KEY       pAdditionalDerivedKeys;
+   CK_DERIVED_KEY_PTR   pAdditionalDerivedKeys;
 } CK_SP800_108_FEEDBACK_KDF_PARAMS;
 
 typedef CK_SP800_108_FEEDBACK_KDF_PARAMS \
@@ -80,3 +80,52 @@ C_ImplCloseSession
 
   return ret;
 }
+
+/* C_ImplWaitForSlotEvent waits for a slot event of the provider. The
+ * blocking waits are sent over a dedicated IPC channel so that they
+ * do not block the application's other calls.
+ */
+CK_RV
+C_ImplWaitForSlotEvent
+(
+  VPIPCConn      *event_conn,
+  CK_ULONG       ulProviderID,
+  CK_FLAGS       flags,
+  CK_SLOT_ID_PTR pSlot
+)
+{
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  conn = event_conn;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0000103);
+  vp_buffer_add_space(&buf, 4);
+
+  vp_buffer_add_uint32(&buf, ulProviderID);
+  vp_buffer_add_uint32(&buf, flags);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  *pSlot = vp_buffer_get_ulong(&buf);
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
+}
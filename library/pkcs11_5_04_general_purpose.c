@@ -195,6 +195,13 @@ C_Finalize
 
   if (vp_global_mutex != NULL)
     {
+      /* Unblock the thread waiting for slot events. */
+      vp_slot_event_cancel();
+
+      /* Close the session IPC channels. The token closes the
+       * application's sessions when the IPC channels are closed. */
+      vp_session_unregister_all();
+
       vp_init_args.DestroyMutex(vp_global_mutex);
       vp_global_mutex = NULL;
     }
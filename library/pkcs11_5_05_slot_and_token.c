@@ -8,6 +8,31 @@
 
 #include "vp_includes.h"
 
+/*************************** Slot event listener ****************************/
+
+/* The IPC channel of the active blocking C_WaitForSlotEvent. */
+static VPIPCConn *vp_event_conn = NULL;
+
+/* Set when C_Finalize cancels the blocking C_WaitForSlotEvent. */
+static volatile bool vp_event_cancelled = false;
+
+void
+vp_slot_event_cancel(void)
+{
+  if (vp_init_args.LockMutex(vp_global_mutex) != CKR_OK)
+    return;
+
+  if (vp_event_conn != NULL)
+    {
+      vp_event_cancelled = true;
+      shutdown(vp_event_conn->socket, SHUT_RDWR);
+      vp_event_conn = NULL;
+    }
+
+  vp_init_args.UnlockMutex(vp_global_mutex);
+}
+
+
 /** Version: 3.0 */
 /** Section: 5.5 Slot and token management function */
 
@@ -228,7 +253,60 @@ C_WaitForSlotEvent
   CK_VOID_PTR pRserved   /* reserved.  Should be NULL_PTR */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  VPIPCConn *conn;
+  CK_RV ret;
+
+  VP_FUNCTION_ENTER;
+
+  if (vp_global_conn == NULL)
+    return CKR_CRYPTOKI_NOT_INITIALIZED;
+  if (pSlot == NULL)
+    return CKR_ARGUMENTS_BAD;
+
+  if (flags & CKF_DONT_BLOCK)
+    return C_ImplWaitForSlotEvent(vp_global_conn, vp_provider_id, flags,
+                                  pSlot);
+
+  /* Open event IPC channel. The token replies when a slot event
+   * occurs. */
+  conn = vp_ipc_connect(SOCKET_PATH);
+  if (conn == NULL)
+    return CKR_DEVICE_REMOVED;
+
+  ret = vp_init_args.LockMutex(vp_global_mutex);
+  if (ret != CKR_OK)
+    {
+      vp_ipc_close(conn);
+      return ret;
+    }
+  if (vp_event_conn != NULL)
+    {
+      /* Only one thread can wait for slot events. */
+      vp_init_args.UnlockMutex(vp_global_mutex);
+      vp_ipc_close(conn);
+      return CKR_FUNCTION_FAILED;
+    }
+  vp_event_conn = conn;
+  vp_event_cancelled = false;
+
+  vp_init_args.UnlockMutex(vp_global_mutex);
+
+  ret = C_ImplWaitForSlotEvent(conn, vp_provider_id, flags, pSlot);
+
+  if (vp_event_cancelled)
+    {
+      vp_ipc_close(conn);
+      return CKR_CRYPTOKI_NOT_INITIALIZED;
+    }
+
+  if (vp_init_args.LockMutex(vp_global_mutex) == CKR_OK)
+    {
+      vp_event_conn = NULL;
+      vp_init_args.UnlockMutex(vp_global_mutex);
+    }
+  vp_ipc_close(conn);
+
+  return ret;
 }
 
 /* C_GetMechanismList obtains a list of mechanism types
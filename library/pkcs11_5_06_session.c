@@ -14,6 +14,7 @@ struct VPSessionStruct
 {
   struct VPSessionStruct *next;
   CK_SESSION_HANDLE id;
+  CK_SLOT_ID slot;
   VPIPCConn *session;
 };
 
@@ -24,7 +25,8 @@ typedef struct VPSessionStruct VPSession;
 static VPSession *sessions[VP_SESSIONS_HASH_SIZE];
 
 static CK_RV
-vp_session_register(VPIPCConn *session, CK_SESSION_HANDLE id)
+vp_session_register(VPIPCConn *session, CK_SESSION_HANDLE id,
+                    CK_SLOT_ID slot)
 {
   int idx = id % VP_SESSIONS_HASH_SIZE;
   VPSession *s;
@@ -35,6 +37,7 @@ vp_session_register(VPIPCConn *session, CK_SESSION_HANDLE id)
     return CKR_HOST_MEMORY;
 
   s->id = id;
+  s->slot = slot;
   s->session = session;
 
   ret = vp_init_args.LockMutex(vp_global_mutex);
@@ -63,8 +66,7 @@ vp_session_unregister(CK_SESSION_HANDLE id)
   if (ret != CKR_OK)
     return ret;
 
-  s = &sessions[idx];
-  while ((*s) != NULL)
+  for (s = &sessions[idx]; (*s) != NULL; s = &(*s)->next)
     if ((*s)->id == id)
       {
         VPSession *session = (*s);
@@ -80,6 +82,53 @@ vp_session_unregister(CK_SESSION_HANDLE id)
   return CKR_OK;
 }
 
+/* Unregister the sessions of the slot, or all sessions if all is
+ * non-zero, and close their IPC channels. */
+static void
+vp_session_unregister_slot(CK_SLOT_ID slot, int all)
+{
+  VPSession *list = NULL;
+  VPSession **s, *next;
+  int i;
+
+  if (vp_init_args.LockMutex(vp_global_mutex) != CKR_OK)
+    return;
+
+  for (i = 0; i < VP_SESSIONS_HASH_SIZE; i++)
+    {
+      for (s = &sessions[i]; (*s) != NULL;)
+        {
+          VPSession *session = (*s);
+
+          if (all || session->slot == slot)
+            {
+              *s = session->next;
+              session->next = list;
+              list = session;
+            }
+          else
+            {
+              s = &session->next;
+            }
+        }
+    }
+
+  vp_init_args.UnlockMutex(vp_global_mutex);
+
+  for (; list != NULL; list = next)
+    {
+      next = list->next;
+      vp_ipc_close(list->session);
+      free(list);
+    }
+}
+
+void
+vp_session_unregister_all(void)
+{
+  vp_session_unregister_slot(0, 1);
+}
+
 VPIPCConn *
 vp_session(CK_SESSION_HANDLE id, CK_RV *ret)
 {
@@ -164,7 +213,7 @@ C_OpenSession
       vp_buffer_uninit(&buf);
       return CKR_DEVICE_REMOVED;
     }
-  ret = vp_session_register(session, *phSession);
+  ret = vp_session_register(session, *phSession, slotID);
   if (ret != CKR_OK)
     {
       C_ImplCloseSession(*phSession);
@@ -238,7 +287,36 @@ C_CloseAllSessions
   CK_SLOT_ID     slotID  /* the token's slot */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Use global session. */
+  conn = vp_global_conn;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050603);
+  vp_buffer_add_space(&buf, 4);
+
+  vp_buffer_add_ulong(&buf, slotID);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  /* The token closed the slot's sessions, close their IPC
+   * channels. */
+  vp_session_unregister_slot(slotID, 0);
+
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 /* C_GetSessionInfo obtains information about the session. */
@@ -299,7 +377,33 @@ C_SessionCancel
   CK_FLAGS          flags      /* flags control which sessions are cancelled */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050605);
+  vp_buffer_add_space(&buf, 4);
+
+  vp_buffer_add_uint32(&buf, flags);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 /* C_GetOperationState obtains the state of the cryptographic operation
@@ -313,7 +417,63 @@ C_GetOperationState
   CK_ULONG_PTR      pulOperationStateLen  /* gets state length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050606);
+  vp_buffer_add_space(&buf, 4);
+
+
+  if (pOperationState == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulOperationStateLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pOperationState == NULL)
+      {
+        *pulOperationStateLen = count;
+      }
+    else if (count > *pulOperationStateLen)
+      {
+        *pulOperationStateLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulOperationStateLen = count;
+        vp_buffer_get_byte_arr(&buf, pOperationState, count);
+      }
+  }
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 /* C_SetOperationState restores the state of the cryptographic
@@ -329,7 +489,35 @@ C_SetOperationState
   CK_OBJECT_HANDLE hAuthenticationKey    /* sign/verify key */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050607);
+  vp_buffer_add_space(&buf, 4);
+
+  vp_buffer_add_byte_arr(&buf, pOperationState, ulOperationStateLen);
+  vp_buffer_add_uint32(&buf, hEncryptionKey);
+  vp_buffer_add_uint32(&buf, hAuthenticationKey);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 /* C_Login logs a user into a token. */
@@ -384,7 +572,35 @@ C_LoginUser
   CK_ULONG          ulUsernameLen /*the length of the user's name */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050609);
+  vp_buffer_add_space(&buf, 4);
+
+  vp_buffer_add_uint32(&buf, userType);
+  vp_buffer_add_byte_arr(&buf, pPin, ulPinLen);
+  vp_buffer_add_byte_arr(&buf, pUsername, ulUsernameLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 /* C_Logout logs a user out from a token. */
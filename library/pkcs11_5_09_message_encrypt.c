@@ -19,7 +19,39 @@ C_MessageEncryptInit
   CK_OBJECT_HANDLE  hKey         /* handle of encryption key */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050901);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_mechanism(&buf, pMechanism);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_uint32(&buf, hKey);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -36,7 +68,80 @@ C_EncryptMessage
   CK_ULONG_PTR pulCiphertextLen /* gets cipher text length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_ENCRYPT_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_ENCRYPT_MESSAGE_PARAMS_PTR pParams = &params;
+  CK_BYTE_PTR iv, tag;
+  CK_ULONG iv_len, tag_len;
+
+  vp_encrypt_message_outputs(pParams, &iv, &iv_len, &tag, &tag_len);
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050902);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_encrypt_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pAssociatedData, ulAssociatedDataLen);
+  vp_buffer_add_byte_arr(&buf, pPlaintext, ulPlaintextLen);
+
+  if (pCiphertext == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulCiphertextLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pCiphertext == NULL)
+      {
+        *pulCiphertextLen = count;
+      }
+    else if (count > *pulCiphertextLen)
+      {
+        *pulCiphertextLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulCiphertextLen = count;
+        vp_buffer_get_byte_arr(&buf, pCiphertext, count);
+      }
+  }
+  vp_buffer_get_byte_arr(&buf, iv, iv_len);
+  vp_buffer_get_byte_arr(&buf, tag, tag_len);
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -49,7 +154,54 @@ C_EncryptMessageBegin
   CK_ULONG ulAssociatedDataLen  /* AEAD Associated data length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_ENCRYPT_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_ENCRYPT_MESSAGE_PARAMS_PTR pParams = &params;
+  CK_BYTE_PTR iv, tag;
+  CK_ULONG iv_len, tag_len;
+
+  vp_encrypt_message_outputs(pParams, &iv, &iv_len, &tag, &tag_len);
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050903);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_encrypt_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pAssociatedData, ulAssociatedDataLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_get_byte_arr(&buf, iv, iv_len);
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -65,7 +217,79 @@ C_EncryptMessageNext
   CK_FLAGS flags                     /* multi mode flag */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_ENCRYPT_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_ENCRYPT_MESSAGE_PARAMS_PTR pParams = &params;
+  CK_BYTE_PTR iv, tag;
+  CK_ULONG iv_len, tag_len;
+
+  vp_encrypt_message_outputs(pParams, &iv, &iv_len, &tag, &tag_len);
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050904);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_encrypt_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pPlaintextPart, ulPlaintextPartLen);
+  vp_buffer_add_uint32(&buf, flags);
+
+  if (pCiphertextPart == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulCiphertextPartLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pCiphertextPart == NULL)
+      {
+        *pulCiphertextPartLen = count;
+      }
+    else if (count > *pulCiphertextPartLen)
+      {
+        *pulCiphertextPartLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulCiphertextPartLen = count;
+        vp_buffer_get_byte_arr(&buf, pCiphertextPart, count);
+      }
+  }
+  vp_buffer_get_byte_arr(&buf, tag, tag_len);
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -74,5 +298,29 @@ C_MessageEncryptFinal
   CK_SESSION_HANDLE hSession        /* the session's handle */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050905);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
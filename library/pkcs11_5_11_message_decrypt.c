@@ -19,7 +19,39 @@ C_MessageDecryptInit
   CK_OBJECT_HANDLE  hKey         /* handle of decryption key */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050b01);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_mechanism(&buf, pMechanism);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_uint32(&buf, hKey);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -36,7 +68,74 @@ C_DecryptMessage
   CK_ULONG_PTR pulPlaintextLen  /* gets plain text length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_ENCRYPT_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_ENCRYPT_MESSAGE_PARAMS_PTR pParams = &params;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050b02);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_encrypt_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pAssociatedData, ulAssociatedDataLen);
+  vp_buffer_add_byte_arr(&buf, pCiphertext, ulCiphertextLen);
+
+  if (pPlaintext == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulPlaintextLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pPlaintext == NULL)
+      {
+        *pulPlaintextLen = count;
+      }
+    else if (count > *pulPlaintextLen)
+      {
+        *pulPlaintextLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulPlaintextLen = count;
+        vp_buffer_get_byte_arr(&buf, pPlaintext, count);
+      }
+  }
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -49,7 +148,42 @@ C_DecryptMessageBegin
   CK_ULONG ulAssociatedDataLen  /* AEAD Associated data length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_ENCRYPT_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_ENCRYPT_MESSAGE_PARAMS_PTR pParams = &params;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050b03);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_encrypt_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pAssociatedData, ulAssociatedDataLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -65,7 +199,74 @@ C_DecryptMessageNext
   CK_FLAGS flags                /* multi mode flag */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_ENCRYPT_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_ENCRYPT_MESSAGE_PARAMS_PTR pParams = &params;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050b04);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_encrypt_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pCiphertext, ulCiphertextLen);
+  vp_buffer_add_uint32(&buf, flags);
+
+  if (pPlaintext == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulPlaintextLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pPlaintext == NULL)
+      {
+        *pulPlaintextLen = count;
+      }
+    else if (count > *pulPlaintextLen)
+      {
+        *pulPlaintextLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulPlaintextLen = count;
+        vp_buffer_get_byte_arr(&buf, pPlaintext, count);
+      }
+  }
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -74,5 +275,29 @@ C_MessageDecryptFinal
   CK_SESSION_HANDLE hSession        /* the session's handle */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050b05);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
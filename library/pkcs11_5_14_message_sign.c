@@ -19,7 +19,39 @@ C_MessageSignInit
   CK_OBJECT_HANDLE  hKey         /* handle of signing key */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050e01);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_mechanism(&buf, pMechanism);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_uint32(&buf, hKey);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -34,7 +66,73 @@ C_SignMessage
   CK_ULONG_PTR pulSignatureLen  /* gets signature length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_SIGN_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_SIGN_MESSAGE_PARAMS_PTR pParams = &params;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050e02);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_sign_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pData, ulDataLen);
+
+  if (pSignature == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulSignatureLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pSignature == NULL)
+      {
+        *pulSignatureLen = count;
+      }
+    else if (count > *pulSignatureLen)
+      {
+        *pulSignatureLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulSignatureLen = count;
+        vp_buffer_get_byte_arr(&buf, pSignature, count);
+      }
+  }
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -45,7 +143,41 @@ C_SignMessageBegin
   CK_ULONG ulParameterLen      /* length of message specific parameter */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_SIGN_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_SIGN_MESSAGE_PARAMS_PTR pParams = &params;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050e03);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_sign_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -60,7 +192,84 @@ C_SignMessageNext
   CK_ULONG_PTR pulSignatureLen  /* gets signature length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_SIGN_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_SIGN_MESSAGE_PARAMS_PTR pParams = &params;
+  CK_ULONG signature_len = 0;
+  CK_BBOOL last = CK_TRUE;
+
+  /* The NULL pulSignatureLen continues the multi-part message. */
+  if (pulSignatureLen == NULL)
+    {
+      last = CK_FALSE;
+      pSignature = NULL;
+      pulSignatureLen = &signature_len;
+    }
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050e04);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_sign_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pData, ulDataLen);
+  vp_buffer_add_bool(&buf, last);
+
+  if (pSignature == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulSignatureLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pSignature == NULL)
+      {
+        *pulSignatureLen = count;
+      }
+    else if (count > *pulSignatureLen)
+      {
+        *pulSignatureLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulSignatureLen = count;
+        vp_buffer_get_byte_arr(&buf, pSignature, count);
+      }
+  }
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -69,5 +278,29 @@ C_MessageSignFinal
   CK_SESSION_HANDLE hSession        /* the session's handle */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0050e05);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
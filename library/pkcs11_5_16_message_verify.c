@@ -19,7 +19,39 @@ C_MessageVerifyInit
   CK_OBJECT_HANDLE  hKey         /* handle of signing key */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051001);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_mechanism(&buf, pMechanism);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_uint32(&buf, hKey);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -34,7 +66,43 @@ C_VerifyMessage
   CK_ULONG ulSignatureLen       /* signature length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_SIGN_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_SIGN_MESSAGE_PARAMS_PTR pParams = &params;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051002);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_sign_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pData, ulDataLen);
+  vp_buffer_add_byte_arr(&buf, pSignature, ulSignatureLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -45,7 +113,41 @@ C_VerifyMessageBegin
   CK_ULONG ulParameterLen      /* length of message specific parameter */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_SIGN_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_SIGN_MESSAGE_PARAMS_PTR pParams = &params;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051003);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_sign_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -60,7 +162,46 @@ C_VerifyMessageNext
   CK_ULONG ulSignatureLen       /* signature length */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_SIGN_MESSAGE_PARAMS params = {pParameter, ulParameterLen};
+  CK_SIGN_MESSAGE_PARAMS_PTR pParams = &params;
+  /* The NULL pSignature continues the multi-part message. */
+  CK_BBOOL last = pSignature != NULL;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051004);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_sign_message_params(&buf, pParams);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_byte_arr(&buf, pData, ulDataLen);
+  vp_buffer_add_byte_arr(&buf, pSignature, ulSignatureLen);
+  vp_buffer_add_bool(&buf, last);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 CK_RV
@@ -69,5 +210,29 @@ C_MessageVerifyFinal
   CK_SESSION_HANDLE hSession        /* the session's handle */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051005);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
@@ -163,7 +163,96 @@ C_WrapKey
   CK_ULONG_PTR      pulWrappedKeyLen /* gets wrapped key size */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_GCM_PARAMS_PTR gcm_params = NULL;
+  CK_BYTE_PTR iv = NULL;
+  CK_ULONG iv_len = 0;
+
+  if (pMechanism->mechanism == CKM_AES_GCM
+      && pMechanism->ulParameterLen == sizeof(CK_GCM_PARAMS))
+    {
+      gcm_params = (CK_GCM_PARAMS_PTR) pMechanism->pParameter;
+      if (gcm_params == NULL)
+        {
+          vp_log(LOG_ERR, "CK_GCM_PARAMS is NULL");
+          return CKR_MECHANISM_PARAM_INVALID;
+        }
+      if (gcm_params->ulIvBits == 0 && pWrappedKey != NULL)
+        {
+          iv = gcm_params->pIv;
+          iv_len = gcm_params->ulIvLen;
+        }
+    }
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051203);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_mechanism(&buf, pMechanism);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_uint32(&buf, hWrappingKey);
+  vp_buffer_add_uint32(&buf, hKey);
+
+  if (pWrappedKey == NULL)
+    vp_buffer_add_uint32(&buf, 0);
+  else
+    vp_buffer_add_uint32(&buf, *pulWrappedKeyLen);
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_get_byte_arr(&buf, iv, iv_len);
+  {
+    uint32_t count = vp_buffer_get_uint32(&buf);
+
+    if (pWrappedKey == NULL)
+      {
+        *pulWrappedKeyLen = count;
+      }
+    else if (count > *pulWrappedKeyLen)
+      {
+        *pulWrappedKeyLen = count;
+        vp_buffer_uninit(&buf);
+        return CKR_BUFFER_TOO_SMALL;
+      }
+    else
+      {
+        *pulWrappedKeyLen = count;
+        vp_buffer_get_byte_arr(&buf, pWrappedKey, count);
+      }
+  }
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  if (iv != NULL)
+    gcm_params->ulIvBits = gcm_params->ulIvLen * 8;
+
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 /* C_UnwrapKey unwraps (decrypts) a wrapped key, creating a new
@@ -182,7 +271,57 @@ C_UnwrapKey
   CK_OBJECT_HANDLE_PTR phKey              /* gets new handle */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  int i;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051204);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_mechanism(&buf, pMechanism);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_uint32(&buf, hUnwrappingKey);
+  vp_buffer_add_byte_arr(&buf, pWrappedKey, ulWrappedKeyLen);
+  vp_buffer_add_uint32(&buf, ulAttributeCount);
+  for (i = 0; i < ulAttributeCount; i++)
+    {
+      CK_ATTRIBUTE *iel = &pTemplate[i];
+
+      vp_buffer_add_uint32(&buf, iel->type);
+      vp_buffer_add_byte_arr(&buf, iel->pValue, iel->ulValueLen);
+    }
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  *phKey = vp_buffer_get_uint32(&buf);
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
 
 /* C_DeriveKey derives a key from a base key, creating a new key
@@ -199,5 +338,174 @@ C_DeriveKey
   CK_OBJECT_HANDLE_PTR phKey              /* gets new handle */
 )
 {
-  VP_FUNCTION_NOT_SUPPORTED;
+  CK_DERIVED_KEY_PTR derived_keys = NULL;
+  CK_ULONG ulAdditionalKeys = 0;
+  CK_OBJECT_HANDLE phAdditionalKeys[VP_MAX_ADDITIONAL_DERIVED_KEYS];
+  CK_VERSION_PTR version_out = NULL;
+  CK_BYTE version[2];
+  CK_ULONG version_len = sizeof(version);
+  CK_SSL3_KEY_MAT_OUT_PTR key_mat = NULL;
+  CK_OBJECT_HANDLE phKeyMaterial[4];
+  CK_ULONG ulKeyMaterial = 4;
+  CK_BYTE iv[2 * VP_MAX_TLS_IV_LEN];
+  CK_ULONG iv_len = sizeof(iv);
+  CK_ULONG iv_size = 0;
+  CK_OBJECT_HANDLE hKey;
+  CK_ULONG n;
+
+  switch (pMechanism->mechanism)
+    {
+    case CKM_SP800_108_COUNTER_KDF:
+    case CKM_SP800_108_DOUBLE_PIPELINE_KDF:
+      if (pMechanism->ulParameterLen == sizeof(CK_SP800_108_KDF_PARAMS)
+          && pMechanism->pParameter != NULL)
+        {
+          CK_SP800_108_KDF_PARAMS_PTR p
+            = (CK_SP800_108_KDF_PARAMS_PTR) pMechanism->pParameter;
+
+          derived_keys = p->pAdditionalDerivedKeys;
+          ulAdditionalKeys = p->ulAdditionalDerivedKeys;
+        }
+      break;
+
+    case CKM_SP800_108_FEEDBACK_KDF:
+      if (pMechanism->ulParameterLen
+          == sizeof(CK_SP800_108_FEEDBACK_KDF_PARAMS)
+          && pMechanism->pParameter != NULL)
+        {
+          CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR p
+            = (CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR) pMechanism->pParameter;
+
+          derived_keys = p->pAdditionalDerivedKeys;
+          ulAdditionalKeys = p->ulAdditionalDerivedKeys;
+        }
+      break;
+
+    case CKM_TLS12_MASTER_KEY_DERIVE:
+      if (pMechanism->ulParameterLen
+          == sizeof(CK_TLS12_MASTER_KEY_DERIVE_PARAMS)
+          && pMechanism->pParameter != NULL)
+        {
+          CK_TLS12_MASTER_KEY_DERIVE_PARAMS_PTR p
+            = (CK_TLS12_MASTER_KEY_DERIVE_PARAMS_PTR) pMechanism->pParameter;
+
+          version_out = p->pVersion;
+        }
+      break;
+
+    case CKM_TLS12_KEY_AND_MAC_DERIVE:
+      if (pMechanism->ulParameterLen == sizeof(CK_TLS12_KEY_MAT_PARAMS)
+          && pMechanism->pParameter != NULL)
+        {
+          CK_TLS12_KEY_MAT_PARAMS_PTR p
+            = (CK_TLS12_KEY_MAT_PARAMS_PTR) pMechanism->pParameter;
+
+          key_mat = p->pReturnedKeyMaterial;
+          if (key_mat == NULL)
+            return CKR_MECHANISM_PARAM_INVALID;
+
+          iv_size = p->ulIVSizeInBits / 8;
+          if (iv_size > VP_MAX_TLS_IV_LEN)
+            {
+              vp_log(LOG_ERR, "TLS IV too long: %d", iv_size);
+              return CKR_MECHANISM_PARAM_INVALID;
+            }
+          if (iv_size > 0
+              && (key_mat->pIVClient == NULL || key_mat->pIVServer == NULL))
+            return CKR_MECHANISM_PARAM_INVALID;
+        }
+      /* The key and MAC derivation does not return a key in phKey. */
+      if (phKey == NULL)
+        phKey = &hKey;
+      break;
+    }
+  if (ulAdditionalKeys > VP_MAX_ADDITIONAL_DERIVED_KEYS)
+    {
+      vp_log(LOG_ERR, "too many additional derived keys: %d",
+             ulAdditionalKeys);
+      return CKR_MECHANISM_PARAM_INVALID;
+    }
+  if (ulAdditionalKeys > 0 && derived_keys == NULL)
+    return CKR_MECHANISM_PARAM_INVALID;
+  for (n = 0; n < ulAdditionalKeys; n++)
+    if (derived_keys[n].phKey == NULL)
+      return CKR_MECHANISM_PARAM_INVALID;
+
+  CK_RV ret = CKR_OK;
+  VPBuffer buf;
+  int i;
+  VPIPCConn *conn = NULL;
+
+  VP_FUNCTION_ENTER;
+
+  /* Lookup session by hSession */
+  conn = vp_session(hSession, &ret);
+  if (ret != CKR_OK)
+    return ret;
+
+  vp_buffer_init(&buf);
+  vp_buffer_add_uint32(&buf, 0xc0051205);
+  vp_buffer_add_space(&buf, 4);
+
+  ret = vp_encode_mechanism(&buf, pMechanism);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+  vp_buffer_add_uint32(&buf, hBaseKey);
+  vp_buffer_add_uint32(&buf, ulAttributeCount);
+  for (i = 0; i < ulAttributeCount; i++)
+    {
+      CK_ATTRIBUTE *iel = &pTemplate[i];
+
+      vp_buffer_add_uint32(&buf, iel->type);
+      vp_buffer_add_byte_arr(&buf, iel->pValue, iel->ulValueLen);
+    }
+
+  ret = vp_ipc_tx(conn, &buf);
+  if (ret != CKR_OK)
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  *phKey = vp_buffer_get_uint32(&buf);
+  vp_buffer_get_uint32_arr(&buf, phAdditionalKeys, ulAdditionalKeys);
+  vp_buffer_get_byte_arr(&buf, version, version_len);
+  vp_buffer_get_uint32_arr(&buf, phKeyMaterial, ulKeyMaterial);
+  vp_buffer_get_byte_arr(&buf, iv, iv_len);
+
+  if (vp_buffer_error(&buf, &ret))
+    {
+      vp_buffer_uninit(&buf);
+      return ret;
+    }
+
+  for (n = 0; n < ulAdditionalKeys; n++)
+    *derived_keys[n].phKey = phAdditionalKeys[n];
+
+  if (version_out != NULL)
+    {
+      version_out->major = version[0];
+      version_out->minor = version[1];
+    }
+  if (key_mat != NULL)
+    {
+      key_mat->hClientMacSecret = phKeyMaterial[0];
+      key_mat->hServerMacSecret = phKeyMaterial[1];
+      key_mat->hClientKey = phKeyMaterial[2];
+      key_mat->hServerKey = phKeyMaterial[3];
+
+      if (iv_size > 0)
+        {
+          memcpy(key_mat->pIVClient, iv, iv_size);
+          memcpy(key_mat->pIVServer, iv + iv_size, iv_size);
+        }
+    }
+
+
+  vp_buffer_uninit(&buf);
+
+  return ret;
 }
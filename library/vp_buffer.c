@@ -194,6 +194,12 @@ vp_buffer_get_uint32(VPBuffer *buf)
   return VP_GET_UINT32(ucp);
 }
 
+CK_ULONG
+vp_buffer_get_ulong(VPBuffer *buf)
+{
+  return vp_buffer_get_uint32(buf);
+}
+
 unsigned char *
 vp_buffer_get_data(VPBuffer *buf, size_t len)
 {
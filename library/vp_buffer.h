@@ -46,6 +46,8 @@ unsigned char vp_buffer_get_byte(VPBuffer *buf);
 
 uint32_t vp_buffer_get_uint32(VPBuffer *buf);
 
+CK_ULONG vp_buffer_get_ulong(VPBuffer *buf);
+
 unsigned char *vp_buffer_get_data(VPBuffer *buf, size_t len);
 
 bool vp_buffer_get_byte_arr(VPBuffer *buf, void *data, size_t data_count);
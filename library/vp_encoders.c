@@ -16,6 +16,123 @@ typedef struct CK_GCM_PARAMS_V230 {
 
 typedef CK_GCM_PARAMS_V230 CK_PTR CK_GCM_PARAMS_V230_PTR;
 
+/* The pkcs11t.h does not define a pointer type for CK_HKDF_PARAMS. */
+typedef CK_HKDF_PARAMS CK_PTR CK_HKDF_PARAMS_PTR;
+
+static void
+vp_encode_oaep_params(VPBuffer *buf, CK_RSA_PKCS_OAEP_PARAMS_PTR p)
+{
+  vp_buffer_add_ulong(buf, p->hashAlg);
+  vp_buffer_add_ulong(buf, p->mgf);
+  vp_buffer_add_ulong(buf, p->source);
+  vp_buffer_add_byte_arr(buf, p->pSourceData, p->ulSourceDataLen);
+}
+
+static void
+vp_encode_ssl3_random_data(VPBuffer *buf, CK_SSL3_RANDOM_DATA *p)
+{
+  vp_buffer_add_byte_arr(buf, p->pClientRandom, p->ulClientRandomLen);
+  vp_buffer_add_byte_arr(buf, p->pServerRandom, p->ulServerRandomLen);
+}
+
+static void
+vp_encode_eddsa_params(VPBuffer *buf, CK_EDDSA_PARAMS_PTR p)
+{
+  vp_buffer_add_bool(buf, p->phFlag);
+  vp_buffer_add_byte_arr(buf, p->pContextData, p->ulContextDataLen);
+}
+
+static CK_RV
+vp_encode_prf_data_params(VPBuffer *buf, CK_PRF_DATA_PARAM_PTR params,
+                          CK_ULONG count)
+{
+  CK_SP800_108_COUNTER_FORMAT_PTR counter;
+  CK_SP800_108_DKM_LENGTH_FORMAT_PTR dkm;
+  CK_ULONG i;
+
+  if (count > 0 && params == NULL)
+    return CKR_MECHANISM_PARAM_INVALID;
+
+  vp_buffer_add_uint32(buf, count);
+  for (i = 0; i < count; i++)
+    {
+      CK_PRF_DATA_PARAM_PTR p = &params[i];
+
+      vp_buffer_add_ulong(buf, p->type);
+
+      switch (p->type)
+        {
+        case CK_SP800_108_ITERATION_VARIABLE:
+        case CK_SP800_108_OPTIONAL_COUNTER:
+          if (p->pValue == NULL)
+            {
+              /* Feedback and double pipeline iteration variables. */
+              vp_buffer_add_byte_arr(buf, NULL, 0);
+              break;
+            }
+          if (p->ulValueLen != sizeof(CK_SP800_108_COUNTER_FORMAT))
+            return CKR_MECHANISM_PARAM_INVALID;
+
+          counter = (CK_SP800_108_COUNTER_FORMAT_PTR) p->pValue;
+
+          vp_buffer_add_uint32(buf, 5);
+          vp_buffer_add_bool(buf, counter->bLittleEndian);
+          vp_buffer_add_ulong(buf, counter->ulWidthInBits);
+          break;
+
+        case CK_SP800_108_DKM_LENGTH:
+          if (p->pValue == NULL
+              || p->ulValueLen != sizeof(CK_SP800_108_DKM_LENGTH_FORMAT))
+            return CKR_MECHANISM_PARAM_INVALID;
+
+          dkm = (CK_SP800_108_DKM_LENGTH_FORMAT_PTR) p->pValue;
+
+          vp_buffer_add_uint32(buf, 9);
+          vp_buffer_add_ulong(buf, dkm->dkmLengthMethod);
+          vp_buffer_add_bool(buf, dkm->bLittleEndian);
+          vp_buffer_add_ulong(buf, dkm->ulWidthInBits);
+          break;
+
+        case CK_SP800_108_BYTE_ARRAY:
+          vp_buffer_add_byte_arr(buf, p->pValue, p->ulValueLen);
+          break;
+
+        default:
+          vp_log(LOG_ERR, "invalid PRF data parameter type %08x", p->type);
+          return CKR_MECHANISM_PARAM_INVALID;
+        }
+    }
+
+  return CKR_OK;
+}
+
+static CK_RV
+vp_encode_derived_keys(VPBuffer *buf, CK_DERIVED_KEY_PTR keys,
+                       CK_ULONG count)
+{
+  CK_ULONG i, j;
+
+  if (count > VP_MAX_ADDITIONAL_DERIVED_KEYS
+      || (count > 0 && keys == NULL))
+    return CKR_MECHANISM_PARAM_INVALID;
+
+  vp_buffer_add_uint32(buf, count);
+  for (i = 0; i < count; i++)
+    {
+      CK_DERIVED_KEY_PTR key = &keys[i];
+
+      vp_buffer_add_uint32(buf, key->ulAttributeCount);
+      for (j = 0; j < key->ulAttributeCount; j++)
+        {
+          CK_ATTRIBUTE_PTR attr = &key->pTemplate[j];
+
+          vp_buffer_add_uint32(buf, attr->type);
+          vp_buffer_add_byte_arr(buf, attr->pValue, attr->ulValueLen);
+        }
+    }
+
+  return CKR_OK;
+}
 
 CK_RV
 vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m)
@@ -32,18 +149,64 @@ vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m)
     case CKM_RSA_PKCS_KEY_PAIR_GEN:
     case CKM_RSA_PKCS:
     case CKM_RSA_X9_31_KEY_PAIR_GEN:
+    case CKM_SHA1_RSA_PKCS:
     case CKM_SHA224_RSA_PKCS:
     case CKM_SHA256_RSA_PKCS:
     case CKM_SHA384_RSA_PKCS:
     case CKM_SHA512_RSA_PKCS:
+    case CKM_SHA3_224_RSA_PKCS:
+    case CKM_SHA3_256_RSA_PKCS:
+    case CKM_SHA3_384_RSA_PKCS:
+    case CKM_SHA3_512_RSA_PKCS:
+    case CKM_SHA_1:
     case CKM_SHA224:
     case CKM_SHA256:
     case CKM_SHA384:
     case CKM_SHA512:
+    case CKM_SHA512_224:
+    case CKM_SHA512_256:
+    case CKM_SHA3_224:
+    case CKM_SHA3_256:
+    case CKM_SHA3_384:
+    case CKM_SHA3_512:
+    case CKM_BLAKE2B_160:
+    case CKM_BLAKE2B_256:
+    case CKM_BLAKE2B_384:
+    case CKM_BLAKE2B_512:
+    case CKM_SHA_1_HMAC:
+    case CKM_SHA224_HMAC:
+    case CKM_SHA256_HMAC:
+    case CKM_SHA384_HMAC:
+    case CKM_SHA512_HMAC:
+    case CKM_SHA512_224_HMAC:
+    case CKM_SHA512_256_HMAC:
+    case CKM_SHA3_224_HMAC:
+    case CKM_SHA3_256_HMAC:
+    case CKM_SHA3_384_HMAC:
+    case CKM_SHA3_512_HMAC:
+    case CKM_BLAKE2B_160_HMAC:
+    case CKM_BLAKE2B_256_HMAC:
+    case CKM_BLAKE2B_384_HMAC:
+    case CKM_BLAKE2B_512_HMAC:
     case CKM_EC_KEY_PAIR_GEN:
+    case CKM_ECDSA_SHA1:
+    case CKM_ECDSA_SHA224:
+    case CKM_ECDSA_SHA256:
+    case CKM_ECDSA_SHA384:
     case CKM_ECDSA_SHA512:
+    case CKM_ECDSA_SHA3_224:
+    case CKM_ECDSA_SHA3_256:
+    case CKM_ECDSA_SHA3_384:
+    case CKM_ECDSA_SHA3_512:
     case CKM_AES_KEY_GEN:
     case CKM_AES_ECB:
+    case CKM_AES_XTS_KEY_GEN:
+    case CKM_DES3_KEY_GEN:
+    case CKM_DES3_ECB:
+    case CKM_HKDF_KEY_GEN:
+    case CKM_CHACHA20_KEY_GEN:
+    case CKM_CHACHA20_POLY1305:
+    case CKM_EC_EDWARDS_KEY_PAIR_GEN:
       if (m->ulParameterLen != 0)
         {
           vp_log(LOG_ERR, "mechanism: %08x: unexpected parameter: len=%d",
@@ -55,6 +218,12 @@ vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m)
 
     case CKM_AES_CBC:
     case CKM_AES_CBC_PAD:
+    case CKM_AES_OFB:
+    case CKM_AES_CFB8:
+    case CKM_AES_CFB64:
+    case CKM_AES_CFB128:
+    case CKM_AES_CTS:
+    case CKM_AES_XTS:
       if (m->ulParameterLen != 16)
         {
           vp_log(LOG_ERR, "mechanism: %08x: invalid IV: len=%d",
@@ -64,6 +233,17 @@ vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m)
       vp_buffer_add_byte_arr(buf, m->pParameter, m->ulParameterLen);
       break;
 
+    case CKM_DES3_CBC:
+    case CKM_DES3_CBC_PAD:
+      if (m->ulParameterLen != 8)
+        {
+          vp_log(LOG_ERR, "mechanism: %08x: invalid IV: len=%d",
+                 m->mechanism, m->ulParameterLen);
+          return CKR_MECHANISM_INVALID;
+        }
+      vp_buffer_add_byte_arr(buf, m->pParameter, m->ulParameterLen);
+      break;
+
     case CKM_AES_CTR:
       if (m->ulParameterLen == sizeof(CK_AES_CTR_PARAMS))
         {
@@ -116,6 +296,11 @@ vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m)
 
           vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
         }
+      else if (m->ulParameterLen == 0)
+        {
+          /* Message-based encryption and decryption. */
+          vp_buffer_add_byte_arr(buf, m->pParameter, m->ulParameterLen);
+        }
       else
         {
           vp_log(LOG_ERR, "mechanism: %08x: invalid CK_GCM_PARAMS: len=%d (%d)",
@@ -124,6 +309,424 @@ vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m)
         }
       break;
 
+    case CKM_EDDSA:
+      if (m->ulParameterLen == sizeof(CK_EDDSA_PARAMS) && m->pParameter != NULL)
+        {
+          vp_encode_eddsa_params(&b, (CK_EDDSA_PARAMS_PTR) m->pParameter);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else if (m->ulParameterLen == 0)
+        {
+          vp_buffer_add_byte_arr(buf, m->pParameter, m->ulParameterLen);
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_EDDSA_PARAMS: len=%d (%d)",
+                 m->mechanism, m->ulParameterLen, sizeof(CK_EDDSA_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_RSA_PKCS_OAEP:
+      if (m->ulParameterLen == sizeof(CK_RSA_PKCS_OAEP_PARAMS)
+          && m->pParameter != NULL)
+        {
+          vp_encode_oaep_params(&b, (CK_RSA_PKCS_OAEP_PARAMS_PTR)
+                                m->pParameter);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_RSA_PKCS_OAEP_PARAMS: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_RSA_PKCS_OAEP_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_SHA1_RSA_PKCS_PSS:
+    case CKM_SHA224_RSA_PKCS_PSS:
+    case CKM_SHA256_RSA_PKCS_PSS:
+    case CKM_SHA384_RSA_PKCS_PSS:
+    case CKM_SHA512_RSA_PKCS_PSS:
+    case CKM_SHA3_224_RSA_PKCS_PSS:
+    case CKM_SHA3_256_RSA_PKCS_PSS:
+    case CKM_SHA3_384_RSA_PKCS_PSS:
+    case CKM_SHA3_512_RSA_PKCS_PSS:
+      if (m->ulParameterLen == sizeof(CK_RSA_PKCS_PSS_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_RSA_PKCS_PSS_PARAMS_PTR p
+            = (CK_RSA_PKCS_PSS_PARAMS_PTR) m->pParameter;
+
+          vp_buffer_add_ulong(&b, p->hashAlg);
+          vp_buffer_add_ulong(&b, p->mgf);
+          vp_buffer_add_ulong(&b, p->sLen);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_RSA_PKCS_PSS_PARAMS: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_RSA_PKCS_PSS_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_RSA_AES_KEY_WRAP:
+      if (m->ulParameterLen == sizeof(CK_RSA_AES_KEY_WRAP_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_RSA_AES_KEY_WRAP_PARAMS_PTR p
+            = (CK_RSA_AES_KEY_WRAP_PARAMS_PTR) m->pParameter;
+
+          if (p->pOAEPParams == NULL)
+            {
+              vp_log(LOG_ERR, "mechanism: %08x: pOAEPParams is NULL",
+                     m->mechanism);
+              return CKR_MECHANISM_PARAM_INVALID;
+            }
+
+          vp_buffer_add_ulong(&b, p->ulAESKeyBits);
+          vp_encode_oaep_params(&b, p->pOAEPParams);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_RSA_AES_KEY_WRAP_PARAMS: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_RSA_AES_KEY_WRAP_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_HKDF_DERIVE:
+    case CKM_HKDF_DATA:
+      if (m->ulParameterLen == sizeof(CK_HKDF_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_HKDF_PARAMS_PTR p = (CK_HKDF_PARAMS_PTR) m->pParameter;
+
+          vp_buffer_add_bool(&b, p->bExtract);
+          vp_buffer_add_bool(&b, p->bExpand);
+          vp_buffer_add_ulong(&b, p->prfHashMechanism);
+          vp_buffer_add_ulong(&b, p->ulSaltType);
+          vp_buffer_add_byte_arr(&b, p->pSalt, p->ulSaltLen);
+          vp_buffer_add_uint32(&b, p->hSaltKey);
+          vp_buffer_add_byte_arr(&b, p->pInfo, p->ulInfoLen);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_HKDF_PARAMS: len=%d (%d)",
+                 m->mechanism, m->ulParameterLen, sizeof(CK_HKDF_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_CONCATENATE_BASE_AND_KEY:
+      if (m->ulParameterLen == sizeof(CK_OBJECT_HANDLE)
+          && m->pParameter != NULL)
+        {
+          vp_buffer_add_uint32(&b, *(CK_OBJECT_HANDLE_PTR) m->pParameter);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_OBJECT_HANDLE: len=%d (%d)",
+                 m->mechanism, m->ulParameterLen, sizeof(CK_OBJECT_HANDLE));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_CONCATENATE_BASE_AND_DATA:
+    case CKM_CONCATENATE_DATA_AND_BASE:
+    case CKM_XOR_BASE_AND_DATA:
+      if (m->ulParameterLen == sizeof(CK_KEY_DERIVATION_STRING_DATA)
+          && m->pParameter != NULL)
+        {
+          CK_KEY_DERIVATION_STRING_DATA_PTR p
+            = (CK_KEY_DERIVATION_STRING_DATA_PTR) m->pParameter;
+
+          vp_buffer_add_byte_arr(&b, p->pData, p->ulLen);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_KEY_DERIVATION_STRING_DATA: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_KEY_DERIVATION_STRING_DATA));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_EXTRACT_KEY_FROM_KEY:
+      if (m->ulParameterLen == sizeof(CK_EXTRACT_PARAMS)
+          && m->pParameter != NULL)
+        {
+          vp_buffer_add_ulong(&b, *(CK_EXTRACT_PARAMS_PTR) m->pParameter);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_EXTRACT_PARAMS: len=%d (%d)",
+                 m->mechanism, m->ulParameterLen, sizeof(CK_EXTRACT_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_TLS12_MASTER_KEY_DERIVE:
+    case CKM_TLS12_MASTER_KEY_DERIVE_DH:
+      if (m->ulParameterLen == sizeof(CK_TLS12_MASTER_KEY_DERIVE_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_TLS12_MASTER_KEY_DERIVE_PARAMS_PTR p
+            = (CK_TLS12_MASTER_KEY_DERIVE_PARAMS_PTR) m->pParameter;
+
+          vp_encode_ssl3_random_data(&b, &p->RandomInfo);
+          vp_buffer_add_ulong(&b, p->prfHashMechanism);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_TLS12_MASTER_KEY_DERIVE_PARAMS: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_TLS12_MASTER_KEY_DERIVE_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_TLS12_KEY_AND_MAC_DERIVE:
+      if (m->ulParameterLen == sizeof(CK_TLS12_KEY_MAT_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_TLS12_KEY_MAT_PARAMS_PTR p
+            = (CK_TLS12_KEY_MAT_PARAMS_PTR) m->pParameter;
+
+          vp_buffer_add_ulong(&b, p->ulMacSizeInBits);
+          vp_buffer_add_ulong(&b, p->ulKeySizeInBits);
+          vp_buffer_add_ulong(&b, p->ulIVSizeInBits);
+          vp_buffer_add_bool(&b, p->bIsExport);
+          vp_encode_ssl3_random_data(&b, &p->RandomInfo);
+          vp_buffer_add_ulong(&b, p->prfHashMechanism);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_TLS12_KEY_MAT_PARAMS: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_TLS12_KEY_MAT_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_TLS12_KDF:
+      if (m->ulParameterLen == sizeof(CK_TLS_KDF_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_TLS_KDF_PARAMS_PTR p = (CK_TLS_KDF_PARAMS_PTR) m->pParameter;
+
+          vp_buffer_add_ulong(&b, p->prfMechanism);
+          vp_buffer_add_byte_arr(&b, p->pLabel, p->ulLabelLength);
+          vp_encode_ssl3_random_data(&b, &p->RandomInfo);
+          vp_buffer_add_byte_arr(&b, p->pContextData, p->ulContextDataLength);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_TLS_KDF_PARAMS: len=%d (%d)",
+                 m->mechanism, m->ulParameterLen, sizeof(CK_TLS_KDF_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_TLS_MAC:
+      if (m->ulParameterLen == sizeof(CK_TLS_MAC_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_TLS_MAC_PARAMS_PTR p = (CK_TLS_MAC_PARAMS_PTR) m->pParameter;
+
+          vp_buffer_add_ulong(&b, p->prfHashMechanism);
+          vp_buffer_add_ulong(&b, p->ulMacLength);
+          vp_buffer_add_ulong(&b, p->ulServerOrClient);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_TLS_MAC_PARAMS: len=%d (%d)",
+                 m->mechanism, m->ulParameterLen, sizeof(CK_TLS_MAC_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_PKCS5_PBKD2:
+      /* The CK_PKCS5_PBKD2_PARAMS and CK_PKCS5_PBKD2_PARAMS2 have the
+       * same size and we only support the corrected PARAMS2 version
+       * where the ulPasswordLen is a CK_ULONG. */
+      if (m->ulParameterLen == sizeof(CK_PKCS5_PBKD2_PARAMS2)
+          && m->pParameter != NULL)
+        {
+          CK_PKCS5_PBKD2_PARAMS2_PTR p
+            = (CK_PKCS5_PBKD2_PARAMS2_PTR) m->pParameter;
+
+          vp_buffer_add_ulong(&b, p->saltSource);
+          vp_buffer_add_byte_arr(&b, p->pSaltSourceData,
+                                 p->ulSaltSourceDataLen);
+          vp_buffer_add_ulong(&b, p->iterations);
+          vp_buffer_add_ulong(&b, p->prf);
+          vp_buffer_add_byte_arr(&b, p->pPrfData, p->ulPrfDataLen);
+          vp_buffer_add_byte_arr(&b, p->pPassword, p->ulPasswordLen);
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_PKCS5_PBKD2_PARAMS2: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_PKCS5_PBKD2_PARAMS2));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_SP800_108_COUNTER_KDF:
+    case CKM_SP800_108_DOUBLE_PIPELINE_KDF:
+      if (m->ulParameterLen == sizeof(CK_SP800_108_KDF_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_SP800_108_KDF_PARAMS_PTR p
+            = (CK_SP800_108_KDF_PARAMS_PTR) m->pParameter;
+
+          vp_buffer_add_ulong(&b, p->prfType);
+          ret = vp_encode_prf_data_params(&b, p->pDataParams,
+                                          p->ulNumberOfDataParams);
+          if (ret != CKR_OK)
+            goto out;
+          ret = vp_encode_derived_keys(&b, p->pAdditionalDerivedKeys,
+                                       p->ulAdditionalDerivedKeys);
+          if (ret != CKR_OK)
+            goto out;
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_SP800_108_KDF_PARAMS: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_SP800_108_KDF_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
+    case CKM_SP800_108_FEEDBACK_KDF:
+      if (m->ulParameterLen == sizeof(CK_SP800_108_FEEDBACK_KDF_PARAMS)
+          && m->pParameter != NULL)
+        {
+          CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR p
+            = (CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR) m->pParameter;
+
+          vp_buffer_add_ulong(&b, p->prfType);
+          ret = vp_encode_prf_data_params(&b, p->pDataParams,
+                                          p->ulNumberOfDataParams);
+          if (ret != CKR_OK)
+            goto out;
+          vp_buffer_add_byte_arr(&b, p->pIV, p->ulIVLen);
+          ret = vp_encode_derived_keys(&b, p->pAdditionalDerivedKeys,
+                                       p->ulAdditionalDerivedKeys);
+          if (ret != CKR_OK)
+            goto out;
+
+          if (vp_buffer_error(&b, &ret))
+            goto out;
+
+          vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+        }
+      else
+        {
+          vp_log(LOG_ERR,
+                 "mechanism: %08x: invalid CK_SP800_108_FEEDBACK_KDF_PARAMS: "
+                 "len=%d (%d)",
+                 m->mechanism, m->ulParameterLen,
+                 sizeof(CK_SP800_108_FEEDBACK_KDF_PARAMS));
+          return CKR_MECHANISM_INVALID;
+        }
+      break;
+
     default:
       vp_log(LOG_ERR, "mechanism: %08x: unsupported: ulParameterLen=%d",
              m->mechanism, m->ulParameterLen);
@@ -137,3 +740,139 @@ vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m)
 
   return ret;
 }
+
+CK_RV
+vp_encode_encrypt_message_params(VPBuffer *buf,
+                                 CK_ENCRYPT_MESSAGE_PARAMS_PTR p)
+{
+  CK_RV ret = CKR_OK;
+  VPBuffer b;
+
+  if (p->pParameter == NULL)
+    {
+      vp_log(LOG_ERR, "message parameter is NULL");
+      return CKR_MECHANISM_PARAM_INVALID;
+    }
+
+  vp_buffer_init(&b);
+
+  if (p->ulParameterLen == sizeof(CK_GCM_MESSAGE_PARAMS))
+    {
+      CK_GCM_MESSAGE_PARAMS_PTR gcm = (CK_GCM_MESSAGE_PARAMS_PTR) p->pParameter;
+
+      vp_buffer_add_byte_arr(&b, gcm->pIv, gcm->ulIvLen);
+      vp_buffer_add_ulong(&b, gcm->ulIvFixedBits);
+      vp_buffer_add_ulong(&b, gcm->ivGenerator);
+      if (gcm->pTag == NULL)
+        vp_buffer_add_byte_arr(&b, NULL, 0);
+      else
+        vp_buffer_add_byte_arr(&b, gcm->pTag, gcm->ulTagBits / 8);
+      vp_buffer_add_ulong(&b, gcm->ulTagBits);
+    }
+  else if (p->ulParameterLen == sizeof(CK_SALSA20_CHACHA20_POLY1305_MSG_PARAMS))
+    {
+      CK_SALSA20_CHACHA20_POLY1305_MSG_PARAMS_PTR chacha
+        = (CK_SALSA20_CHACHA20_POLY1305_MSG_PARAMS_PTR) p->pParameter;
+
+      vp_buffer_add_byte_arr(&b, chacha->pNonce, chacha->ulNonceLen);
+      if (chacha->pTag == NULL)
+        vp_buffer_add_byte_arr(&b, NULL, 0);
+      else
+        vp_buffer_add_byte_arr(&b, chacha->pTag, VP_POLY1305_TAG_LEN);
+    }
+  else
+    {
+      vp_log(LOG_ERR, "invalid message parameter: len=%d", p->ulParameterLen);
+      ret = CKR_MECHANISM_PARAM_INVALID;
+      goto out;
+    }
+
+  if (vp_buffer_error(&b, &ret))
+    goto out;
+
+  vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+
+ out:
+
+  vp_buffer_uninit(&b);
+
+  return ret;
+}
+
+void
+vp_encrypt_message_outputs(CK_ENCRYPT_MESSAGE_PARAMS_PTR p,
+                           CK_BYTE_PTR *iv, CK_ULONG *iv_len,
+                           CK_BYTE_PTR *tag, CK_ULONG *tag_len)
+{
+  *iv = NULL;
+  *iv_len = 0;
+  *tag = NULL;
+  *tag_len = 0;
+
+  if (p->pParameter == NULL)
+    return;
+
+  if (p->ulParameterLen == sizeof(CK_GCM_MESSAGE_PARAMS))
+    {
+      CK_GCM_MESSAGE_PARAMS_PTR gcm = (CK_GCM_MESSAGE_PARAMS_PTR) p->pParameter;
+
+      if (gcm->ivGenerator != CKG_NO_GENERATE)
+        {
+          *iv = gcm->pIv;
+          *iv_len = gcm->ulIvLen;
+        }
+      if (gcm->pTag != NULL)
+        {
+          *tag = gcm->pTag;
+          *tag_len = gcm->ulTagBits / 8;
+        }
+    }
+  else if (p->ulParameterLen == sizeof(CK_SALSA20_CHACHA20_POLY1305_MSG_PARAMS))
+    {
+      CK_SALSA20_CHACHA20_POLY1305_MSG_PARAMS_PTR chacha
+        = (CK_SALSA20_CHACHA20_POLY1305_MSG_PARAMS_PTR) p->pParameter;
+
+      if (chacha->pTag != NULL)
+        {
+          *tag = chacha->pTag;
+          *tag_len = VP_POLY1305_TAG_LEN;
+        }
+    }
+}
+
+CK_RV
+vp_encode_sign_message_params(VPBuffer *buf, CK_SIGN_MESSAGE_PARAMS_PTR p)
+{
+  CK_RV ret = CKR_OK;
+  VPBuffer b;
+
+  if (p->pParameter == NULL || p->ulParameterLen == 0)
+    {
+      vp_buffer_add_byte_arr(buf, NULL, 0);
+      return CKR_OK;
+    }
+
+  vp_buffer_init(&b);
+
+  if (p->ulParameterLen == sizeof(CK_EDDSA_PARAMS))
+    {
+      vp_encode_eddsa_params(&b, (CK_EDDSA_PARAMS_PTR) p->pParameter);
+    }
+  else
+    {
+      vp_log(LOG_ERR, "invalid message parameter: len=%d", p->ulParameterLen);
+      ret = CKR_MECHANISM_PARAM_INVALID;
+      goto out;
+    }
+
+  if (vp_buffer_error(&b, &ret))
+    goto out;
+
+  vp_buffer_add_byte_arr(buf, vp_buffer_ptr(&b), vp_buffer_len(&b));
+
+ out:
+
+  vp_buffer_uninit(&b);
+
+  return ret;
+}
@@ -39,10 +39,21 @@ typedef unsigned long int CK_HANDLE;
 
 #define SOCKET_PATH "/tmp/vp.sock"
 
+/* The maximum number of additional keys in SP 800-108 key derivation. */
+#define VP_MAX_ADDITIONAL_DERIVED_KEYS 16
+
+/* The maximum IV length in TLS key and MAC derivation. */
+#define VP_MAX_TLS_IV_LEN 16
+
+/* The length of the ChaCha20-Poly1305 authentication tag. */
+#define VP_POLY1305_TAG_LEN 16
+
 /****************** Implementation specific RPC functions *******************/
 
 CK_RV C_ImplOpenSession(CK_ULONG ulProviderID, CK_SESSION_HANDLE hSession);
 CK_RV C_ImplCloseSession(CK_SESSION_HANDLE hSession);
+CK_RV C_ImplWaitForSlotEvent(VPIPCConn *event_conn, CK_ULONG ulProviderID,
+                             CK_FLAGS flags, CK_SLOT_ID_PTR pSlot);
 
 
 /*************************** Global library state ***************************/
@@ -53,12 +64,45 @@ extern void *vp_global_mutex;
 extern CK_ULONG vp_provider_id;
 
 VPIPCConn *vp_session(CK_SESSION_HANDLE id, CK_RV *ret);
+void vp_session_unregister_all(void);
+void vp_slot_event_cancel(void);
 
 
 /***************************** Custom encoders ******************************/
 
 CK_RV vp_encode_mechanism(VPBuffer *buf, CK_MECHANISM_PTR m);
 
+/* The message-based encryption and decryption parameters. The
+ * parameter type depends on the mechanism of the message operation
+ * and it is resolved from the parameter length.
+ */
+typedef struct CK_ENCRYPT_MESSAGE_PARAMS {
+  CK_VOID_PTR pParameter;
+  CK_ULONG    ulParameterLen;
+} CK_ENCRYPT_MESSAGE_PARAMS;
+
+typedef CK_ENCRYPT_MESSAGE_PARAMS CK_PTR CK_ENCRYPT_MESSAGE_PARAMS_PTR;
+
+CK_RV vp_encode_encrypt_message_params(VPBuffer *buf,
+                                       CK_ENCRYPT_MESSAGE_PARAMS_PTR p);
+void vp_encrypt_message_outputs(CK_ENCRYPT_MESSAGE_PARAMS_PTR p,
+                                CK_BYTE_PTR *iv, CK_ULONG *iv_len,
+                                CK_BYTE_PTR *tag, CK_ULONG *tag_len);
+
+/* The message-based signing and verification parameters. The
+ * parameters are optional and their type depends on the mechanism of
+ * the message operation.
+ */
+typedef struct CK_SIGN_MESSAGE_PARAMS {
+  CK_VOID_PTR pParameter;
+  CK_ULONG    ulParameterLen;
+} CK_SIGN_MESSAGE_PARAMS;
+
+typedef CK_SIGN_MESSAGE_PARAMS CK_PTR CK_SIGN_MESSAGE_PARAMS_PTR;
+
+CK_RV vp_encode_sign_message_params(VPBuffer *buf,
+                                    CK_SIGN_MESSAGE_PARAMS_PTR p);
+
 
 /********************************* Logging **********************************/
 
@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2023 Markku Rossi.
+//
+// All rights reserved.
+//
+
+package pkcs11
+
+import (
+	"crypto/elliptic"
+	"encoding/asn1"
+)
+
+var curves = []struct {
+	oid   asn1.ObjectIdentifier
+	curve elliptic.Curve
+}{
+	{
+		oid:   asn1.ObjectIdentifier{1, 3, 132, 0, 33},
+		curve: elliptic.P224(),
+	},
+	{
+		oid:   asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7},
+		curve: elliptic.P256(),
+	},
+	{
+		oid:   asn1.ObjectIdentifier{1, 3, 132, 0, 34},
+		curve: elliptic.P384(),
+	},
+	{
+		oid:   asn1.ObjectIdentifier{1, 3, 132, 0, 35},
+		curve: elliptic.P521(),
+	},
+}
+
+// CurveByParams returns the elliptic curve specified by the DER
+// encoded CKA_EC_PARAMS value.
+func CurveByParams(params []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+
+	rest, err := asn1.Unmarshal(params, &oid)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrDomainParamsInvalid
+	}
+	for _, c := range curves {
+		if c.oid.Equal(oid) {
+			return c.curve, nil
+		}
+	}
+	return nil, ErrCurveNotSupported
+}
+
+// CurveParams returns the DER encoded CKA_EC_PARAMS value for the
+// elliptic curve.
+func CurveParams(curve elliptic.Curve) ([]byte, error) {
+	for _, c := range curves {
+		if c.curve == curve {
+			return asn1.Marshal(c.oid)
+		}
+	}
+	return nil, ErrCurveNotSupported
+}
+
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// EdwardsParams returns the DER encoded CKA_EC_PARAMS value for the
+// Ed25519 curve.
+func EdwardsParams() []byte {
+	data, err := asn1.Marshal(oidEd25519)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// CheckEdwardsParams checks that the DER encoded CKA_EC_PARAMS value
+// specifies the Ed25519 curve. The curve is specified either with its
+// object identifier or with the curve name.
+func CheckEdwardsParams(params []byte) error {
+	var oid asn1.ObjectIdentifier
+	rest, err := asn1.Unmarshal(params, &oid)
+	if err == nil && len(rest) == 0 {
+		if oid.Equal(oidEd25519) {
+			return nil
+		}
+		return ErrCurveNotSupported
+	}
+	var name string
+	rest, err = asn1.UnmarshalWithParams(params, &name, "printable")
+	if err != nil || len(rest) != 0 {
+		return ErrDomainParamsInvalid
+	}
+	if name != "edwards25519" {
+		return ErrCurveNotSupported
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//
+// Copyright (c) 2023 Markku Rossi.
+//
+// All rights reserved.
+//
+
+package pkcs11
+
+import (
+	"crypto/des"
+	"math/bits"
+)
+
+// DES3KeySize specifies the DES3 key size in bytes.
+const DES3KeySize = 24
+
+// DES3SetParity sets the odd parity bits of the DES3 key.
+func DES3SetParity(key []byte) {
+	for i, b := range key {
+		if bits.OnesCount8(b&0xfe)%2 == 0 {
+			key[i] = b | 0x01
+		} else {
+			key[i] = b & 0xfe
+		}
+	}
+}
+
+// DES3CheckParity tests if the DES3 key has valid odd parity bits.
+func DES3CheckParity(key []byte) bool {
+	for _, b := range key {
+		if bits.OnesCount8(b)%2 == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// DES3CheckValue computes the CKA_CHECK_VALUE of the DES3 key. The
+// check value is the first three bytes of the ECB encryption of a
+// zero block.
+func DES3CheckValue(key []byte) ([]byte, error) {
+	b, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, ErrAttributeValueInvalid
+	}
+	var block [des.BlockSize]byte
+	b.Encrypt(block[:], block[:])
+
+	return block[:3], nil
+}
@@ -0,0 +1,43 @@
+//
+// Copyright (c) 2023 Markku Rossi.
+//
+// All rights reserved.
+//
+
+package pkcs11
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDES3Parity(t *testing.T) {
+	key := make([]byte, DES3KeySize)
+	for i := range key {
+		key[i] = byte(i * 37)
+	}
+	DES3SetParity(key)
+	if !DES3CheckParity(key) {
+		t.Errorf("DES3SetParity: invalid parity: %x", key)
+	}
+	key[0] ^= 0x01
+	if DES3CheckParity(key) {
+		t.Errorf("DES3CheckParity: parity error not detected: %x", key)
+	}
+}
+
+func TestDES3CheckValue(t *testing.T) {
+	// Single DES test vector: E(0101010101010101, 0) = 8CA64DE9C1B123A7.
+	key, _ := hex.DecodeString(
+		"010101010101010101010101010101010101010101010101")
+	expected, _ := hex.DecodeString("8ca64d")
+
+	cv, err := DES3CheckValue(key)
+	if err != nil {
+		t.Fatalf("DES3CheckValue failed: %s", err)
+	}
+	if !bytes.Equal(cv, expected) {
+		t.Errorf("DES3CheckValue: got %x, expected %x", cv, expected)
+	}
+}
@@ -26,6 +26,9 @@ type Char = byte
 // Flags defines basic protocol type CK_FLAGS.
 type Flags uint32
 
+// GeneratorFunction defines basic protocol type CK_GENERATOR_FUNCTION.
+type GeneratorFunction Ulong
+
 // KeyType defines basic protocol type CK_KEY_TYPE.
 type KeyType uint32
 
@@ -38,6 +41,21 @@ type ObjectClass uint32
 // ObjectHandle defines basic protocol type CK_OBJECT_HANDLE.
 type ObjectHandle uint32
 
+// Pkcs5Pbkd2PseudoRandomFunctionType defines basic protocol type CK_PKCS5_PBKD2_PSEUDO_RANDOM_FUNCTION_TYPE.
+type Pkcs5Pbkd2PseudoRandomFunctionType Ulong
+
+// Pkcs5Pbkdf2SaltSourceType defines basic protocol type CK_PKCS5_PBKDF2_SALT_SOURCE_TYPE.
+type Pkcs5Pbkdf2SaltSourceType Ulong
+
+// PrfDataType defines basic protocol type CK_PRF_DATA_TYPE.
+type PrfDataType Ulong
+
+// RsaPkcsMgfType defines basic protocol type CK_RSA_PKCS_MGF_TYPE.
+type RsaPkcsMgfType Ulong
+
+// RsaPkcsOaepSourceType defines basic protocol type CK_RSA_PKCS_OAEP_SOURCE_TYPE.
+type RsaPkcsOaepSourceType Ulong
+
 // SessionHandle defines basic protocol type CK_SESSION_HANDLE.
 type SessionHandle uint32
 
@@ -47,6 +65,9 @@ type SlotID Ulong
 // SlotIDPtr defines basic protocol type CK_SLOT_ID_PTR.
 type SlotIDPtr uint32
 
+// Sp800108DkmLengthMethod defines basic protocol type CK_SP800_108_DKM_LENGTH_METHOD.
+type Sp800108DkmLengthMethod Ulong
+
 // State defines basic protocol type CK_STATE.
 type State uint32
 
@@ -77,6 +98,31 @@ type Attribute struct {
 	Value []Byte
 }
 
+// DerivedKey defines compound protocol type CK_DERIVED_KEY.
+type DerivedKey struct {
+	Template Template
+}
+
+// EddsaParams defines compound protocol type CK_EDDSA_PARAMS.
+type EddsaParams struct {
+	Flag        Bbool
+	ContextData []Byte
+}
+
+// EncryptMessageParams defines compound protocol type CK_ENCRYPT_MESSAGE_PARAMS.
+type EncryptMessageParams struct {
+	Parameter []VoidPtr
+}
+
+// GcmMessageParams defines compound protocol type CK_GCM_MESSAGE_PARAMS.
+type GcmMessageParams struct {
+	Iv          []Byte
+	IvFixedBits Ulong
+	IvGenerator GeneratorFunction
+	Tag         []Byte
+	TagBits     Ulong
+}
+
 // GcmParams defines compound protocol type CK_GCM_PARAMS.
 type GcmParams struct {
 	Iv      []Byte
@@ -85,6 +131,17 @@ type GcmParams struct {
 	TagBits Ulong
 }
 
+// HkdfParams defines compound protocol type CK_HKDF_PARAMS.
+type HkdfParams struct {
+	Extract          Bbool
+	Expand           Bbool
+	PrfHashMechanism MechanismType
+	SaltType         Ulong
+	Salt             []Byte
+	SaltKey          ObjectHandle
+	Info             []Byte
+}
+
 // Info defines compound protocol type CK_INFO.
 type Info struct {
 	CryptokiVersion    Version
@@ -94,6 +151,11 @@ type Info struct {
 	LibraryVersion     Version
 }
 
+// KeyDerivationStringData defines compound protocol type CK_KEY_DERIVATION_STRING_DATA.
+type KeyDerivationStringData struct {
+	Data []Byte
+}
+
 // Mechanism defines compound protocol type CK_MECHANISM.
 type Mechanism struct {
 	Mechanism MechanismType
@@ -107,6 +169,49 @@ type MechanismInfo struct {
 	Flags      Flags
 }
 
+// Pkcs5Pbkd2Params2 defines compound protocol type CK_PKCS5_PBKD2_PARAMS2.
+type Pkcs5Pbkd2Params2 struct {
+	SaltSource     Pkcs5Pbkdf2SaltSourceType
+	SaltSourceData []VoidPtr
+	Iterations     Ulong
+	Prf            Pkcs5Pbkd2PseudoRandomFunctionType
+	PrfData        []VoidPtr
+	Password       []UTF8Char
+}
+
+// PrfDataParam defines compound protocol type CK_PRF_DATA_PARAM.
+type PrfDataParam struct {
+	Type  PrfDataType
+	Value []VoidPtr
+}
+
+// RsaAesKeyWrapParams defines compound protocol type CK_RSA_AES_KEY_WRAP_PARAMS.
+type RsaAesKeyWrapParams struct {
+	AESKeyBits Ulong
+	OAEPParams RsaPkcsOaepParams
+}
+
+// RsaPkcsOaepParams defines compound protocol type CK_RSA_PKCS_OAEP_PARAMS.
+type RsaPkcsOaepParams struct {
+	HashAlg    MechanismType
+	Mgf        RsaPkcsMgfType
+	Source     RsaPkcsOaepSourceType
+	SourceData []VoidPtr
+}
+
+// RsaPkcsPssParams defines compound protocol type CK_RSA_PKCS_PSS_PARAMS.
+type RsaPkcsPssParams struct {
+	HashAlg MechanismType
+	Mgf     RsaPkcsMgfType
+	SLen    Ulong
+}
+
+// Salsa20Chacha20Poly1305MsgParams defines compound protocol type CK_SALSA20_CHACHA20_POLY1305_MSG_PARAMS.
+type Salsa20Chacha20Poly1305MsgParams struct {
+	Nonce []Byte
+	Tag   []Byte
+}
+
 // SessionInfo defines compound protocol type CK_SESSION_INFO.
 type SessionInfo struct {
 	SlotID      Ulong
@@ -115,6 +220,11 @@ type SessionInfo struct {
 	DeviceError Ulong
 }
 
+// SignMessageParams defines compound protocol type CK_SIGN_MESSAGE_PARAMS.
+type SignMessageParams struct {
+	Parameter []VoidPtr
+}
+
 // SlotInfo defines compound protocol type CK_SLOT_INFO.
 type SlotInfo struct {
 	SlotDescription [64]UTF8Char
@@ -124,6 +234,71 @@ type SlotInfo struct {
 	FirmwareVersion Version
 }
 
+// Sp800108CounterFormat defines compound protocol type CK_SP800_108_COUNTER_FORMAT.
+type Sp800108CounterFormat struct {
+	LittleEndian Bbool
+	WidthInBits  Ulong
+}
+
+// Sp800108DkmLengthFormat defines compound protocol type CK_SP800_108_DKM_LENGTH_FORMAT.
+type Sp800108DkmLengthFormat struct {
+	DkmLengthMethod Sp800108DkmLengthMethod
+	LittleEndian    Bbool
+	WidthInBits     Ulong
+}
+
+// Sp800108FeedbackKdfParams defines compound protocol type CK_SP800_108_FEEDBACK_KDF_PARAMS.
+type Sp800108FeedbackKdfParams struct {
+	PrfType               MechanismType
+	DataParams            []PrfDataParam
+	IV                    []Byte
+	AdditionalDerivedKeys []DerivedKey
+}
+
+// Sp800108KdfParams defines compound protocol type CK_SP800_108_KDF_PARAMS.
+type Sp800108KdfParams struct {
+	PrfType               MechanismType
+	DataParams            []PrfDataParam
+	AdditionalDerivedKeys []DerivedKey
+}
+
+// Ssl3RandomData defines compound protocol type CK_SSL3_RANDOM_DATA.
+type Ssl3RandomData struct {
+	ClientRandom []Byte
+	ServerRandom []Byte
+}
+
+// Tls12KeyMatParams defines compound protocol type CK_TLS12_KEY_MAT_PARAMS.
+type Tls12KeyMatParams struct {
+	MacSizeInBits    Ulong
+	KeySizeInBits    Ulong
+	IVSizeInBits     Ulong
+	IsExport         Bbool
+	RandomInfo       Ssl3RandomData
+	PrfHashMechanism MechanismType
+}
+
+// Tls12MasterKeyDeriveParams defines compound protocol type CK_TLS12_MASTER_KEY_DERIVE_PARAMS.
+type Tls12MasterKeyDeriveParams struct {
+	RandomInfo       Ssl3RandomData
+	PrfHashMechanism MechanismType
+}
+
+// TlsKdfParams defines compound protocol type CK_TLS_KDF_PARAMS.
+type TlsKdfParams struct {
+	PrfMechanism MechanismType
+	Label        []Byte
+	RandomInfo   Ssl3RandomData
+	ContextData  []Byte
+}
+
+// TlsMacParams defines compound protocol type CK_TLS_MAC_PARAMS.
+type TlsMacParams struct {
+	PrfHashMechanism MechanismType
+	MacLength        Ulong
+	ServerOrClient   Ulong
+}
+
 // TokenInfo defines compound protocol type CK_TOKEN_INFO.
 type TokenInfo struct {
 	Label              [32]UTF8Char
@@ -163,6 +338,17 @@ type ImplCloseSessionReq struct {
 	Session SessionHandle
 }
 
+// ImplWaitForSlotEventReq defines the arguments of C_ImplWaitForSlotEvent.
+type ImplWaitForSlotEventReq struct {
+	ProviderID Ulong
+	Flags      Flags
+}
+
+// ImplWaitForSlotEventResp defines the result of C_ImplWaitForSlotEvent.
+type ImplWaitForSlotEventResp struct {
+	Slot SlotID
+}
+
 // InitializeResp defines the result of C_Initialize.
 type InitializeResp struct {
 	ProviderID Ulong
@@ -257,17 +443,52 @@ type OpenSessionResp struct {
 	Session SessionHandle
 }
 
+// CloseAllSessionsReq defines the arguments of C_CloseAllSessions.
+type CloseAllSessionsReq struct {
+	SlotID SlotID
+}
+
 // GetSessionInfoResp defines the result of C_GetSessionInfo.
 type GetSessionInfoResp struct {
 	Info SessionInfo
 }
 
+// SessionCancelReq defines the arguments of C_SessionCancel.
+type SessionCancelReq struct {
+	Flags Flags
+}
+
+// GetOperationStateReq defines the arguments of C_GetOperationState.
+type GetOperationStateReq struct {
+	OperationStateSize uint32
+}
+
+// GetOperationStateResp defines the result of C_GetOperationState.
+type GetOperationStateResp struct {
+	OperationStateLen int
+	OperationState    []Byte
+}
+
+// SetOperationStateReq defines the arguments of C_SetOperationState.
+type SetOperationStateReq struct {
+	OperationState    []Byte
+	EncryptionKey     ObjectHandle
+	AuthenticationKey ObjectHandle
+}
+
 // LoginReq defines the arguments of C_Login.
 type LoginReq struct {
 	UserType UserType
 	Pin      []UTF8Char
 }
 
+// LoginUserReq defines the arguments of C_LoginUser.
+type LoginUserReq struct {
+	UserType UserType
+	Pin      []UTF8Char
+	Username []UTF8Char
+}
+
 // CreateObjectReq defines the arguments of C_CreateObject.
 type CreateObjectReq struct {
 	Template Template
@@ -377,6 +598,54 @@ type EncryptFinalResp struct {
 	LastEncryptedPart    []Byte
 }
 
+// MessageEncryptInitReq defines the arguments of C_MessageEncryptInit.
+type MessageEncryptInitReq struct {
+	Mechanism Mechanism
+	Key       ObjectHandle
+}
+
+// EncryptMessageReq defines the arguments of C_EncryptMessage.
+type EncryptMessageReq struct {
+	Params         EncryptMessageParams
+	AssociatedData []Byte
+	Plaintext      []Byte
+	CiphertextSize uint32
+}
+
+// EncryptMessageResp defines the result of C_EncryptMessage.
+type EncryptMessageResp struct {
+	CiphertextLen int
+	Ciphertext    []Byte
+	Iv            []Byte
+	Tag           []Byte
+}
+
+// EncryptMessageBeginReq defines the arguments of C_EncryptMessageBegin.
+type EncryptMessageBeginReq struct {
+	Params         EncryptMessageParams
+	AssociatedData []Byte
+}
+
+// EncryptMessageBeginResp defines the result of C_EncryptMessageBegin.
+type EncryptMessageBeginResp struct {
+	Iv []Byte
+}
+
+// EncryptMessageNextReq defines the arguments of C_EncryptMessageNext.
+type EncryptMessageNextReq struct {
+	Params             EncryptMessageParams
+	PlaintextPart      []Byte
+	Flags              Flags
+	CiphertextPartSize uint32
+}
+
+// EncryptMessageNextResp defines the result of C_EncryptMessageNext.
+type EncryptMessageNextResp struct {
+	CiphertextPartLen int
+	CiphertextPart    []Byte
+	Tag               []Byte
+}
+
 // DecryptInitReq defines the arguments of C_DecryptInit.
 type DecryptInitReq struct {
 	Mechanism Mechanism
@@ -418,6 +687,46 @@ type DecryptFinalResp struct {
 	LastPart    []Byte
 }
 
+// MessageDecryptInitReq defines the arguments of C_MessageDecryptInit.
+type MessageDecryptInitReq struct {
+	Mechanism Mechanism
+	Key       ObjectHandle
+}
+
+// DecryptMessageReq defines the arguments of C_DecryptMessage.
+type DecryptMessageReq struct {
+	Params         EncryptMessageParams
+	AssociatedData []Byte
+	Ciphertext     []Byte
+	PlaintextSize  uint32
+}
+
+// DecryptMessageResp defines the result of C_DecryptMessage.
+type DecryptMessageResp struct {
+	PlaintextLen int
+	Plaintext    []Byte
+}
+
+// DecryptMessageBeginReq defines the arguments of C_DecryptMessageBegin.
+type DecryptMessageBeginReq struct {
+	Params         EncryptMessageParams
+	AssociatedData []Byte
+}
+
+// DecryptMessageNextReq defines the arguments of C_DecryptMessageNext.
+type DecryptMessageNextReq struct {
+	Params        EncryptMessageParams
+	Ciphertext    []Byte
+	Flags         Flags
+	PlaintextSize uint32
+}
+
+// DecryptMessageNextResp defines the result of C_DecryptMessageNext.
+type DecryptMessageNextResp struct {
+	PlaintextLen int
+	Plaintext    []Byte
+}
+
 // DigestInitReq defines the arguments of C_DigestInit.
 type DigestInitReq struct {
 	Mechanism Mechanism
@@ -440,6 +749,11 @@ type DigestUpdateReq struct {
 	Part []Byte
 }
 
+// DigestKeyReq defines the arguments of C_DigestKey.
+type DigestKeyReq struct {
+	Key ObjectHandle
+}
+
 // DigestFinalReq defines the arguments of C_DigestFinal.
 type DigestFinalReq struct {
 	DigestSize uint32
@@ -485,6 +799,44 @@ type SignFinalResp struct {
 	Signature    []Byte
 }
 
+// MessageSignInitReq defines the arguments of C_MessageSignInit.
+type MessageSignInitReq struct {
+	Mechanism Mechanism
+	Key       ObjectHandle
+}
+
+// SignMessageReq defines the arguments of C_SignMessage.
+type SignMessageReq struct {
+	Params        SignMessageParams
+	Data          []Byte
+	SignatureSize uint32
+}
+
+// SignMessageResp defines the result of C_SignMessage.
+type SignMessageResp struct {
+	SignatureLen int
+	Signature    []Byte
+}
+
+// SignMessageBeginReq defines the arguments of C_SignMessageBegin.
+type SignMessageBeginReq struct {
+	Params SignMessageParams
+}
+
+// SignMessageNextReq defines the arguments of C_SignMessageNext.
+type SignMessageNextReq struct {
+	Params        SignMessageParams
+	Data          []Byte
+	Last          Bbool
+	SignatureSize uint32
+}
+
+// SignMessageNextResp defines the result of C_SignMessageNext.
+type SignMessageNextResp struct {
+	SignatureLen int
+	Signature    []Byte
+}
+
 // VerifyInitReq defines the arguments of C_VerifyInit.
 type VerifyInitReq struct {
 	Mechanism Mechanism
@@ -507,6 +859,80 @@ type VerifyFinalReq struct {
 	Signature []Byte
 }
 
+// MessageVerifyInitReq defines the arguments of C_MessageVerifyInit.
+type MessageVerifyInitReq struct {
+	Mechanism Mechanism
+	Key       ObjectHandle
+}
+
+// VerifyMessageReq defines the arguments of C_VerifyMessage.
+type VerifyMessageReq struct {
+	Params    SignMessageParams
+	Data      []Byte
+	Signature []Byte
+}
+
+// VerifyMessageBeginReq defines the arguments of C_VerifyMessageBegin.
+type VerifyMessageBeginReq struct {
+	Params SignMessageParams
+}
+
+// VerifyMessageNextReq defines the arguments of C_VerifyMessageNext.
+type VerifyMessageNextReq struct {
+	Params    SignMessageParams
+	Data      []Byte
+	Signature []Byte
+	Last      Bbool
+}
+
+// DigestEncryptUpdateReq defines the arguments of C_DigestEncryptUpdate.
+type DigestEncryptUpdateReq struct {
+	Part              []Byte
+	EncryptedPartSize uint32
+}
+
+// DigestEncryptUpdateResp defines the result of C_DigestEncryptUpdate.
+type DigestEncryptUpdateResp struct {
+	EncryptedPartLen int
+	EncryptedPart    []Byte
+}
+
+// DecryptDigestUpdateReq defines the arguments of C_DecryptDigestUpdate.
+type DecryptDigestUpdateReq struct {
+	EncryptedPart []Byte
+	PartSize      uint32
+}
+
+// DecryptDigestUpdateResp defines the result of C_DecryptDigestUpdate.
+type DecryptDigestUpdateResp struct {
+	PartLen int
+	Part    []Byte
+}
+
+// SignEncryptUpdateReq defines the arguments of C_SignEncryptUpdate.
+type SignEncryptUpdateReq struct {
+	Part              []Byte
+	EncryptedPartSize uint32
+}
+
+// SignEncryptUpdateResp defines the result of C_SignEncryptUpdate.
+type SignEncryptUpdateResp struct {
+	EncryptedPartLen int
+	EncryptedPart    []Byte
+}
+
+// DecryptVerifyUpdateReq defines the arguments of C_DecryptVerifyUpdate.
+type DecryptVerifyUpdateReq struct {
+	EncryptedPart []Byte
+	PartSize      uint32
+}
+
+// DecryptVerifyUpdateResp defines the result of C_DecryptVerifyUpdate.
+type DecryptVerifyUpdateResp struct {
+	PartLen int
+	Part    []Byte
+}
+
 // GenerateKeyReq defines the arguments of C_GenerateKey.
 type GenerateKeyReq struct {
 	Mechanism Mechanism
@@ -531,6 +957,50 @@ type GenerateKeyPairResp struct {
 	PrivateKey ObjectHandle
 }
 
+// WrapKeyReq defines the arguments of C_WrapKey.
+type WrapKeyReq struct {
+	Mechanism      Mechanism
+	WrappingKey    ObjectHandle
+	Key            ObjectHandle
+	WrappedKeySize uint32
+}
+
+// WrapKeyResp defines the result of C_WrapKey.
+type WrapKeyResp struct {
+	Iv            []Byte
+	WrappedKeyLen int
+	WrappedKey    []Byte
+}
+
+// UnwrapKeyReq defines the arguments of C_UnwrapKey.
+type UnwrapKeyReq struct {
+	Mechanism     Mechanism
+	UnwrappingKey ObjectHandle
+	WrappedKey    []Byte
+	Template      Template
+}
+
+// UnwrapKeyResp defines the result of C_UnwrapKey.
+type UnwrapKeyResp struct {
+	Key ObjectHandle
+}
+
+// DeriveKeyReq defines the arguments of C_DeriveKey.
+type DeriveKeyReq struct {
+	Mechanism Mechanism
+	BaseKey   ObjectHandle
+	Template  Template
+}
+
+// DeriveKeyResp defines the result of C_DeriveKey.
+type DeriveKeyResp struct {
+	Key            ObjectHandle
+	AdditionalKeys []ObjectHandle
+	Version        []Byte
+	KeyMaterial    []ObjectHandle
+	Iv             []Byte
+}
+
 // SeedRandomReq defines the arguments of C_SeedRandom.
 type SeedRandomReq struct {
 	Seed []Byte
@@ -550,6 +1020,7 @@ type GenerateRandomResp struct {
 type Provider interface {
 	ImplOpenSession(req *ImplOpenSessionReq) error
 	ImplCloseSession(req *ImplCloseSessionReq) error
+	ImplWaitForSlotEvent(req *ImplWaitForSlotEventReq) (*ImplWaitForSlotEventResp, error)
 	Initialize() (*InitializeResp, error)
 	GetInfo() (*GetInfoResp, error)
 	GetSlotList(req *GetSlotListReq) (*GetSlotListResp, error)
@@ -562,8 +1033,13 @@ type Provider interface {
 	SetPIN(req *SetPINReq) error
 	OpenSession(req *OpenSessionReq) (*OpenSessionResp, error)
 	CloseSession() error
+	CloseAllSessions(req *CloseAllSessionsReq) error
 	GetSessionInfo() (*GetSessionInfoResp, error)
+	SessionCancel(req *SessionCancelReq) error
+	GetOperationState(req *GetOperationStateReq) (*GetOperationStateResp, error)
+	SetOperationState(req *SetOperationStateReq) error
 	Login(req *LoginReq) error
+	LoginUser(req *LoginUserReq) error
 	Logout() error
 	CreateObject(req *CreateObjectReq) (*CreateObjectResp, error)
 	CopyObject(req *CopyObjectReq) (*CopyObjectResp, error)
@@ -577,24 +1053,52 @@ type Provider interface {
 	Encrypt(req *EncryptReq) (*EncryptResp, error)
 	EncryptUpdate(req *EncryptUpdateReq) (*EncryptUpdateResp, error)
 	EncryptFinal(req *EncryptFinalReq) (*EncryptFinalResp, error)
+	MessageEncryptInit(req *MessageEncryptInitReq) error
+	EncryptMessage(req *EncryptMessageReq) (*EncryptMessageResp, error)
+	EncryptMessageBegin(req *EncryptMessageBeginReq) (*EncryptMessageBeginResp, error)
+	EncryptMessageNext(req *EncryptMessageNextReq) (*EncryptMessageNextResp, error)
+	MessageEncryptFinal() error
 	DecryptInit(req *DecryptInitReq) error
 	Decrypt(req *DecryptReq) (*DecryptResp, error)
 	DecryptUpdate(req *DecryptUpdateReq) (*DecryptUpdateResp, error)
 	DecryptFinal(req *DecryptFinalReq) (*DecryptFinalResp, error)
+	MessageDecryptInit(req *MessageDecryptInitReq) error
+	DecryptMessage(req *DecryptMessageReq) (*DecryptMessageResp, error)
+	DecryptMessageBegin(req *DecryptMessageBeginReq) error
+	DecryptMessageNext(req *DecryptMessageNextReq) (*DecryptMessageNextResp, error)
+	MessageDecryptFinal() error
 	DigestInit(req *DigestInitReq) error
 	Digest(req *DigestReq) (*DigestResp, error)
 	DigestUpdate(req *DigestUpdateReq) error
+	DigestKey(req *DigestKeyReq) error
 	DigestFinal(req *DigestFinalReq) (*DigestFinalResp, error)
 	SignInit(req *SignInitReq) error
 	Sign(req *SignReq) (*SignResp, error)
 	SignUpdate(req *SignUpdateReq) error
 	SignFinal(req *SignFinalReq) (*SignFinalResp, error)
+	MessageSignInit(req *MessageSignInitReq) error
+	SignMessage(req *SignMessageReq) (*SignMessageResp, error)
+	SignMessageBegin(req *SignMessageBeginReq) error
+	SignMessageNext(req *SignMessageNextReq) (*SignMessageNextResp, error)
+	MessageSignFinal() error
 	VerifyInit(req *VerifyInitReq) error
 	Verify(req *VerifyReq) error
 	VerifyUpdate(req *VerifyUpdateReq) error
 	VerifyFinal(req *VerifyFinalReq) error
+	MessageVerifyInit(req *MessageVerifyInitReq) error
+	VerifyMessage(req *VerifyMessageReq) error
+	VerifyMessageBegin(req *VerifyMessageBeginReq) error
+	VerifyMessageNext(req *VerifyMessageNextReq) error
+	MessageVerifyFinal() error
+	DigestEncryptUpdate(req *DigestEncryptUpdateReq) (*DigestEncryptUpdateResp, error)
+	DecryptDigestUpdate(req *DecryptDigestUpdateReq) (*DecryptDigestUpdateResp, error)
+	SignEncryptUpdate(req *SignEncryptUpdateReq) (*SignEncryptUpdateResp, error)
+	DecryptVerifyUpdate(req *DecryptVerifyUpdateReq) (*DecryptVerifyUpdateResp, error)
 	GenerateKey(req *GenerateKeyReq) (*GenerateKeyResp, error)
 	GenerateKeyPair(req *GenerateKeyPairReq) (*GenerateKeyPairResp, error)
+	WrapKey(req *WrapKeyReq) (*WrapKeyResp, error)
+	UnwrapKey(req *UnwrapKeyReq) (*UnwrapKeyResp, error)
+	DeriveKey(req *DeriveKeyReq) (*DeriveKeyResp, error)
 	SeedRandom(req *SeedRandomReq) error
 	GenerateRandom(req *GenerateRandomReq) (*GenerateRandomResp, error)
 }
@@ -612,6 +1116,11 @@ func (b *Base) ImplCloseSession(req *ImplCloseSessionReq) error {
 	return ErrFunctionNotSupported
 }
 
+// ImplWaitForSlotEvent implements the Provider.ImplWaitForSlotEvent().
+func (b *Base) ImplWaitForSlotEvent(req *ImplWaitForSlotEventReq) (*ImplWaitForSlotEventResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
 // Initialize implements the Provider.Initialize().
 func (b *Base) Initialize() (*InitializeResp, error) {
 	return nil, ErrFunctionNotSupported
@@ -672,16 +1181,41 @@ func (b *Base) CloseSession() error {
 	return ErrFunctionNotSupported
 }
 
+// CloseAllSessions implements the Provider.CloseAllSessions().
+func (b *Base) CloseAllSessions(req *CloseAllSessionsReq) error {
+	return ErrFunctionNotSupported
+}
+
 // GetSessionInfo implements the Provider.GetSessionInfo().
 func (b *Base) GetSessionInfo() (*GetSessionInfoResp, error) {
 	return nil, ErrFunctionNotSupported
 }
 
+// SessionCancel implements the Provider.SessionCancel().
+func (b *Base) SessionCancel(req *SessionCancelReq) error {
+	return ErrFunctionNotSupported
+}
+
+// GetOperationState implements the Provider.GetOperationState().
+func (b *Base) GetOperationState(req *GetOperationStateReq) (*GetOperationStateResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// SetOperationState implements the Provider.SetOperationState().
+func (b *Base) SetOperationState(req *SetOperationStateReq) error {
+	return ErrFunctionNotSupported
+}
+
 // Login implements the Provider.Login().
 func (b *Base) Login(req *LoginReq) error {
 	return ErrFunctionNotSupported
 }
 
+// LoginUser implements the Provider.LoginUser().
+func (b *Base) LoginUser(req *LoginUserReq) error {
+	return ErrFunctionNotSupported
+}
+
 // Logout implements the Provider.Logout().
 func (b *Base) Logout() error {
 	return ErrFunctionNotSupported
@@ -747,6 +1281,31 @@ func (b *Base) EncryptFinal(req *EncryptFinalReq) (*EncryptFinalResp, error) {
 	return nil, ErrFunctionNotSupported
 }
 
+// MessageEncryptInit implements the Provider.MessageEncryptInit().
+func (b *Base) MessageEncryptInit(req *MessageEncryptInitReq) error {
+	return ErrFunctionNotSupported
+}
+
+// EncryptMessage implements the Provider.EncryptMessage().
+func (b *Base) EncryptMessage(req *EncryptMessageReq) (*EncryptMessageResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// EncryptMessageBegin implements the Provider.EncryptMessageBegin().
+func (b *Base) EncryptMessageBegin(req *EncryptMessageBeginReq) (*EncryptMessageBeginResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// EncryptMessageNext implements the Provider.EncryptMessageNext().
+func (b *Base) EncryptMessageNext(req *EncryptMessageNextReq) (*EncryptMessageNextResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// MessageEncryptFinal implements the Provider.MessageEncryptFinal().
+func (b *Base) MessageEncryptFinal() error {
+	return ErrFunctionNotSupported
+}
+
 // DecryptInit implements the Provider.DecryptInit().
 func (b *Base) DecryptInit(req *DecryptInitReq) error {
 	return ErrFunctionNotSupported
@@ -767,6 +1326,31 @@ func (b *Base) DecryptFinal(req *DecryptFinalReq) (*DecryptFinalResp, error) {
 	return nil, ErrFunctionNotSupported
 }
 
+// MessageDecryptInit implements the Provider.MessageDecryptInit().
+func (b *Base) MessageDecryptInit(req *MessageDecryptInitReq) error {
+	return ErrFunctionNotSupported
+}
+
+// DecryptMessage implements the Provider.DecryptMessage().
+func (b *Base) DecryptMessage(req *DecryptMessageReq) (*DecryptMessageResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// DecryptMessageBegin implements the Provider.DecryptMessageBegin().
+func (b *Base) DecryptMessageBegin(req *DecryptMessageBeginReq) error {
+	return ErrFunctionNotSupported
+}
+
+// DecryptMessageNext implements the Provider.DecryptMessageNext().
+func (b *Base) DecryptMessageNext(req *DecryptMessageNextReq) (*DecryptMessageNextResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// MessageDecryptFinal implements the Provider.MessageDecryptFinal().
+func (b *Base) MessageDecryptFinal() error {
+	return ErrFunctionNotSupported
+}
+
 // DigestInit implements the Provider.DigestInit().
 func (b *Base) DigestInit(req *DigestInitReq) error {
 	return ErrFunctionNotSupported
@@ -782,6 +1366,11 @@ func (b *Base) DigestUpdate(req *DigestUpdateReq) error {
 	return ErrFunctionNotSupported
 }
 
+// DigestKey implements the Provider.DigestKey().
+func (b *Base) DigestKey(req *DigestKeyReq) error {
+	return ErrFunctionNotSupported
+}
+
 // DigestFinal implements the Provider.DigestFinal().
 func (b *Base) DigestFinal(req *DigestFinalReq) (*DigestFinalResp, error) {
 	return nil, ErrFunctionNotSupported
@@ -807,6 +1396,31 @@ func (b *Base) SignFinal(req *SignFinalReq) (*SignFinalResp, error) {
 	return nil, ErrFunctionNotSupported
 }
 
+// MessageSignInit implements the Provider.MessageSignInit().
+func (b *Base) MessageSignInit(req *MessageSignInitReq) error {
+	return ErrFunctionNotSupported
+}
+
+// SignMessage implements the Provider.SignMessage().
+func (b *Base) SignMessage(req *SignMessageReq) (*SignMessageResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// SignMessageBegin implements the Provider.SignMessageBegin().
+func (b *Base) SignMessageBegin(req *SignMessageBeginReq) error {
+	return ErrFunctionNotSupported
+}
+
+// SignMessageNext implements the Provider.SignMessageNext().
+func (b *Base) SignMessageNext(req *SignMessageNextReq) (*SignMessageNextResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// MessageSignFinal implements the Provider.MessageSignFinal().
+func (b *Base) MessageSignFinal() error {
+	return ErrFunctionNotSupported
+}
+
 // VerifyInit implements the Provider.VerifyInit().
 func (b *Base) VerifyInit(req *VerifyInitReq) error {
 	return ErrFunctionNotSupported
@@ -827,6 +1441,51 @@ func (b *Base) VerifyFinal(req *VerifyFinalReq) error {
 	return ErrFunctionNotSupported
 }
 
+// MessageVerifyInit implements the Provider.MessageVerifyInit().
+func (b *Base) MessageVerifyInit(req *MessageVerifyInitReq) error {
+	return ErrFunctionNotSupported
+}
+
+// VerifyMessage implements the Provider.VerifyMessage().
+func (b *Base) VerifyMessage(req *VerifyMessageReq) error {
+	return ErrFunctionNotSupported
+}
+
+// VerifyMessageBegin implements the Provider.VerifyMessageBegin().
+func (b *Base) VerifyMessageBegin(req *VerifyMessageBeginReq) error {
+	return ErrFunctionNotSupported
+}
+
+// VerifyMessageNext implements the Provider.VerifyMessageNext().
+func (b *Base) VerifyMessageNext(req *VerifyMessageNextReq) error {
+	return ErrFunctionNotSupported
+}
+
+// MessageVerifyFinal implements the Provider.MessageVerifyFinal().
+func (b *Base) MessageVerifyFinal() error {
+	return ErrFunctionNotSupported
+}
+
+// DigestEncryptUpdate implements the Provider.DigestEncryptUpdate().
+func (b *Base) DigestEncryptUpdate(req *DigestEncryptUpdateReq) (*DigestEncryptUpdateResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// DecryptDigestUpdate implements the Provider.DecryptDigestUpdate().
+func (b *Base) DecryptDigestUpdate(req *DecryptDigestUpdateReq) (*DecryptDigestUpdateResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// SignEncryptUpdate implements the Provider.SignEncryptUpdate().
+func (b *Base) SignEncryptUpdate(req *SignEncryptUpdateReq) (*SignEncryptUpdateResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// DecryptVerifyUpdate implements the Provider.DecryptVerifyUpdate().
+func (b *Base) DecryptVerifyUpdate(req *DecryptVerifyUpdateReq) (*DecryptVerifyUpdateResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
 // GenerateKey implements the Provider.GenerateKey().
 func (b *Base) GenerateKey(req *GenerateKeyReq) (*GenerateKeyResp, error) {
 	return nil, ErrFunctionNotSupported
@@ -837,6 +1496,21 @@ func (b *Base) GenerateKeyPair(req *GenerateKeyPairReq) (*GenerateKeyPairResp, e
 	return nil, ErrFunctionNotSupported
 }
 
+// WrapKey implements the Provider.WrapKey().
+func (b *Base) WrapKey(req *WrapKeyReq) (*WrapKeyResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// UnwrapKey implements the Provider.UnwrapKey().
+func (b *Base) UnwrapKey(req *UnwrapKeyReq) (*UnwrapKeyResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
+// DeriveKey implements the Provider.DeriveKey().
+func (b *Base) DeriveKey(req *DeriveKeyReq) (*DeriveKeyResp, error) {
+	return nil, ErrFunctionNotSupported
+}
+
 // SeedRandom implements the Provider.SeedRandom().
 func (b *Base) SeedRandom(req *SeedRandomReq) error {
 	return ErrFunctionNotSupported
@@ -847,9 +1521,97 @@ func (b *Base) GenerateRandom(req *GenerateRandomReq) (*GenerateRandomResp, erro
 	return nil, ErrFunctionNotSupported
 }
 
+// RPC message types.
+const (
+	MsgImplOpenSession      Type = 0xc0000101
+	MsgImplCloseSession     Type = 0xc0000102
+	MsgImplWaitForSlotEvent Type = 0xc0000103
+	MsgInitialize           Type = 0xc0050401
+	MsgGetInfo              Type = 0xc0050403
+	MsgGetSlotList          Type = 0xc0050501
+	MsgGetSlotInfo          Type = 0xc0050502
+	MsgGetTokenInfo         Type = 0xc0050503
+	MsgGetMechanismList     Type = 0xc0050505
+	MsgGetMechanismInfo     Type = 0xc0050506
+	MsgInitToken            Type = 0xc0050507
+	MsgInitPIN              Type = 0xc0050508
+	MsgSetPIN               Type = 0xc0050509
+	MsgOpenSession          Type = 0xc0050601
+	MsgCloseSession         Type = 0xc0050602
+	MsgCloseAllSessions     Type = 0xc0050603
+	MsgGetSessionInfo       Type = 0xc0050604
+	MsgSessionCancel        Type = 0xc0050605
+	MsgGetOperationState    Type = 0xc0050606
+	MsgSetOperationState    Type = 0xc0050607
+	MsgLogin                Type = 0xc0050608
+	MsgLoginUser            Type = 0xc0050609
+	MsgLogout               Type = 0xc005060a
+	MsgCreateObject         Type = 0xc0050701
+	MsgCopyObject           Type = 0xc0050702
+	MsgDestroyObject        Type = 0xc0050703
+	MsgGetObjectSize        Type = 0xc0050704
+	MsgGetAttributeValue    Type = 0xc0050705
+	MsgFindObjectsInit      Type = 0xc0050707
+	MsgFindObjects          Type = 0xc0050708
+	MsgFindObjectsFinal     Type = 0xc0050709
+	MsgEncryptInit          Type = 0xc0050801
+	MsgEncrypt              Type = 0xc0050802
+	MsgEncryptUpdate        Type = 0xc0050803
+	MsgEncryptFinal         Type = 0xc0050804
+	MsgMessageEncryptInit   Type = 0xc0050901
+	MsgEncryptMessage       Type = 0xc0050902
+	MsgEncryptMessageBegin  Type = 0xc0050903
+	MsgEncryptMessageNext   Type = 0xc0050904
+	MsgMessageEncryptFinal  Type = 0xc0050905
+	MsgDecryptInit          Type = 0xc0050a01
+	MsgDecrypt              Type = 0xc0050a02
+	MsgDecryptUpdate        Type = 0xc0050a03
+	MsgDecryptFinal         Type = 0xc0050a04
+	MsgMessageDecryptInit   Type = 0xc0050b01
+	MsgDecryptMessage       Type = 0xc0050b02
+	MsgDecryptMessageBegin  Type = 0xc0050b03
+	MsgDecryptMessageNext   Type = 0xc0050b04
+	MsgMessageDecryptFinal  Type = 0xc0050b05
+	MsgDigestInit           Type = 0xc0050c01
+	MsgDigest               Type = 0xc0050c02
+	MsgDigestUpdate         Type = 0xc0050c03
+	MsgDigestKey            Type = 0xc0050c04
+	MsgDigestFinal          Type = 0xc0050c05
+	MsgSignInit             Type = 0xc0050d01
+	MsgSign                 Type = 0xc0050d02
+	MsgSignUpdate           Type = 0xc0050d03
+	MsgSignFinal            Type = 0xc0050d04
+	MsgMessageSignInit      Type = 0xc0050e01
+	MsgSignMessage          Type = 0xc0050e02
+	MsgSignMessageBegin     Type = 0xc0050e03
+	MsgSignMessageNext      Type = 0xc0050e04
+	MsgMessageSignFinal     Type = 0xc0050e05
+	MsgVerifyInit           Type = 0xc0050f01
+	MsgVerify               Type = 0xc0050f02
+	MsgVerifyUpdate         Type = 0xc0050f03
+	MsgVerifyFinal          Type = 0xc0050f04
+	MsgMessageVerifyInit    Type = 0xc0051001
+	MsgVerifyMessage        Type = 0xc0051002
+	MsgVerifyMessageBegin   Type = 0xc0051003
+	MsgVerifyMessageNext    Type = 0xc0051004
+	MsgMessageVerifyFinal   Type = 0xc0051005
+	MsgDigestEncryptUpdate  Type = 0xc0051101
+	MsgDecryptDigestUpdate  Type = 0xc0051102
+	MsgSignEncryptUpdate    Type = 0xc0051103
+	MsgDecryptVerifyUpdate  Type = 0xc0051104
+	MsgGenerateKey          Type = 0xc0051201
+	MsgGenerateKeyPair      Type = 0xc0051202
+	MsgWrapKey              Type = 0xc0051203
+	MsgUnwrapKey            Type = 0xc0051204
+	MsgDeriveKey            Type = 0xc0051205
+	MsgSeedRandom           Type = 0xc0051301
+	MsgGenerateRandom       Type = 0xc0051302
+)
+
 var msgTypeNames = map[Type]string{
 	0xc0000101: "ImplOpenSession",
 	0xc0000102: "ImplCloseSession",
+	0xc0000103: "ImplWaitForSlotEvent",
 	0xc0050401: "Initialize",
 	0xc0050403: "GetInfo",
 	0xc0050501: "GetSlotList",
@@ -862,8 +1624,13 @@ var msgTypeNames = map[Type]string{
 	0xc0050509: "SetPIN",
 	0xc0050601: "OpenSession",
 	0xc0050602: "CloseSession",
+	0xc0050603: "CloseAllSessions",
 	0xc0050604: "GetSessionInfo",
+	0xc0050605: "SessionCancel",
+	0xc0050606: "GetOperationState",
+	0xc0050607: "SetOperationState",
 	0xc0050608: "Login",
+	0xc0050609: "LoginUser",
 	0xc005060a: "Logout",
 	0xc0050701: "CreateObject",
 	0xc0050702: "CopyObject",
@@ -877,24 +1644,52 @@ var msgTypeNames = map[Type]string{
 	0xc0050802: "Encrypt",
 	0xc0050803: "EncryptUpdate",
 	0xc0050804: "EncryptFinal",
+	0xc0050901: "MessageEncryptInit",
+	0xc0050902: "EncryptMessage",
+	0xc0050903: "EncryptMessageBegin",
+	0xc0050904: "EncryptMessageNext",
+	0xc0050905: "MessageEncryptFinal",
 	0xc0050a01: "DecryptInit",
 	0xc0050a02: "Decrypt",
 	0xc0050a03: "DecryptUpdate",
 	0xc0050a04: "DecryptFinal",
+	0xc0050b01: "MessageDecryptInit",
+	0xc0050b02: "DecryptMessage",
+	0xc0050b03: "DecryptMessageBegin",
+	0xc0050b04: "DecryptMessageNext",
+	0xc0050b05: "MessageDecryptFinal",
 	0xc0050c01: "DigestInit",
 	0xc0050c02: "Digest",
 	0xc0050c03: "DigestUpdate",
+	0xc0050c04: "DigestKey",
 	0xc0050c05: "DigestFinal",
 	0xc0050d01: "SignInit",
 	0xc0050d02: "Sign",
 	0xc0050d03: "SignUpdate",
 	0xc0050d04: "SignFinal",
+	0xc0050e01: "MessageSignInit",
+	0xc0050e02: "SignMessage",
+	0xc0050e03: "SignMessageBegin",
+	0xc0050e04: "SignMessageNext",
+	0xc0050e05: "MessageSignFinal",
 	0xc0050f01: "VerifyInit",
 	0xc0050f02: "Verify",
 	0xc0050f03: "VerifyUpdate",
 	0xc0050f04: "VerifyFinal",
+	0xc0051001: "MessageVerifyInit",
+	0xc0051002: "VerifyMessage",
+	0xc0051003: "VerifyMessageBegin",
+	0xc0051004: "VerifyMessageNext",
+	0xc0051005: "MessageVerifyFinal",
+	0xc0051101: "DigestEncryptUpdate",
+	0xc0051102: "DecryptDigestUpdate",
+	0xc0051103: "SignEncryptUpdate",
+	0xc0051104: "DecryptVerifyUpdate",
 	0xc0051201: "GenerateKey",
 	0xc0051202: "GenerateKeyPair",
+	0xc0051203: "WrapKey",
+	0xc0051204: "UnwrapKey",
+	0xc0051205: "DeriveKey",
 	0xc0051301: "SeedRandom",
 	0xc0051302: "GenerateRandom",
 }
@@ -930,6 +1725,17 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return nil, p.ImplCloseSession(&req)
 
+	case 0xc0000103: // ImplWaitForSlotEvent
+		var req ImplWaitForSlotEventReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.ImplWaitForSlotEvent(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
 	case 0xc0050401: // Initialize
 		resp, err := p.Initialize()
 		if err != nil {
@@ -1034,6 +1840,13 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 	case 0xc0050602: // CloseSession
 		return nil, p.CloseSession()
 
+	case 0xc0050603: // CloseAllSessions
+		var req CloseAllSessionsReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.CloseAllSessions(&req)
+
 	case 0xc0050604: // GetSessionInfo
 		resp, err := p.GetSessionInfo()
 		if err != nil {
@@ -1041,6 +1854,31 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return Marshal(resp)
 
+	case 0xc0050605: // SessionCancel
+		var req SessionCancelReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.SessionCancel(&req)
+
+	case 0xc0050606: // GetOperationState
+		var req GetOperationStateReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.GetOperationState(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050607: // SetOperationState
+		var req SetOperationStateReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.SetOperationState(&req)
+
 	case 0xc0050608: // Login
 		var req LoginReq
 		if err := Unmarshal(data, &req); err != nil {
@@ -1048,6 +1886,13 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return nil, p.Login(&req)
 
+	case 0xc0050609: // LoginUser
+		var req LoginUserReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.LoginUser(&req)
+
 	case 0xc005060a: // Logout
 		return nil, p.Logout()
 
@@ -1167,6 +2012,49 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return Marshal(resp)
 
+	case 0xc0050901: // MessageEncryptInit
+		var req MessageEncryptInitReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.MessageEncryptInit(&req)
+
+	case 0xc0050902: // EncryptMessage
+		var req EncryptMessageReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.EncryptMessage(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050903: // EncryptMessageBegin
+		var req EncryptMessageBeginReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.EncryptMessageBegin(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050904: // EncryptMessageNext
+		var req EncryptMessageNextReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.EncryptMessageNext(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050905: // MessageEncryptFinal
+		return nil, p.MessageEncryptFinal()
+
 	case 0xc0050a01: // DecryptInit
 		var req DecryptInitReq
 		if err := Unmarshal(data, &req); err != nil {
@@ -1207,6 +2095,45 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return Marshal(resp)
 
+	case 0xc0050b01: // MessageDecryptInit
+		var req MessageDecryptInitReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.MessageDecryptInit(&req)
+
+	case 0xc0050b02: // DecryptMessage
+		var req DecryptMessageReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.DecryptMessage(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050b03: // DecryptMessageBegin
+		var req DecryptMessageBeginReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.DecryptMessageBegin(&req)
+
+	case 0xc0050b04: // DecryptMessageNext
+		var req DecryptMessageNextReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.DecryptMessageNext(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050b05: // MessageDecryptFinal
+		return nil, p.MessageDecryptFinal()
+
 	case 0xc0050c01: // DigestInit
 		var req DigestInitReq
 		if err := Unmarshal(data, &req); err != nil {
@@ -1232,6 +2159,13 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return nil, p.DigestUpdate(&req)
 
+	case 0xc0050c04: // DigestKey
+		var req DigestKeyReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.DigestKey(&req)
+
 	case 0xc0050c05: // DigestFinal
 		var req DigestFinalReq
 		if err := Unmarshal(data, &req); err != nil {
@@ -1279,6 +2213,45 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return Marshal(resp)
 
+	case 0xc0050e01: // MessageSignInit
+		var req MessageSignInitReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.MessageSignInit(&req)
+
+	case 0xc0050e02: // SignMessage
+		var req SignMessageReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.SignMessage(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050e03: // SignMessageBegin
+		var req SignMessageBeginReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.SignMessageBegin(&req)
+
+	case 0xc0050e04: // SignMessageNext
+		var req SignMessageNextReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.SignMessageNext(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0050e05: // MessageSignFinal
+		return nil, p.MessageSignFinal()
+
 	case 0xc0050f01: // VerifyInit
 		var req VerifyInitReq
 		if err := Unmarshal(data, &req); err != nil {
@@ -1307,6 +2280,81 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return nil, p.VerifyFinal(&req)
 
+	case 0xc0051001: // MessageVerifyInit
+		var req MessageVerifyInitReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.MessageVerifyInit(&req)
+
+	case 0xc0051002: // VerifyMessage
+		var req VerifyMessageReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.VerifyMessage(&req)
+
+	case 0xc0051003: // VerifyMessageBegin
+		var req VerifyMessageBeginReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.VerifyMessageBegin(&req)
+
+	case 0xc0051004: // VerifyMessageNext
+		var req VerifyMessageNextReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return nil, p.VerifyMessageNext(&req)
+
+	case 0xc0051005: // MessageVerifyFinal
+		return nil, p.MessageVerifyFinal()
+
+	case 0xc0051101: // DigestEncryptUpdate
+		var req DigestEncryptUpdateReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.DigestEncryptUpdate(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0051102: // DecryptDigestUpdate
+		var req DecryptDigestUpdateReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.DecryptDigestUpdate(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0051103: // SignEncryptUpdate
+		var req SignEncryptUpdateReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.SignEncryptUpdate(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0051104: // DecryptVerifyUpdate
+		var req DecryptVerifyUpdateReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.DecryptVerifyUpdate(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
 	case 0xc0051201: // GenerateKey
 		var req GenerateKeyReq
 		if err := Unmarshal(data, &req); err != nil {
@@ -1329,6 +2377,39 @@ func call(p Provider, msgType Type, data []byte) ([]byte, error) {
 		}
 		return Marshal(resp)
 
+	case 0xc0051203: // WrapKey
+		var req WrapKeyReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.WrapKey(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0051204: // UnwrapKey
+		var req UnwrapKeyReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.UnwrapKey(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
+	case 0xc0051205: // DeriveKey
+		var req DeriveKeyReq
+		if err := Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		resp, err := p.DeriveKey(&req)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(resp)
+
 	case 0xc0051301: // SeedRandom
 		var req SeedRandomReq
 		if err := Unmarshal(data, &req); err != nil {
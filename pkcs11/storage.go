@@ -7,6 +7,9 @@
 package pkcs11
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"log"
 	"math/big"
@@ -16,6 +19,10 @@ import (
 type Object struct {
 	Attrs  Template
 	Native interface{}
+
+	// Owner is the name of the user owning the object. The objects
+	// without an owner are accessible for all users.
+	Owner string
 }
 
 // Inflate populates the object's Native member based on object class
@@ -32,6 +39,8 @@ func (obj *Object) Inflate() error {
 		return obj.inflatePublicKey()
 	case CkoPrivateKey:
 		return obj.inflatePrivateKey()
+	case CkoSecretKey:
+		return obj.inflateSecretKey()
 	default:
 		return nil
 	}
@@ -61,6 +70,22 @@ func (obj *Object) inflatePublicKey() error {
 		}
 		return nil
 
+	case CkkECEdwards:
+		err := obj.checkEdwardsParams()
+		if err != nil {
+			return err
+		}
+		q, err := obj.Attrs.OptBytes(CkaECPoint)
+		if err != nil {
+			return err
+		}
+		if len(q) != ed25519.PublicKeySize {
+			log.Printf("%s validation error: invalid EC point", keyType)
+			return ErrTemplateInconsistent
+		}
+		obj.Native = ed25519.PublicKey(q)
+		return nil
+
 	default:
 		log.Printf("\u251c\u2574inflatePublicKey: %s", keyType)
 		return nil
@@ -114,12 +139,96 @@ func (obj *Object) inflatePrivateKey() error {
 		obj.Native = key
 		return nil
 
+	case CkkEC:
+		params, err := obj.Attrs.OptBytes(CkaECParams)
+		if err != nil {
+			return err
+		}
+		curve, err := CurveByParams(params)
+		if err != nil {
+			return err
+		}
+		d, err := obj.Attrs.BigInt(CkaValue)
+		if err != nil {
+			return err
+		}
+		if d.Sign() <= 0 || d.Cmp(curve.Params().N) >= 0 {
+			log.Printf("%s validation error: invalid private value", keyType)
+			return ErrTemplateInconsistent
+		}
+		key := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: curve,
+			},
+			D: d,
+		}
+		key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+		obj.Native = key
+		return nil
+
+	case CkkECEdwards:
+		err := obj.checkEdwardsParams()
+		if err != nil {
+			return err
+		}
+		seed, err := obj.Attrs.OptBytes(CkaValue)
+		if err != nil {
+			return err
+		}
+		if len(seed) != ed25519.SeedSize {
+			log.Printf("%s validation error: invalid private value", keyType)
+			return ErrTemplateInconsistent
+		}
+		obj.Native = ed25519.NewKeyFromSeed(seed)
+		return nil
+
 	default:
 		log.Printf("\u251c\u2574inflatePrivateKey: %s", keyType)
 		return nil
 	}
 }
 
+// checkEdwardsParams checks the CKA_EC_PARAMS of the Edwards curve
+// key.
+func (obj *Object) checkEdwardsParams() error {
+	params, err := obj.Attrs.OptBytes(CkaECParams)
+	if err != nil {
+		return err
+	}
+	return CheckEdwardsParams(params)
+}
+
+func (obj *Object) inflateSecretKey() error {
+	value, err := obj.Attrs.OptBytes(CkaValue)
+	if err == nil {
+		obj.Attrs = obj.Attrs.SetInt(CkaValueLen, len(value))
+		obj.Native = value
+	}
+	key, ok := obj.Native.([]byte)
+	if !ok {
+		// Key value is provided by the object's creator.
+		return nil
+	}
+	keyType := KeyType(obj.Attrs.OptInt(CkaKeyType, -1))
+	switch keyType {
+	case CkkDES3:
+		if len(key) != DES3KeySize || !DES3CheckParity(key) {
+			log.Printf("%s validation error: invalid key value", keyType)
+			return ErrAttributeValueInvalid
+		}
+		cv, err := DES3CheckValue(key)
+		if err != nil {
+			return err
+		}
+		v, err := obj.Attrs.OptBytes(CkaCheckValue)
+		if err == nil && len(v) > 0 && !bytes.Equal(v, cv) {
+			return ErrAttributeValueInvalid
+		}
+		obj.Attrs = obj.Attrs.Set(CkaCheckValue, cv)
+	}
+	return nil
+}
+
 // HandleAllocator allocates object handles. The handles are not
 // guaranteed to be unique.
 type HandleAllocator func() (ObjectHandle, error)
@@ -76,10 +76,8 @@ func (s *MemoryStorage) Update(h ObjectHandle, obj *Object) error {
 	if !ok {
 		return ErrObjectHandleInvalid
 	}
-	oldID, err := old.Attrs.OptBytes(CkaUniqueID)
-	if err != nil {
-		return err
-	}
+	// The objects created without CKA_UNIQUE_ID can't get one.
+	oldID, _ := old.Attrs.OptBytes(CkaUniqueID)
 	newID, err := obj.Attrs.OptBytes(CkaUniqueID)
 	if err == nil {
 		if bytes.Compare(oldID, newID) != 0 {
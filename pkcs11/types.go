@@ -76,6 +76,22 @@ const (
 	CkfExtension       Flags = 0x80000000
 )
 
+// Flags that describe the type of a session.
+const (
+	CkfRWSession     Flags = 0x00000002
+	CkfSerialSession Flags = 0x00000004
+)
+
+// Flags for C_WaitForSlotEvent.
+const (
+	CkfDontBlock Flags = 0x00000001
+)
+
+// Flags for the multi-part message functions.
+const (
+	CkfEndOfMessage Flags = 0x00000001
+)
+
 // Mechanism types.
 const (
 	CkmRSAPKCSKeyPairGen           MechanismType = 0x00000000
@@ -1256,6 +1272,70 @@ const (
 	CksRWSOFunctions
 )
 
+// RSA PKCS #1 mask generation functions.
+const (
+	CkgMGF1SHA1    RsaPkcsMgfType = 0x00000001
+	CkgMGF1SHA256  RsaPkcsMgfType = 0x00000002
+	CkgMGF1SHA384  RsaPkcsMgfType = 0x00000003
+	CkgMGF1SHA512  RsaPkcsMgfType = 0x00000004
+	CkgMGF1SHA224  RsaPkcsMgfType = 0x00000005
+	CkgMGF1SHA3224 RsaPkcsMgfType = 0x00000006
+	CkgMGF1SHA3256 RsaPkcsMgfType = 0x00000007
+	CkgMGF1SHA3384 RsaPkcsMgfType = 0x00000008
+	CkgMGF1SHA3512 RsaPkcsMgfType = 0x00000009
+)
+
+// RSA PKCS #1 OAEP encoding parameter sources.
+const (
+	CkzDataSpecified RsaPkcsOaepSourceType = 0x00000001
+)
+
+// HKDF salt types.
+const (
+	CkfHKDFSaltNull Ulong = 0x00000001
+	CkfHKDFSaltData Ulong = 0x00000002
+	CkfHKDFSaltKey  Ulong = 0x00000004
+)
+
+// SP 800-108 PRF data parameter types.
+const (
+	CkSP800108IterationVariable PrfDataType = 0x00000001
+	CkSP800108OptionalCounter   PrfDataType = 0x00000002
+	CkSP800108DKMLength         PrfDataType = 0x00000003
+	CkSP800108ByteArray         PrfDataType = 0x00000004
+)
+
+// SP 800-108 DKM length methods.
+const (
+	CkSP800108DKMLengthSumOfKeys     Sp800108DkmLengthMethod = 0x00000001
+	CkSP800108DKMLengthSumOfSegments Sp800108DkmLengthMethod = 0x00000002
+)
+
+// PKCS #5 PBKDF2 pseudorandom functions.
+const (
+	CkpPKCS5PBKD2HMACSHA1      Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000001
+	CkpPKCS5PBKD2HMACGOSTR3411 Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000002
+	CkpPKCS5PBKD2HMACSHA224    Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000003
+	CkpPKCS5PBKD2HMACSHA256    Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000004
+	CkpPKCS5PBKD2HMACSHA384    Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000005
+	CkpPKCS5PBKD2HMACSHA512    Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000006
+	CkpPKCS5PBKD2HMACSHA512224 Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000007
+	CkpPKCS5PBKD2HMACSHA512256 Pkcs5Pbkd2PseudoRandomFunctionType = 0x00000008
+)
+
+// PKCS #5 PBKDF2 salt sources.
+const (
+	CkzSaltSpecified Pkcs5Pbkdf2SaltSourceType = 0x00000001
+)
+
+// IV and nonce generator functions.
+const (
+	CkgNoGenerate      GeneratorFunction = 0x00000000
+	CkgGenerate        GeneratorFunction = 0x00000001
+	CkgGenerateCounter GeneratorFunction = 0x00000002
+	CkgGenerateRandom  GeneratorFunction = 0x00000003
+)
+
 // Key types.
 const (
 	CkkRSA            KeyType = 0x00000000
@@ -1478,7 +1558,8 @@ func (tmpl Template) OptBool(t AttributeType) (bool, error) {
 	}
 	// Default values.
 	switch t {
-	case CkaToken, CkaPrivate, CkaSensitive, CkaWrapWithTrusted, CkaExtractable:
+	case CkaToken, CkaPrivate, CkaSensitive, CkaWrapWithTrusted, CkaExtractable,
+		CkaAlwaysAuthenticate, CkaWrap, CkaUnwrap, CkaDerive:
 		return false, nil
 
 	case CkaModifiable, CkaCopyable, CkaDestroyable: